@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	DatasetETH   = "eth"
+	DatasetERC20 = "erc20"
+
+	// ERC-20 dataset output, read by the state-syncer through
+	// PLINKO_STATE_ERC20_DB_PATH / PLINKO_STATE_ERC20_MAPPING_PATH
+	ERC20DatabasePath = "/data/erc20/database.bin"
+	ERC20MappingPath  = "/data/erc20/token-mapping.bin"
+
+	// 20 bytes holder + 20 bytes token + 4 bytes index
+	TokenMappingRecordSize = 44
+)
+
+// balanceOf(address) selector
+var balanceOfSelector = []byte{0x70, 0xa0, 0x82, 0x31}
+
+// Get dataset from environment or use default
+func getDataset() string {
+	switch dataset := strings.ToLower(strings.TrimSpace(os.Getenv("DATASET"))); dataset {
+	case "", DatasetETH:
+		return DatasetETH
+	case DatasetERC20:
+		return DatasetERC20
+	default:
+		log.Fatalf("Unknown DATASET %q (want %q or %q)", dataset, DatasetETH, DatasetERC20)
+		return ""
+	}
+}
+
+// Get ERC-20 token contracts from ERC20_TOKENS (comma-separated)
+func getERC20Tokens() ([]common.Address, error) {
+	var tokens []common.Address
+	seen := make(map[common.Address]bool)
+	for _, part := range strings.Split(os.Getenv("ERC20_TOKENS"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !common.IsHexAddress(part) {
+			return nil, fmt.Errorf("invalid token address %q", part)
+		}
+		token := common.HexToAddress(part)
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("ERC20_TOKENS is empty")
+	}
+	return tokens, nil
+}
+
+// TokenBalance is one (holder, token) entry of the ERC-20 dataset
+type TokenBalance struct {
+	Holder  common.Address
+	Token   common.Address
+	Balance *big.Int
+}
+
+// generateERC20Dataset builds the (holder, token) → balance database. Every
+// holder gets one entry per token so that later transfers between tracked
+// holders always hit a mapped entry.
+func generateERC20Dataset(totalAccounts int, rpcURL string, workers int) {
+	if _, err := os.Stat(ERC20DatabasePath); err == nil {
+		log.Println("✓ ERC-20 database already exists at", ERC20DatabasePath)
+		log.Println("✓ Skipping generation (delete file to regenerate)")
+		return
+	}
+
+	tokens, err := getERC20Tokens()
+	if err != nil {
+		log.Fatalf("ERC-20 dataset: %v", err)
+	}
+	log.Printf("Tokens: %d\n", len(tokens))
+
+	client, err := ethclient.Dial(rpcURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to Anvil: %v", err)
+	}
+	defer client.Close()
+	waitForAnvil(client)
+
+	start := time.Now()
+	holders := generateAnvilAddresses(totalAccounts)
+
+	log.Println("Querying token balances...")
+	balances := queryTokenBalancesConcurrent(client, tokenPairs(holders, tokens), workers)
+	log.Printf("Queried %d token balances in %v\n", len(balances), time.Since(start))
+
+	if err := os.MkdirAll(filepath.Dir(ERC20DatabasePath), 0o755); err != nil {
+		log.Fatalf("Failed to create ERC-20 output dir: %v", err)
+	}
+
+	log.Println("Writing ERC-20 database.bin...")
+	if err := writeTokenDatabase(ERC20DatabasePath, balances); err != nil {
+		log.Fatalf("Failed to write ERC-20 database.bin: %v", err)
+	}
+
+	log.Println("Writing token-mapping.bin...")
+	if err := writeTokenMapping(ERC20MappingPath, balances); err != nil {
+		log.Fatalf("Failed to write token-mapping.bin: %v", err)
+	}
+
+	log.Println()
+	log.Println("✅ ERC-20 database generation complete!")
+	log.Printf("Total time: %v\n", time.Since(start))
+}
+
+// tokenPairs returns every (holder, token) pair sorted by holder then token
+// bytes, which is the database order
+func tokenPairs(holders, tokens []common.Address) []TokenBalance {
+	pairs := make([]TokenBalance, 0, len(holders)*len(tokens))
+	for _, holder := range holders {
+		for _, token := range tokens {
+			pairs = append(pairs, TokenBalance{Holder: holder, Token: token})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if c := bytes.Compare(pairs[i].Holder[:], pairs[j].Holder[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(pairs[i].Token[:], pairs[j].Token[:]) < 0
+	})
+	return pairs
+}
+
+// queryTokenBalancesConcurrent fills in balanceOf for every pair
+func queryTokenBalancesConcurrent(client *ethclient.Client, pairs []TokenBalance, workers int) []TokenBalance {
+	jobs := make(chan int, len(pairs))
+	var wg sync.WaitGroup
+	var processed int64
+	var mu sync.Mutex
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+
+			for i := range jobs {
+				balance, err := queryTokenBalance(ctx, client, pairs[i].Token, pairs[i].Holder)
+				if err != nil {
+					log.Printf("Error querying %s balance of %s: %v\n", pairs[i].Token.Hex(), pairs[i].Holder.Hex(), err)
+					balance = big.NewInt(0)
+				}
+				pairs[i].Balance = balance
+
+				mu.Lock()
+				processed++
+				if processed%BatchSize == 0 {
+					log.Printf("  Processed %d/%d token balances (%.1f%%)\n",
+						processed, len(pairs), float64(processed)/float64(len(pairs))*100)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range pairs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return pairs
+}
+
+func queryTokenBalance(ctx context.Context, client *ethclient.Client, token, holder common.Address) (*big.Int, error) {
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(holder.Bytes(), 32)...)
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) < 32 {
+		// Not a contract (or not ERC-20); treat as empty
+		return big.NewInt(0), nil
+	}
+	return new(big.Int).SetBytes(out[:32]), nil
+}
+
+// writeTokenDatabase writes one 32-byte balance entry per pair
+func writeTokenDatabase(path string, balances []TokenBalance) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, b := range balances {
+		entry := encodeUint256(b.Balance)
+		if _, err := w.Write(entry[:]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// writeTokenMapping writes token-mapping.bin with (holder, token)→index
+func writeTokenMapping(path string, balances []TokenBalance) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var record [TokenMappingRecordSize]byte
+	for i, b := range balances {
+		copy(record[0:20], b.Holder.Bytes())
+		copy(record[20:40], b.Token.Bytes())
+		binary.LittleEndian.PutUint32(record[40:44], uint32(i))
+		if _, err := w.Write(record[:]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
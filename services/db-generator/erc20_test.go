@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TestTokenMappingFormat validates token-mapping.bin and the ERC-20 database
+// ordering
+func TestTokenMappingFormat(t *testing.T) {
+	holders := []common.Address{
+		common.HexToAddress("0x1000000000000000000000000000000000000002"),
+		common.HexToAddress("0x1000000000000000000000000000000000000001"),
+	}
+	tokens := []common.Address{
+		common.HexToAddress("0xdac17f958d2ee523a2206206994597c13d831ec7"),
+		common.HexToAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"),
+	}
+	pairs := tokenPairs(holders, tokens)
+	for i := range pairs {
+		pairs[i].Balance = big.NewInt(int64(i + 1))
+	}
+
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "database.bin")
+	mapPath := filepath.Join(dir, "token-mapping.bin")
+	if err := writeTokenDatabase(dbPath, pairs); err != nil {
+		t.Fatalf("write database: %v", err)
+	}
+	if err := writeTokenMapping(mapPath, pairs); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+
+	db, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("read database: %v", err)
+	}
+	mapping, err := os.ReadFile(mapPath)
+	if err != nil {
+		t.Fatalf("read mapping: %v", err)
+	}
+	if len(db) != 4*DBEntrySize || len(mapping) != 4*TokenMappingRecordSize {
+		t.Fatalf("sizes: database %d, mapping %d", len(db), len(mapping))
+	}
+
+	// Sorted by holder, then token
+	wantOrder := []struct{ holder, token common.Address }{
+		{holders[1], tokens[1]},
+		{holders[1], tokens[0]},
+		{holders[0], tokens[1]},
+		{holders[0], tokens[0]},
+	}
+	for i, want := range wantOrder {
+		rec := mapping[i*TokenMappingRecordSize : (i+1)*TokenMappingRecordSize]
+		holder := common.BytesToAddress(rec[0:20])
+		token := common.BytesToAddress(rec[20:40])
+		index := binary.LittleEndian.Uint32(rec[40:44])
+		if holder != want.holder || token != want.token || index != uint32(i) {
+			t.Errorf("record %d: got (%s, %s, %d)", i, holder.Hex(), token.Hex(), index)
+		}
+		if balance := binary.LittleEndian.Uint64(db[i*DBEntrySize:]); balance != uint64(i+1) {
+			t.Errorf("balance %d: got %d, want %d", i, balance, i+1)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"log"
@@ -8,10 +9,13 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
@@ -46,6 +50,36 @@ func getRPCURL() string {
 	return "http://eth-mock:8545" // Default for docker-compose
 }
 
+// Account layouts, matching PLINKO_STATE_ACCOUNT_LAYOUT in the syncers:
+// "balance" stores one entry per account, "account" stores three entries
+// per account in the order [nonce, balance, code_hash].
+const (
+	LayoutBalance = "balance"
+	LayoutAccount = "account"
+
+	DBEntrySize = 32 // Every field is a 256-bit little-endian integer
+)
+
+// Get account layout from environment or use default
+func getAccountLayout() string {
+	switch layout := strings.ToLower(strings.TrimSpace(os.Getenv("ACCOUNT_LAYOUT"))); layout {
+	case "", LayoutBalance:
+		return LayoutBalance
+	case LayoutAccount:
+		return LayoutAccount
+	default:
+		log.Fatalf("Unknown ACCOUNT_LAYOUT %q (want %q or %q)", layout, LayoutBalance, LayoutAccount)
+		return ""
+	}
+}
+
+func entriesPerAccount(layout string) int {
+	if layout == LayoutAccount {
+		return 3
+	}
+	return 1
+}
+
 // Get concurrent workers from environment or use default
 func getConcurrentWorkers() int {
 	if workers := os.Getenv("CONCURRENT_WORKERS"); workers != "" {
@@ -57,14 +91,18 @@ func getConcurrentWorkers() int {
 }
 
 type AccountData struct {
-	Address common.Address
-	Balance *big.Int
+	Address  common.Address
+	Nonce    uint64
+	Balance  *big.Int
+	CodeHash common.Hash
 }
 
 func main() {
 	totalAccounts := getTotalAccounts()
 	rpcURL := getRPCURL()
 	concurrentWorkers := getConcurrentWorkers()
+	layout := getAccountLayout()
+	dataset := getDataset()
 
 	log.Println("========================================")
 	log.Println("Plinko PIR Database Generator (Go)")
@@ -72,8 +110,15 @@ func main() {
 	log.Printf("Accounts: %d\n", totalAccounts)
 	log.Printf("RPC URL: %s\n", rpcURL)
 	log.Printf("Concurrent workers: %d\n", concurrentWorkers)
+	log.Printf("Account layout: %s\n", layout)
+	log.Printf("Dataset: %s\n", dataset)
 	log.Println()
 
+	if dataset == DatasetERC20 {
+		generateERC20Dataset(totalAccounts, rpcURL, concurrentWorkers)
+		return
+	}
+
 	// Check if database already exists
 	if _, err := os.Stat(DatabasePath); err == nil {
 		log.Println("✓ Database already exists at", DatabasePath)
@@ -99,11 +144,11 @@ func main() {
 	addresses := generateAnvilAddresses(totalAccounts)
 	log.Printf("Generated %d addresses in %v\n", len(addresses), time.Since(startGen))
 
-	// Query balances concurrently
-	log.Println("Querying account balances...")
+	// Query balances (and nonce/code for the account layout) concurrently
+	log.Println("Querying accounts...")
 	startQuery := time.Now()
-	accounts := queryBalancesConcurrent(client, addresses, concurrentWorkers)
-	log.Printf("Queried %d balances in %v\n", len(accounts), time.Since(startQuery))
+	accounts := queryAccountsConcurrent(client, addresses, concurrentWorkers, layout)
+	log.Printf("Queried %d accounts in %v\n", len(accounts), time.Since(startQuery))
 
 	// Sort accounts by address (deterministic ordering)
 	log.Println("Sorting accounts by address...")
@@ -111,9 +156,9 @@ func main() {
 		return accounts[i].Address.Hex() < accounts[j].Address.Hex()
 	})
 
-	// Write database.bin (8 bytes per account)
+	// Write database.bin (32 bytes per field, 1 or 3 fields per account)
 	log.Println("Writing database.bin...")
-	if err := writeDatabaseBin(accounts); err != nil {
+	if err := writeDatabaseBin(DatabasePath, accounts, layout); err != nil {
 		log.Fatalf("Failed to write database.bin: %v", err)
 	}
 
@@ -124,7 +169,7 @@ func main() {
 	}
 
 	// Verify output
-	verifyOutput(totalAccounts)
+	verifyOutput(totalAccounts, layout)
 
 	log.Println()
 	log.Println("✅ Database generation complete!")
@@ -172,8 +217,9 @@ func generateAnvilAddresses(count int) []common.Address {
 	return addresses
 }
 
-// queryBalancesConcurrent queries account balances with high concurrency
-func queryBalancesConcurrent(client *ethclient.Client, addresses []common.Address, workers int) []AccountData {
+// queryAccountsConcurrent queries account state with high concurrency. The
+// balance is always read; nonce and code hash only for the account layout.
+func queryAccountsConcurrent(client *ethclient.Client, addresses []common.Address, workers int, layout string) []AccountData {
 	accounts := make([]AccountData, len(addresses))
 
 	// Worker pool
@@ -192,16 +238,7 @@ func queryBalancesConcurrent(client *ethclient.Client, addresses []common.Addres
 			ctx := context.Background()
 
 			for i := range jobs {
-				balance, err := client.BalanceAt(ctx, addresses[i], nil)
-				if err != nil {
-					log.Printf("Error querying balance for %s: %v\n", addresses[i].Hex(), err)
-					balance = big.NewInt(0)
-				}
-
-				accounts[i] = AccountData{
-					Address: addresses[i],
-					Balance: balance,
-				}
+				accounts[i] = queryAccount(ctx, client, addresses[i], layout)
 
 				// Progress reporting
 				mu.Lock()
@@ -228,46 +265,82 @@ func queryBalancesConcurrent(client *ethclient.Client, addresses []common.Addres
 	return accounts
 }
 
-// writeDatabaseBin writes database.bin with 8-byte balance entries
-func writeDatabaseBin(accounts []AccountData) error {
-	f, err := os.Create(DatabasePath)
+// queryAccount reads one account. Failed queries are logged and leave the
+// field at its empty value so a single bad account does not stop generation.
+func queryAccount(ctx context.Context, client *ethclient.Client, addr common.Address, layout string) AccountData {
+	acc := AccountData{Address: addr, Balance: big.NewInt(0)}
+
+	if balance, err := client.BalanceAt(ctx, addr, nil); err != nil {
+		log.Printf("Error querying balance for %s: %v\n", addr.Hex(), err)
+	} else {
+		acc.Balance = balance
+	}
+
+	if layout != LayoutAccount {
+		return acc
+	}
+
+	if nonce, err := client.NonceAt(ctx, addr, nil); err != nil {
+		log.Printf("Error querying nonce for %s: %v\n", addr.Hex(), err)
+	} else {
+		acc.Nonce = nonce
+	}
+
+	acc.CodeHash = types.EmptyCodeHash
+	if code, err := client.CodeAt(ctx, addr, nil); err != nil {
+		log.Printf("Error querying code for %s: %v\n", addr.Hex(), err)
+	} else if len(code) > 0 {
+		acc.CodeHash = crypto.Keccak256Hash(code)
+	}
+
+	return acc
+}
+
+// writeDatabaseBin writes database.bin with one 32-byte entry per field
+func writeDatabaseBin(path string, accounts []AccountData, layout string) error {
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	maxUint64 := new(big.Int).SetUint64(^uint64(0))
-	clampedCount := 0
-
-	// Write 8 bytes per account (uint64 balance in wei, clamped to max)
-	for i, acc := range accounts {
-		var balance uint64
-
-		// Check for overflow and clamp to uint64 max
-		if acc.Balance.Cmp(maxUint64) > 0 {
-			balance = ^uint64(0) // Max uint64
-			clampedCount++
-			if clampedCount <= 5 { // Log first 5 overflows
-				log.Printf("⚠️  Warning: Balance at index %d exceeds uint64 max, clamping to %d wei",
-					i, balance)
+	w := bufio.NewWriter(f)
+	for _, acc := range accounts {
+		for _, field := range encodeAccount(acc, layout) {
+			if _, err := w.Write(field[:]); err != nil {
+				return err
 			}
-		} else {
-			balance = acc.Balance.Uint64()
-		}
-
-		// Write as little-endian uint64
-		var buf [8]byte
-		binary.LittleEndian.PutUint64(buf[:], balance)
-		if _, err := f.Write(buf[:]); err != nil {
-			return err
 		}
 	}
+	return w.Flush()
+}
 
-	if clampedCount > 0 {
-		log.Printf("⚠️  Total clamped balances: %d out of %d accounts", clampedCount, len(accounts))
+// encodeAccount returns the database entries for acc in layout order.
+func encodeAccount(acc AccountData, layout string) [][DBEntrySize]byte {
+	balance := encodeUint256(acc.Balance)
+	if layout != LayoutAccount {
+		return [][DBEntrySize]byte{balance}
 	}
+	return [][DBEntrySize]byte{
+		encodeUint256(new(big.Int).SetUint64(acc.Nonce)),
+		balance,
+		encodeUint256(new(big.Int).SetBytes(acc.CodeHash[:])),
+	}
+}
 
-	return nil
+// encodeUint256 stores v (balances, nonces and hashes all fit in 256 bits) as
+// a 256-bit little-endian integer, which is the same as four little-endian
+// uint64 words with the least significant first.
+func encodeUint256(v *big.Int) [DBEntrySize]byte {
+	var out [DBEntrySize]byte
+	if v == nil || v.Sign() <= 0 {
+		return out
+	}
+	v.FillBytes(out[:])
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
 }
 
 // writeAddressMapping writes address-mapping.bin with address→index mapping
@@ -297,13 +370,13 @@ func writeAddressMapping(accounts []AccountData) error {
 }
 
 // verifyOutput checks file sizes match expected values
-func verifyOutput(totalAccounts int) {
+func verifyOutput(totalAccounts int, layout string) {
 	// Check database.bin
 	dbInfo, err := os.Stat(DatabasePath)
 	if err != nil {
 		log.Printf("⚠️  Could not stat database.bin: %v\n", err)
 	} else {
-		expectedDB := int64(totalAccounts * 8)
+		expectedDB := int64(totalAccounts * entriesPerAccount(layout) * DBEntrySize)
 		if dbInfo.Size() == expectedDB {
 			log.Printf("✅ database.bin: %d bytes (expected %d)\n", dbInfo.Size(), expectedDB)
 		} else {
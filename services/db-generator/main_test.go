@@ -3,9 +3,13 @@ package main
 import (
 	"encoding/binary"
 	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // TestBalanceOverflowHandling tests that large balances don't cause overflow
@@ -76,34 +80,63 @@ func TestBalanceOverflowHandling(t *testing.T) {
 	}
 }
 
-// TestDatabaseBinFormat validates database.bin structure
+// TestDatabaseBinFormat validates database.bin structure for both layouts
 func TestDatabaseBinFormat(t *testing.T) {
+	codeHash := crypto.Keccak256Hash([]byte{0x60, 0x80})
 	accounts := []AccountData{
-		{Address: common.HexToAddress("0x1000000000000000000000000000000000000001"), Balance: big.NewInt(1000)},
-		{Address: common.HexToAddress("0x1000000000000000000000000000000000000002"), Balance: big.NewInt(2000)},
+		{Address: common.HexToAddress("0x1000000000000000000000000000000000000001"), Nonce: 7, Balance: big.NewInt(1000), CodeHash: types.EmptyCodeHash},
+		{Address: common.HexToAddress("0x1000000000000000000000000000000000000002"), Nonce: 1, Balance: new(big.Int).Lsh(big.NewInt(1), 70), CodeHash: codeHash},
 		{Address: common.HexToAddress("0x1000000000000000000000000000000000000003"), Balance: big.NewInt(3000)},
 	}
 
-	// Simulate database.bin creation
-	data := make([]byte, len(accounts)*8)
-	for i, acc := range accounts {
-		balance := acc.Balance.Uint64()
-		binary.LittleEndian.PutUint64(data[i*8:(i+1)*8], balance)
+	// word reads the little-endian uint64 word w of entry i
+	word := func(data []byte, i, w int) uint64 {
+		return binary.LittleEndian.Uint64(data[i*DBEntrySize+w*8:])
 	}
 
-	// Verify size
-	expectedSize := len(accounts) * 8
-	if len(data) != expectedSize {
-		t.Errorf("Database size mismatch: got %d bytes, want %d bytes", len(data), expectedSize)
-	}
+	for _, layout := range []string{LayoutBalance, LayoutAccount} {
+		t.Run(layout, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.bin")
+			if err := writeDatabaseBin(path, accounts, layout); err != nil {
+				t.Fatalf("write database: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read database: %v", err)
+			}
 
-	// Verify each entry
-	for i, acc := range accounts {
-		readBalance := binary.LittleEndian.Uint64(data[i*8 : (i+1)*8])
-		expectedBalance := acc.Balance.Uint64()
-		if readBalance != expectedBalance {
-			t.Errorf("Balance mismatch at index %d: got %d, want %d", i, readBalance, expectedBalance)
-		}
+			perAccount := entriesPerAccount(layout)
+			if expected := len(accounts) * perAccount * DBEntrySize; len(data) != expected {
+				t.Fatalf("Database size mismatch: got %d bytes, want %d bytes", len(data), expected)
+			}
+
+			balanceOffset := 0
+			if layout == LayoutAccount {
+				balanceOffset = 1
+			}
+			// Balances above 64 bits spill into the second word instead of clamping
+			if got := word(data, 1*perAccount+balanceOffset, 1); got != 1<<6 {
+				t.Errorf("high balance word = %d, want %d", got, 1<<6)
+			}
+			if got := word(data, 2*perAccount+balanceOffset, 0); got != 3000 {
+				t.Errorf("balance at account 2 = %d, want 3000", got)
+			}
+
+			if layout != LayoutAccount {
+				return
+			}
+			if got := word(data, 0, 0); got != 7 {
+				t.Errorf("nonce at account 0 = %d, want 7", got)
+			}
+			// The code hash is stored as a little-endian integer, so the last
+			// hash byte comes first
+			if got := data[1*perAccount*DBEntrySize+2*DBEntrySize]; got != codeHash[31] {
+				t.Errorf("code hash low byte = %#x, want %#x", got, codeHash[31])
+			}
+			if got := data[1*perAccount*DBEntrySize+3*DBEntrySize-1]; got != codeHash[0] {
+				t.Errorf("code hash high byte = %#x, want %#x", got, codeHash[0])
+			}
+		})
 	}
 }
 
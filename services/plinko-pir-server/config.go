@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +13,8 @@ const (
 	defaultServerPort           = "3000"
 	defaultDatabasePath         = "/data/database.bin"
 	defaultDatabaseWaitTimeout  = 120 * time.Second
+	defaultEpochOverlap         = time.Hour
+	defaultEpochPollInterval    = 10 * time.Second
 	deprecatedHintPathEnvNotice = "Deprecated hint path env var detected (%s); treating as database path"
 )
 
@@ -19,6 +22,18 @@ type Config struct {
 	ServerPort          string
 	DatabasePath        string
 	DatabaseWaitTimeout time.Duration
+
+	// EpochManifestPath points at the state-syncer's deltas/manifest.json.
+	// When set, databases are loaded per epoch from SnapshotsRoot instead
+	// of DatabasePath.
+	EpochManifestPath string
+	SnapshotsRoot     string
+	EpochOverlap      time.Duration
+	EpochPollInterval time.Duration
+
+	// FollowDeltas applies the manifest's deltas to the served databases,
+	// checking each block against its published digest.
+	FollowDeltas bool
 }
 
 func LoadConfig() Config {
@@ -26,6 +41,8 @@ func LoadConfig() Config {
 		ServerPort:          defaultServerPort,
 		DatabasePath:        defaultDatabasePath,
 		DatabaseWaitTimeout: defaultDatabaseWaitTimeout,
+		EpochOverlap:        defaultEpochOverlap,
+		EpochPollInterval:   defaultEpochPollInterval,
 	}
 
 	if v := firstNonEmpty(
@@ -66,6 +83,22 @@ func LoadConfig() Config {
 		}
 	}
 
+	cfg.EpochManifestPath = strings.TrimSpace(os.Getenv("PLINKO_PIR_EPOCH_MANIFEST"))
+	cfg.SnapshotsRoot = strings.TrimSpace(os.Getenv("PLINKO_PIR_SNAPSHOTS_ROOT"))
+	if cfg.SnapshotsRoot == "" && cfg.EpochManifestPath != "" {
+		// <public>/deltas/manifest.json → <public>/snapshots
+		cfg.SnapshotsRoot = filepath.Join(filepath.Dir(filepath.Dir(cfg.EpochManifestPath)), "snapshots")
+	}
+	cfg.EpochOverlap = durationEnv("PLINKO_PIR_EPOCH_OVERLAP", cfg.EpochOverlap)
+	cfg.EpochPollInterval = durationEnv("PLINKO_PIR_EPOCH_POLL_INTERVAL", cfg.EpochPollInterval)
+	if v := strings.TrimSpace(os.Getenv("PLINKO_PIR_FOLLOW_DELTAS")); v != "" {
+		follow, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("Invalid PLINKO_PIR_FOLLOW_DELTAS value %q, not following deltas", v)
+		}
+		cfg.FollowDeltas = follow
+	}
+
 	cfg.ServerPort = strings.TrimSpace(cfg.ServerPort)
 	cfg.DatabasePath = strings.TrimSpace(cfg.DatabasePath)
 
@@ -85,6 +118,19 @@ func (c Config) ListenAddress() string {
 	return ":" + port
 }
 
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Invalid %s value %q, using default %v", key, v, def)
+		return def
+	}
+	return d
+}
+
 func firstNonEmpty(values ...string) string {
 	for _, v := range values {
 		trimmed := strings.TrimSpace(v)
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"plinko-pir-server/dbdigest"
+)
+
+// Delta files as the state-syncer writes them: version 1 is a count and a
+// reserved word followed by the records; version 2 starts with a 128-byte
+// header (magic, version, header size, record width, dataset, block, block
+// hash, parent hash, count) and ends with the SHA-256 of everything before.
+// Each record is an entry index and the XOR of its old and new value.
+const (
+	deltaMagic        = "PLKD"
+	deltaVersion2     = 2
+	deltaV1HeaderSize = 16
+	deltaV2HeaderSize = 128
+	deltaRecordSize   = 8 + DBEntrySize
+)
+
+// DeltaEntry is a delta listed in deltas/manifest.json or one of its pages,
+// with the database digest after its block.
+type DeltaEntry struct {
+	Block  uint64 `json:"block"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// BundleEntry is a bundle listed in deltas/manifest.json or one of its
+// pages. Level 1 bundles replace the delta entries in their range, and
+// Digest is the database digest after EndBlock.
+type BundleEntry struct {
+	EndBlock uint64 `json:"endBlock"`
+	Digest   string `json:"digest,omitempty"`
+}
+
+// PageEntry points at a sealed page of older entries; Path is relative to
+// the manifest.
+type PageEntry struct {
+	StartBlock uint64 `json:"startBlock"`
+	EndBlock   uint64 `json:"endBlock"`
+	Path       string `json:"path"`
+}
+
+// readDeltaRecords reads the records of the delta file at path.
+func readDeltaRecords(path string) ([]dbdigest.Delta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	headerSize, count := deltaV1HeaderSize, uint64(0)
+	if len(data) >= 4 && string(data[:4]) == deltaMagic {
+		if len(data) < deltaV2HeaderSize+sha256.Size {
+			return nil, fmt.Errorf("%s: truncated", filepath.Base(path))
+		}
+		if version := binary.LittleEndian.Uint16(data[4:6]); version != deltaVersion2 {
+			return nil, fmt.Errorf("%s: unsupported version %d", filepath.Base(path), version)
+		}
+		if width := binary.LittleEndian.Uint32(data[8:12]); width != DBEntrySize {
+			return nil, fmt.Errorf("%s: unsupported record width %d", filepath.Base(path), width)
+		}
+		headerSize = int(binary.LittleEndian.Uint16(data[6:8]))
+		if headerSize < deltaV2HeaderSize || headerSize+sha256.Size > len(data) {
+			return nil, fmt.Errorf("%s: bad header size %d", filepath.Base(path), headerSize)
+		}
+		count = binary.LittleEndian.Uint64(data[120:128])
+		if count > uint64(len(data)-headerSize-sha256.Size)/deltaRecordSize {
+			return nil, fmt.Errorf("%s: truncated", filepath.Base(path))
+		}
+		body := headerSize + int(count)*deltaRecordSize
+		sum := sha256.Sum256(data[:body])
+		if !bytes.Equal(sum[:], data[body:body+sha256.Size]) {
+			return nil, fmt.Errorf("%s: checksum mismatch", filepath.Base(path))
+		}
+	} else {
+		if len(data) < deltaV1HeaderSize {
+			return nil, fmt.Errorf("%s: truncated", filepath.Base(path))
+		}
+		count = binary.LittleEndian.Uint64(data[:8])
+		if count > uint64(len(data)-deltaV1HeaderSize)/deltaRecordSize {
+			return nil, fmt.Errorf("%s: truncated", filepath.Base(path))
+		}
+	}
+
+	deltas := make([]dbdigest.Delta, count)
+	for i := range deltas {
+		rec := data[headerSize+i*deltaRecordSize:]
+		deltas[i].Index = binary.LittleEndian.Uint64(rec)
+		for w := range deltas[i].Delta {
+			deltas[i].Delta[w] = binary.LittleEndian.Uint64(rec[8+8*w:])
+		}
+	}
+	return deltas, nil
+}
+
+// manifestDeltas lists the delta files in deltaDir after block from, up to
+// the latest block in manifest, oldest first. Bundling drops the entries of
+// the blocks it covers from the manifest, so the files are listed from the
+// directory; each comes with the digest the manifest publishes for the
+// database after it, taken from the delta entries, the bundles or the
+// manifest's own digest at the latest block, whichever is latest before the
+// next file. A block with no digest published after it gets none.
+func manifestDeltas(manifest EpochManifest, deltaDir string, from uint64) ([]DeltaEntry, error) {
+	digests := make(map[uint64]string)
+	record := func(deltas []DeltaEntry, bundles []BundleEntry) {
+		for _, delta := range deltas {
+			if delta.Digest != "" {
+				digests[delta.Block] = delta.Digest
+			}
+		}
+		for _, bundle := range bundles {
+			if bundle.Digest != "" {
+				digests[bundle.EndBlock] = bundle.Digest
+			}
+		}
+	}
+	for _, page := range manifest.Pages {
+		if page.EndBlock <= from {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(deltaDir, filepath.FromSlash(page.Path)))
+		if err != nil {
+			return nil, err
+		}
+		var contents struct {
+			Deltas  []DeltaEntry  `json:"deltas"`
+			Bundles []BundleEntry `json:"bundles"`
+		}
+		if err := json.Unmarshal(data, &contents); err != nil {
+			return nil, fmt.Errorf("manifest page %s: %w", page.Path, err)
+		}
+		record(contents.Deltas, contents.Bundles)
+	}
+	record(manifest.Deltas, manifest.Bundles)
+	latest := manifest.LatestBlock
+	if manifest.Digest != "" {
+		digests[latest] = manifest.Digest
+	}
+
+	files, err := os.ReadDir(deltaDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DeltaEntry
+	for _, file := range files {
+		name, ok := strings.CutPrefix(file.Name(), "delta-")
+		if !ok {
+			continue
+		}
+		if name, ok = strings.CutSuffix(name, ".bin"); !ok {
+			continue
+		}
+		block, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || block <= from || block > latest {
+			continue
+		}
+		entries = append(entries, DeltaEntry{Block: block})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Block < entries[j].Block })
+
+	for i := range entries {
+		next := latest + 1
+		if i+1 < len(entries) {
+			next = entries[i+1].Block
+		}
+		at := uint64(0)
+		for block, digest := range digests {
+			if block >= entries[i].Block && block < next && block >= at {
+				entries[i].Digest, at = digest, block
+			}
+		}
+	}
+	return entries, nil
+}
+
+// FollowDeltas brings every served database up to the latest block in
+// manifest, whose delta files are in deltaDir. Each block is checked against
+// the digest published for it (see manifestDeltas); a database that does
+// not match stops following (see applyBlock) while the others go on.
+func (r *EpochRouter) FollowDeltas(manifest EpochManifest, deltaDir string) error {
+	r.mu.RLock()
+	servers := make([]*PlinkoPIRServer, 0, len(r.servers))
+	for _, server := range r.servers {
+		servers = append(servers, server)
+	}
+	r.mu.RUnlock()
+
+	from := uint64(0)
+	for i, server := range servers {
+		if block, _ := server.position(); i == 0 || block < from {
+			from = block
+		}
+	}
+	entries, err := manifestDeltas(manifest, deltaDir, from)
+	if err != nil {
+		return err
+	}
+
+	records := make(map[uint64][]dbdigest.Delta)
+	for _, server := range servers {
+		for _, entry := range entries {
+			block, halted := server.position()
+			if halted != "" {
+				break
+			}
+			if entry.Block <= block {
+				continue
+			}
+			deltas, ok := records[entry.Block]
+			if !ok {
+				deltas, err = readDeltaRecords(filepath.Join(deltaDir, fmt.Sprintf("delta-%06d.bin", entry.Block)))
+				if err != nil {
+					return err
+				}
+				records[entry.Block] = deltas
+			}
+			if err := server.applyBlock(entry.Block, deltas, entry.Digest); err != nil {
+				log.Printf("⚠️ Stopped following deltas after block %d: %v", block, err)
+			}
+		}
+	}
+	return nil
+}
+
+// position returns the block the database holds the state after and, once
+// it stopped following deltas, why.
+func (s *PlinkoPIRServer) position() (uint64, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.block, s.halted
+}
+
+// size returns the number of entries, which grows as deltas are followed.
+func (s *PlinkoPIRServer) size() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dbSize
+}
+
+// applyBlock applies the delta records of block and checks the database
+// against want, the digest published for the block; an empty want is not
+// checked. A block that does not match is undone, XOR deltas being their
+// own inverse, so the database stays at the last block that did. That block
+// and one the database cannot hold without a new epoch stop the server
+// from following deltas, which /health reports.
+func (s *PlinkoPIRServer) applyBlock(block uint64, deltas []dbdigest.Delta, want string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lanes == nil {
+		digest := dbdigest.FromWords(s.database, s.dbSize)
+		s.lanes = &digest
+	}
+	size := s.dbSize
+	for _, delta := range deltas {
+		size = max(size, delta.Index+1)
+	}
+	err := s.lanes.ApplyDeltas(s.database, deltas, want)
+	if errors.Is(err, dbdigest.ErrMismatch) {
+		s.lanes.ApplyDeltas(s.database, deltas, "")
+	}
+	if err != nil {
+		s.halted = fmt.Sprintf("block %d: %v", block, err)
+		return err
+	}
+	s.dbSize, s.block, s.digest = size, block, s.lanes.Sum()
+	return nil
+}
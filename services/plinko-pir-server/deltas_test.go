@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plinko-pir-server/dbdigest"
+)
+
+// writeDelta writes deltas as the state-syncer's version 2 delta file for
+// block.
+func writeDelta(t *testing.T, dir string, block uint64, deltas []dbdigest.Delta) {
+	t.Helper()
+	buf := make([]byte, deltaV2HeaderSize, deltaV2HeaderSize+len(deltas)*deltaRecordSize+sha256.Size)
+	copy(buf, deltaMagic)
+	binary.LittleEndian.PutUint16(buf[4:], deltaVersion2)
+	binary.LittleEndian.PutUint16(buf[6:], deltaV2HeaderSize)
+	binary.LittleEndian.PutUint32(buf[8:], DBEntrySize)
+	binary.LittleEndian.PutUint64(buf[48:], block)
+	binary.LittleEndian.PutUint64(buf[120:], uint64(len(deltas)))
+	for _, delta := range deltas {
+		buf = binary.LittleEndian.AppendUint64(buf, delta.Index)
+		for _, w := range delta.Delta {
+			buf = binary.LittleEndian.AppendUint64(buf, w)
+		}
+	}
+	sum := sha256.Sum256(buf)
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("delta-%06d.bin", block)), append(buf, sum[:]...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowDeltasRejectsMismatch(t *testing.T) {
+	root := t.TempDir()
+	writeSnapshotDB(t, root, "block-000005", 16, 7)
+	deltaDir := t.TempDir()
+
+	// The canonical database, to compute the digest after each block.
+	words := make([]uint64, 32*DBEntryLength)
+	for i := 0; i < 16; i++ {
+		words[i*DBEntryLength] = 7
+	}
+	canonical := dbdigest.FromWords(words, 16)
+	publish := func(block uint64, deltas []dbdigest.Delta) string {
+		writeDelta(t, deltaDir, block, deltas)
+		if err := canonical.ApplyDeltas(words, deltas, ""); err != nil {
+			t.Fatal(err)
+		}
+		return canonical.Sum()
+	}
+	digest6 := publish(6, []dbdigest.Delta{{Index: 2, Delta: dbdigest.Entry{1}}})
+	// Block 7 grows the database by an entry.
+	digest7 := publish(7, []dbdigest.Delta{{Index: 16, Delta: dbdigest.Entry{9}}})
+	// Block 8's file was tampered with: it no longer produces its digest.
+	digest8 := publish(8, []dbdigest.Delta{{Index: 3, Delta: dbdigest.Entry{2}}})
+	writeDelta(t, deltaDir, 8, []dbdigest.Delta{{Index: 3, Delta: dbdigest.Entry{4}}})
+	digest9 := publish(9, []dbdigest.Delta{{Index: 4, Delta: dbdigest.Entry{1}}})
+
+	// Block 6 was moved to a page.
+	page, _ := json.Marshal(map[string]any{"deltas": []DeltaEntry{{Block: 6, Digest: digest6}}})
+	if err := os.MkdirAll(filepath.Join(deltaDir, "pages"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(deltaDir, "pages", "page-000006.json"), page, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk, set := derivePlinkoParams(16)
+	manifest := EpochManifest{
+		Epochs:      []EpochInfo{{Block: 5, Snapshot: "block-000005", ChunkSize: chunk, SetSize: set}},
+		LatestBlock: 9,
+		Pages:       []PageEntry{{StartBlock: 6, EndBlock: 6, Path: "pages/page-000006.json"}},
+		Deltas:      []DeltaEntry{{Block: 7, Digest: digest7}, {Block: 8, Digest: digest8}, {Block: 9, Digest: digest9}},
+	}
+	router := NewEpochRouter(0)
+	if err := router.Apply(manifest, root, time.Now()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := router.FollowDeltas(manifest, deltaDir); err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+
+	status := router.Status()
+	if len(status) != 1 || status[0].Block != 7 || status[0].Digest != digest7 || status[0].DBSize != 17 || status[0].Halted == "" {
+		t.Fatalf("status = %+v", status)
+	}
+	server, _, _ := router.Lookup(nil)
+	if got := server.DBAccess(2)[0]; got != 6 {
+		t.Fatalf("entry 2 = %d, want 6 after block 6", got)
+	}
+	if got := server.DBAccess(16)[0]; got != 9 {
+		t.Fatalf("entry 16 = %d, want 9 after block 7", got)
+	}
+	if got := server.DBAccess(3)[0]; got != 7 {
+		t.Fatalf("entry 3 = %d, want the tampered block 8 undone", got)
+	}
+	if got := server.DBAccess(4)[0]; got != 7 {
+		t.Fatalf("entry 4 = %d, want block 9 not applied", got)
+	}
+}
+
+func TestFollowDeltasAcrossBundles(t *testing.T) {
+	root := t.TempDir()
+	writeSnapshotDB(t, root, "block-000005", 16, 7)
+	deltaDir := t.TempDir()
+
+	words := make([]uint64, 16*DBEntryLength)
+	for i := 0; i < 16; i++ {
+		words[i*DBEntryLength] = 7
+	}
+	canonical := dbdigest.FromWords(words, 16)
+	publish := func(block uint64, deltas []dbdigest.Delta) string {
+		writeDelta(t, deltaDir, block, deltas)
+		if err := canonical.ApplyDeltas(words, deltas, ""); err != nil {
+			t.Fatal(err)
+		}
+		return canonical.Sum()
+	}
+	publish(6, []dbdigest.Delta{{Index: 1, Delta: dbdigest.Entry{1}}})
+	digest7 := publish(7, []dbdigest.Delta{{Index: 2, Delta: dbdigest.Entry{1}}})
+	digest9 := publish(9, []dbdigest.Delta{{Index: 3, Delta: dbdigest.Entry{1}}})
+	// Not yet in the manifest.
+	publish(11, []dbdigest.Delta{{Index: 4, Delta: dbdigest.Entry{1}}})
+
+	// The bundle of blocks 6-8 replaced their entries, and block 8 changed
+	// nothing; block 9's entry was bundled too, and the manifest's digest
+	// covers it through block 10.
+	chunk, set := derivePlinkoParams(16)
+	manifest := EpochManifest{
+		Epochs:      []EpochInfo{{Block: 5, Snapshot: "block-000005", ChunkSize: chunk, SetSize: set}},
+		LatestBlock: 10,
+		Digest:      digest9,
+		Bundles:     []BundleEntry{{EndBlock: 8, Digest: digest7}},
+	}
+	follow := func() EpochStatus {
+		router := NewEpochRouter(0)
+		if err := router.Apply(manifest, root, time.Now()); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if err := router.FollowDeltas(manifest, deltaDir); err != nil {
+			t.Fatalf("follow: %v", err)
+		}
+		return router.Status()[0]
+	}
+	if status := follow(); status.Block != 9 || status.Digest != digest9 || status.Halted != "" {
+		t.Fatalf("status = %+v", status)
+	}
+
+	// A tampered block inside the bundle is caught at the bundle's digest.
+	writeDelta(t, deltaDir, 7, []dbdigest.Delta{{Index: 2, Delta: dbdigest.Entry{3}}})
+	if status := follow(); status.Block != 6 || status.Halted == "" {
+		t.Fatalf("tampered status = %+v", status)
+	}
+}
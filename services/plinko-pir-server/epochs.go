@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"plinko-pir-server/dbdigest"
+)
+
+// EpochInfo mirrors the state-syncer's entry in deltas/manifest.json. An
+// epoch is one set of PIR parameters; its database is the snapshot the
+// syncer published when it announced the epoch.
+type EpochInfo struct {
+	Epoch           uint64 `json:"epoch"`
+	Block           uint64 `json:"block"`
+	ActivationBlock uint64 `json:"activationBlock"`
+	DBSize          uint64 `json:"dbSize"`
+	ChunkSize       uint64 `json:"chunkSize"`
+	SetSize         uint64 `json:"setSize"`
+	Snapshot        string `json:"snapshot"`
+}
+
+// EpochManifest is the part of deltas/manifest.json the server follows.
+type EpochManifest struct {
+	Epoch     uint64      `json:"epoch"`
+	Epochs    []EpochInfo `json:"epochs"`
+	NextEpoch *EpochInfo  `json:"nextEpoch,omitempty"`
+
+	// The rest locates the published deltas and their digests, for
+	// FollowDeltas: Digest is the database's as of LatestBlock.
+	LatestBlock uint64        `json:"latestBlock"`
+	Digest      string        `json:"digest,omitempty"`
+	Deltas      []DeltaEntry  `json:"deltas"`
+	Bundles     []BundleEntry `json:"bundles"`
+	Pages       []PageEntry   `json:"pages,omitempty"`
+}
+
+// EpochRouter serves every epoch a client may still hold hints for: the
+// active one, the announced next one (so clients can switch as soon as they
+// have rehinted) and, for the overlap window after a switch, the previous
+// one. Requests name their epoch; those that don't get the active one.
+type EpochRouter struct {
+	mu       sync.RWMutex
+	servers  map[uint64]*PlinkoPIRServer
+	current  uint64
+	retireAt map[uint64]time.Time
+	overlap  time.Duration
+}
+
+func NewEpochRouter(overlap time.Duration) *EpochRouter {
+	return &EpochRouter{
+		servers:  make(map[uint64]*PlinkoPIRServer),
+		retireAt: make(map[uint64]time.Time),
+		overlap:  overlap,
+	}
+}
+
+// newSingleEpochRouter serves one database as epoch 0, for deployments
+// without an epoch manifest.
+func newSingleEpochRouter(server *PlinkoPIRServer) *EpochRouter {
+	r := NewEpochRouter(0)
+	r.servers[0] = server
+	return r
+}
+
+// Lookup returns the server for the requested epoch, or the active one when
+// requested is nil.
+func (r *EpochRouter) Lookup(requested *uint64) (*PlinkoPIRServer, uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	epoch := r.current
+	if requested != nil {
+		epoch = *requested
+	}
+	server, ok := r.servers[epoch]
+	if !ok {
+		return nil, 0, fmt.Errorf("epoch %d is not served (active epoch %d), rehint from the current snapshot", epoch, r.current)
+	}
+	return server, epoch, nil
+}
+
+// Current returns the active epoch and its server.
+func (r *EpochRouter) Current() (uint64, *PlinkoPIRServer) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.servers[r.current]
+}
+
+// Apply brings the served epochs in line with manifest. Missing databases
+// are loaded from snapshotsRoot before the switch, so the active epoch never
+// points at a database that is not in memory. Epochs superseded by the
+// active one are retired overlap after the switch was observed; announced
+// epochs that were replaced are dropped at once.
+func (r *EpochRouter) Apply(manifest EpochManifest, snapshotsRoot string, now time.Time) error {
+	wanted := make(map[uint64]EpochInfo)
+	for _, info := range manifest.Epochs {
+		if info.Epoch == manifest.Epoch {
+			wanted[info.Epoch] = info
+		}
+	}
+	if _, ok := wanted[manifest.Epoch]; !ok {
+		return fmt.Errorf("manifest has no entry for active epoch %d", manifest.Epoch)
+	}
+	if next := manifest.NextEpoch; next != nil && next.Epoch > manifest.Epoch {
+		wanted[next.Epoch] = *next
+	}
+
+	loaded := make(map[uint64]*PlinkoPIRServer)
+	for epoch, info := range wanted {
+		if r.serves(epoch) {
+			continue
+		}
+		dir := filepath.Join(snapshotsRoot, info.Snapshot)
+		server, err := loadDatabaseFile(filepath.Join(dir, "database.bin"), info.ChunkSize, info.SetSize)
+		if err != nil {
+			return fmt.Errorf("epoch %d: %w", epoch, err)
+		}
+		if err := verifySnapshot(dir, server); err != nil {
+			return fmt.Errorf("epoch %d: %w", epoch, err)
+		}
+		server.block = info.Block
+		log.Printf("Loaded epoch %d from %s: %d entries, ChunkSize: %d, SetSize: %d\n",
+			epoch, info.Snapshot, server.dbSize, server.chunkSize, server.setSize)
+		loaded[epoch] = server
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for epoch, server := range loaded {
+		r.servers[epoch] = server
+	}
+	if manifest.Epoch != r.current {
+		log.Printf("Epoch %d active; older epochs retire at %s\n", manifest.Epoch, now.Add(r.overlap).Format(time.RFC3339))
+		r.current = manifest.Epoch
+	}
+	for epoch := range r.servers {
+		switch {
+		case epoch < r.current:
+			if _, ok := r.retireAt[epoch]; !ok {
+				r.retireAt[epoch] = now.Add(r.overlap)
+			}
+			if !now.Before(r.retireAt[epoch]) {
+				log.Printf("Retired epoch %d\n", epoch)
+				delete(r.servers, epoch)
+				delete(r.retireAt, epoch)
+			}
+		case epoch > r.current:
+			if _, ok := wanted[epoch]; !ok {
+				log.Printf("Dropped announced epoch %d\n", epoch)
+				delete(r.servers, epoch)
+			}
+		}
+	}
+	return nil
+}
+
+// verifySnapshot checks the database loaded into server against the digest
+// in the manifest of the snapshot in dir. Snapshots published without a
+// digest are served unchecked.
+func verifySnapshot(dir string, server *PlinkoPIRServer) error {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var manifest struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("decode %s manifest: %w", filepath.Base(dir), err)
+	}
+	if manifest.Digest == "" {
+		return nil
+	}
+	digest := dbdigest.FromWords(server.database, server.dbSize)
+	if sum := digest.Sum(); sum != manifest.Digest {
+		return fmt.Errorf("%s database digest %s, manifest says %s", filepath.Base(dir), sum, manifest.Digest)
+	}
+	server.digest, server.lanes = manifest.Digest, &digest
+	return nil
+}
+
+func (r *EpochRouter) serves(epoch uint64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.servers[epoch]
+	return ok
+}
+
+// EpochStatus describes one served epoch in /health.
+type EpochStatus struct {
+	Epoch     uint64     `json:"epoch"`
+	DBSize    uint64     `json:"db_size"`
+	ChunkSize uint64     `json:"chunk_size"`
+	SetSize   uint64     `json:"set_size"`
+	Digest    string     `json:"digest,omitempty"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+
+	// Block is the block the database holds the state after; Halted says
+	// why it stopped following deltas.
+	Block  uint64 `json:"block"`
+	Halted string `json:"halted,omitempty"`
+}
+
+func (r *EpochRouter) Status() []EpochStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]EpochStatus, 0, len(r.servers))
+	for epoch, server := range r.servers {
+		server.mu.RLock()
+		status := EpochStatus{
+			Epoch:     epoch,
+			DBSize:    server.dbSize,
+			ChunkSize: server.chunkSize,
+			SetSize:   server.setSize,
+			Digest:    server.digest,
+			Block:     server.block,
+			Halted:    server.halted,
+		}
+		server.mu.RUnlock()
+		if at, ok := r.retireAt[epoch]; ok {
+			status.RetiresAt = &at
+		}
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Epoch < out[j].Epoch })
+	return out
+}
+
+func readEpochManifest(path string) (EpochManifest, error) {
+	var manifest EpochManifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// watchEpochs re-reads the manifest every interval, forever, and with
+// followDeltas applies the deltas it lists.
+func (r *EpochRouter) watchEpochs(manifestPath, snapshotsRoot string, interval time.Duration, followDeltas bool) {
+	for {
+		time.Sleep(interval)
+		manifest, err := readEpochManifest(manifestPath)
+		if err == nil {
+			err = r.Apply(manifest, snapshotsRoot, time.Now())
+		}
+		if err == nil && followDeltas {
+			err = r.FollowDeltas(manifest, filepath.Dir(manifestPath))
+		}
+		if err != nil {
+			log.Printf("epoch refresh failed: %v", err)
+		}
+	}
+}
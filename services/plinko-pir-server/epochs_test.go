@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plinko-pir-server/dbdigest"
+)
+
+func writeSnapshotDB(t *testing.T, root, version string, entries int, value uint64) {
+	t.Helper()
+	dir := filepath.Join(root, version)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	data := make([]byte, entries*DBEntrySize)
+	for i := 0; i < entries; i++ {
+		binary.LittleEndian.PutUint64(data[i*DBEntrySize:], value)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "database.bin"), data, 0o600); err != nil {
+		t.Fatalf("write db: %v", err)
+	}
+}
+
+func TestEpochRouterOverlap(t *testing.T) {
+	root := t.TempDir()
+	writeSnapshotDB(t, root, "block-000000", 10, 1)
+	writeSnapshotDB(t, root, "block-000050", 20, 2)
+
+	chunk0, set0 := derivePlinkoParams(10)
+	epoch0 := EpochInfo{Epoch: 0, Snapshot: "block-000000", ChunkSize: chunk0, SetSize: set0}
+	epoch1 := EpochInfo{Epoch: 1, Block: 50, ActivationBlock: 60, Snapshot: "block-000050", ChunkSize: 16, SetSize: 4}
+
+	router := NewEpochRouter(time.Hour)
+	start := time.Now()
+
+	// Announced: both epochs served, epoch 0 by default.
+	if err := router.Apply(EpochManifest{Epochs: []EpochInfo{epoch0}, NextEpoch: &epoch1}, root, start); err != nil {
+		t.Fatalf("apply announcement: %v", err)
+	}
+	if _, epoch, err := router.Lookup(nil); err != nil || epoch != 0 {
+		t.Fatalf("default epoch = %d, %v", epoch, err)
+	}
+	one := uint64(1)
+	server, _, err := router.Lookup(&one)
+	if err != nil || server.chunkSize != 16 || server.setSize != 4 || server.DBAccess(0)[0] != 2 {
+		t.Fatalf("epoch 1 lookup: %+v, %v", server, err)
+	}
+
+	// Activated: epoch 1 is the default, epoch 0 stays for the overlap.
+	activated := EpochManifest{Epoch: 1, Epochs: []EpochInfo{epoch0, epoch1}}
+	if err := router.Apply(activated, root, start.Add(time.Minute)); err != nil {
+		t.Fatalf("apply activation: %v", err)
+	}
+	if _, epoch, _ := router.Lookup(nil); epoch != 1 {
+		t.Fatalf("default epoch after switch = %d", epoch)
+	}
+	zero := uint64(0)
+	if _, _, err := router.Lookup(&zero); err != nil {
+		t.Fatalf("epoch 0 during overlap: %v", err)
+	}
+
+	if err := router.Apply(activated, root, start.Add(time.Hour+time.Minute)); err != nil {
+		t.Fatalf("apply after overlap: %v", err)
+	}
+	if _, _, err := router.Lookup(&zero); err == nil {
+		t.Fatal("epoch 0 still served after overlap")
+	}
+	if status := router.Status(); len(status) != 1 || status[0].Epoch != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestPlinkoQueryEpochs(t *testing.T) {
+	root := t.TempDir()
+	writeSnapshotDB(t, root, "block-000000", 16, 7)
+	chunk, set := derivePlinkoParams(16)
+	router := NewEpochRouter(0)
+	manifest := EpochManifest{Epochs: []EpochInfo{{Snapshot: "block-000000", ChunkSize: chunk, SetSize: set}}}
+	if err := router.Apply(manifest, root, time.Now()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	query := func(epoch *uint64) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(PlinkoQueryRequest{P: []uint64{0}, Offsets: make([]uint64, set), Epoch: epoch})
+		rec := httptest.NewRecorder()
+		router.plinkoQueryHandler(rec, httptest.NewRequest(http.MethodPost, "/query/plinko", bytes.NewReader(body)))
+		return rec
+	}
+
+	rec := query(nil)
+	var resp PlinkoQueryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("query: %d %v", rec.Code, err)
+	}
+	if resp.Epoch != 0 || resp.R0 != "7" {
+		t.Fatalf("response = %+v", resp)
+	}
+
+	stale := uint64(3)
+	if rec := query(&stale); rec.Code != http.StatusGone {
+		t.Fatalf("unknown epoch: got %d", rec.Code)
+	}
+}
+
+func TestEpochRouterVerifiesDigest(t *testing.T) {
+	root := t.TempDir()
+	writeSnapshotDB(t, root, "block-000000", 16, 7)
+	chunk, set := derivePlinkoParams(16)
+	manifest := EpochManifest{Epochs: []EpochInfo{{Snapshot: "block-000000", ChunkSize: chunk, SetSize: set}}}
+	writeDigest := func(digest string) {
+		t.Helper()
+		data, _ := json.Marshal(map[string]string{"digest": digest})
+		if err := os.WriteFile(filepath.Join(root, "block-000000", "manifest.json"), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A snapshot of other values is refused.
+	words := make([]uint64, 16*DBEntryLength)
+	for i := 0; i < 16; i++ {
+		words[i*DBEntryLength] = 8
+	}
+	other := dbdigest.FromWords(words, 16)
+	writeDigest(other.Sum())
+	if err := NewEpochRouter(0).Apply(manifest, root, time.Now()); err == nil {
+		t.Fatal("served a database that does not match its digest")
+	}
+
+	for i := 0; i < 16; i++ {
+		words[i*DBEntryLength] = 7
+	}
+	want := dbdigest.FromWords(words, 16)
+	writeDigest(want.Sum())
+	router := NewEpochRouter(0)
+	if err := router.Apply(manifest, root, time.Now()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if status := router.Status(); len(status) != 1 || status[0].Digest != want.Sum() {
+		t.Fatalf("status = %+v", status)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -17,18 +18,24 @@ func main() {
 	log.Printf("Configuration: port=%s, database_path=%s, database_timeout=%s\n",
 		cfg.ListenAddress(), cfg.DatabasePath, cfg.DatabaseWaitTimeout)
 
-	waitForDatabase(cfg.DatabasePath, cfg.DatabaseWaitTimeout)
+	var router *EpochRouter
+	if cfg.EpochManifestPath != "" {
+		router = loadEpochs(cfg)
+	} else {
+		waitForDatabase(cfg.DatabasePath, cfg.DatabaseWaitTimeout)
 
-	log.Println("Loading canonical database snapshot...")
-	server := loadServer(cfg.DatabasePath)
-	log.Printf("✅ Database loaded: %d entries (%d MB)\n",
-		server.dbSize, server.dbSize*DBEntrySize/1024/1024)
-	log.Printf("   ChunkSize: %d, SetSize: %d\n", server.chunkSize, server.setSize)
+		log.Println("Loading canonical database snapshot...")
+		server := loadServer(cfg.DatabasePath)
+		log.Printf("✅ Database loaded: %d entries (%d MB)\n",
+			server.dbSize, server.dbSize*DBEntrySize/1024/1024)
+		log.Printf("   ChunkSize: %d, SetSize: %d\n", server.chunkSize, server.setSize)
+		router = newSingleEpochRouter(server)
+	}
 	log.Println()
 
-	http.HandleFunc("/health", corsMiddleware(server.healthHandler))
-	http.HandleFunc("/query/plaintext", corsMiddleware(server.plaintextQueryHandler))
-	http.HandleFunc("/query/plinko", corsMiddleware(server.plinkoQueryHandler))
+	http.HandleFunc("/health", corsMiddleware(router.healthHandler))
+	http.HandleFunc("/query/plaintext", corsMiddleware(router.plaintextQueryHandler))
+	http.HandleFunc("/query/plinko", corsMiddleware(router.plinkoQueryHandler))
 
 	addr := cfg.ListenAddress()
 	log.Printf("🚀 Plinko PIR Server listening on %s\n", addr)
@@ -43,6 +50,31 @@ func main() {
 	}
 }
 
+// loadEpochs loads the epochs announced in the state-syncer manifest and
+// keeps following it in the background.
+func loadEpochs(cfg Config) *EpochRouter {
+	log.Printf("Epoch manifest: %s (snapshots=%s, overlap=%s)\n", cfg.EpochManifestPath, cfg.SnapshotsRoot, cfg.EpochOverlap)
+	waitForDatabase(cfg.EpochManifestPath, cfg.DatabaseWaitTimeout)
+
+	manifest, err := readEpochManifest(cfg.EpochManifestPath)
+	if err != nil {
+		log.Fatalf("Failed to read epoch manifest: %v", err)
+	}
+	router := NewEpochRouter(cfg.EpochOverlap)
+	if err := router.Apply(manifest, cfg.SnapshotsRoot, time.Now()); err != nil {
+		log.Fatalf("Failed to load epochs: %v", err)
+	}
+	log.Printf("✅ Serving epoch %d\n", manifest.Epoch)
+	if cfg.FollowDeltas {
+		if err := router.FollowDeltas(manifest, filepath.Dir(cfg.EpochManifestPath)); err != nil {
+			log.Printf("Failed to follow deltas: %v", err)
+		}
+	}
+
+	go router.watchEpochs(cfg.EpochManifestPath, cfg.SnapshotsRoot, cfg.EpochPollInterval, cfg.FollowDeltas)
+	return router
+}
+
 func waitForDatabase(path string, timeout time.Duration) {
 	log.Printf("Waiting for canonical database at %s...\n", path)
 
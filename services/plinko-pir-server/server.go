@@ -3,12 +3,16 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
+
+	"plinko-pir-server/dbdigest"
 )
 
 const (
@@ -23,14 +27,26 @@ type PlinkoPIRServer struct {
 	dbSize    uint64
 	chunkSize uint64
 	setSize   uint64
+	// digest is the dbdigest the snapshot's manifest vouches for, if any.
+	digest string
+
+	// Delta following (see deltas.go): mu keeps queries off the database
+	// while a block is applied, block is the one it holds the state after,
+	// lanes its running digest and halted why it stopped following.
+	mu     sync.RWMutex
+	block  uint64
+	lanes  *dbdigest.Digest
+	halted string
 }
 
 type PlaintextQueryRequest struct {
-	Index uint64 `json:"index"`
+	Index uint64  `json:"index"`
+	Epoch *uint64 `json:"epoch,omitempty"`
 }
 
 type PlaintextQueryResponse struct {
 	Value           string `json:"value"`
+	Epoch           uint64 `json:"epoch"`
 	ServerTimeNanos uint64 `json:"server_time_nanos"`
 }
 
@@ -39,6 +55,9 @@ type PlinkoQueryRequest struct {
 	P []uint64 `json:"p"`
 	// Offsets is the list of offsets for each block
 	Offsets []uint64 `json:"offsets"`
+	// Epoch selects the database the client's hints were built for; the
+	// active epoch when omitted
+	Epoch *uint64 `json:"epoch,omitempty"`
 }
 
 type PlinkoQueryResponse struct {
@@ -46,6 +65,8 @@ type PlinkoQueryResponse struct {
 	R0 string `json:"r0"`
 	// R1 is the parity of the blocks NOT in P
 	R1 string `json:"r1"`
+	// Epoch is the epoch that answered the query
+	Epoch           uint64 `json:"epoch"`
 	ServerTimeNanos uint64 `json:"server_time_nanos"`
 }
 
@@ -66,23 +87,39 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 }
 
 func loadServer(databasePath string) *PlinkoPIRServer {
+	server, err := loadDatabaseFile(databasePath, 0, 0)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return server
+}
+
+// loadDatabaseFile loads a canonical database. Zero chunkSize and setSize
+// derive them from the file size; epochs pass the parameters announced in
+// the manifest, which leave room for growth.
+func loadDatabaseFile(databasePath string, chunkSize, setSize uint64) (*PlinkoPIRServer, error) {
 	data, err := os.ReadFile(databasePath)
 	if err != nil {
-		log.Fatalf("Failed to read database file %s: %v", databasePath, err)
+		return nil, fmt.Errorf("read database file %s: %w", databasePath, err)
 	}
 
 	if len(data)%DBEntrySize != 0 {
-		log.Fatalf("Invalid database file: size %d is not a multiple of %d", len(data), DBEntrySize)
+		return nil, fmt.Errorf("invalid database file: size %d is not a multiple of %d", len(data), DBEntrySize)
 	}
 
 	entryCount := len(data) / DBEntrySize
 	if entryCount == 0 {
-		log.Fatal("Invalid database file: contains zero entries")
+		return nil, fmt.Errorf("invalid database file: contains zero entries")
 	}
 
 	dbSize := uint64(entryCount)
-	chunkSize, setSize := derivePlinkoParams(dbSize)
+	if chunkSize == 0 || setSize == 0 {
+		chunkSize, setSize = derivePlinkoParams(dbSize)
+	}
 	totalEntries := chunkSize * setSize
+	if totalEntries < dbSize {
+		return nil, fmt.Errorf("invalid database file: %d entries exceed chunk_size*set_size %d", dbSize, totalEntries)
+	}
 
 	// database slice holds flattened uint64 words
 	database := make([]uint64, totalEntries*DBEntryLength)
@@ -101,10 +138,17 @@ func loadServer(databasePath string) *PlinkoPIRServer {
 		dbSize:    dbSize,
 		chunkSize: chunkSize,
 		setSize:   setSize,
-	}
+	}, nil
 }
 
 func (s *PlinkoPIRServer) DBAccess(id uint64) DBEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entry(id)
+}
+
+// entry reads entry id; the caller holds mu.
+func (s *PlinkoPIRServer) entry(id uint64) DBEntry {
 	if id < uint64(len(s.database)/DBEntryLength) {
 		startIdx := id * DBEntryLength
 		var entry DBEntry
@@ -116,20 +160,23 @@ func (s *PlinkoPIRServer) DBAccess(id uint64) DBEntry {
 	return DBEntry{}
 }
 
-func (s *PlinkoPIRServer) healthHandler(w http.ResponseWriter, r *http.Request) {
+func (router *EpochRouter) healthHandler(w http.ResponseWriter, r *http.Request) {
+	epoch, s := router.Current()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":     "healthy",
 		"service":    "plinko-pir-server",
-		"db_size":    s.dbSize,
+		"epoch":      epoch,
+		"db_size":    s.size(),
 		"chunk_size": s.chunkSize,
 		"set_size":   s.setSize,
 		"entry_size": DBEntrySize,
+		"epochs":     router.Status(),
 	})
 }
 
-func (s *PlinkoPIRServer) plaintextQueryHandler(w http.ResponseWriter, r *http.Request) {
+func (router *EpochRouter) plaintextQueryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost && r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -154,6 +201,20 @@ func (s *PlinkoPIRServer) plaintextQueryHandler(w http.ResponseWriter, r *http.R
 			return
 		}
 		req.Index = index
+		if epochStr := r.URL.Query().Get("epoch"); epochStr != "" {
+			epoch, err := strconv.ParseUint(epochStr, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid epoch", http.StatusBadRequest)
+				return
+			}
+			req.Epoch = &epoch
+		}
+	}
+
+	s, epoch, err := router.Lookup(req.Epoch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
 	}
 
 	startTime := time.Now()
@@ -162,6 +223,7 @@ func (s *PlinkoPIRServer) plaintextQueryHandler(w http.ResponseWriter, r *http.R
 
 	resp := PlaintextQueryResponse{
 		Value:           entry.String(),
+		Epoch:           epoch,
 		ServerTimeNanos: uint64(elapsed.Nanoseconds()),
 	}
 
@@ -169,7 +231,7 @@ func (s *PlinkoPIRServer) plaintextQueryHandler(w http.ResponseWriter, r *http.R
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (s *PlinkoPIRServer) plinkoQueryHandler(w http.ResponseWriter, r *http.Request) {
+func (router *EpochRouter) plinkoQueryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -181,6 +243,14 @@ func (s *PlinkoPIRServer) plinkoQueryHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Hints built for a retired epoch cannot be answered; 410 tells the
+	// client to rehint rather than retry.
+	s, epoch, err := router.Lookup(req.Epoch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
 	// Validation
 	if uint64(len(req.Offsets)) != s.setSize {
 		http.Error(w, "Invalid number of offsets", http.StatusBadRequest)
@@ -196,6 +266,7 @@ func (s *PlinkoPIRServer) plinkoQueryHandler(w http.ResponseWriter, r *http.Requ
 	resp := PlinkoQueryResponse{
 		R0:              r0.String(),
 		R1:              r1.String(),
+		Epoch:           epoch,
 		ServerTimeNanos: uint64(elapsed.Nanoseconds()),
 	}
 
@@ -204,6 +275,9 @@ func (s *PlinkoPIRServer) plinkoQueryHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (s *PlinkoPIRServer) HandlePlinkoQuery(P []uint64, offsets []uint64) (DBEntry, DBEntry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	// Convert P slice to map for O(1) lookup
 	pMap := make(map[uint64]bool, len(P))
 	for _, idx := range P {
@@ -246,7 +320,7 @@ func (s *PlinkoPIRServer) HandlePlinkoQuery(P []uint64, offsets []uint64) (DBEnt
 		}
 
 		dbIndex := i*s.chunkSize + offset
-		entry := s.DBAccess(dbIndex)
+		entry := s.entry(dbIndex)
 
 		if pMap[i] {
 			// If block i is in P, add to r0
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// BundleLevels are the block spans of each bundle level. Level 1 bundles
+// (BundleSize blocks) are cut by the bundler as blocks arrive and keep every
+// block's delta file. Higher levels are built by the compactor from the
+// complete set of bundles one level down and hold a single delta file in
+// which every index appears once, with the XOR of all its deltas in the
+// range; indices whose deltas cancel out are dropped. A client coming back
+// after a long gap downloads each changed entry once per top-level bundle
+// instead of once per change.
+var BundleLevels = []uint64{BundleSize, 100 * BundleSize, 10000 * BundleSize}
+
+func bundleFilename(start, end uint64) string {
+	return fmt.Sprintf("bundle-%06d-%06d.bin", start, end)
+}
+
+// RunCompactor compacts finished bundles every interval, forever.
+func (b *DeltaBundler) RunCompactor(interval time.Duration) {
+	for {
+		if err := b.Compact(); err != nil {
+			log.Printf("compaction failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Compact builds every higher-level bundle whose lower-level bundles are all
+// published. Building happens outside the bundler lock; only the manifest
+// update takes it.
+func (b *DeltaBundler) Compact() error {
+	b.mu.Lock()
+	manifest, err := b.readManifest()
+	var bundles []BundleInfo
+	if err == nil {
+		bundles, err = b.allBundles(manifest)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	have := make(map[[2]uint64]BundleInfo, len(bundles))
+	for _, bundle := range bundles {
+		have[[2]uint64{bundle.StartBlock, bundle.EndBlock}] = bundle
+	}
+	for level := 2; level <= len(BundleLevels); level++ {
+		span, childSpan := BundleLevels[level-1], BundleLevels[level-2]
+		for _, child := range bundles {
+			if child.EndBlock-child.StartBlock+1 != childSpan || child.EndBlock%span != 0 {
+				continue
+			}
+			start, end := child.EndBlock-span+1, child.EndBlock
+			if _, ok := have[[2]uint64{start, end}]; ok {
+				continue
+			}
+			children := make([]BundleInfo, 0, span/childSpan)
+			for s := start; s < end; s += childSpan {
+				c, ok := have[[2]uint64{s, s + childSpan - 1}]
+				if !ok {
+					break
+				}
+				children = append(children, c)
+			}
+			if uint64(len(children)) != span/childSpan {
+				continue
+			}
+
+			info, err := b.compactBundle(level, start, end, children)
+			if err != nil {
+				return fmt.Errorf("level %d bundle %d-%d: %w", level, start, end, err)
+			}
+			b.mu.Lock()
+			current, err := b.readManifest()
+			if err == nil {
+				mergeBundle(&current, info)
+				err = b.writeManifest(current)
+			}
+			b.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			have[[2]uint64{start, end}] = info
+			// Let the next level see this bundle in the same pass.
+			bundles = append(bundles, info)
+		}
+	}
+	return nil
+}
+
+// compactBundle coalesces children into one delta file and publishes it.
+func (b *DeltaBundler) compactBundle(level int, start, end uint64, children []BundleInfo) (BundleInfo, error) {
+	merged := make(map[uint64]DBEntry)
+	for _, child := range children {
+		data, err := os.ReadFile(filepath.Join(b.cfg.DeltaOutputDir, bundleFilename(child.StartBlock, child.EndBlock)))
+		if err != nil {
+			return BundleInfo{}, err
+		}
+		files, err := decodeDeltaBundle(data)
+		if err != nil {
+			return BundleInfo{}, fmt.Errorf("bundle %d-%d: %w", child.StartBlock, child.EndBlock, err)
+		}
+		for _, file := range files {
+			for _, delta := range file.Deltas {
+				entry := merged[delta.Index]
+				for w := range entry {
+					entry[w] ^= delta.Delta[w]
+				}
+				merged[delta.Index] = entry
+			}
+		}
+	}
+
+	deltas := make([]PublishedDelta, 0, len(merged))
+	for index, delta := range merged {
+		if delta != (DBEntry{}) {
+			deltas = append(deltas, PublishedDelta{Index: index, Delta: delta})
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Index < deltas[j].Index })
+
+	// The file spans many blocks, so its header names the last one and
+	// carries no hashes.
+	path := filepath.Join(b.cfg.DeltaOutputDir, bundleFilename(start, end))
+	header := DeltaHeader{Dataset: deltaDataset, Block: end}
+	if err := saveDelta(path, header, deltas); err != nil {
+		return BundleInfo{}, err
+	}
+	log.Printf("📦 Compacted %d bundles into level %d bundle %d-%d (%d records)", len(children), level, start, end, len(deltas))
+
+	_, digest, err := hashFile(path)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	info := BundleInfo{StartBlock: start, EndBlock: end, Level: level, SHA256: digest}
+	job := publishJob{Target: targetBundle, StartBlock: start, EndBlock: end}
+	published := b.publish(path, job)
+	info.CID, info.URL = published.CID, published.URL
+	if b.cfg.PackedDeltas {
+		cid, packedDigest, err := b.publishPacked(path, job)
+		if err != nil {
+			log.Printf("⚠️ Failed to pack bundle %d-%d: %v", start, end, err)
+		}
+		info.PackedCID, info.PackedSHA256 = cid, packedDigest
+	}
+	return info, nil
+}
+
+// BundleCoverItem is one download in a bundle cover: a bundle, or a run of
+// blocks to fetch as individual deltas when Bundle is nil.
+type BundleCoverItem struct {
+	StartBlock uint64
+	EndBlock   uint64
+	Bundle     *BundleInfo
+}
+
+// BundleCover returns the fewest downloads that bring a client from block
+// from to block to: at each block it takes the largest bundle starting
+// there that does not overshoot to, and falls back to individual deltas
+// until the next bundle boundary. Because the levels nest, taking the
+// largest bundle first is optimal. bundles should include those in the
+// manifest's pages (see allBundles).
+func BundleCover(bundles []BundleInfo, from, to uint64) []BundleCoverItem {
+	byStart := make(map[uint64]*BundleInfo, len(bundles))
+	for i := range bundles {
+		b := &bundles[i]
+		if b.EndBlock > to {
+			continue
+		}
+		if best, ok := byStart[b.StartBlock]; !ok || b.EndBlock > best.EndBlock {
+			byStart[b.StartBlock] = b
+		}
+	}
+
+	var cover []BundleCoverItem
+	for block := from; block <= to; {
+		if b, ok := byStart[block]; ok {
+			cover = append(cover, BundleCoverItem{StartBlock: b.StartBlock, EndBlock: b.EndBlock, Bundle: b})
+			block = b.EndBlock + 1
+			continue
+		}
+		if n := len(cover); n > 0 && cover[n-1].Bundle == nil && cover[n-1].EndBlock == block-1 {
+			cover[n-1].EndBlock = block
+		} else {
+			cover = append(cover, BundleCoverItem{StartBlock: block, EndBlock: block})
+		}
+		block++
+	}
+	return cover
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"plinko-update-service/manifestsig"
 )
 
 const (
@@ -24,6 +26,7 @@ type Config struct {
 	PublicRoot          string
 	DeltaOutputDir      string
 	SnapshotVersion     string
+	SnapshotBlock       uint64
 	HealthPort          string
 	DatabaseWaitTimeout time.Duration
 	RPCURL              string
@@ -31,6 +34,27 @@ type Config struct {
 	UseSimulated        bool
 	IPFSAPI             string
 	IPFSGateway         string
+	Finality            FinalityPolicy
+	ChangeSource        string
+	ReplayDir           string
+	RecordDir           string
+	RPCBatchSize        int
+	RPCConcurrency      int
+	RPCRateLimit        uint64
+	RPCMaxRetries       int
+	AccountLayout       AccountLayout
+	PackedDeltas        bool
+	CompactInterval     time.Duration
+	SigningKeys         []manifestsig.Key
+	// IPNSKey names the IPFS key whose IPNS name points at the latest delta
+	// manifest; empty disables IPNS.
+	IPNSKey string
+	// Publishers lists the backends artifacts are copied to (see
+	// publisher.go); PublishDir and PublishURL configure "fs", S3 "s3".
+	Publishers []string
+	PublishDir string
+	PublishURL string
+	S3         S3Config
 }
 
 func LoadConfig() Config {
@@ -42,6 +66,9 @@ func LoadConfig() Config {
 		SnapshotVersion:     "",
 		HealthPort:          defaultHealthPort,
 		DatabaseWaitTimeout: defaultDatabaseWaitTimeout,
+		RPCBatchSize:        defaultRPCBatchSize,
+		RPCConcurrency:      defaultRPCConcurrency,
+		RPCMaxRetries:       defaultRPCMaxRetries,
 	}
 
 	if v := firstNonEmpty(
@@ -76,6 +103,21 @@ func LoadConfig() Config {
 		cfg.SnapshotVersion = v
 	}
 
+	// The database is the state after SnapshotBlock and blocks after it are
+	// processed as deltas. The snapshot is anchored to that block's header,
+	// and database.bin does not record the block it was built at, so the
+	// block must be given: a missing or bad value is fatal rather than a
+	// mislabelled snapshot.
+	v := strings.TrimSpace(os.Getenv("PLINKO_UPDATE_SNAPSHOT_BLOCK"))
+	if v == "" {
+		log.Fatalf("PLINKO_UPDATE_SNAPSHOT_BLOCK is required: set it to the block database.bin holds the state after")
+	}
+	block, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid PLINKO_UPDATE_SNAPSHOT_BLOCK %q: %v", v, err)
+	}
+	cfg.SnapshotBlock = block
+
 	if v := firstNonEmpty(
 		os.Getenv("PLINKO_UPDATE_HEALTH_PORT"),
 		os.Getenv("HEALTH_PORT"),
@@ -121,6 +163,79 @@ func LoadConfig() Config {
 		}
 	}
 
+	// The simulated/trace flags pick the default change source;
+	// PLINKO_UPDATE_CHANGE_SOURCE overrides both.
+	cfg.ChangeSource = SourceTrace
+	if cfg.UseSimulated {
+		cfg.ChangeSource = SourceSimulated
+	} else if v := os.Getenv("PLINKO_UPDATE_TRACE_CHANGES"); v != "" {
+		if parsed, ok := parseBool(v); ok && !parsed {
+			cfg.ChangeSource = SourceRPC
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("PLINKO_UPDATE_CHANGE_SOURCE")); v != "" {
+		cfg.ChangeSource = strings.ToLower(v)
+	}
+	cfg.UseSimulated = cfg.ChangeSource == SourceSimulated
+	cfg.ReplayDir = strings.TrimSpace(os.Getenv("PLINKO_UPDATE_REPLAY_DIR"))
+	cfg.RecordDir = strings.TrimSpace(os.Getenv("PLINKO_UPDATE_RECORD_DIR"))
+
+	cfg.RPCBatchSize = int(envUint("PLINKO_UPDATE_RPC_BATCH_SIZE", uint64(cfg.RPCBatchSize)))
+	cfg.RPCConcurrency = int(envUint("PLINKO_UPDATE_RPC_CONCURRENCY", uint64(cfg.RPCConcurrency)))
+	cfg.RPCRateLimit = envUint("PLINKO_UPDATE_RPC_RATE_LIMIT", 0)
+	cfg.RPCMaxRetries = int(envUint("PLINKO_UPDATE_RPC_MAX_RETRIES", uint64(cfg.RPCMaxRetries)))
+
+	var confirmations uint64
+	if v := strings.TrimSpace(os.Getenv("PLINKO_UPDATE_CONFIRMATIONS")); v != "" {
+		if parsed, err := strconv.ParseUint(v, 10, 64); err == nil {
+			confirmations = parsed
+		} else {
+			log.Printf("Invalid confirmations value %q, ignoring", v)
+		}
+	}
+	finality, err := parseFinalityPolicy(os.Getenv("PLINKO_UPDATE_FINALITY"), confirmations)
+	if err != nil {
+		log.Printf("%v, following latest head", err)
+		finality = FinalityPolicy{Mode: FinalityLatest}
+	}
+	cfg.Finality = finality
+
+	// The layout decides which entry every field lives in; guessing would
+	// corrupt the database, so an unknown value is fatal.
+	layout, err := parseAccountLayout(os.Getenv("PLINKO_UPDATE_ACCOUNT_LAYOUT"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.AccountLayout = layout
+
+	// Bundles are merged into higher levels in the background; 0 disables.
+	cfg.CompactInterval = time.Minute
+	if v := strings.TrimSpace(os.Getenv("PLINKO_UPDATE_COMPACT_INTERVAL")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.CompactInterval = d
+		} else {
+			log.Printf("Invalid PLINKO_UPDATE_COMPACT_INTERVAL %q, using %s", v, cfg.CompactInterval)
+		}
+	}
+
+	// Manifests are signed with every configured key. A key that fails to
+	// load is fatal rather than a silent switch to unsigned manifests.
+	keys, err := manifestsig.LoadKeys(os.Getenv("PLINKO_UPDATE_SIGNING_KEYS"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, key := range keys {
+		log.Printf("Signing manifests with key %s (public key %s)", key.ID, key.PublicKeyHex())
+	}
+	cfg.SigningKeys = keys
+
+	// Raw deltas are always published; the packed encoding is opt-in.
+	if v := os.Getenv("PLINKO_UPDATE_PACKED_DELTAS"); v != "" {
+		if parsed, ok := parseBool(v); ok {
+			cfg.PackedDeltas = parsed
+		}
+	}
+
 	if v := firstNonEmpty(os.Getenv("PLINKO_STATE_IPFS_API"), os.Getenv("IPFS_API")); v != "" {
 		cfg.IPFSAPI = strings.TrimSpace(v)
 	}
@@ -129,6 +244,23 @@ func LoadConfig() Config {
 		cfg.IPFSGateway = strings.TrimRight(strings.TrimSpace(v), "/")
 	}
 
+	// Without PLINKO_UPDATE_PUBLISHERS, artifacts are pinned to IPFS when
+	// an API is configured, as before.
+	cfg.IPNSKey = strings.TrimSpace(os.Getenv("PLINKO_UPDATE_IPNS_KEY"))
+	cfg.Publishers = parsePublishers(os.Getenv("PLINKO_UPDATE_PUBLISHERS"), cfg.IPFSAPI)
+	cfg.PublishDir = strings.TrimSpace(os.Getenv("PLINKO_UPDATE_PUBLISH_DIR"))
+	cfg.PublishURL = strings.TrimSpace(os.Getenv("PLINKO_UPDATE_PUBLISH_URL"))
+	cfg.S3 = S3Config{
+		Endpoint:        strings.TrimSpace(os.Getenv("PLINKO_UPDATE_S3_ENDPOINT")),
+		Region:          firstNonEmpty(os.Getenv("PLINKO_UPDATE_S3_REGION"), os.Getenv("AWS_REGION")),
+		Bucket:          strings.TrimSpace(os.Getenv("PLINKO_UPDATE_S3_BUCKET")),
+		Prefix:          strings.TrimSpace(os.Getenv("PLINKO_UPDATE_S3_PREFIX")),
+		AccessKeyID:     firstNonEmpty(os.Getenv("PLINKO_UPDATE_S3_ACCESS_KEY_ID"), os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: firstNonEmpty(os.Getenv("PLINKO_UPDATE_S3_SECRET_ACCESS_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    strings.TrimSpace(os.Getenv("AWS_SESSION_TOKEN")),
+		PublicURL:       strings.TrimSpace(os.Getenv("PLINKO_UPDATE_S3_PUBLIC_URL")),
+	}
+
 	cfg.DatabasePath = strings.TrimSpace(cfg.DatabasePath)
 	cfg.AddressMappingPath = strings.TrimSpace(cfg.AddressMappingPath)
 	cfg.PublicRoot = strings.TrimSpace(cfg.PublicRoot)
@@ -177,3 +309,16 @@ func parseBool(value string) (bool, bool) {
 		return false, false
 	}
 }
+
+func envUint(key string, fallback uint64) uint64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		log.Printf("Invalid %s value %q, using %d", key, v, fallback)
+		return fallback
+	}
+	return parsed
+}
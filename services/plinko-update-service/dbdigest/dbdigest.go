@@ -0,0 +1,205 @@
+// Package dbdigest computes the digest the syncers publish of a Plinko
+// database, so anyone holding a copy can check it against the canonical
+// one without rehashing the published file.
+//
+// The digest is LtHash16, a homomorphic hash of the set of (index, value)
+// pairs with a non-zero value: 1024 16-bit lanes, where each pair adds its
+// element hash lane by lane modulo 2^16. Changing an entry subtracts the
+// element hash of the old pair and adds that of the new one, so a digest
+// follows a stream of deltas in constant time per changed entry, and empty
+// entries, including those a database grows by, contribute nothing.
+//
+// The element hash of entry index with value v is 2048 bytes of
+// AES-256-CTR keystream (zero IV) under the key
+//
+//	SHA-256(Context || index || v[0] || v[1] || v[2] || v[3])
+//
+// with every integer encoded as 8 little-endian bytes, read as 1024
+// little-endian uint16 lanes. Digests are published as Sum: the hex
+// SHA-256 of the lanes in little-endian order.
+//
+// The state-syncer, whose module the update service does not depend on,
+// has the original in state-syncer/dbdigest. Keep the copies identical.
+package dbdigest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+const (
+	// Lanes is the number of 16-bit lanes in a digest.
+	Lanes = 1024
+	// Size is the length of a digest's lanes in bytes.
+	Size = 2 * Lanes
+	// EntryLength is the number of uint64 words in a database entry.
+	EntryLength = 4
+	// Context prefixes every element hash key.
+	Context = "plinko lthash16 v1\x00"
+)
+
+// Entry is one database entry, as the words of database.bin.
+type Entry [EntryLength]uint64
+
+// Delta is one record of a delta file: entry Index changes by XOR with
+// Delta.
+type Delta struct {
+	Index uint64
+	Delta Entry
+}
+
+// ErrMismatch reports a database copy whose digest differs from the
+// published one. The copy diverged and should be refetched from a snapshot.
+var ErrMismatch = errors.New("dbdigest: digest mismatch")
+
+// Digest is an LtHash16 state. The zero value is the digest of an empty
+// database.
+type Digest [Lanes]uint16
+
+var zeroIV [aes.BlockSize]byte
+
+// element returns the element hash of entry index holding v.
+func element(index uint64, v Entry) *Digest {
+	key := make([]byte, 0, len(Context)+8*(1+EntryLength))
+	key = append(key, Context...)
+	key = binary.LittleEndian.AppendUint64(key, index)
+	for _, word := range v {
+		key = binary.LittleEndian.AppendUint64(key, word)
+	}
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		panic(err) // a 32-byte key is always valid
+	}
+	var stream [Size]byte
+	cipher.NewCTR(block, zeroIV[:]).XORKeyStream(stream[:], stream[:])
+
+	var e Digest
+	for i := range e {
+		e[i] = binary.LittleEndian.Uint16(stream[2*i:])
+	}
+	return &e
+}
+
+// Add adds entry index holding v. Empty entries are not part of the set.
+func (d *Digest) Add(index uint64, v Entry) {
+	if v == (Entry{}) {
+		return
+	}
+	e := element(index, v)
+	for i := range d {
+		d[i] += e[i]
+	}
+}
+
+// Remove removes entry index holding v.
+func (d *Digest) Remove(index uint64, v Entry) {
+	if v == (Entry{}) {
+		return
+	}
+	e := element(index, v)
+	for i := range d {
+		d[i] -= e[i]
+	}
+}
+
+// Update records that entry index changed from old to new.
+func (d *Digest) Update(index uint64, old, new Entry) {
+	if old == new {
+		return
+	}
+	d.Remove(index, old)
+	d.Add(index, new)
+}
+
+// Combine adds every pair of other to d, as if they were added one by one.
+func (d *Digest) Combine(other *Digest) {
+	for i := range d {
+		d[i] += other[i]
+	}
+}
+
+// Bytes returns the lanes in little-endian order.
+func (d *Digest) Bytes() []byte {
+	out := make([]byte, Size)
+	for i, lane := range d {
+		binary.LittleEndian.PutUint16(out[2*i:], lane)
+	}
+	return out
+}
+
+// Sum returns the published form of the digest.
+func (d *Digest) Sum() string {
+	sum := sha256.Sum256(d.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// FromWords returns the digest of the first entries entries of db, a
+// database as flat words, hashing in parallel.
+func FromWords(db []uint64, entries uint64) Digest {
+	if max := uint64(len(db) / EntryLength); entries > max {
+		entries = max
+	}
+	workers := uint64(runtime.GOMAXPROCS(0))
+	span := (entries + workers - 1) / workers
+	parts := make([]Digest, workers)
+	var wg sync.WaitGroup
+	for w := uint64(0); w < workers; w++ {
+		start, end := w*span, min((w+1)*span, entries)
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(part *Digest) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				var v Entry
+				copy(v[:], db[i*EntryLength:])
+				part.Add(i, v)
+			}
+		}(&parts[w])
+	}
+	wg.Wait()
+
+	var d Digest
+	for i := range parts {
+		d.Combine(&parts[i])
+	}
+	return d
+}
+
+// ApplyDeltas applies one block's delta records to db, a database as flat
+// words whose digest is d, following them in d, and then checks d against
+// want, the digest published for the block. A mismatch returns ErrMismatch
+// and leaves db and d holding the diverged state. An empty want is not
+// checked. Entries past the end of db fail before anything is applied; a
+// client grows its copy to the block's database size first.
+func (d *Digest) ApplyDeltas(db []uint64, deltas []Delta, want string) error {
+	entries := uint64(len(db) / EntryLength)
+	for _, delta := range deltas {
+		if delta.Index >= entries {
+			return fmt.Errorf("dbdigest: delta for entry %d beyond a database of %d", delta.Index, entries)
+		}
+	}
+	for _, delta := range deltas {
+		words := db[delta.Index*EntryLength : (delta.Index+1)*EntryLength]
+		var old, next Entry
+		copy(old[:], words)
+		for i := range next {
+			next[i] = old[i] ^ delta.Delta[i]
+		}
+		copy(words, next[:])
+		d.Update(delta.Index, old, next)
+	}
+	if sum := d.Sum(); want != "" && sum != want {
+		return fmt.Errorf("%w: have %s, want %s", ErrMismatch, sum, want)
+	}
+	return nil
+}
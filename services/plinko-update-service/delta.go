@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Delta file format, version 2. All integers are little-endian.
+//
+//	offset  size  field
+//	     0     4  magic "PLKD"
+//	     4     2  version (2)
+//	     6     2  header size (128; readers skip unknown trailing header bytes)
+//	     8     4  record width: bytes of delta per record (32)
+//	    12     4  reserved, zero
+//	    16    32  dataset ID, zero-padded ASCII
+//	    48     8  block number
+//	    56    32  block hash (zero when the source does not know it)
+//	    88    32  parent hash
+//	   120     8  record count
+//	   128     …  records: index u64 followed by record-width bytes of delta
+//	     …    32  SHA-256 of everything above
+//
+// Version 1 files have a 16-byte header (count u64, reserved u64) followed
+// by 40-byte records and nothing else. They never start with the magic, which
+// would be a count of over a billion records, so readers tell the two apart by the
+// first four bytes. A bundle is a concatenation of delta files and may mix
+// both versions.
+const (
+	// deltaDataset is the dataset ID written into delta headers; the update
+	// service publishes the account dataset only.
+	deltaDataset = "eth"
+
+	deltaMagic         = "PLKD"
+	DeltaVersion1      = 1
+	DeltaVersion2      = 2
+	deltaV1HeaderSize  = 16
+	deltaRecordSize    = 8 + DBEntrySize
+	deltaV2HeaderSize  = 128
+	deltaDatasetIDSize = 32
+	deltaChecksumSize  = sha256.Size
+)
+
+var errDeltaTruncated = errors.New("delta file truncated")
+
+// DeltaHeader describes one published delta file. Files read from version 1
+// carry only Version, RecordWidth and Count.
+type DeltaHeader struct {
+	Version     uint16
+	Dataset     string
+	Block       uint64
+	BlockHash   common.Hash
+	ParentHash  common.Hash
+	RecordWidth uint32
+	Count       uint64
+}
+
+// DeltaFile is a decoded delta file.
+type DeltaFile struct {
+	DeltaHeader
+	Deltas []PublishedDelta
+}
+
+// newDeltaHeader builds the header for the deltas of one block of dataset.
+func newDeltaHeader(dataset string, changes *BlockChanges) DeltaHeader {
+	header := DeltaHeader{
+		Version:     DeltaVersion2,
+		Dataset:     dataset,
+		Block:       changes.Block,
+		RecordWidth: DBEntrySize,
+	}
+	if changes.Hash != nil {
+		header.BlockHash = *changes.Hash
+	}
+	if changes.ParentHash != nil {
+		header.ParentHash = *changes.ParentHash
+	}
+	return header
+}
+
+// encodeDelta serializes deltas as a version 2 delta file. header.Count and
+// header.RecordWidth are taken from deltas.
+func encodeDelta(header DeltaHeader, deltas []PublishedDelta) ([]byte, error) {
+	size := deltaV2HeaderSize + len(deltas)*deltaRecordSize + deltaChecksumSize
+	buf, err := appendDeltaHeader(make([]byte, 0, size), deltaMagic, header, len(deltas))
+	if err != nil {
+		return nil, err
+	}
+
+	var rec [deltaRecordSize]byte
+	for _, delta := range deltas {
+		binary.LittleEndian.PutUint64(rec[0:8], delta.Index)
+		for i := 0; i < DBEntryLength; i++ {
+			binary.LittleEndian.PutUint64(rec[8+i*8:16+i*8], delta.Delta[i])
+		}
+		buf = append(buf, rec[:]...)
+	}
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...), nil
+}
+
+// appendDeltaHeader appends the 128-byte version 2 header, which packed
+// files share under their own magic.
+func appendDeltaHeader(buf []byte, magic string, header DeltaHeader, count int) ([]byte, error) {
+	if len(header.Dataset) > deltaDatasetIDSize {
+		return nil, fmt.Errorf("dataset ID %q longer than %d bytes", header.Dataset, deltaDatasetIDSize)
+	}
+	var h [deltaV2HeaderSize]byte
+	copy(h[0:4], magic)
+	binary.LittleEndian.PutUint16(h[4:6], DeltaVersion2)
+	binary.LittleEndian.PutUint16(h[6:8], deltaV2HeaderSize)
+	binary.LittleEndian.PutUint32(h[8:12], DBEntrySize)
+	copy(h[16:48], header.Dataset)
+	binary.LittleEndian.PutUint64(h[48:56], header.Block)
+	copy(h[56:88], header.BlockHash[:])
+	copy(h[88:120], header.ParentHash[:])
+	binary.LittleEndian.PutUint64(h[120:128], uint64(count))
+	return append(buf, h[:]...), nil
+}
+
+func saveDelta(path string, header DeltaHeader, deltas []PublishedDelta) error {
+	data, err := encodeDelta(header, deltas)
+	if err != nil {
+		return err
+	}
+
+	// Create a temporary file in the same directory
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "delta-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := f.Name()
+
+	// Clean up temp file on error
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	if err = f.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to chmod temp file: %w", err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+
+	// Ensure data is written to disk
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	// Atomic rename
+	if err = os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+// decodeDelta decodes the delta file at the start of data, in either
+// version, and returns it with the number of bytes it occupied. Version 2
+// files are rejected unless their checksum matches.
+func decodeDelta(data []byte) (DeltaFile, int, error) {
+	if len(data) >= 4 && string(data[0:4]) == deltaMagic {
+		return decodeDeltaV2(data)
+	}
+	return decodeDeltaV1(data)
+}
+
+func decodeDeltaV1(data []byte) (DeltaFile, int, error) {
+	var file DeltaFile
+	if len(data) < deltaV1HeaderSize {
+		return file, 0, errDeltaTruncated
+	}
+	count := binary.LittleEndian.Uint64(data[0:8])
+	if count > uint64(len(data)-deltaV1HeaderSize)/deltaRecordSize {
+		return file, 0, fmt.Errorf("%w: v1 header claims %d records in %d bytes", errDeltaTruncated, count, len(data))
+	}
+	file.DeltaHeader = DeltaHeader{Version: DeltaVersion1, RecordWidth: DBEntrySize, Count: count}
+	file.Deltas = decodeDeltaRecords(data[deltaV1HeaderSize:], count)
+	return file, deltaV1HeaderSize + int(count)*deltaRecordSize, nil
+}
+
+func decodeDeltaV2(data []byte) (DeltaFile, int, error) {
+	var file DeltaFile
+	header, headerSize, err := parseDeltaHeader(data)
+	if err != nil {
+		return file, 0, err
+	}
+	count := header.Count
+	if len(data) < headerSize+deltaChecksumSize ||
+		count > uint64(len(data)-headerSize-deltaChecksumSize)/deltaRecordSize {
+		return file, 0, fmt.Errorf("%w: header claims %d records in %d bytes", errDeltaTruncated, count, len(data))
+	}
+	body := headerSize + int(count)*deltaRecordSize
+	sum := sha256.Sum256(data[:body])
+	if !bytes.Equal(sum[:], data[body:body+deltaChecksumSize]) {
+		return file, 0, errors.New("delta checksum mismatch")
+	}
+
+	file.DeltaHeader = header
+	file.Deltas = decodeDeltaRecords(data[headerSize:], count)
+	return file, body + deltaChecksumSize, nil
+}
+
+// parseDeltaHeader parses a version 2 header (of a plain or packed file; the
+// caller checks the magic) and returns it with its size.
+func parseDeltaHeader(data []byte) (DeltaHeader, int, error) {
+	var header DeltaHeader
+	if len(data) < deltaV2HeaderSize {
+		return header, 0, errDeltaTruncated
+	}
+	version := binary.LittleEndian.Uint16(data[4:6])
+	if version != DeltaVersion2 {
+		return header, 0, fmt.Errorf("unsupported delta version %d", version)
+	}
+	headerSize := int(binary.LittleEndian.Uint16(data[6:8]))
+	if headerSize < deltaV2HeaderSize || headerSize > len(data) {
+		return header, 0, fmt.Errorf("bad delta header size %d", headerSize)
+	}
+	width := binary.LittleEndian.Uint32(data[8:12])
+	if width != DBEntrySize {
+		return header, 0, fmt.Errorf("unsupported delta record width %d", width)
+	}
+	header = DeltaHeader{
+		Version:     version,
+		Dataset:     string(bytes.TrimRight(data[16:48], "\x00")),
+		Block:       binary.LittleEndian.Uint64(data[48:56]),
+		BlockHash:   common.BytesToHash(data[56:88]),
+		ParentHash:  common.BytesToHash(data[88:120]),
+		RecordWidth: width,
+		Count:       binary.LittleEndian.Uint64(data[120:128]),
+	}
+	return header, headerSize, nil
+}
+
+func decodeDeltaRecords(data []byte, count uint64) []PublishedDelta {
+	deltas := make([]PublishedDelta, count)
+	for i := range deltas {
+		rec := data[i*deltaRecordSize : (i+1)*deltaRecordSize]
+		deltas[i].Index = binary.LittleEndian.Uint64(rec[0:8])
+		for w := 0; w < DBEntryLength; w++ {
+			deltas[i].Delta[w] = binary.LittleEndian.Uint64(rec[8+w*8 : 16+w*8])
+		}
+	}
+	return deltas
+}
+
+// decodeDeltaBundle splits a bundle into its delta files, ignoring the
+// bundle index if there is one (see bundle.go).
+func decodeDeltaBundle(data []byte) ([]DeltaFile, error) {
+	data, _, err := splitBundle(data)
+	if err != nil {
+		return nil, err
+	}
+	var files []DeltaFile
+	for offset := 0; offset < len(data); {
+		file, n, err := decodeDelta(data[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("delta %d at offset %d: %w", len(files), offset, err)
+		}
+		files = append(files, file)
+		offset += n
+	}
+	return files, nil
+}
+
+// readDeltaFile reads and validates a single delta file.
+func readDeltaFile(path string) (DeltaFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DeltaFile{}, err
+	}
+	file, n, err := decodeDelta(data)
+	if err != nil {
+		return file, fmt.Errorf("%s: %w", path, err)
+	}
+	if n != len(data) {
+		return file, fmt.Errorf("%s: %d trailing bytes after delta", path, len(data)-n)
+	}
+	return file, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delta feed. Instead of polling manifest.json, clients ask the service
+// what to fetch:
+//
+//	GET /deltas?since=N[&wait=30s]
+//
+// returns the fewest bundles and deltas that take a client whose hints are
+// at block N to the newest block it can safely reach. With wait, a client
+// that is already current is held until the next block is processed (up
+// to maxFeedWait), so polling costs one request per block.
+//
+//	GET /deltas/stream
+//
+// is a Server-Sent Events stream with one "block" event per processed
+// block as it is published. Each event's id is the block number, so a
+// client that reconnects can catch up with /deltas?since=<last id>.
+const (
+	maxFeedWait       = time.Minute
+	feedHeartbeat     = 15 * time.Second
+	feedSubscriberBuf = 64
+)
+
+// FeedEvent announces one processed block. Delta is nil for blocks
+// without changes.
+type FeedEvent struct {
+	Block uint64     `json:"block"`
+	Delta *DeltaInfo `json:"delta,omitempty"`
+}
+
+// DeltaFeed fans out FeedEvents to subscribers. A subscriber that falls
+// feedSubscriberBuf events behind is dropped; its stream ends and the
+// client resumes from /deltas?since.
+type DeltaFeed struct {
+	mu   sync.Mutex
+	subs map[chan FeedEvent]struct{}
+}
+
+func newDeltaFeed() *DeltaFeed {
+	return &DeltaFeed{subs: make(map[chan FeedEvent]struct{})}
+}
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription. The channel is closed when the subscription ends.
+func (f *DeltaFeed) Subscribe() (<-chan FeedEvent, func()) {
+	ch := make(chan FeedEvent, feedSubscriberBuf)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() { f.drop(ch) }
+}
+
+func (f *DeltaFeed) drop(ch chan FeedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish sends ev to every subscriber without blocking.
+func (f *DeltaFeed) Publish(ev FeedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// DeltaPlan lists what a client at block Since downloads to reach
+// CoveredThrough. Bundles and deltas may be applied in any order. Blocks
+// in the range without a bundle or delta had no changes. The first bundle
+// may start at or before Since; apply only its blocks after Since.
+// CoveredThrough is below LatestBlock when blocks after Since were skipped
+// and the client cannot safely pass the gap; it equals Since when the next
+// block was never processed, and the client has to start over from a
+// snapshot.
+type DeltaPlan struct {
+	Since          uint64       `json:"since"`
+	LatestBlock    uint64       `json:"latestBlock"`
+	CoveredThrough uint64       `json:"coveredThrough"`
+	Bundles        []BundleInfo `json:"bundles"`
+	Deltas         []DeltaInfo  `json:"deltas"`
+}
+
+// Plan builds the DeltaPlan for a client at block since.
+func (b *DeltaBundler) Plan(since uint64) (DeltaPlan, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return DeltaPlan{}, err
+	}
+	plan := DeltaPlan{Since: since, LatestBlock: manifest.LatestBlock, CoveredThrough: since, Bundles: []BundleInfo{}, Deltas: []DeltaInfo{}}
+	if since >= manifest.LatestBlock {
+		return plan, nil
+	}
+
+	// Only pages that reach past since matter.
+	bundles := manifest.Bundles
+	deltas := manifest.Deltas
+	coverage := manifest.Coverage
+	for i := len(manifest.Pages) - 1; i >= 0 && manifest.Pages[i].EndBlock > since; i-- {
+		page, err := b.readPage(manifest.Pages[i])
+		if err != nil {
+			return DeltaPlan{}, err
+		}
+		bundles = append(append([]BundleInfo(nil), page.Bundles...), bundles...)
+		deltas = append(append([]DeltaInfo(nil), page.Deltas...), deltas...)
+		coverage = append(append([]CoverageRange(nil), page.Coverage...), coverage...)
+	}
+	if len(coverage) > 0 {
+		end, ok := CoveredThrough(coverage, since+1)
+		if !ok {
+			return plan, nil
+		}
+		plan.CoveredThrough = end
+	} else {
+		// Manifests written before coverage was recorded.
+		plan.CoveredThrough = manifest.LatestBlock
+	}
+
+	byBlock := make(map[uint64]DeltaInfo, len(deltas))
+	for _, delta := range deltas {
+		byBlock[delta.Block] = delta
+	}
+	// Deltas inside a bundle are pruned once it is cut, so a since that
+	// falls mid-bundle starts from the indexed bundle holding since+1; its
+	// per-block index lets the client skip the blocks it already has.
+	from := since + 1
+	var straddle *BundleInfo
+	for i := range bundles {
+		bundle := &bundles[i]
+		if bundle.Indexed && bundle.StartBlock < from && from <= bundle.EndBlock && bundle.EndBlock <= plan.CoveredThrough &&
+			(straddle == nil || bundle.EndBlock < straddle.EndBlock) {
+			straddle = bundle
+		}
+	}
+	if straddle != nil {
+		plan.Bundles = append(plan.Bundles, *straddle)
+		from = straddle.EndBlock + 1
+	}
+	for _, item := range BundleCover(bundles, from, plan.CoveredThrough) {
+		if item.Bundle != nil {
+			plan.Bundles = append(plan.Bundles, *item.Bundle)
+			continue
+		}
+		for block := item.StartBlock; block <= item.EndBlock; block++ {
+			if delta, ok := byBlock[block]; ok {
+				plan.Deltas = append(plan.Deltas, delta)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// handleDeltas serves GET /deltas?since=N[&wait=D].
+func (b *DeltaBundler) handleDeltas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "since must be a block number", http.StatusBadRequest)
+		return
+	}
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			http.Error(w, "wait must be a duration such as 30s", http.StatusBadRequest)
+			return
+		}
+		if wait > maxFeedWait {
+			wait = maxFeedWait
+		}
+	}
+
+	// Subscribe before planning so a block published in between is not
+	// missed.
+	events, cancel := b.feed.Subscribe()
+	defer cancel()
+	plan, err := b.Plan(since)
+	if err == nil && plan.LatestBlock <= since && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-events:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+		plan, err = b.Plan(since)
+	}
+	if err != nil {
+		log.Printf("⚠️ Delta plan since %d: %v", since, err)
+		http.Error(w, "manifest unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// handleDeltaStream serves the SSE stream at /deltas/stream.
+func (b *DeltaBundler) handleDeltaStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := b.feed.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: block\ndata: %s\n\n", ev.Block, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeltaFeed(t *testing.T) {
+	dir := t.TempDir()
+	bundler := NewDeltaBundler(Config{DeltaOutputDir: dir}, nil)
+	process := func(block uint64) {
+		t.Helper()
+		if block%10 != 0 {
+			if err := bundler.RecordEmptyBlock(block); err != nil {
+				t.Fatalf("record %d: %v", block, err)
+			}
+			return
+		}
+		path := filepath.Join(dir, fmt.Sprintf("delta-%06d.bin", block))
+		if err := saveDelta(path, DeltaHeader{Block: block}, []PublishedDelta{{Index: block, Delta: DBEntry{block}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := bundler.PublishDelta(block, path, ""); err != nil {
+			t.Fatalf("publish %d: %v", block, err)
+		}
+	}
+	for block := uint64(1); block <= 250; block++ {
+		process(block)
+	}
+	if err := bundler.ScheduleBundles(); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+
+	plan, err := bundler.Plan(50)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	var deltas []uint64
+	for _, delta := range plan.Deltas {
+		deltas = append(deltas, delta.Block)
+	}
+	// Block 51 sits inside the 1-100 bundle, whose deltas were pruned.
+	if plan.CoveredThrough != 250 || len(plan.Bundles) != 2 || plan.Bundles[0].StartBlock != 1 ||
+		plan.Bundles[1].StartBlock != 101 || fmt.Sprint(deltas) != "[210 220 230 240 250]" {
+		t.Fatalf("plan = %+v, deltas %v", plan, deltas)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deltas", bundler.handleDeltas)
+	mux.HandleFunc("/deltas/stream", bundler.handleDeltaStream)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	stream, err := http.Get(srv.URL + "/deltas/stream")
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	defer stream.Body.Close()
+
+	// A long poll from the tip returns once the next block is processed.
+	done := make(chan DeltaPlan)
+	go func() {
+		resp, err := http.Get(srv.URL + "/deltas?since=250&wait=10s")
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		defer resp.Body.Close()
+		var plan DeltaPlan
+		if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+			t.Error(err)
+		}
+		done <- plan
+	}()
+	for block := uint64(251); block <= 260; block++ {
+		process(block)
+	}
+	if plan := <-done; plan.LatestBlock <= 250 {
+		t.Fatalf("long poll returned %+v", plan)
+	}
+
+	var events []FeedEvent
+	scanner := bufio.NewScanner(stream.Body)
+	for len(events) < 10 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var ev FeedEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("event %q: %v", data, err)
+			}
+			events = append(events, ev)
+		}
+	}
+	if len(events) != 10 || events[0].Block != 251 || events[0].Delta != nil ||
+		events[9].Block != 260 || events[9].Delta == nil || events[9].Delta.SHA256 == "" {
+		t.Fatalf("events = %+v", events)
+	}
+}
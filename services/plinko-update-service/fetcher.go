@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	defaultRPCBatchSize    = 100
+	defaultRPCConcurrency  = 4
+	defaultRPCMaxRetries   = 5
+	defaultRPCRetryBackoff = 250 * time.Millisecond
+	maxRPCRetryBackoff     = 10 * time.Second
+)
+
+// AccountFetcher reads account fields (balance, nonce, code) for many
+// addresses at one block using JSON-RPC batch requests. Batches run with
+// bounded concurrency, failed elements are retried with exponential backoff,
+// and every HTTP request (a whole batch counts once) draws from a shared
+// token bucket so public endpoints such as publicnode do not throttle the
+// service.
+type AccountFetcher struct {
+	client      *rpc.Client
+	limiter     *tokenBucket
+	batchSize   int
+	concurrency int
+	maxRetries  int
+	backoff     time.Duration
+}
+
+func newAccountFetcher(client *rpc.Client, limiter *tokenBucket, batchSize, concurrency, maxRetries int, backoff time.Duration) *AccountFetcher {
+	if batchSize <= 0 {
+		batchSize = defaultRPCBatchSize
+	}
+	if concurrency <= 0 {
+		concurrency = defaultRPCConcurrency
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	if backoff <= 0 {
+		backoff = defaultRPCRetryBackoff
+	}
+	return &AccountFetcher{
+		client:      client,
+		limiter:     limiter,
+		batchSize:   batchSize,
+		concurrency: concurrency,
+		maxRetries:  maxRetries,
+		backoff:     backoff,
+	}
+}
+
+// Balances returns the balance of every address at block. Like Nonces and
+// CodeHashes it fails if any address could not be read after all retries,
+// so callers never publish a block with silently missing updates.
+func (f *AccountFetcher) Balances(ctx context.Context, addresses []common.Address, block *big.Int) (map[common.Address]*big.Int, error) {
+	raw, err := f.fetchAll(ctx, "eth_getBalance", addresses, block)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[common.Address]*big.Int, len(raw))
+	for addr, msg := range raw {
+		var balance hexutil.Big
+		if err := json.Unmarshal(msg, &balance); err != nil {
+			return nil, fmt.Errorf("decode balance of %s: %w", addr.Hex(), err)
+		}
+		balances[addr] = balance.ToInt()
+	}
+	return balances, nil
+}
+
+// Nonces returns the transaction count of every address at block.
+func (f *AccountFetcher) Nonces(ctx context.Context, addresses []common.Address, block *big.Int) (map[common.Address]uint64, error) {
+	raw, err := f.fetchAll(ctx, "eth_getTransactionCount", addresses, block)
+	if err != nil {
+		return nil, err
+	}
+	nonces := make(map[common.Address]uint64, len(raw))
+	for addr, msg := range raw {
+		var nonce hexutil.Uint64
+		if err := json.Unmarshal(msg, &nonce); err != nil {
+			return nil, fmt.Errorf("decode nonce of %s: %w", addr.Hex(), err)
+		}
+		nonces[addr] = uint64(nonce)
+	}
+	return nonces, nil
+}
+
+// CodeHashes returns the keccak256 hash of every address's code at block.
+// Accounts without code get types.EmptyCodeHash, matching the state trie.
+func (f *AccountFetcher) CodeHashes(ctx context.Context, addresses []common.Address, block *big.Int) (map[common.Address]common.Hash, error) {
+	raw, err := f.fetchAll(ctx, "eth_getCode", addresses, block)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[common.Address]common.Hash, len(raw))
+	for addr, msg := range raw {
+		var code hexutil.Bytes
+		if err := json.Unmarshal(msg, &code); err != nil {
+			return nil, fmt.Errorf("decode code of %s: %w", addr.Hex(), err)
+		}
+		if len(code) == 0 {
+			hashes[addr] = types.EmptyCodeHash
+		} else {
+			hashes[addr] = crypto.Keccak256Hash(code)
+		}
+	}
+	return hashes, nil
+}
+
+// fetchAll calls method(address, block) for every address and returns the
+// raw results.
+func (f *AccountFetcher) fetchAll(ctx context.Context, method string, addresses []common.Address, block *big.Int) (map[common.Address]json.RawMessage, error) {
+	result := make(map[common.Address]json.RawMessage, len(addresses))
+	if len(addresses) == 0 {
+		return result, nil
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		sem      = make(chan struct{}, f.concurrency)
+	)
+	blockArg := toBlockArg(block)
+
+	for start := 0; start < len(addresses); start += f.batchSize {
+		end := start + f.batchSize
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		batch := addresses[start:end]
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			values, err := f.fetchBatch(ctx, method, batch, blockArg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for addr, value := range values {
+				result[addr] = value
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// fetchBatch sends one batch of method calls, re-sending only the elements
+// that failed until they succeed or retries run out.
+func (f *AccountFetcher) fetchBatch(ctx context.Context, method string, addresses []common.Address, blockArg string) (map[common.Address]json.RawMessage, error) {
+	values := make(map[common.Address]json.RawMessage, len(addresses))
+	pending := addresses
+	var lastErr error
+
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, retryDelay(f.backoff, attempt)); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		elems := make([]rpc.BatchElem, len(pending))
+		results := make([]json.RawMessage, len(pending))
+		for i, addr := range pending {
+			elems[i] = rpc.BatchElem{
+				Method: method,
+				Args:   []any{addr, blockArg},
+				Result: &results[i],
+			}
+		}
+
+		if err := f.client.BatchCallContext(ctx, elems); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		var failed []common.Address
+		for i, elem := range elems {
+			if elem.Error != nil {
+				lastErr = elem.Error
+				failed = append(failed, pending[i])
+				continue
+			}
+			values[pending[i]] = results[i]
+		}
+		if len(failed) == 0 {
+			return values, nil
+		}
+		pending = failed
+	}
+
+	return nil, fmt.Errorf("%s failed for %d addresses after %d attempts: %w", method, len(pending), f.maxRetries+1, lastErr)
+}
+
+func toBlockArg(block *big.Int) string {
+	if block == nil {
+		return "latest"
+	}
+	return hexutil.EncodeBig(block)
+}
+
+// retryDelay is exponential backoff with up to 50% jitter, capped at
+// maxRPCRetryBackoff.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRPCRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRPCRetryBackoff {
+		delay = maxRPCRetryBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tokenBucket is a minimal rate limiter. A nil bucket never blocks.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond float64, burst int) *tokenBucket {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/ethereum/go-ethereum v1.13.5
 	github.com/ipfs/go-ipfs-api v0.7.0
+	github.com/klauspost/compress v1.17.11
 )
 
 require (
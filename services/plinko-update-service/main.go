@@ -15,9 +15,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+
+	"plinko-update-service/dbdigest"
 )
 
 const (
@@ -48,8 +48,9 @@ type PlinkoUpdateService struct {
 	setSize         uint64
 	snapshotVersion string
 	addressIndex    map[string]uint64
-	useSimulated    bool
 	chainID         *big.Int
+	source          ChangeSource
+	digest          dbdigest.Digest
 }
 
 func main() {
@@ -58,8 +59,8 @@ func main() {
 	log.Println("========================================")
 
 	cfg := LoadConfig()
-	log.Printf("Configuration: database=%s, public_root=%s, delta_dir=%s, rpc=%s, simulated_updates=%v\n",
-		cfg.DatabasePath, cfg.PublicRoot, cfg.DeltaOutputDir, cfg.RPCURL, cfg.UseSimulated)
+	log.Printf("Configuration: database=%s, public_root=%s, delta_dir=%s, rpc=%s, change_source=%s, finality=%s, layout=%s\n",
+		cfg.DatabasePath, cfg.PublicRoot, cfg.DeltaOutputDir, cfg.RPCURL, cfg.ChangeSource, cfg.Finality, cfg.AccountLayout)
 
 	waitForDatabase(cfg.DatabasePath, cfg.DatabaseWaitTimeout)
 
@@ -67,6 +68,9 @@ func main() {
 	database, dbSize, chunkSize, setSize := loadDatabase(cfg.DatabasePath)
 	log.Printf("Loaded database: %d entries (ChunkSize: %d, SetSize: %d)\n",
 		dbSize, chunkSize, setSize)
+	hashStart := time.Now()
+	digest := dbdigest.FromWords(database, dbSize)
+	log.Printf("Database digest %s (%s)\n", digest.Sum(), time.Since(hashStart).Round(time.Millisecond))
 
 	addressIndex, err := loadAddressMapping(cfg.AddressMappingPath)
 	if err != nil {
@@ -79,28 +83,23 @@ func main() {
 		log.Fatalf("Failed to create snapshots directory: %v", err)
 	}
 
-	version, err := publishSnapshot(cfg, cfg.DatabasePath, dbSize, chunkSize, setSize)
+	publisher, err := newPublisher(cfg)
 	if err != nil {
-		log.Fatalf("Failed to publish snapshot: %v", err)
+		log.Fatalf("Failed to initialize publisher: %v", err)
 	}
-	log.Printf("Published snapshot version %s\n", version)
-
-	if err := ensureAddressMappingPublished(cfg.AddressMappingPath, cfg.PublicAddressMappingPath()); err != nil {
-		log.Fatalf("Failed to publish address-mapping.bin: %v", err)
+	if publisher != nil {
+		log.Printf("Publishing artifacts to %s\n", publisher.Name())
 	}
-	log.Println("Address mapping exported for CDN")
-
-	// Create Plinko update manager
-	log.Println("Initializing Plinko Update Manager...")
-	pm := NewPlinkoUpdateManager(database, dbSize, chunkSize, setSize)
 
-	// Create delta directory
+	// The bundler publishes the snapshot too, so it is created first.
 	if err := os.MkdirAll(cfg.DeltaOutputDir, 0o755); err != nil {
 		log.Fatalf("Failed to create delta directory: %v", err)
 	}
+	bundler := NewDeltaBundler(cfg, publisher)
 
-	// Initialize Delta Bundler
-	bundler := NewDeltaBundler(cfg)
+	// Create Plinko update manager
+	log.Println("Initializing Plinko Update Manager...")
+	pm := NewPlinkoUpdateManager(database, dbSize, chunkSize, setSize)
 
 	// Create service
 	service := &PlinkoUpdateService{
@@ -113,22 +112,54 @@ func main() {
 		dbSize:          dbSize,
 		chunkSize:       chunkSize,
 		setSize:         setSize,
-		snapshotVersion: version,
 		addressIndex:    addressIndex,
-		useSimulated:    cfg.UseSimulated,
+		digest:          digest,
 	}
 
-	// Start health check server
-	go service.startHealthServer()
-
-	// Connect to Ethereum
+	// Connect to Ethereum before publishing: the snapshot is anchored to
+	// the header of the block the database was taken at.
 	log.Printf("Connecting to Ethereum RPC at %s...\n", cfg.RPCURL)
 	if err := service.connectToEthereum(); err != nil {
 		log.Fatalf("Failed to connect to Ethereum: %v", err)
 	}
 	defer service.client.Close()
 
-	log.Println("✅ Connected to Anvil")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	anchor, err := fetchChainAnchor(ctx, service.client, service.chainID, cfg.SnapshotBlock)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to read snapshot block %d: %v", cfg.SnapshotBlock, err)
+	}
+
+	version, err := publishSnapshot(cfg, cfg.DatabasePath, dbSize, chunkSize, setSize, anchor, digest.Sum(), bundler)
+	if err != nil {
+		log.Fatalf("Failed to publish snapshot: %v", err)
+	}
+	log.Printf("Published snapshot version %s (block %d, hash %s)\n", version, anchor.Block, anchor.Hash)
+	service.snapshotVersion = version
+
+	if err := ensureAddressMappingPublished(cfg.AddressMappingPath, cfg.PublicAddressMappingPath()); err != nil {
+		log.Fatalf("Failed to publish address-mapping.bin: %v", err)
+	}
+	if publisher != nil {
+		if err := publisher.Update(cfg.PublicAddressMappingPath()); err != nil {
+			log.Printf("%s publish (address-mapping.bin) failed: %v", publisher.Name(), err)
+		}
+	}
+	log.Println("Address mapping exported for CDN")
+
+	// Start health check server
+	go service.startHealthServer()
+
+	go bundler.RunScheduler()
+	if publisher != nil {
+		go bundler.RunPublishQueue()
+	}
+	if cfg.CompactInterval > 0 {
+		go bundler.RunCompactor(cfg.CompactInterval)
+	}
+
+	log.Printf("✅ Connected to Ethereum (change source: %s)\n", service.source.Name())
 	log.Println()
 	log.Println("Starting block monitoring...")
 	log.Println("========================================")
@@ -205,6 +236,12 @@ func (s *PlinkoUpdateService) connectToEthereum() error {
 		return fmt.Errorf("failed to fetch chain ID: %w", err)
 	}
 	s.chainID = chainID
+
+	source, err := newChangeSource(s.cfg, s.client, s.chainID, s.addressIndex, s.dbSize)
+	if err != nil {
+		return fmt.Errorf("failed to create %s change source: %w", s.cfg.ChangeSource, err)
+	}
+	s.source = source
 	return nil
 }
 
@@ -213,52 +250,74 @@ func (s *PlinkoUpdateService) monitorBlocks() {
 	ticker := time.NewTicker(BlockProcessDelay)
 	defer ticker.Stop()
 
-	var lastBlockNumber uint64 = 0
+	lastBlockNumber := s.cfg.SnapshotBlock
 
 	for range ticker.C {
-		// Get latest block number
-		blockNumber, err := s.client.BlockNumber(ctx)
+		// Get the newest block allowed by the finality policy
+		blockNumber, ok, err := s.cfg.Finality.TargetBlock(ctx, s.client)
 		if err != nil {
 			log.Printf("Error getting block number: %v\n", err)
 			continue
 		}
+		if !ok {
+			continue
+		}
 
-		// Process new blocks
-		if blockNumber > lastBlockNumber {
-			for bn := lastBlockNumber + 1; bn <= blockNumber; bn++ {
-				if err := s.processBlock(ctx, bn); err != nil {
-					log.Printf("Error processing block %d: %v\n", bn, err)
-				}
-			}
-			lastBlockNumber = blockNumber
+		lastBlockNumber = s.processBlocks(ctx, lastBlockNumber, blockNumber)
+	}
+}
+
+// processBlocks processes the blocks after last up to target in order and
+// returns the last one processed. It stops at a block that fails, which is
+// retried on the next tick rather than skipped, as the state-syncer does.
+func (s *PlinkoUpdateService) processBlocks(ctx context.Context, last, target uint64) uint64 {
+	for last < target {
+		if err := s.processBlock(ctx, last+1); err != nil {
+			log.Printf("Error processing block %d, will retry: %v\n", last+1, err)
+			break
 		}
+		last++
 	}
+	return last
 }
 
+// processBlock applies the changes of blockNumber and publishes its delta.
+// An error means the block was not applied and should be retried.
 func (s *PlinkoUpdateService) processBlock(ctx context.Context, blockNumber uint64) error {
 	startTime := time.Now()
 
-	// Get block header
-	header, err := s.client.HeaderByNumber(ctx, big.NewInt(int64(blockNumber)))
+	changes, err := s.source.BlockChanges(ctx, blockNumber)
 	if err != nil {
-		return fmt.Errorf("failed to get block header: %w", err)
+		return fmt.Errorf("%s source: %w", s.source.Name(), err)
 	}
 
-	// Detect updates for this block
-	updates := s.detectChanges(ctx, blockNumber, header)
+	// Resolve changes against the database
+	updates := s.resolveUpdates(changes)
 
-	if len(updates) == 0 {
-		// No changes detected
+	// The first block after the snapshot is published even without changes,
+	// so that its delta chains to the snapshot's block hash.
+	chain := blockNumber == s.cfg.SnapshotBlock+1 && changes != nil && changes.ParentHash != nil
+
+	if len(updates) == 0 && !chain {
+		// No changes detected; the bundler still needs to know the block
+		// was processed.
+		if err := s.bundler.RecordEmptyBlock(blockNumber); err != nil {
+			log.Printf("⚠️ Bundler error for block %d: %v\n", blockNumber, err)
+		}
 		return nil
 	}
 
 	// Generate hint deltas using Plinko
 	deltas, updateDuration := s.updateManager.ApplyUpdates(updates)
 	recordBatch(len(updates), updateDuration)
+	for _, update := range updates {
+		s.digest.Update(update.Index, dbdigest.Entry(update.OldValue), dbdigest.Entry(update.NewValue))
+	}
 
 	// Save delta file
 	deltaPath := filepath.Join(s.cfg.DeltaOutputDir, fmt.Sprintf("delta-%06d.bin", blockNumber))
-	if err := saveDelta(deltaPath, deltas); err != nil {
+	if err := saveDelta(deltaPath, newDeltaHeader(deltaDataset, changes), deltas); err != nil {
+		s.undoUpdates(updates)
 		return fmt.Errorf("failed to save delta: %w", err)
 	}
 
@@ -271,102 +330,79 @@ func (s *PlinkoUpdateService) processBlock(ctx context.Context, blockNumber uint
 		updateDuration, blockDuration)
 	recordBlock(blockNumber, len(updates), blockDuration)
 
-	// Process bundling (and update manifest)
-	// We now call PublishDelta which handles manifest update and triggers bundling if needed
-	if err := s.bundler.PublishDelta(blockNumber, deltaPath); err != nil {
+	// Publish the delta and update the manifest; bundling happens in the
+	// background scheduler
+	if err := s.bundler.PublishDelta(blockNumber, deltaPath, s.digest.Sum()); err != nil {
 		log.Printf("⚠️ Bundler error for block %d: %v\n", blockNumber, err)
 	}
 
 	return nil
 }
 
-func (s *PlinkoUpdateService) detectChanges(ctx context.Context, blockNumber uint64, header *types.Header) []DBUpdate {
-	if !s.useSimulated {
-		return s.detectRPCChanges(ctx, blockNumber, header)
-	}
-
-	updates := make([]DBUpdate, ChangesPerBlock)
-
-	// Simulate deterministic changes based on block number
-	for i := 0; i < ChangesPerBlock; i++ {
-		index := uint64((blockNumber*ChangesPerBlock + uint64(i)) % s.dbSize)
-
-		// Read old value
-		oldValue := s.readDBEntry(index)
-
-		// Generate new value (simulated change)
-		var newValue DBEntry
-		newValue[0] = uint64(blockNumber)*1000 + uint64(i)
-
-		updates[i] = DBUpdate{
-			Index:    index,
-			OldValue: oldValue,
-			NewValue: newValue,
-		}
+// undoUpdates restores the values updates replaced, so that a block whose
+// delta could not be saved is computed afresh when it is retried.
+func (s *PlinkoUpdateService) undoUpdates(updates []DBUpdate) {
+	undo := make([]DBUpdate, len(updates))
+	for i, update := range updates {
+		undo[i] = DBUpdate{Index: update.Index, OldValue: update.NewValue, NewValue: update.OldValue}
+		s.digest.Update(update.Index, dbdigest.Entry(update.NewValue), dbdigest.Entry(update.OldValue))
 	}
-
-	return updates
+	s.updateManager.ApplyUpdates(undo)
 }
 
-func (s *PlinkoUpdateService) detectRPCChanges(ctx context.Context, blockNumber uint64, header *types.Header) []DBUpdate {
-	if s.client == nil || s.chainID == nil {
-		log.Println("Ethereum client not initialized; cannot fetch live updates")
+// resolveUpdates converts source changes into DBUpdates, placing account
+// fields according to cfg.AccountLayout. Accounts missing from the address
+// mapping are skipped, unchanged values are dropped and
+// repeated writes to the same index keep only the last value so each delta
+// is computed against the value actually stored.
+func (s *PlinkoUpdateService) resolveUpdates(changes *BlockChanges) []DBUpdate {
+	if changes == nil {
 		return nil
 	}
 
-	block, err := s.client.BlockByNumber(ctx, new(big.Int).SetUint64(blockNumber))
-	if err != nil {
-		log.Printf("Failed to load block %d: %v\n", blockNumber, err)
-		return nil
-	}
-
-	addresses := make(map[string]struct{})
-	signer := types.LatestSignerForChainID(s.chainID)
-
-	for _, tx := range block.Transactions() {
-		if from, err := types.Sender(signer, tx); err == nil {
-			addresses[strings.ToLower(from.Hex())] = struct{}{}
+	order := make([]uint64, 0, len(changes.Entries)+len(changes.Accounts))
+	values := make(map[uint64]DBEntry, cap(order))
+	set := func(index uint64, value DBEntry) {
+		if index >= s.dbSize {
+			return
 		}
-		if to := tx.To(); to != nil {
-			addresses[strings.ToLower(to.Hex())] = struct{}{}
+		if _, seen := values[index]; !seen {
+			order = append(order, index)
 		}
+		values[index] = value
 	}
 
-	if len(addresses) == 0 {
-		return nil
+	for _, entry := range changes.Entries {
+		set(entry.Index, entry.Value)
 	}
-
-	blockRef := new(big.Int).SetUint64(blockNumber)
-	updates := make([]DBUpdate, 0, len(addresses))
-
-	for addrHex := range addresses {
-		index, ok := s.addressIndex[addrHex]
+	setField := func(accountIdx uint64, field string, value DBEntry) {
+		if index, ok := s.cfg.AccountLayout.EntryIndex(accountIdx, field); ok {
+			set(index, value)
+		}
+	}
+	for _, account := range changes.Accounts {
+		accountIdx, ok := s.addressIndex[strings.ToLower(account.Address.Hex())]
 		if !ok {
 			continue
 		}
-
-		balance, err := s.client.BalanceAt(ctx, common.HexToAddress(addrHex), blockRef)
-		if err != nil {
-			log.Printf("BalanceAt failed for %s: %v\n", addrHex, err)
-			continue
+		if account.Nonce != nil {
+			setField(accountIdx, FieldNonce, DBEntry{uint64(*account.Nonce)})
 		}
-
-		oldValue := s.readDBEntry(index)
-		newValue := bigIntToDBEntry(balance)
-
-		// Check if value changed
-		changed := false
-		for i := 0; i < DBEntryLength; i++ {
-			if oldValue[i] != newValue[i] {
-				changed = true
-				break
-			}
+		if account.Balance != nil {
+			setField(accountIdx, FieldBalance, bigIntToDBEntry(account.Balance.ToInt()))
+		}
+		if account.CodeHash != nil {
+			setField(accountIdx, FieldCodeHash, hashToDBEntry(*account.CodeHash))
 		}
+	}
 
-		if !changed {
+	updates := make([]DBUpdate, 0, len(order))
+	for _, index := range order {
+		oldValue := s.readDBEntry(index)
+		newValue := values[index]
+		if oldValue == newValue {
 			continue
 		}
-
 		updates = append(updates, DBUpdate{
 			Index:    index,
 			OldValue: oldValue,
@@ -406,72 +442,6 @@ func (s *PlinkoUpdateService) readDBEntry(index uint64) DBEntry {
 	return entry
 }
 
-func saveDelta(path string, deltas []PublishedDelta) error {
-	// Create a temporary file in the same directory
-	dir := filepath.Dir(path)
-	f, err := os.CreateTemp(dir, "delta-*.tmp")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	tempPath := f.Name()
-
-	// Clean up temp file on error
-	defer func() {
-		if err != nil {
-			f.Close()
-			os.Remove(tempPath)
-		}
-	}()
-
-	// Write delta count
-	var header [16]byte
-	binary.LittleEndian.PutUint64(header[0:8], uint64(len(deltas)))
-	binary.LittleEndian.PutUint64(header[8:16], 0) // Reserved
-
-	if _, err = f.Write(header[:]); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
-	}
-
-	if err = f.Chmod(0644); err != nil {
-		return fmt.Errorf("failed to chmod temp file: %w", err)
-	}
-
-	// Write each delta
-	// Format: [8 bytes Index] [32 bytes Delta]
-	// Client uses their local iPRF to determine which hints to update
-	for _, delta := range deltas {
-		var entry [40]byte
-		binary.LittleEndian.PutUint64(entry[0:8], delta.Index)
-
-		for i := 0; i < DBEntryLength; i++ {
-			binary.LittleEndian.PutUint64(entry[8+i*8:16+i*8], delta.Delta[i])
-		}
-
-		if _, err = f.Write(entry[:]); err != nil {
-			return fmt.Errorf("failed to write delta entry: %w", err)
-		}
-	}
-
-	// Ensure data is written to disk
-	if err = f.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file: %w", err)
-	}
-
-	if err = f.Close(); err != nil {
-		return fmt.Errorf("failed to close temp file: %w", err)
-	}
-
-	// Atomic rename
-	if err = os.Rename(tempPath, path); err != nil {
-		// Attempt to remove temp file since rename failed and deferred cleanup
-		// might not trigger if err was nil before this block
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to rename temp file: %w", err)
-	}
-
-	return nil
-}
-
 func boolToUint64(b bool) uint64 {
 	if b {
 		return 1
@@ -495,6 +465,10 @@ func (s *PlinkoUpdateService) startHealthServer() {
 		json.NewEncoder(w).Encode(snapshotMetrics())
 	})
 
+	// Delta feed for clients (see feed.go)
+	http.HandleFunc("/deltas", s.bundler.handleDeltas)
+	http.HandleFunc("/deltas/stream", s.bundler.handleDeltaStream)
+
 	log.Printf("Health check server listening on :%s\n", s.cfg.HealthPort)
 	if err := http.ListenAndServe(":"+s.cfg.HealthPort, nil); err != nil {
 		log.Printf("Health server error: %v\n", err)
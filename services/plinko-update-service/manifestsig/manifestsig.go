@@ -0,0 +1,303 @@
+// Package manifestsig signs and verifies the manifests the syncers publish.
+//
+// A manifest is signed as the exact bytes served, so verification does not
+// depend on how JSON is re-encoded. The signatures live next to it in
+// <manifest>.sig:
+//
+//	{
+//	  "sha256": "<hex SHA-256 of the manifest bytes>",
+//	  "sequence": 1234,
+//	  "signedAt": 1718000000,
+//	  "signatures": [
+//	    {"keyId": "2024-06", "algorithm": "ed25519", "signature": "<base64>"}
+//	  ]
+//	}
+//
+// Each signature is Ed25519 over SignatureContext, the sequence and the
+// signing time as big-endian uint64s, then the manifest bytes. Manifests
+// list the SHA-256 of every file they reference, so a verified manifest
+// authenticates the deltas, bundles and snapshots fetched through any
+// mirror.
+//
+// The sequence is the manifest's latest block and never goes down, so a
+// Verifier that remembers the last one it accepted catches a mirror serving
+// an older, validly signed manifest; with a MaxAge it also catches one that
+// stops updating.
+//
+// Keys are rotated by ID: the publisher signs with every configured key,
+// and a verifier accepts a manifest when any signature is by a key in its
+// Keyring. To rotate, add the new key to the publisher, ship the new public
+// key to clients, then drop the old key.
+package manifestsig
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Algorithm is the only signature algorithm in use.
+	Algorithm = "ed25519"
+	// SignatureContext prefixes the signed message so manifest signatures
+	// cannot be replayed as signatures over anything else.
+	SignatureContext = "plinko manifest signature v2\x00"
+	// Suffix is appended to a manifest's path or URL to find its signatures.
+	Suffix = ".sig"
+)
+
+var (
+	// ErrDigestMismatch means the signature file is for different manifest
+	// bytes, typically because one of the two was fetched mid-update.
+	ErrDigestMismatch = errors.New("manifestsig: manifest does not match signature file")
+	// ErrUntrusted means no signature is by a trusted key and valid.
+	ErrUntrusted = errors.New("manifestsig: no valid signature by a trusted key")
+	// ErrRollback means the manifest is older than one already accepted.
+	ErrRollback = errors.New("manifestsig: manifest is older than the last one accepted")
+	// ErrStale means the manifest was signed longer ago than the
+	// Verifier's MaxAge.
+	ErrStale = errors.New("manifestsig: manifest signature is too old")
+)
+
+// Signature is one key's signature over a manifest.
+type Signature struct {
+	KeyID     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	Signature []byte `json:"signature"`
+}
+
+// File is the content of a <manifest>.sig file. Sequence and SignedAt (Unix
+// seconds) are signed along with the manifest.
+type File struct {
+	SHA256     string      `json:"sha256"`
+	Sequence   uint64      `json:"sequence"`
+	SignedAt   int64       `json:"signedAt"`
+	Signatures []Signature `json:"signatures"`
+}
+
+// Key is a named Ed25519 signing key.
+type Key struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+}
+
+// PublicKeyHex returns the hex public key, the form a Keyring takes.
+func (k Key) PublicKeyHex() string {
+	return hex.EncodeToString(k.PrivateKey.Public().(ed25519.PublicKey))
+}
+
+// LoadKeys reads a comma-separated list of id:path pairs, each path a PEM
+// PKCS #8 Ed25519 private key as written by
+// `openssl genpkey -algorithm ed25519`. An empty spec yields no keys.
+func LoadKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, item := range splitList(spec) {
+		id, path, ok := strings.Cut(item, ":")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("manifestsig: signing key %q is not id:path", item)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("manifestsig: key %s: %w", id, err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("manifestsig: key %s: no PEM block in %s", id, path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("manifestsig: key %s: %w", id, err)
+		}
+		priv, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("manifestsig: key %s is %T, not Ed25519", id, parsed)
+		}
+		keys = append(keys, Key{ID: id, PrivateKey: priv})
+	}
+	return keys, nil
+}
+
+// Sign signs payload, the manifest as of block sequence, with every key at
+// time at.
+func Sign(payload []byte, sequence uint64, at time.Time, keys []Key) File {
+	digest := sha256.Sum256(payload)
+	file := File{SHA256: hex.EncodeToString(digest[:]), Sequence: sequence, SignedAt: at.Unix()}
+	msg := message(payload, file)
+	for _, key := range keys {
+		file.Signatures = append(file.Signatures, Signature{
+			KeyID:     key.ID,
+			Algorithm: Algorithm,
+			Signature: ed25519.Sign(key.PrivateKey, msg),
+		})
+	}
+	return file
+}
+
+// WriteFile writes the signatures of payload, the content of the file at
+// path as of block sequence, to path+Suffix. It does nothing without keys.
+func WriteFile(path string, payload []byte, sequence uint64, keys []Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(Sign(payload, sequence, time.Now(), keys), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + Suffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+Suffix)
+}
+
+// Keyring maps key IDs to the public keys a client trusts.
+type Keyring map[string]ed25519.PublicKey
+
+// ParseKeyring reads a comma-separated list of id:hex pairs, each hex a
+// 32-byte Ed25519 public key.
+func ParseKeyring(spec string) (Keyring, error) {
+	ring := make(Keyring)
+	for _, item := range splitList(spec) {
+		id, hexKey, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("manifestsig: trusted key %q is not id:hex", item)
+		}
+		pub, err := hex.DecodeString(hexKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("manifestsig: trusted key %s is not a hex Ed25519 public key", id)
+		}
+		ring[id] = ed25519.PublicKey(pub)
+	}
+	return ring, nil
+}
+
+// Verify checks payload against the signature file and returns the ID of
+// the first trusted key that signed it. Signatures by unknown keys are
+// ignored, so a manifest signed during a rotation verifies with either key.
+// It does not check the sequence against earlier manifests; see Verifier.
+func (k Keyring) Verify(payload []byte, file File) (string, error) {
+	digest := sha256.Sum256(payload)
+	if !strings.EqualFold(file.SHA256, hex.EncodeToString(digest[:])) {
+		return "", ErrDigestMismatch
+	}
+	msg := message(payload, file)
+	for _, sig := range file.Signatures {
+		pub, ok := k[sig.KeyID]
+		if !ok || sig.Algorithm != Algorithm {
+			continue
+		}
+		if ed25519.Verify(pub, msg, sig.Signature) {
+			return sig.KeyID, nil
+		}
+	}
+	return "", ErrUntrusted
+}
+
+// VerifyJSON checks payload against the raw content of its .sig file. Like
+// Verify, it cannot tell an old manifest from the current one; clients that
+// poll a manifest use a Verifier.
+func (k Keyring) VerifyJSON(payload, sigData []byte) (string, error) {
+	var file File
+	if err := json.Unmarshal(sigData, &file); err != nil {
+		return "", fmt.Errorf("manifestsig: decode signature file: %w", err)
+	}
+	return k.Verify(payload, file)
+}
+
+// ReadFile reads the manifest at path and returns its bytes once they
+// verify against path+Suffix.
+func (k Keyring) ReadFile(path string) ([]byte, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := os.ReadFile(path + Suffix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := k.VerifyJSON(payload, sigData); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Verifier verifies successive fetches of one manifest. It rejects a
+// manifest whose sequence is below the last one it accepted and, with a
+// MaxAge, one signed longer ago than that.
+type Verifier struct {
+	Keyring Keyring
+	MaxAge  time.Duration
+
+	mu   sync.Mutex
+	last uint64
+}
+
+// NewVerifier returns a Verifier for ring that accepts nothing older than
+// sequence last, say the one a client persisted from its previous run.
+func NewVerifier(ring Keyring, last uint64) *Verifier {
+	return &Verifier{Keyring: ring, last: last}
+}
+
+// Last returns the sequence of the newest manifest accepted so far.
+func (v *Verifier) Last() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.last
+}
+
+// Verify checks payload against the signature file like Keyring.Verify,
+// then that it is not older than the last manifest accepted. An accepted
+// manifest's sequence becomes the new minimum.
+func (v *Verifier) Verify(payload []byte, file File) (string, error) {
+	keyID, err := v.Keyring.Verify(payload, file)
+	if err != nil {
+		return "", err
+	}
+	if v.MaxAge > 0 && time.Since(time.Unix(file.SignedAt, 0)) > v.MaxAge {
+		return "", fmt.Errorf("%w: signed at %s", ErrStale, time.Unix(file.SignedAt, 0).UTC().Format(time.RFC3339))
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if file.Sequence < v.last {
+		return "", fmt.Errorf("%w: sequence %d, accepted %d", ErrRollback, file.Sequence, v.last)
+	}
+	v.last = file.Sequence
+	return keyID, nil
+}
+
+// VerifyJSON checks payload against the raw content of its .sig file.
+func (v *Verifier) VerifyJSON(payload, sigData []byte) (string, error) {
+	var file File
+	if err := json.Unmarshal(sigData, &file); err != nil {
+		return "", fmt.Errorf("manifestsig: decode signature file: %w", err)
+	}
+	return v.Verify(payload, file)
+}
+
+func message(payload []byte, file File) []byte {
+	msg := make([]byte, 0, len(SignatureContext)+16+len(payload))
+	msg = append(msg, SignatureContext...)
+	msg = binary.BigEndian.AppendUint64(msg, file.Sequence)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(file.SignedAt))
+	return append(msg, payload...)
+}
+
+func splitList(spec string) []string {
+	var items []string
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,123 @@
+package manifestsig
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSignAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := LoadKeys("old:" + writeKey(t, dir, "old") + ", new:" + writeKey(t, dir, "new"))
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+
+	manifest := filepath.Join(dir, "manifest.json")
+	payload := []byte(`{"latestBlock":42}`)
+	if err := os.WriteFile(manifest, payload, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(manifest, payload, 42, keys); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	// A client that only knows the new key accepts the rotation-era
+	// manifest.
+	ring, err := ParseKeyring("new:" + keys[1].PublicKeyHex())
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if got, err := ring.ReadFile(manifest); err != nil || string(got) != string(payload) {
+		t.Fatalf("read verified: %q, %v", got, err)
+	}
+
+	sigData, err := os.ReadFile(manifest + Suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.VerifyJSON([]byte(`{"latestBlock":43}`), sigData); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("tampered manifest: %v", err)
+	}
+
+	// A signature file rewritten for forged content does not verify either.
+	forged := []byte(`{"latestBlock":43}`)
+	now := time.Now()
+	file := Sign(forged, 42, now, nil)
+	file.Signatures = Sign(payload, 42, now, keys).Signatures
+	if _, err := ring.Verify(forged, file); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("forged manifest: %v", err)
+	}
+
+	untrusted, err := ParseKeyring("other:" + keys[0].PublicKeyHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := untrusted.ReadFile(manifest); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("unknown key ID: %v", err)
+	}
+}
+
+func TestVerifierRejectsRollback(t *testing.T) {
+	keys, err := LoadKeys("k:" + writeKey(t, t.TempDir(), "k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := ParseKeyring("k:" + keys[0].PublicKeyHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	older, newer := []byte(`{"latestBlock":41}`), []byte(`{"latestBlock":42}`)
+	olderSig, newerSig := Sign(older, 41, now, keys), Sign(newer, 42, now, keys)
+
+	v := NewVerifier(ring, 0)
+	if _, err := v.Verify(newer, newerSig); err != nil || v.Last() != 42 {
+		t.Fatalf("newer: last %d, %v", v.Last(), err)
+	}
+	// The same manifest again is fine; the one before it is not, although
+	// its signature is valid.
+	if _, err := v.Verify(newer, newerSig); err != nil {
+		t.Fatalf("same manifest: %v", err)
+	}
+	if _, err := v.Verify(older, olderSig); !errors.Is(err, ErrRollback) || v.Last() != 42 {
+		t.Fatalf("older manifest: last %d, %v", v.Last(), err)
+	}
+
+	// The sequence is signed: raising it on an old manifest breaks the
+	// signature.
+	olderSig.Sequence = 43
+	if _, err := v.Verify(older, olderSig); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("raised sequence: %v", err)
+	}
+
+	// A manifest signed longer ago than MaxAge is stale, as a frozen
+	// mirror's eventually is.
+	v.MaxAge = time.Hour
+	stale := Sign(newer, 42, now.Add(-2*time.Hour), keys)
+	if _, err := v.Verify(newer, stale); !errors.Is(err, ErrStale) {
+		t.Fatalf("stale manifest: %v", err)
+	}
+}
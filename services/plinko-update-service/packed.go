@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Packed delta encoding. Most deltas are balance changes whose XOR touches
+// one or two of the four words, and the indices in a block are sparse, so
+// the fixed 40-byte records compress poorly on their own. A packed file is
+// one zstd frame over a sequence of packed deltas, one per block:
+//
+//	header   the 128-byte version 2 header with magic "PLKP"
+//	records  count times, sorted by index:
+//	           uvarint  index minus the previous record's index (first: index)
+//	           byte     word mask; bit w set when word w is non-zero
+//	           u64 LE   each non-zero word, lowest first
+//
+// There is no SHA-256 trailer; the zstd frame checksum covers the content.
+// A packed delta-XXXXXX.bin is published as delta-XXXXXX.zst and a packed
+// bundle-S-E.bin as bundle-S-E.zst, holding the same blocks in the same
+// order. The manifest lists EncodingPacked when they are published.
+const (
+	EncodingRaw    = "raw"
+	EncodingPacked = "packed+zstd"
+
+	packedDeltaMagic = "PLKP"
+	packedExt        = ".zst"
+
+	// maxPackedSize bounds the decompressed size of a packed file.
+	maxPackedSize = 1 << 30
+)
+
+var (
+	packedEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	packedDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxPackedSize))
+)
+
+// packDeltaFiles encodes files in the packed form and compresses them as a
+// single zstd frame.
+func packDeltaFiles(files []DeltaFile) ([]byte, error) {
+	var buf []byte
+	for _, file := range files {
+		deltas := append([]PublishedDelta(nil), file.Deltas...)
+		sort.SliceStable(deltas, func(i, j int) bool { return deltas[i].Index < deltas[j].Index })
+
+		var err error
+		if buf, err = appendDeltaHeader(buf, packedDeltaMagic, file.DeltaHeader, len(deltas)); err != nil {
+			return nil, err
+		}
+		var prev uint64
+		for _, delta := range deltas {
+			buf = binary.AppendUvarint(buf, delta.Index-prev)
+			prev = delta.Index
+
+			var mask byte
+			for w, word := range delta.Delta {
+				if word != 0 {
+					mask |= 1 << w
+				}
+			}
+			buf = append(buf, mask)
+			for _, word := range delta.Delta {
+				if word != 0 {
+					buf = binary.LittleEndian.AppendUint64(buf, word)
+				}
+			}
+		}
+	}
+	return packedEncoder.EncodeAll(buf, nil), nil
+}
+
+// unpackDeltaFiles decompresses and decodes a packed delta or bundle.
+// Records come back sorted by index; XOR deltas commute, so applying them
+// in that order gives the same hints as the raw file.
+func unpackDeltaFiles(data []byte) ([]DeltaFile, error) {
+	buf, err := packedDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompress packed deltas: %w", err)
+	}
+
+	var files []DeltaFile
+	for len(buf) > 0 {
+		if len(buf) < 4 || string(buf[0:4]) != packedDeltaMagic {
+			return nil, fmt.Errorf("packed delta %d: bad magic", len(files))
+		}
+		header, headerSize, err := parseDeltaHeader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("packed delta %d: %w", len(files), err)
+		}
+		buf = buf[headerSize:]
+		// Every record takes at least two bytes.
+		if header.Count > uint64(len(buf))/2 {
+			return nil, fmt.Errorf("packed delta %d: %w", len(files), errDeltaTruncated)
+		}
+
+		file := DeltaFile{DeltaHeader: header, Deltas: make([]PublishedDelta, header.Count)}
+		var index uint64
+		for i := range file.Deltas {
+			gap, n := binary.Uvarint(buf)
+			if n <= 0 || len(buf) < n+1 {
+				return nil, fmt.Errorf("packed delta %d record %d: %w", len(files), i, errDeltaTruncated)
+			}
+			index += gap
+			mask := buf[n]
+			buf = buf[n+1:]
+			if mask >= 1<<DBEntryLength {
+				return nil, fmt.Errorf("packed delta %d record %d: bad word mask %#x", len(files), i, mask)
+			}
+
+			file.Deltas[i].Index = index
+			for w := 0; w < DBEntryLength; w++ {
+				if mask&(1<<w) == 0 {
+					continue
+				}
+				if len(buf) < 8 {
+					return nil, fmt.Errorf("packed delta %d record %d: %w", len(files), i, errDeltaTruncated)
+				}
+				file.Deltas[i].Delta[w] = binary.LittleEndian.Uint64(buf)
+				buf = buf[8:]
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// writePacked packs the delta files in raw, which may be a single delta or a
+// bundle, and writes them to path.
+func writePacked(path string, raw []byte) error {
+	files, err := decodeDeltaBundle(raw)
+	if err != nil {
+		return err
+	}
+	data, err := packDeltaFiles(files)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"plinko-update-service/manifestsig"
+)
+
+// Publisher backends, as listed in Config.Publishers.
+const (
+	PublisherIPFS = "ipfs"
+	PublisherFS   = "fs"
+	PublisherS3   = "s3"
+)
+
+// Publisher copies finished artifacts to where clients fetch them from.
+// The files under the public root stay the reference copy, so a failed
+// publish is logged and costs only that mirror.
+type Publisher interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Publish uploads the artifact at path, which never changes afterwards.
+	Publish(path string) (Published, error)
+	// Update uploads the artifact at path over the copy published under
+	// the same name before, as for the root manifests. Content-addressed
+	// backends have no stable names and skip it.
+	Update(path string) error
+}
+
+// Published says where an artifact ended up; each backend fills in what it
+// has. IPFS sets the CID and GatewayURL, name-addressed backends the URL.
+type Published struct {
+	CID        string
+	GatewayURL string
+	URL        string
+}
+
+// newPublisher builds the backends listed in cfg.Publishers. It returns nil
+// when none are configured.
+func newPublisher(cfg Config) (Publisher, error) {
+	var publishers multiPublisher
+	for _, name := range cfg.Publishers {
+		switch name {
+		case PublisherIPFS:
+			p, err := newIPFSPublisher(cfg.IPFSAPI, cfg.IPFSGateway)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil {
+				return nil, fmt.Errorf("ipfs publisher needs an IPFS API address")
+			}
+			publishers = append(publishers, p)
+		case PublisherFS:
+			p, err := newFilePublisher(cfg.PublicRoot, cfg.PublishDir, cfg.PublishURL)
+			if err != nil {
+				return nil, err
+			}
+			publishers = append(publishers, p)
+		case PublisherS3:
+			p, err := newS3Publisher(cfg.PublicRoot, cfg.S3)
+			if err != nil {
+				return nil, err
+			}
+			publishers = append(publishers, p)
+		default:
+			return nil, fmt.Errorf("unknown publisher %q (want %s, %s or %s)", name, PublisherIPFS, PublisherFS, PublisherS3)
+		}
+	}
+	switch len(publishers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return publishers[0], nil
+	}
+	return publishers, nil
+}
+
+// parsePublishers splits a comma-separated backend list. An unset list
+// keeps the old behaviour of pinning to IPFS when an API is configured.
+func parsePublishers(value, ipfsAPI string) []string {
+	if strings.TrimSpace(value) == "" {
+		if ipfsAPI != "" {
+			return []string{PublisherIPFS}
+		}
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" && name != "none" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// publicKey returns the slash-separated name of path below root, which is
+// what name-addressed backends publish it under.
+func publicKey(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not below the public root %s", path, root)
+	}
+	return rel, nil
+}
+
+// updateSigned republishes the mutable file at path, followed by its
+// detached signatures when it is signed.
+func updateSigned(p Publisher, path string, signed bool) error {
+	if err := p.Update(path); err != nil {
+		return err
+	}
+	if !signed {
+		return nil
+	}
+	return p.Update(path + manifestsig.Suffix)
+}
+
+// multiPublisher publishes to every backend in order. Each field of the
+// result comes from the first backend that set it.
+type multiPublisher []Publisher
+
+func (m multiPublisher) Name() string {
+	names := make([]string, len(m))
+	for i, p := range m {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+func (m multiPublisher) Publish(path string) (Published, error) {
+	var out Published
+	var errs []error
+	for _, p := range m {
+		res, err := p.Publish(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		if out.CID == "" {
+			out.CID, out.GatewayURL = res.CID, res.GatewayURL
+		}
+		if out.URL == "" {
+			out.URL = res.URL
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+func (m multiPublisher) Update(path string) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Update(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyPin checks the pin on every backend that can.
+func (m multiPublisher) VerifyPin(cid string) error {
+	for _, p := range m {
+		if v, ok := p.(pinVerifier); ok {
+			if err := v.VerifyPin(cid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PublishName publishes the name on the first backend that has names.
+func (m multiPublisher) PublishName(key string, paths ...string) (string, error) {
+	for _, p := range m {
+		if n, ok := p.(namePublisher); ok {
+			return n.PublishName(key, paths...)
+		}
+	}
+	return "", fmt.Errorf("no publisher in %s supports names", m.Name())
+}
+
+// FilePublisher copies artifacts into another directory tree, such as a
+// volume a CDN origin serves, keeping their names below the public root.
+type FilePublisher struct {
+	root    string
+	dir     string
+	baseURL string
+}
+
+func newFilePublisher(root, dir, baseURL string) (*FilePublisher, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("fs publisher needs a target directory")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FilePublisher{root: root, dir: dir, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (p *FilePublisher) Name() string { return PublisherFS }
+
+func (p *FilePublisher) Publish(path string) (Published, error) {
+	key, err := p.copy(path)
+	if err != nil {
+		return Published{}, err
+	}
+	if p.baseURL == "" {
+		return Published{}, nil
+	}
+	return Published{URL: p.baseURL + "/" + key}, nil
+}
+
+func (p *FilePublisher) Update(path string) error {
+	_, err := p.copy(path)
+	return err
+}
+
+func (p *FilePublisher) copy(path string) (string, error) {
+	key, err := publicKey(p.root, path)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(p.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	return key, copyFile(path, dst)
+}
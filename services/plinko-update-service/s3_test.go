@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type s3Object struct {
+	data         []byte
+	cacheControl string
+	// parts is the number of parts of a multipart upload, 0 for a PUT.
+	parts int
+}
+
+// fakeS3 is a path-style stand-in for an S3-compatible store that keeps
+// the objects PUT into it, in one request or as a multipart upload.
+func fakeS3(t *testing.T) (*httptest.Server, map[string]s3Object) {
+	type upload struct {
+		cacheControl string
+		parts        map[string][]byte
+	}
+	var mu sync.Mutex
+	objects := make(map[string]s3Object)
+	uploads := make(map[string]*upload)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if sum := sha256.Sum256(data); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		query := r.URL.Query()
+		id := query.Get("uploadId")
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			id = fmt.Sprintf("upload-%d", len(uploads)+1)
+			uploads[id] = &upload{cacheControl: r.Header.Get("Cache-Control"), parts: make(map[string][]byte)}
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+		case r.Method == http.MethodPut && id != "":
+			if uploads[id] == nil {
+				http.Error(w, "NoSuchUpload", http.StatusNotFound)
+				return
+			}
+			number := query.Get("partNumber")
+			uploads[id].parts[number] = data
+			w.Header().Set("ETag", `"etag-`+number+`"`)
+		case r.Method == http.MethodPost && id != "":
+			var complete struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+			if uploads[id] == nil || xml.Unmarshal(data, &complete) != nil {
+				http.Error(w, "NoSuchUpload", http.StatusNotFound)
+				return
+			}
+			var object []byte
+			for i, part := range complete.Parts {
+				number := strconv.Itoa(part.PartNumber)
+				if part.PartNumber != i+1 || part.ETag != `"etag-`+number+`"` {
+					http.Error(w, "InvalidPart", http.StatusBadRequest)
+					return
+				}
+				object = append(object, uploads[id].parts[number]...)
+			}
+			objects[r.URL.Path] = s3Object{data: object, cacheControl: uploads[id].cacheControl, parts: len(complete.Parts)}
+			delete(uploads, id)
+		case r.Method == http.MethodDelete && id != "":
+			delete(uploads, id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut:
+			objects[r.URL.Path] = s3Object{data: data, cacheControl: r.Header.Get("Cache-Control")}
+		default:
+			http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, objects
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	srv, objects := fakeS3(t)
+	root := t.TempDir()
+	publisher, err := newS3Publisher(root, S3Config{Endpoint: srv.URL, Bucket: "plinko", AccessKeyID: "minio", SecretAccessKey: "minio123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.partSize = 8
+
+	// Over the part size: three parts, each signed with its own hash.
+	path := filepath.Join(root, "database.bin")
+	data := []byte("twenty bytes of data")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Update(path); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if obj := objects["/plinko/database.bin"]; string(obj.data) != string(data) || obj.parts != 3 || obj.cacheControl != "no-cache" {
+		t.Fatalf("object = %q in %d parts, cache %q", obj.data, obj.parts, obj.cacheControl)
+	}
+
+	// Up to the part size: a single PUT.
+	path = filepath.Join(root, "manifest.json")
+	if err := os.WriteFile(path, []byte("one part"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.Publish(path); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if obj := objects["/plinko/manifest.json"]; string(obj.data) != "one part" || obj.parts != 0 {
+		t.Fatalf("object = %q in %d parts", obj.data, obj.parts)
+	}
+}
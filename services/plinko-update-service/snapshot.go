@@ -1,33 +1,81 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"plinko-update-service/manifestsig"
 )
 
 type SnapshotFile struct {
-	Path    string `json:"path"`
-	Size    int64  `json:"size"`
-	SHA256  string `json:"sha256"`
-	Comment string `json:"comment,omitempty"`
+	Path    string            `json:"path"`
+	Size    int64             `json:"size"`
+	SHA256  string            `json:"sha256"`
+	Comment string            `json:"comment,omitempty"`
+	IPFS    *SnapshotFileIPFS `json:"ipfs,omitempty"`
+	// URL is the copy on a name-addressed publisher such as S3.
+	URL string `json:"url,omitempty"`
+}
+
+type SnapshotFileIPFS struct {
+	CID        string `json:"cid"`
+	GatewayURL string `json:"gateway_url,omitempty"`
 }
 
 type SnapshotManifest struct {
 	Version     string         `json:"version"`
+	Block       uint64         `json:"block"`
 	GeneratedAt time.Time      `json:"generated_at"`
 	DBSize      uint64         `json:"db_size"`
 	ChunkSize   uint64         `json:"chunk_size"`
 	SetSize     uint64         `json:"set_size"`
+	Finality    FinalityPolicy `json:"finality"`
+	Layout      AccountLayout  `json:"layout"`
 	Files       []SnapshotFile `json:"files"`
+	// Digest is the dbdigest of database.bin, which a server loading the
+	// snapshot checks before serving it.
+	Digest string `json:"digest,omitempty"`
+	// ChainID, BlockHash and StateRoot anchor database.bin to the chain as
+	// the state after Block. The first delta after the snapshot has
+	// BlockHash as its parent hash.
+	ChainID   uint64       `json:"chain_id,omitempty"`
+	BlockHash *common.Hash `json:"block_hash,omitempty"`
+	StateRoot *common.Hash `json:"state_root,omitempty"`
+}
+
+// ChainAnchor is the chain position of a database: the state after Block
+// on chain ChainID, whose header has Hash and StateRoot.
+type ChainAnchor struct {
+	ChainID   uint64
+	Block     uint64
+	Hash      common.Hash
+	StateRoot common.Hash
+}
+
+// fetchChainAnchor reads the anchor of block from client.
+func fetchChainAnchor(ctx context.Context, client *ethclient.Client, chainID *big.Int, block uint64) (ChainAnchor, error) {
+	header, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(block))
+	if err != nil {
+		return ChainAnchor{}, fmt.Errorf("HeaderByNumber: %w", err)
+	}
+	return ChainAnchor{ChainID: chainID.Uint64(), Block: block, Hash: header.Hash(), StateRoot: header.Root}, nil
 }
 
-func publishSnapshot(cfg Config, dbPath string, dbSize, chunkSize, setSize uint64) (string, error) {
+// publishSnapshot copies the database, the state at anchor, into a new
+// public snapshot with its digest and publishes it through bundler, which
+// retries failed publishes.
+func publishSnapshot(cfg Config, dbPath string, dbSize, chunkSize, setSize uint64, anchor ChainAnchor, digest string, bundler *DeltaBundler) (string, error) {
 	size, hash, err := hashFile(dbPath)
 	if err != nil {
 		return "", fmt.Errorf("hash database: %w", err)
@@ -35,11 +83,7 @@ func publishSnapshot(cfg Config, dbPath string, dbSize, chunkSize, setSize uint6
 
 	version := cfg.SnapshotVersion
 	if version == "" {
-		if len(hash) >= 12 {
-			version = hash[:12]
-		} else {
-			version = hash
-		}
+		version = fmt.Sprintf("block-%06d", anchor.Block)
 	}
 
 	snapshotDir := filepath.Join(cfg.PublicSnapshotsDir(), version)
@@ -51,29 +95,52 @@ func publishSnapshot(cfg Config, dbPath string, dbSize, chunkSize, setSize uint6
 	if err := copyFile(dbPath, destPath); err != nil {
 		return "", fmt.Errorf("copy database to public snapshot: %w", err)
 	}
+	fileEntry := SnapshotFile{
+		Path:   "database.bin",
+		Size:   size,
+		SHA256: hash,
+	}
+	published := bundler.publish(destPath, publishJob{Target: targetSnapshot})
+	if published.CID != "" {
+		fileEntry.IPFS = &SnapshotFileIPFS{CID: published.CID, GatewayURL: published.GatewayURL}
+	}
+	fileEntry.URL = published.URL
 
+	blockHash, stateRoot := anchor.Hash, anchor.StateRoot
 	manifest := SnapshotManifest{
 		Version:     version,
+		Block:       anchor.Block,
+		ChainID:     anchor.ChainID,
+		BlockHash:   &blockHash,
+		StateRoot:   &stateRoot,
 		GeneratedAt: time.Now().UTC(),
 		DBSize:      dbSize,
 		ChunkSize:   chunkSize,
 		SetSize:     setSize,
-		Files: []SnapshotFile{
-			{
-				Path:   "database.bin",
-				Size:   size,
-				SHA256: hash,
-			},
-		},
+		Finality:    cfg.Finality,
+		Layout:      cfg.AccountLayout,
+		Files:       []SnapshotFile{fileEntry},
+		Digest:      digest,
 	}
 
-	if err := writeJSON(filepath.Join(snapshotDir, "manifest.json"), manifest); err != nil {
+	manifestPath := filepath.Join(snapshotDir, "manifest.json")
+	if err := writeJSON(manifestPath, manifest); err != nil {
 		return "", fmt.Errorf("write snapshot manifest: %w", err)
 	}
+	if len(cfg.SigningKeys) > 0 {
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return "", fmt.Errorf("read snapshot manifest: %w", err)
+		}
+		if err := manifestsig.WriteFile(manifestPath, data, manifest.Block, cfg.SigningKeys); err != nil {
+			return "", fmt.Errorf("sign snapshot manifest: %w", err)
+		}
+	}
 
 	if err := updateLatestSnapshotSymlink(cfg.PublicSnapshotsDir(), version); err != nil {
 		return "", fmt.Errorf("update snapshot symlink: %w", err)
 	}
+	bundler.publishSnapshotManifest(manifestPath)
 
 	return version, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	SourceSimulated = "simulated"
+	SourceRPC       = "rpc"
+	SourceTrace     = "trace"
+	SourceReplay    = "replay"
+)
+
+// ChangeSource reports what changed in a single block. Sources describe
+// changes in chain terms (accounts and balances) or, for synthetic data, as
+// raw database entries; the service resolves them against its own database to
+// build DBUpdates, so sources never need access to the database itself.
+type ChangeSource interface {
+	Name() string
+	BlockChanges(ctx context.Context, blockNumber uint64) (*BlockChanges, error)
+}
+
+// BlockChanges is the source-independent result for one block. It is also the
+// on-disk recording format used by recordingSource and replaySource. Hash and
+// ParentHash identify the block in the delta header and StateRoot is the
+// state the block leaves; sources without a chain behind them leave them nil.
+type BlockChanges struct {
+	Block      uint64          `json:"block"`
+	Hash       *common.Hash    `json:"hash,omitempty"`
+	ParentHash *common.Hash    `json:"parent_hash,omitempty"`
+	StateRoot  *common.Hash    `json:"state_root,omitempty"`
+	Accounts   []AccountChange `json:"accounts,omitempty"`
+	Entries    []EntryChange   `json:"entries,omitempty"`
+}
+
+// AccountChange is the post-block state of an account touched in the block.
+// A nil field was not read by the source and leaves the stored entry as is.
+type AccountChange struct {
+	Address  common.Address  `json:"address"`
+	Nonce    *hexutil.Uint64 `json:"nonce,omitempty"`
+	Balance  *hexutil.Big    `json:"balance,omitempty"`
+	CodeHash *common.Hash    `json:"code_hash,omitempty"`
+}
+
+// EntryChange sets a database entry directly, bypassing the address mapping.
+type EntryChange struct {
+	Index uint64  `json:"index"`
+	Value DBEntry `json:"value"`
+}
+
+// simulatedSource emits deterministic fake updates so the pipeline can run
+// without an Ethereum endpoint.
+type simulatedSource struct {
+	dbSize uint64
+}
+
+func newSimulatedSource(dbSize uint64) *simulatedSource {
+	return &simulatedSource{dbSize: dbSize}
+}
+
+func (s *simulatedSource) Name() string { return SourceSimulated }
+
+func (s *simulatedSource) BlockChanges(ctx context.Context, block uint64) (*BlockChanges, error) {
+	changes := &BlockChanges{Block: block}
+	if s.dbSize == 0 {
+		return changes, nil
+	}
+	changes.Entries = make([]EntryChange, ChangesPerBlock)
+	for i := 0; i < ChangesPerBlock; i++ {
+		changes.Entries[i] = EntryChange{
+			Index: (block*uint64(ChangesPerBlock) + uint64(i)) % s.dbSize,
+			Value: DBEntry{block*1000 + uint64(i)},
+		}
+	}
+	return changes, nil
+}
+
+// rpcSource reads touched accounts from an Ethereum endpoint and fetches
+// the post-block value of every field in the account layout in batches.
+// With tracing enabled it is the "trace" source, otherwise it uses the tx
+// from/to heuristic ("rpc").
+type rpcSource struct {
+	client  *ethclient.Client
+	signer  types.Signer
+	tracer  *traceDetector
+	fetcher *AccountFetcher
+	limiter *tokenBucket
+	layout  AccountLayout
+	tracked map[string]uint64
+}
+
+func newRPCSource(client *ethclient.Client, chainID *big.Int, tracked map[string]uint64, layout AccountLayout, trace bool, fetcher *AccountFetcher, limiter *tokenBucket) *rpcSource {
+	return &rpcSource{
+		client:  client,
+		signer:  types.LatestSignerForChainID(chainID),
+		tracer:  newTraceDetector(client, trace, limiter),
+		fetcher: fetcher,
+		limiter: limiter,
+		layout:  layout,
+		tracked: tracked,
+	}
+}
+
+func (s *rpcSource) Name() string {
+	if s.tracer.Enabled() {
+		return SourceTrace
+	}
+	return SourceRPC
+}
+
+func (s *rpcSource) BlockChanges(ctx context.Context, blockNumber uint64) (*BlockChanges, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	block, err := s.client.BlockByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+	if err != nil {
+		return nil, fmt.Errorf("BlockByNumber: %w", err)
+	}
+
+	var addresses []common.Address
+	for _, addrHex := range sortedAddresses(s.tracer.touchedAddresses(ctx, block, s.signer)) {
+		if _, ok := s.tracked[addrHex]; ok {
+			addresses = append(addresses, common.HexToAddress(addrHex))
+		}
+	}
+
+	hash, parent, root := block.Hash(), block.ParentHash(), block.Root()
+	changes := &BlockChanges{Block: blockNumber, Hash: &hash, ParentHash: &parent, StateRoot: &root}
+	if len(addresses) == 0 {
+		return changes, nil
+	}
+
+	var (
+		nonces     map[common.Address]uint64
+		balances   map[common.Address]*big.Int
+		codeHashes map[common.Address]common.Hash
+	)
+	if s.layout.Has(FieldNonce) {
+		if nonces, err = s.fetcher.Nonces(ctx, addresses, block.Number()); err != nil {
+			return nil, err
+		}
+	}
+	if s.layout.Has(FieldBalance) {
+		if balances, err = s.fetcher.Balances(ctx, addresses, block.Number()); err != nil {
+			return nil, err
+		}
+	}
+	if s.layout.Has(FieldCodeHash) {
+		if codeHashes, err = s.fetcher.CodeHashes(ctx, addresses, block.Number()); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, addr := range addresses {
+		change := AccountChange{Address: addr}
+		if nonce, ok := nonces[addr]; ok {
+			change.Nonce = (*hexutil.Uint64)(&nonce)
+		}
+		if balance, ok := balances[addr]; ok {
+			change.Balance = (*hexutil.Big)(balance)
+		}
+		if hash, ok := codeHashes[addr]; ok {
+			change.CodeHash = &hash
+		}
+		changes.Accounts = append(changes.Accounts, change)
+	}
+	return changes, nil
+}
+
+// recordingSource wraps another source and writes every result to dir so a
+// live session can later be replayed offline with replaySource.
+type recordingSource struct {
+	inner ChangeSource
+	dir   string
+}
+
+func newRecordingSource(inner ChangeSource, dir string) (*recordingSource, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create record dir: %w", err)
+	}
+	return &recordingSource{inner: inner, dir: dir}, nil
+}
+
+func (r *recordingSource) Name() string { return r.inner.Name() }
+
+func (r *recordingSource) BlockChanges(ctx context.Context, block uint64) (*BlockChanges, error) {
+	changes, err := r.inner.BlockChanges(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeJSON(recordingPath(r.dir, block), changes); err != nil {
+		log.Printf("record block %d failed: %v", block, err)
+	}
+	return changes, nil
+}
+
+// replaySource serves BlockChanges previously captured by recordingSource (or
+// hand-written fixtures). A block without a recording is reported as
+// os.ErrNotExist so callers can tell the end of the recording from a failure.
+type replaySource struct {
+	dir string
+}
+
+func newReplaySource(dir string) *replaySource {
+	return &replaySource{dir: dir}
+}
+
+func (r *replaySource) Name() string { return SourceReplay }
+
+func (r *replaySource) BlockChanges(ctx context.Context, block uint64) (*BlockChanges, error) {
+	data, err := os.ReadFile(recordingPath(r.dir, block))
+	if err != nil {
+		return nil, err
+	}
+	var changes BlockChanges
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, fmt.Errorf("decode recording for block %d: %w", block, err)
+	}
+	if changes.Block != block {
+		return nil, fmt.Errorf("recording for block %d holds block %d", block, changes.Block)
+	}
+	return &changes, nil
+}
+
+func recordingPath(dir string, block uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("block-%06d.json", block))
+}
+
+func sortedAddresses(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for addr := range set {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// newChangeSource builds the source selected by cfg.ChangeSource, wrapped in a
+// recorder when cfg.RecordDir is set.
+func newChangeSource(cfg Config, client *ethclient.Client, chainID *big.Int, tracked map[string]uint64, dbSize uint64) (ChangeSource, error) {
+	var source ChangeSource
+	switch strings.ToLower(cfg.ChangeSource) {
+	case SourceSimulated:
+		source = newSimulatedSource(dbSize)
+	case SourceRPC, SourceTrace:
+		if client == nil {
+			return nil, fmt.Errorf("%s source requires an RPC client", cfg.ChangeSource)
+		}
+		limiter := newTokenBucket(float64(cfg.RPCRateLimit), cfg.RPCConcurrency)
+		fetcher := newAccountFetcher(client.Client(), limiter, cfg.RPCBatchSize, cfg.RPCConcurrency, cfg.RPCMaxRetries, defaultRPCRetryBackoff)
+		source = newRPCSource(client, chainID, tracked, cfg.AccountLayout, cfg.ChangeSource == SourceTrace, fetcher, limiter)
+	case SourceReplay:
+		if cfg.ReplayDir == "" {
+			return nil, fmt.Errorf("replay source requires PLINKO_UPDATE_REPLAY_DIR")
+		}
+		source = newReplaySource(cfg.ReplayDir)
+	default:
+		return nil, fmt.Errorf("unknown change source %q", cfg.ChangeSource)
+	}
+	if cfg.RecordDir != "" {
+		return newRecordingSource(source, cfg.RecordDir)
+	}
+	return source, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"plinko-update-service/dbdigest"
+)
+
+// newReplayService returns a service over an 8-entry database replaying the
+// recordings in replayDir, with account 0x10…01 at index 2.
+func newReplayService(t *testing.T, replayDir string) *PlinkoUpdateService {
+	t.Helper()
+	layout, err := parseAccountLayout(LayoutBalance)
+	if err != nil {
+		t.Fatalf("layout: %v", err)
+	}
+	tmp := t.TempDir()
+	cfg := Config{
+		PublicRoot:     tmp,
+		DeltaOutputDir: filepath.Join(tmp, "deltas"),
+		Finality:       FinalityPolicy{Mode: FinalityLatest},
+		AccountLayout:  layout,
+	}
+	if err := os.MkdirAll(cfg.DeltaOutputDir, 0o755); err != nil {
+		t.Fatalf("create delta dir: %v", err)
+	}
+
+	const dbSize = 8
+	chunkSize, setSize := derivePlinkoParams(dbSize)
+	database := make([]uint64, chunkSize*setSize*DBEntryLength)
+	return &PlinkoUpdateService{
+		database:      database,
+		updateManager: NewPlinkoUpdateManager(database, dbSize, chunkSize, setSize),
+		bundler:       NewDeltaBundler(cfg, nil),
+		cfg:           cfg,
+		dbSize:        dbSize,
+		chunkSize:     chunkSize,
+		setSize:       setSize,
+		addressIndex:  map[string]uint64{"0x1000000000000000000000000000000000000001": 2},
+		source:        newReplaySource(replayDir),
+		digest:        dbdigest.FromWords(database, dbSize),
+	}
+}
+
+func TestProcessBlockFromReplay(t *testing.T) {
+	s := newReplayService(t, filepath.Join("testdata", "replay"))
+	cfg := s.cfg
+
+	ctx := context.Background()
+	for block := uint64(1); block <= 2; block++ {
+		if err := s.processBlock(ctx, block); err != nil {
+			t.Fatalf("process block %d: %v", block, err)
+		}
+	}
+
+	delta, err := readDeltaFile(filepath.Join(cfg.DeltaOutputDir, "delta-000001.bin"))
+	if err != nil {
+		t.Fatalf("read delta: %v", err)
+	}
+	if delta.Version != DeltaVersion2 || delta.Dataset != deltaDataset || delta.Block != 1 || delta.Count != 2 {
+		t.Fatalf("block 1 delta header = %+v", delta.DeltaHeader)
+	}
+	if got := s.readDBEntry(2); got != (DBEntry{1000000000000000000}) {
+		t.Fatalf("balance entry = %v", got)
+	}
+	if got := s.readDBEntry(5); got != (DBEntry{3}) {
+		t.Fatalf("raw entry = %v", got)
+	}
+
+	// Block 2 repeats an unchanged balance, so no delta is written.
+	if _, err := os.Stat(filepath.Join(cfg.DeltaOutputDir, "delta-000002.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected no delta for block 2, stat err=%v", err)
+	}
+
+	// The digest kept up with the deltas matches one of the final database.
+	manifest, err := s.bundler.readManifest()
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	digest := dbdigest.FromWords(s.database, s.dbSize)
+	if len(manifest.Deltas) != 1 || manifest.Deltas[0].Digest != digest.Sum() || manifest.Digest != digest.Sum() {
+		t.Fatalf("manifest digests %q %+v, want %s", manifest.Digest, manifest.Deltas, digest.Sum())
+	}
+}
+
+func TestProcessBlocksRetriesFailedBlock(t *testing.T) {
+	replayDir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join("testdata", "replay", "block-000001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(recordingPath(replayDir, 1), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newReplayService(t, replayDir)
+	ctx := context.Background()
+
+	// Block 2 has no recording yet: processing stops before it.
+	if last := s.processBlocks(ctx, 0, 3); last != 1 {
+		t.Fatalf("processed through block %d, want 1", last)
+	}
+	for block := uint64(2); block <= 3; block++ {
+		changes := &BlockChanges{Block: block, Entries: []EntryChange{{Index: block + 2, Value: DBEntry{block}}}}
+		if err := writeJSON(recordingPath(replayDir, block), changes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Block 2's delta cannot be saved: its updates are undone so that the
+	// retry computes the same delta.
+	deltaDir := s.cfg.DeltaOutputDir
+	s.cfg.DeltaOutputDir = filepath.Join(replayDir, "block-000001.json")
+	if last := s.processBlocks(ctx, 1, 3); last != 1 {
+		t.Fatalf("processed through block %d, want 1", last)
+	}
+	if got := s.readDBEntry(4); got != (DBEntry{}) {
+		t.Fatalf("entry 4 = %v after a failed block", got)
+	}
+	if digest := dbdigest.FromWords(s.database, s.dbSize); s.digest.Sum() != digest.Sum() {
+		t.Fatalf("digest %s after a failed block, want %s", s.digest.Sum(), digest.Sum())
+	}
+
+	s.cfg.DeltaOutputDir = deltaDir
+	if last := s.processBlocks(ctx, 1, 3); last != 3 {
+		t.Fatalf("processed through block %d, want 3", last)
+	}
+	delta, err := readDeltaFile(filepath.Join(deltaDir, "delta-000002.bin"))
+	if err != nil {
+		t.Fatalf("read retried delta: %v", err)
+	}
+	if delta.Count != 1 || delta.Deltas[0].Index != 4 || delta.Deltas[0].Delta != (DBEntry{2}) {
+		t.Fatalf("retried delta = %+v", delta)
+	}
+}
@@ -34,6 +34,34 @@ export class PlinkoClient {
     return null;
   }
 
+  /**
+   * Merge the sealed manifest pages overlapping startBlock-endBlock into
+   * this.manifest. Pages are immutable, so the CDN and browser cache them;
+   * the root manifest lists each with its path.
+   * @param {number} startBlock
+   * @param {number} endBlock
+   */
+  async loadManifestPages(startBlock, endBlock) {
+    const manifest = this.manifest;
+    if (!manifest || !manifest.pages) return;
+    manifest._loadedPages = manifest._loadedPages || new Set();
+    const wanted = manifest.pages.filter(p => p.endBlock >= startBlock && p.startBlock <= endBlock &&
+        !manifest._loadedPages.has(p.path));
+    const pages = await Promise.all(wanted.map(async (info) => {
+      const response = await fetch(`${this.cdnUrl}/deltas/${info.path}`);
+      if (!response.ok) {
+        throw new Error(`Failed to fetch manifest page ${info.path}: ${response.status}`);
+      }
+      return response.json();
+    }));
+
+    const byStart = (a, b) => a.startBlock - b.startBlock;
+    manifest.bundles = pages.flatMap(p => p.bundles || []).concat(manifest.bundles || []);
+    manifest.deltas = pages.flatMap(p => p.deltas || []).concat(manifest.deltas || []);
+    manifest.coverage = pages.flatMap(p => p.coverage || []).concat(manifest.coverage || []).sort(byStart);
+    wanted.forEach(p => manifest._loadedPages.add(p.path));
+  }
+
   /**
    * Discover latest delta block number
    * @returns {Promise<number>} - Latest block with delta file
@@ -133,33 +161,76 @@ export class PlinkoClient {
 
   /**
    * Parse delta file(s)
-   * Supports single delta file or concatenated bundle
+   * Supports single delta file or concatenated bundle, in either the
+   * versioned format (magic "PLKD") or the original 16-byte-header format
    */
   parseDeltas(buffer) {
     const allDeltas = [];
     let offset = 0;
     const view = new DataView(buffer.buffer, buffer.byteOffset, buffer.byteLength);
+    const end = this._bundleDeltasEnd(view);
 
-    while (offset < buffer.byteLength) {
-        if (buffer.byteLength - offset < 16) break;
-        
-        const count = Number(view.getBigUint64(offset, true));
-        const size = 16 + count * 40;
-        
-        if (offset + size > buffer.byteLength) {
+    while (offset < end) {
+        const layout = this._deltaLayout(view, offset);
+        if (!layout) break;
+
+        if (offset + layout.size > end) {
             console.warn("Truncated delta bundle");
             break;
         }
-        
-        const fileData = new Uint8Array(buffer.buffer, buffer.byteOffset + offset, size);
+
+        const fileData = new Uint8Array(buffer.buffer, buffer.byteOffset + offset, layout.size);
         const deltas = this._parseSingleDeltaFile(fileData);
         allDeltas.push(...deltas);
-        
-        offset += size;
+
+        offset += layout.size;
     }
     return allDeltas;
   }
 
+  /**
+   * Indexed bundles end with a block index and a 24-byte trailer
+   * (index offset u64, count u32, entry size u16, version u16, reserved u32,
+   * magic "PLKB"); the delta files stop at the index offset.
+   */
+  _bundleDeltasEnd(view) {
+    const size = view.byteLength;
+    if (size < 24 || view.getUint32(size - 4, false) !== 0x504c4b42) { // "PLKB"
+      return size;
+    }
+    const indexOffset = Number(view.getBigUint64(size - 24, true));
+    return indexOffset <= size - 24 ? indexOffset : size;
+  }
+
+  /**
+   * Locate the records of the delta file starting at offset.
+   * Version 2: 128-byte header (magic, version, header size, record width,
+   * dataset, block, block hash, parent hash, count), records, 32-byte SHA-256.
+   * Version 1: 16-byte header (count, reserved), records.
+   */
+  _deltaLayout(view, offset) {
+    const remaining = view.byteLength - offset;
+    const isV2 = remaining >= 4 &&
+      view.getUint32(offset, false) === 0x504c4b44; // "PLKD"
+
+    if (isV2) {
+      if (remaining < 128) return null;
+      const version = view.getUint16(offset + 4, true);
+      const headerSize = view.getUint16(offset + 6, true);
+      const width = view.getUint32(offset + 8, true);
+      if (version !== 2 || width !== 32) {
+        console.warn(`Unsupported delta file (version ${version}, record width ${width})`);
+        return null;
+      }
+      const count = Number(view.getBigUint64(offset + 120, true));
+      return { headerSize, count, size: headerSize + count * 40 + 32 };
+    }
+
+    if (remaining < 16) return null;
+    const count = Number(view.getBigUint64(offset, true));
+    return { headerSize: 16, count, size: 16 + count * 40 };
+  }
+
   _parseSingleDeltaFile(deltaData) {
     if (!deltaData || !deltaData.buffer) {
       console.warn('Invalid delta data');
@@ -169,13 +240,12 @@ export class PlinkoClient {
     // Use byteOffset and byteLength to handle subarrays correctly
     const view = new DataView(deltaData.buffer, deltaData.byteOffset, deltaData.byteLength);
 
-    if (view.byteLength < 16) {
-      console.warn(`Delta file too short (no header). Length: ${view.byteLength}`);
+    const layout = this._deltaLayout(view, 0);
+    if (!layout) {
+      console.warn(`Delta file too short or unsupported. Length: ${view.byteLength}`);
       return [];
     }
-
-    const count = Number(view.getBigUint64(0, true));
-    const expectedSize = 16 + count * 40;
+    const { headerSize, count, size: expectedSize } = layout;
 
     if (view.byteLength < expectedSize) {
       console.warn(`Delta file truncated. Expected ${expectedSize} bytes, got ${view.byteLength} bytes. Count: ${count}`);
@@ -183,7 +253,7 @@ export class PlinkoClient {
     }
 
     const deltas = [];
-    let offset = 16; // Skip header
+    let offset = headerSize; // Skip header
 
     for (let i = 0; i < count; i++) {
       // Read 32-byte delta (4 * uint64)
@@ -217,6 +287,15 @@ export class PlinkoClient {
     if (!this.manifest) {
         await this.fetchManifest();
     }
+    await this.loadManifestPages(startBlock, endBlock);
+
+    // Past the end of the manifest's coverage blocks were never processed,
+    // so the deltas there are incomplete. Stop short of the gap.
+    const covered = this.coveredThrough(startBlock);
+    if (covered !== null && covered < endBlock) {
+        console.warn(`Deltas cover blocks ${startBlock}-${covered} only, stopping there`);
+        endBlock = covered;
+    }
 
     while (current <= endBlock) {
         // Check for bundle
@@ -249,6 +328,15 @@ export class PlinkoClient {
              }
         }
 
+        // Unbundled blocks that are covered but list no delta had no changes.
+        if (covered !== null && this.manifest.nextBundle && current >= this.manifest.nextBundle &&
+            !(this.manifest.deltas || []).some(d => d.block === current)) {
+            this.currentBlock = current;
+            localStorage.setItem('plinko_current_block', String(current));
+            current++;
+            continue;
+        }
+
         // Individual delta
         try {
             // Download delta
@@ -285,11 +373,40 @@ export class PlinkoClient {
     return totalDeltas;
   }
 
+  /**
+   * Last block of the contiguous manifest coverage starting at or before
+   * `from` (see coverage.go in the state-syncer), `from - 1` when `from` is
+   * not covered, or null when the manifest predates coverage.
+   * @param {number} from - First block to sync
+   * @returns {number|null}
+   */
+  coveredThrough(from) {
+      const coverage = this.manifest && this.manifest.coverage;
+      if (!coverage) return null;
+      let end = null;
+      for (const r of coverage) {
+          if (end !== null) {
+              if (r.startBlock !== end + 1) break;
+              end = r.endBlock;
+          } else if (r.startBlock <= from && from <= r.endBlock) {
+              end = r.endBlock;
+          }
+      }
+      return end === null ? from - 1 : end;
+  }
+
   findBundle(start, end) {
       if (!this.manifest || !this.manifest.bundles) return null;
-      // Find a bundle that starts at 'start' and fits within 'end'
-      // Prefer largest bundle?
-      return this.manifest.bundles.find(b => b.startBlock === start && b.endBlock <= end);
+      // Find the largest bundle that starts at 'start' and fits within 'end'.
+      // Compacted levels (see manifest.bundleLevels) nest, so taking the
+      // largest one each time gives the shortest cover.
+      let best = null;
+      for (const b of this.manifest.bundles) {
+          if (b.startBlock === start && b.endBlock <= end && (!best || b.endBlock > best.endBlock)) {
+              best = b;
+          }
+      }
+      return best;
   }
 
   async downloadBundle(bundle) {
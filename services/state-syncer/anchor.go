@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ChainAnchor ties a database state to the chain: it is the state after
+// Block on chain ChainID, whose header has Hash and StateRoot. Without a
+// chain behind the source (simulated and replay sources without hashes)
+// only Block is set.
+type ChainAnchor struct {
+	ChainID   uint64
+	Block     uint64
+	Hash      common.Hash
+	StateRoot common.Hash
+}
+
+// fetchChainAnchor reads the anchor of block from client. With no client
+// the anchor carries only the block number.
+func fetchChainAnchor(ctx context.Context, client *ethclient.Client, limiter *tokenBucket, chainID *big.Int, block uint64) (ChainAnchor, error) {
+	anchor := ChainAnchor{Block: block}
+	if client == nil {
+		return anchor, nil
+	}
+	header, err := blockHeader(ctx, client, limiter, block)
+	if err != nil {
+		return anchor, err
+	}
+	anchor.ChainID = chainID.Uint64()
+	anchor.Hash, anchor.StateRoot = header.Hash(), header.Root
+	return anchor, nil
+}
+
+// anchorSource returns the anchor of a block. openSyncer asks it for the
+// block its database recovered.
+type anchorSource func(block uint64) (ChainAnchor, error)
+
+// chainAnchors returns an anchorSource reading headers from client, or
+// carrying only block numbers without one.
+func chainAnchors(ctx context.Context, client *ethclient.Client, limiter *tokenBucket, chainID *big.Int) anchorSource {
+	return func(block uint64) (ChainAnchor, error) {
+		return fetchChainAnchor(ctx, client, limiter, chainID, block)
+	}
+}
+
+// advance returns the anchor after applying changes, the changes of the
+// block after a.
+func (a ChainAnchor) advance(changes *BlockChanges) ChainAnchor {
+	next := ChainAnchor{ChainID: a.ChainID, Block: changes.Block}
+	if changes.Hash != nil {
+		next.Hash = *changes.Hash
+	}
+	if changes.StateRoot != nil {
+		next.StateRoot = *changes.StateRoot
+	}
+	return next
+}
+
+// hashField returns h for an omitempty manifest field, nil when unknown.
+func hashField(h common.Hash) *common.Hash {
+	if h == (common.Hash{}) {
+		return nil
+	}
+	return &h
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSnapshotAnchorsChain(t *testing.T) {
+	replayDir := t.TempDir()
+	s := newTestSyncer(t, newReplaySource(replayDir), LayoutAccount)
+	s.cfg.SnapshotEvery = 1
+	s.head = ChainAnchor{ChainID: 1, Hash: common.Hash{0xb0}}
+
+	hash := func(block uint64) *common.Hash { return &common.Hash{0xb0 + byte(block)} }
+	root := func(block uint64) *common.Hash { return &common.Hash{0x50 + byte(block)} }
+	for block := uint64(1); block <= 3; block++ {
+		changes := &BlockChanges{Block: block, Hash: hash(block), ParentHash: hash(block - 1), StateRoot: root(block)}
+		if block == 1 {
+			changes.Entries = []EntryChange{{Index: 3, Value: DBEntry{1}}}
+		}
+		if err := writeJSON(recordingPath(replayDir, block), changes); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+	}
+	for block := uint64(1); block <= 3; block++ {
+		if err := s.ProcessBlock(context.Background(), block); err != nil {
+			t.Fatalf("block %d: %v", block, err)
+		}
+	}
+
+	var manifest SnapshotManifest
+	data, err := os.ReadFile(filepath.Join(s.cfg.SnapshotsRoot(), "block-000001", "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ChainID != 1 || manifest.BlockHash == nil || *manifest.BlockHash != *hash(1) || manifest.StateRoot == nil || *manifest.StateRoot != *root(1) {
+		t.Fatalf("snapshot anchor: chain %d, hash %v, root %v", manifest.ChainID, manifest.BlockHash, manifest.StateRoot)
+	}
+
+	// Block 2 changed nothing but is the first after the snapshot, so it
+	// is published to carry the link; block 3 is not.
+	file, err := readDeltaFile(filepath.Join(s.cfg.DeltaDir, "delta-000002.bin"))
+	if err != nil {
+		t.Fatalf("read delta: %v", err)
+	}
+	if file.ParentHash != *manifest.BlockHash || len(file.Deltas) != 0 {
+		t.Fatalf("delta 2: parent %s, %d deltas", file.ParentHash, len(file.Deltas))
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.DeltaDir, "delta-000003.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected no delta for block 3, stat err=%v", err)
+	}
+	if s.head.Block != 3 || s.head.Hash != *hash(3) {
+		t.Fatalf("head = %+v", s.head)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Indexed bundle format. A bundle is its delta files concatenated in block
+// order, followed by an index and a fixed-size trailer:
+//
+//	deltas   delta files, back to back
+//	index    count entries of bundleIndexEntrySize bytes:
+//	           u64       block number
+//	           u64       offset of the block's delta file in the bundle
+//	           u64       length of the delta file
+//	           [32]byte  SHA-256 of the delta file
+//	           [32]byte  block hash from the delta header
+//	trailer  bundleTrailerSize bytes:
+//	           u64       index offset
+//	           u32       entry count
+//	           u16       entry size
+//	           u16       version (1)
+//	           u32       reserved, zero
+//	           [4]byte   magic "PLKB"
+//
+// A client reads the trailer with a suffix Range request, then the index,
+// then exactly the blocks it needs. Every block in the bundle's range has
+// an entry; blocks without changes have no delta file and an entry of
+// length zero, with the hash of empty input. Readers that predate the
+// index stop at the deltas: decodeDeltaBundle strips it, and an unindexed
+// bundle has no trailer.
+const (
+	bundleMagic          = "PLKB"
+	bundleIndexVersion   = 1
+	bundleIndexEntrySize = 88
+	bundleTrailerSize    = 24
+)
+
+// BundleIndexEntry locates one block's delta file inside a bundle.
+type BundleIndexEntry struct {
+	Block     uint64
+	Offset    uint64
+	Length    uint64
+	SHA256    [32]byte
+	BlockHash common.Hash
+}
+
+// bundleDelta is one delta file going into a bundle, or an empty block when
+// Data is nil. The block is given separately because version 1 headers do
+// not carry it.
+type bundleDelta struct {
+	Block uint64
+	Data  []byte
+}
+
+// encodeBundle concatenates deltas, which must be in block order, and
+// appends their index.
+func encodeBundle(deltas []bundleDelta) ([]byte, error) {
+	var buf bytes.Buffer
+	entries := make([]BundleIndexEntry, 0, len(deltas))
+	for _, delta := range deltas {
+		data := delta.Data
+		if data == nil {
+			entries = append(entries, BundleIndexEntry{
+				Block:  delta.Block,
+				Offset: uint64(buf.Len()),
+				SHA256: sha256.Sum256(nil),
+			})
+			continue
+		}
+		file, n, err := decodeDelta(data)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", delta.Block, err)
+		}
+		if n != len(data) {
+			return nil, fmt.Errorf("block %d: %d trailing bytes", delta.Block, len(data)-n)
+		}
+		entries = append(entries, BundleIndexEntry{
+			Block:     delta.Block,
+			Offset:    uint64(buf.Len()),
+			Length:    uint64(len(data)),
+			SHA256:    sha256.Sum256(data),
+			BlockHash: file.BlockHash,
+		})
+		buf.Write(data)
+	}
+
+	indexOffset := uint64(buf.Len())
+	var entry [bundleIndexEntrySize]byte
+	for _, e := range entries {
+		binary.LittleEndian.PutUint64(entry[0:8], e.Block)
+		binary.LittleEndian.PutUint64(entry[8:16], e.Offset)
+		binary.LittleEndian.PutUint64(entry[16:24], e.Length)
+		copy(entry[24:56], e.SHA256[:])
+		copy(entry[56:88], e.BlockHash[:])
+		buf.Write(entry[:])
+	}
+
+	var trailer [bundleTrailerSize]byte
+	binary.LittleEndian.PutUint64(trailer[0:8], indexOffset)
+	binary.LittleEndian.PutUint32(trailer[8:12], uint32(len(entries)))
+	binary.LittleEndian.PutUint16(trailer[12:14], bundleIndexEntrySize)
+	binary.LittleEndian.PutUint16(trailer[14:16], bundleIndexVersion)
+	copy(trailer[20:24], bundleMagic)
+	buf.Write(trailer[:])
+	return buf.Bytes(), nil
+}
+
+// parseBundleTrailer decodes the last bundleTrailerSize bytes of a bundle
+// of the given size. ok is false for bundles without an index.
+func parseBundleTrailer(trailer []byte, size uint64) (indexOffset uint64, count uint32, ok bool, err error) {
+	if len(trailer) != bundleTrailerSize || string(trailer[20:24]) != bundleMagic {
+		return 0, 0, false, nil
+	}
+	indexOffset = binary.LittleEndian.Uint64(trailer[0:8])
+	count = binary.LittleEndian.Uint32(trailer[8:12])
+	if v := binary.LittleEndian.Uint16(trailer[14:16]); v != bundleIndexVersion {
+		return 0, 0, false, fmt.Errorf("unsupported bundle index version %d", v)
+	}
+	if w := binary.LittleEndian.Uint16(trailer[12:14]); w != bundleIndexEntrySize {
+		return 0, 0, false, fmt.Errorf("unsupported bundle index entry size %d", w)
+	}
+	if size < bundleTrailerSize || indexOffset > size ||
+		indexOffset+uint64(count)*bundleIndexEntrySize != size-bundleTrailerSize {
+		return 0, 0, false, errors.New("bundle index does not fit the bundle")
+	}
+	return indexOffset, count, true, nil
+}
+
+// parseBundleIndex decodes count index entries and checks that they cover
+// deltas of at most indexOffset bytes.
+func parseBundleIndex(data []byte, count uint32, indexOffset uint64) ([]BundleIndexEntry, error) {
+	if uint64(len(data)) != uint64(count)*bundleIndexEntrySize {
+		return nil, errors.New("bundle index truncated")
+	}
+	entries := make([]BundleIndexEntry, count)
+	for i := range entries {
+		rec := data[i*bundleIndexEntrySize : (i+1)*bundleIndexEntrySize]
+		e := &entries[i]
+		e.Block = binary.LittleEndian.Uint64(rec[0:8])
+		e.Offset = binary.LittleEndian.Uint64(rec[8:16])
+		e.Length = binary.LittleEndian.Uint64(rec[16:24])
+		copy(e.SHA256[:], rec[24:56])
+		copy(e.BlockHash[:], rec[56:88])
+		if e.Offset > indexOffset || e.Length > indexOffset-e.Offset {
+			return nil, fmt.Errorf("bundle index entry %d out of range", i)
+		}
+	}
+	return entries, nil
+}
+
+// splitBundle separates a bundle read in full into its deltas and index.
+// Unindexed bundles return all of data and a nil index.
+func splitBundle(data []byte) ([]byte, []BundleIndexEntry, error) {
+	if len(data) < bundleTrailerSize {
+		return data, nil, nil
+	}
+	indexOffset, count, ok, err := parseBundleTrailer(data[len(data)-bundleTrailerSize:], uint64(len(data)))
+	if err != nil || !ok {
+		return data, nil, err
+	}
+	entries, err := parseBundleIndex(data[indexOffset:len(data)-bundleTrailerSize], count, indexOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data[:indexOffset], entries, nil
+}
+
+// readBundleIndex reads the index of a bundle through r, as a client would
+// with Range requests.
+func readBundleIndex(r io.ReaderAt, size int64) ([]BundleIndexEntry, error) {
+	if size < bundleTrailerSize {
+		return nil, errors.New("bundle has no index")
+	}
+	trailer := make([]byte, bundleTrailerSize)
+	if _, err := r.ReadAt(trailer, size-bundleTrailerSize); err != nil {
+		return nil, fmt.Errorf("read bundle trailer: %w", err)
+	}
+	indexOffset, count, ok, err := parseBundleTrailer(trailer, uint64(size))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("bundle has no index")
+	}
+	index := make([]byte, uint64(count)*bundleIndexEntrySize)
+	if _, err := r.ReadAt(index, int64(indexOffset)); err != nil {
+		return nil, fmt.Errorf("read bundle index: %w", err)
+	}
+	return parseBundleIndex(index, count, indexOffset)
+}
+
+// readBundleBlock reads and verifies the delta file of the indexed block.
+func readBundleBlock(r io.ReaderAt, entry BundleIndexEntry) (DeltaFile, error) {
+	data := make([]byte, entry.Length)
+	if _, err := r.ReadAt(data, int64(entry.Offset)); err != nil {
+		return DeltaFile{}, fmt.Errorf("read block %d: %w", entry.Block, err)
+	}
+	if sha256.Sum256(data) != entry.SHA256 {
+		return DeltaFile{}, fmt.Errorf("block %d: bundle index hash mismatch", entry.Block)
+	}
+	if entry.Length == 0 {
+		return DeltaFile{DeltaHeader: DeltaHeader{Version: DeltaVersion2, Block: entry.Block}}, nil
+	}
+	file, n, err := decodeDelta(data)
+	if err != nil {
+		return file, fmt.Errorf("block %d: %w", entry.Block, err)
+	}
+	if n != len(data) {
+		return file, fmt.Errorf("block %d: %d trailing bytes", entry.Block, len(data)-n)
+	}
+	return file, nil
+}
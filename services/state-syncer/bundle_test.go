@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestIndexedBundle(t *testing.T) {
+	hash := common.HexToHash("0x1234")
+	v2, err := encodeDelta(DeltaHeader{Dataset: DatasetETH, Block: 12, BlockHash: hash}, []HintDelta{{Index: 3, Delta: DBEntry{4}}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	old := []HintDelta{{Index: 1, Delta: DBEntry{7}}}
+	bundle, err := encodeBundle([]bundleDelta{{Block: 10, Data: encodeDeltaV1(old)}, {Block: 12, Data: v2}})
+	if err != nil {
+		t.Fatalf("encode bundle: %v", err)
+	}
+
+	r := bytes.NewReader(bundle)
+	index, err := readBundleIndex(r, int64(len(bundle)))
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	if len(index) != 2 || index[0].Block != 10 || index[1].Block != 12 || index[1].BlockHash != hash {
+		t.Fatalf("index = %+v", index)
+	}
+	file, err := readBundleBlock(r, index[1])
+	if err != nil || file.Block != 12 || file.Deltas[0].Index != 3 {
+		t.Fatalf("block 12: %+v, %v", file, err)
+	}
+	if file, err := readBundleBlock(r, index[0]); err != nil || !reflect.DeepEqual(file.Deltas, old) {
+		t.Fatalf("block 10: %+v, %v", file, err)
+	}
+
+	// Sequential readers see only the deltas.
+	files, err := decodeDeltaBundle(bundle)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("decode bundle: %d files, %v", len(files), err)
+	}
+
+	corrupt := append([]byte(nil), bundle...)
+	corrupt[index[1].Offset+deltaV2HeaderSize] ^= 1
+	if _, err := readBundleBlock(bytes.NewReader(corrupt), index[1]); err == nil {
+		t.Fatal("corrupted block read")
+	}
+}
+
+func TestSchedulerBundlesEmptyBlocks(t *testing.T) {
+	dir := t.TempDir()
+	bundler := NewDeltaBundler(Config{DeltaDir: dir}, nil)
+	published := map[uint64]bool{51: true, 57: true, 2 * BundleSize: true}
+	// The run starts mid-range, so 1-100 is never bundled.
+	for block := uint64(51); block <= 2*BundleSize+10; block++ {
+		if !published[block] {
+			if err := bundler.RecordEmptyBlock(block); err != nil {
+				t.Fatalf("record %d: %v", block, err)
+			}
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("delta-%06d.bin", block))
+		if err := saveDelta(path, DeltaHeader{Block: block}, []HintDelta{{Index: block, Delta: DBEntry{block}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := bundler.PublishDelta(block, path, ""); err != nil {
+			t.Fatalf("publish %d: %v", block, err)
+		}
+	}
+
+	// A missing delta file that is not an empty block fails the bundle,
+	// which stays scheduled.
+	if err := os.Mkdir(filepath.Join(dir, "delta-000150.bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundler.ScheduleBundles(); err == nil {
+		t.Fatal("bundle with unreadable delta succeeded")
+	}
+	if err := os.Remove(filepath.Join(dir, "delta-000150.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundler.ScheduleBundles(); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+
+	bundle, err := os.ReadFile(filepath.Join(dir, "bundle-000101-000200.bin"))
+	if err != nil {
+		t.Fatalf("read bundle: %v", err)
+	}
+	r := bytes.NewReader(bundle)
+	index, err := readBundleIndex(r, int64(len(bundle)))
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	if len(index) != BundleSize || index[0].Block != 101 || index[BundleSize-1].Length == 0 {
+		t.Fatalf("index = %+v", index)
+	}
+	file, err := readBundleBlock(r, index[0])
+	if err != nil || file.Block != 101 || len(file.Deltas) != 0 {
+		t.Fatalf("empty block: %+v, %v", file, err)
+	}
+
+	var manifest Manifest
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if len(manifest.Bundles) != 1 || manifest.Bundles[0].StartBlock != 101 || !manifest.Bundles[0].Indexed {
+		t.Fatalf("manifest bundles=%+v", manifest.Bundles)
+	}
+	if manifest.LatestBlock != 2*BundleSize+10 || manifest.NextBundle != 2*BundleSize+1 || len(manifest.Deltas) != 2 {
+		t.Fatalf("manifest latest=%d next=%d deltas=%+v", manifest.LatestBlock, manifest.NextBundle, manifest.Deltas)
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"state-syncer/manifestsig"
 )
 
 const (
@@ -16,149 +21,340 @@ const (
 )
 
 type DeltaBundler struct {
-	cfg           Config
-	ipfsPublisher *IPFSPublisher
-	mu            sync.Mutex
-	latestBlock   uint64
+	cfg       Config
+	publisher Publisher
+	mu        sync.Mutex
+	// wake nudges the bundle scheduler when a bundle boundary is reached.
+	wake chan struct{}
+	// manifest caches the root manifest as last written, and pages the
+	// sealed pages read so far; both are guarded by mu.
+	manifest *Manifest
+	pages    map[uint64]ManifestPage
+	// ipnsDirty is set when the manifest changes after ipnsPublished, the
+	// last time ipnsName was pointed at it; all three are guarded by mu.
+	ipnsDirty     bool
+	ipnsPublished time.Time
+	ipnsName      string
+	// queue holds the failed publishes, loaded on first use and guarded by
+	// queueMu (see publishqueue.go).
+	queueMu sync.Mutex
+	queue   []publishJob
 }
 
 type Manifest struct {
-	LatestBlock uint64       `json:"latestBlock"`
-	Bundles     []BundleInfo `json:"bundles"`
-	Deltas      []DeltaInfo  `json:"deltas,omitempty"`
+	Dataset     string         `json:"dataset,omitempty"`
+	LatestBlock uint64         `json:"latestBlock"`
+	Finality    FinalityPolicy `json:"finality"`
+	Epoch       uint64         `json:"epoch"`
+	Epochs      []EpochInfo    `json:"epochs,omitempty"`
+	NextEpoch   *EpochInfo     `json:"nextEpoch,omitempty"`
+	Bundles     []BundleInfo   `json:"bundles"`
+	Deltas      []DeltaInfo    `json:"deltas,omitempty"`
+	// NextBundle is the first block of the next level 1 bundle the
+	// scheduler will cut; zero until the first block is recorded.
+	NextBundle uint64 `json:"nextBundle,omitempty"`
+	// Coverage lists the processed blocks up to LatestBlock, with a hash
+	// per range (see coverage.go).
+	Coverage []CoverageRange `json:"coverage,omitempty"`
+	// Pages hold the entries of older blocks (see pages.go).
+	Pages []PageInfo `json:"pages,omitempty"`
+	// BundleLevels are the spans of bundle levels 1, 2, …; BundleCover
+	// picks the fewest bundles and deltas for a block range.
+	BundleLevels []uint64 `json:"bundleLevels,omitempty"`
+	// Encodings lists the forms each delta and bundle is published in:
+	// EncodingRaw (.bin) always, EncodingPacked (.zst) when enabled.
+	Encodings []string `json:"encodings,omitempty"`
+	// AddressDeltas lists the blocks that appended accounts to the address
+	// mapping, each with an address-delta-<block>.bin of mapping records.
+	AddressDeltas []DeltaInfo `json:"addressDeltas,omitempty"`
+	// Digest is the dbdigest of the database as of LatestBlock.
+	Digest string `json:"digest,omitempty"`
 }
 
 type BundleInfo struct {
 	StartBlock uint64 `json:"startBlock"`
 	EndBlock   uint64 `json:"endBlock"`
 	CID        string `json:"cid,omitempty"`
+	PackedCID  string `json:"packedCid,omitempty"`
 	URL        string `json:"url,omitempty"`
+	// Level is the bundle's place in BundleLevels, from 1; level 1 bundles
+	// hold every block's delta file, higher levels one coalesced delta
+	// (see compactor.go).
+	Level int `json:"level,omitempty"`
+	// Indexed bundles end with a block index for Range reads (bundle.go).
+	Indexed bool `json:"indexed,omitempty"`
+	// SHA256 and PackedSHA256 are the hex digests of the .bin and .zst
+	// files, which a signed manifest vouches for (see manifestsig).
+	SHA256       string `json:"sha256,omitempty"`
+	PackedSHA256 string `json:"packedSha256,omitempty"`
+	// Digest is the dbdigest of the database after EndBlock, carried over
+	// from the last delta the bundle replaces in the manifest.
+	Digest string `json:"digest,omitempty"`
 }
 
 type DeltaInfo struct {
-	Block uint64 `json:"block"`
-	CID   string `json:"cid"`
+	Block        uint64 `json:"block"`
+	CID          string `json:"cid"`
+	PackedCID    string `json:"packedCid,omitempty"`
+	SHA256       string `json:"sha256,omitempty"`
+	PackedSHA256 string `json:"packedSha256,omitempty"`
+	// Digest is the dbdigest of the database after the block, which a
+	// copy kept current with the deltas should match.
+	Digest string `json:"digest,omitempty"`
 }
 
-func NewDeltaBundler(cfg Config, ipfsPublisher *IPFSPublisher) *DeltaBundler {
+func NewDeltaBundler(cfg Config, publisher Publisher) *DeltaBundler {
 	return &DeltaBundler{
-		cfg:           cfg,
-		ipfsPublisher: ipfsPublisher,
+		cfg:       cfg,
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+		pages:     make(map[uint64]ManifestPage),
 	}
 }
 
-func (b *DeltaBundler) PublishDelta(blockNumber uint64, path string) error {
+// PublishDelta publishes the delta of blockNumber at path and lists it in
+// the manifest with digest, the database digest after the block.
+func (b *DeltaBundler) PublishDelta(blockNumber uint64, path, digest string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	b.latestBlock = blockNumber
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	info := DeltaInfo{Block: blockNumber, SHA256: hex.EncodeToString(sum[:]), Digest: digest}
 
-	// Pin to IPFS
-	var cid string
-	if b.ipfsPublisher != nil {
-		var err error
-		cid, err = b.ipfsPublisher.PublishFile(path)
-		if err != nil {
-			log.Printf("⚠️ Failed to publish delta %d to IPFS: %v", blockNumber, err)
-		} else {
-			log.Printf("🌐 Delta %d pinned to IPFS: %s", blockNumber, cid)
+	job := publishJob{Target: targetDelta, StartBlock: blockNumber}
+	info.CID = b.publish(path, job).CID
+
+	if b.cfg.PackedDeltas {
+		if info.PackedCID, info.PackedSHA256, err = b.publishPacked(path, job); err != nil {
+			log.Printf("⚠️ Failed to pack delta %d: %v", blockNumber, err)
 		}
 	}
 
 	// Update manifest with new delta
-	return b.addDeltaToManifest(blockNumber, cid)
+	return b.addDeltaToManifest(info, sum)
+}
+
+// publishPacked writes the packed form of the raw delta or bundle at path
+// next to it and publishes it as job, returning its CID if pinned and its
+// digest. The raw file stays the reference; a failure here only costs
+// clients the smaller download.
+func (b *DeltaBundler) publishPacked(path string, job publishJob) (cid, digest string, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	packedPath := strings.TrimSuffix(path, filepath.Ext(path)) + packedExt
+	if err := writePacked(packedPath, raw); err != nil {
+		return "", "", err
+	}
+	if _, digest, err = hashFile(packedPath); err != nil {
+		return "", "", err
+	}
+	job.Packed = true
+	return b.publish(packedPath, job).CID, digest, nil
+}
+
+// PublishAddressDelta publishes an address delta and lists it in the manifest.
+func (b *DeltaBundler) PublishAddressDelta(blockNumber uint64, path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, digest, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	info := DeltaInfo{Block: blockNumber, SHA256: digest}
+	info.CID = b.publish(path, publishJob{Target: targetAddressDelta, StartBlock: blockNumber}).CID
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	manifest.AddressDeltas = append(manifest.AddressDeltas, info)
+	return b.writeManifest(manifest)
 }
 
+// EpochState returns the last epoch recorded in the manifest and the
+// announced next one, either of which may be nil.
+func (b *DeltaBundler) EpochState() (current, next *EpochInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if n := len(manifest.Epochs); n > 0 {
+		current = &manifest.Epochs[n-1]
+	}
+	return current, manifest.NextEpoch, nil
+}
+
+// AnnounceEpoch publishes the upcoming epoch so that clients can rehint for
+// it before it activates.
+func (b *DeltaBundler) AnnounceEpoch(info EpochInfo) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	manifest.NextEpoch = &info
+	return b.writeManifest(manifest)
+}
+
+// StartEpoch records a new set of PIR parameters. Clients compare the
+// manifest's epoch with the one their hints were built for and rehint from
+// the epoch's snapshot when it moved.
+func (b *DeltaBundler) StartEpoch(info EpochInfo) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	manifest.Epoch = info.Epoch
+	manifest.Epochs = append(manifest.Epochs, info)
+	if manifest.NextEpoch != nil && manifest.NextEpoch.Epoch <= info.Epoch {
+		manifest.NextEpoch = nil
+	}
+	return b.writeManifest(manifest)
+}
+
+// createBundle cuts the level 1 bundle for startBlock..endBlock, all of
+// which have been processed. Only the manifest update takes the lock.
 func (b *DeltaBundler) createBundle(startBlock, endBlock uint64) error {
 	log.Printf("📦 Creating delta bundle for blocks %d-%d...", startBlock, endBlock)
 
-	var bundleData bytes.Buffer
-
-	// Concatenate deltas
+	// Collect deltas. Blocks without changes have no delta file and get an
+	// empty index entry, so every block in the range is accounted for.
+	var deltas []bundleDelta
 	for i := startBlock; i <= endBlock; i++ {
 		filename := fmt.Sprintf("delta-%06d.bin", i)
 		path := filepath.Join(b.cfg.DeltaDir, filename)
 
 		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			deltas = append(deltas, bundleDelta{Block: i})
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("missing delta file %s: %w", filename, err)
+			return fmt.Errorf("read delta file %s: %w", filename, err)
 		}
-
-		bundleData.Write(data)
+		deltas = append(deltas, bundleDelta{Block: i, Data: data})
+	}
+	bundleData, err := encodeBundle(deltas)
+	if err != nil {
+		return fmt.Errorf("encode bundle: %w", err)
 	}
 
 	// Write bundle file
-	bundleFilename := fmt.Sprintf("bundle-%06d-%06d.bin", startBlock, endBlock)
+	bundleFilename := bundleFilename(startBlock, endBlock)
 	bundlePath := filepath.Join(b.cfg.DeltaDir, bundleFilename)
 
-	if err := os.WriteFile(bundlePath, bundleData.Bytes(), 0644); err != nil {
+	if err := os.WriteFile(bundlePath, bundleData, 0644); err != nil {
 		return fmt.Errorf("failed to write bundle file: %w", err)
 	}
 
-	log.Printf("✅ Bundle created: %s (%.2f MB)", bundleFilename, float64(bundleData.Len())/1024/1024)
+	log.Printf("✅ Bundle created: %s (%.2f MB)", bundleFilename, float64(len(bundleData))/1024/1024)
 
-	// Publish to IPFS
-	var cid string
-	if b.ipfsPublisher != nil {
-		var err error
-		cid, err = b.ipfsPublisher.PublishFile(bundlePath)
-		if err != nil {
-			log.Printf("⚠️ Failed to publish bundle to IPFS: %v", err)
-		} else {
-			log.Printf("🌐 Bundle pinned to IPFS: %s", cid)
-		}
-	}
+	job := publishJob{Target: targetBundle, StartBlock: startBlock, EndBlock: endBlock}
+	published := b.publish(bundlePath, job)
 
-	// Add to manifest
-	if err := b.addBundleToManifest(startBlock, endBlock, cid); err != nil {
-		return err
+	digest := sha256.Sum256(bundleData)
+	info := BundleInfo{
+		StartBlock: startBlock,
+		EndBlock:   endBlock,
+		CID:        published.CID,
+		URL:        published.URL,
+		Level:      1,
+		Indexed:    true,
+		SHA256:     hex.EncodeToString(digest[:]),
 	}
-
-	// Clean up individual deltas from manifest that are now bundled
-	if err := b.cleanupBundledDeltas(endBlock); err != nil {
-		log.Printf("Failed to clean up bundled deltas up to block %d: %v", endBlock, err)
-		// Non-critical error, so we don't return it to allow processing to continue
+	if b.cfg.PackedDeltas {
+		if info.PackedCID, info.PackedSHA256, err = b.publishPacked(bundlePath, job); err != nil {
+			log.Printf("⚠️ Failed to pack bundle %d-%d: %v", startBlock, endBlock, err)
+		}
 	}
 
-	return nil
+	// Add to manifest
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addBundleToManifest(info)
 }
 
-func (b *DeltaBundler) addBundleToManifest(start, end uint64, cid string) error {
+// addBundleToManifest records a new level 1 bundle, moves NextBundle past
+// it and drops the individual deltas in its range from the manifest. The
+// digest of the last of them stays published as the bundle's.
+func (b *DeltaBundler) addBundleToManifest(info BundleInfo) error {
 	manifest, err := b.readManifest()
 	if err != nil {
 		return err
 	}
 
-	// Check if bundle already exists
-	exists := false
-	for i, bundle := range manifest.Bundles {
-		if bundle.StartBlock == start && bundle.EndBlock == end {
-			if cid != "" {
-				manifest.Bundles[i].CID = cid // Update CID if available
-			}
-			exists = true
-			break
+	deltas := make([]DeltaInfo, 0, len(manifest.Deltas))
+	for _, delta := range manifest.Deltas {
+		if delta.Block < info.StartBlock || delta.Block > info.EndBlock {
+			deltas = append(deltas, delta)
+		} else if delta.Digest != "" {
+			info.Digest = delta.Digest
 		}
 	}
+	manifest.Deltas = deltas
 
-	if !exists {
-		manifest.Bundles = append(manifest.Bundles, BundleInfo{
-			StartBlock: start,
-			EndBlock:   end,
-			CID:        cid,
-		})
-		// Sort bundles
-		sort.Slice(manifest.Bundles, func(i, j int) bool {
-			return manifest.Bundles[i].StartBlock < manifest.Bundles[j].StartBlock
-		})
+	mergeBundle(&manifest, info)
+	if info.EndBlock >= manifest.NextBundle {
+		manifest.NextBundle = info.EndBlock + 1
 	}
+	return b.writeManifest(manifest)
+}
 
-	manifest.LatestBlock = b.latestBlock
+// mergeBundle adds info to the manifest, or fills in the CIDs and digests
+// of an existing entry for the same range.
+func mergeBundle(manifest *Manifest, info BundleInfo) {
+	for i, bundle := range manifest.Bundles {
+		if bundle.StartBlock == info.StartBlock && bundle.EndBlock == info.EndBlock {
+			if info.CID != "" {
+				manifest.Bundles[i].CID = info.CID // Update CID if available
+			}
+			if info.PackedCID != "" {
+				manifest.Bundles[i].PackedCID = info.PackedCID
+			}
+			if info.URL != "" {
+				manifest.Bundles[i].URL = info.URL
+			}
+			if info.SHA256 != "" {
+				manifest.Bundles[i].SHA256 = info.SHA256
+			}
+			if info.PackedSHA256 != "" {
+				manifest.Bundles[i].PackedSHA256 = info.PackedSHA256
+			}
+			if info.Digest != "" {
+				manifest.Bundles[i].Digest = info.Digest
+			}
+			return
+		}
+	}
 
-	return b.writeManifest(manifest)
+	manifest.Bundles = append(manifest.Bundles, info)
+	// Sort bundles, larger levels first where they share a start block
+	sort.Slice(manifest.Bundles, func(i, j int) bool {
+		a, b := manifest.Bundles[i], manifest.Bundles[j]
+		if a.StartBlock != b.StartBlock {
+			return a.StartBlock < b.StartBlock
+		}
+		return a.EndBlock > b.EndBlock
+	})
 }
 
-func (b *DeltaBundler) addDeltaToManifest(block uint64, cid string) error {
+func (b *DeltaBundler) addDeltaToManifest(info DeltaInfo, digest [32]byte) error {
 	manifest, err := b.readManifest()
 	if err != nil {
 		return err
@@ -167,66 +363,60 @@ func (b *DeltaBundler) addDeltaToManifest(block uint64, cid string) error {
 	// Check if delta already exists
 	exists := false
 	for i, delta := range manifest.Deltas {
-		if delta.Block == block {
-			if cid != "" {
-				manifest.Deltas[i].CID = cid
+		if delta.Block == info.Block {
+			if info.CID == "" {
+				info.CID = delta.CID
 			}
+			if info.PackedCID == "" {
+				info.PackedCID = delta.PackedCID
+			}
+			manifest.Deltas[i] = info
 			exists = true
 			break
 		}
 	}
 
 	if !exists {
-		manifest.Deltas = append(manifest.Deltas, DeltaInfo{
-			Block: block,
-			CID:   cid,
-		})
+		manifest.Deltas = append(manifest.Deltas, info)
 		// Sort deltas
 		sort.Slice(manifest.Deltas, func(i, j int) bool {
 			return manifest.Deltas[i].Block < manifest.Deltas[j].Block
 		})
 	}
 
-	manifest.LatestBlock = b.latestBlock
-
-	// Save manifest BEFORE triggering bundle creation
-	if err := b.writeManifest(manifest); err != nil {
-		return err
-	}
-
-	// Trigger bundle creation if needed
-	if block > 0 && block%BundleSize == 0 {
-		startBlock := block - BundleSize + 1
-		endBlock := block
-
-		if err := b.createBundle(startBlock, endBlock); err != nil {
-			log.Printf("Failed to create bundle %d-%d: %v", startBlock, endBlock, err)
-			// Do not return error, as delta was successfully added
-		}
+	if info.Digest != "" && info.Block >= manifest.LatestBlock {
+		manifest.Digest = info.Digest
 	}
-
-	return nil
+	b.advance(&manifest, info.Block, digest)
+	return b.writeManifest(manifest)
 }
 
-func (b *DeltaBundler) cleanupBundledDeltas(bundledUpTo uint64) error {
-	manifest, err := b.readManifest()
-	if err != nil {
-		return err
-	}
-
-	// Filter out deltas that are <= bundledUpTo
-	newDeltas := make([]DeltaInfo, 0)
-	for _, delta := range manifest.Deltas {
-		if delta.Block > bundledUpTo {
-			newDeltas = append(newDeltas, delta)
+// readManifest returns a copy of the root manifest that the caller may
+// modify. Only the first call reads the file.
+func (b *DeltaBundler) readManifest() (Manifest, error) {
+	if b.manifest == nil {
+		manifest, err := b.loadManifest()
+		if err != nil {
+			return manifest, err
 		}
+		b.manifest = &manifest
 	}
-	manifest.Deltas = newDeltas
+	return cloneManifest(*b.manifest), nil
+}
 
-	return b.writeManifest(manifest)
+// cloneManifest copies the slices of m so that appending to or sorting the
+// copy leaves m alone.
+func cloneManifest(m Manifest) Manifest {
+	m.Epochs = append([]EpochInfo(nil), m.Epochs...)
+	m.Bundles = append([]BundleInfo(nil), m.Bundles...)
+	m.Deltas = append([]DeltaInfo(nil), m.Deltas...)
+	m.Coverage = append([]CoverageRange(nil), m.Coverage...)
+	m.Pages = append([]PageInfo(nil), m.Pages...)
+	m.AddressDeltas = append([]DeltaInfo(nil), m.AddressDeltas...)
+	return m
 }
 
-func (b *DeltaBundler) readManifest() (Manifest, error) {
+func (b *DeltaBundler) loadManifest() (Manifest, error) {
 	manifestPath := filepath.Join(b.cfg.DeltaDir, "manifest.json")
 	var manifest Manifest
 	data, err := os.ReadFile(manifestPath)
@@ -247,6 +437,16 @@ func (b *DeltaBundler) readManifest() (Manifest, error) {
 
 func (b *DeltaBundler) writeManifest(manifest Manifest) error {
 	manifestPath := filepath.Join(b.cfg.DeltaDir, "manifest.json")
+	manifest.Dataset = b.cfg.Dataset
+	manifest.Finality = b.cfg.Finality
+	manifest.BundleLevels = BundleLevels
+	manifest.Encodings = []string{EncodingRaw}
+	if b.cfg.PackedDeltas {
+		manifest.Encodings = append(manifest.Encodings, EncodingPacked)
+	}
+	if err := b.sealPages(&manifest); err != nil {
+		return err
+	}
 
 	data, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
@@ -286,5 +486,18 @@ func (b *DeltaBundler) writeManifest(manifest Manifest) error {
 		return fmt.Errorf("failed to rename manifest file: %w", err)
 	}
 
+	// The signatures follow the manifest; a client that catches the two
+	// mid-update sees a digest mismatch and refetches.
+	b.manifest = &manifest
+	b.ipnsDirty = true
+	if err := manifestsig.WriteFile(manifestPath, data, manifest.LatestBlock, b.cfg.SigningKeys); err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	if b.publisher != nil {
+		if err := updateSigned(b.publisher, manifestPath, len(b.cfg.SigningKeys) > 0); err != nil {
+			log.Printf("⚠️ Failed to publish manifest to %s: %v", b.publisher.Name(), err)
+		}
+	}
+
 	return nil
 }
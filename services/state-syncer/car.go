@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"state-syncer/manifestsig"
+)
+
+// Snapshots and bundles are published to IPFS as UnixFS DAGs built here
+// rather than by the node, so their CIDs are known offline and the same
+// blocks can be exported as CAR files for pinning services. The layout is
+// what `ipfs add --cid-version=1` produces: 256 KiB raw leaves under
+// balanced dag-pb nodes of at most 174 links.
+const (
+	unixfsChunkSize = 256 << 10
+	unixfsMaxLinks  = 174
+
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+)
+
+var cidEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// dagNode is a built node as its parent links to it.
+type dagNode struct {
+	cid []byte
+	// tsize is the size of the node and everything below it.
+	tsize uint64
+	// fileSize is the number of file bytes below the node.
+	fileSize uint64
+}
+
+// CID returns the node's CID in its usual base32 form.
+func (n dagNode) CID() string {
+	return "b" + strings.ToLower(cidEncoding.EncodeToString(n.cid))
+}
+
+// blockSink receives each block of a DAG as it is built, children before
+// parents. Building with a nil sink only computes the CIDs.
+type blockSink func(cid, data []byte) error
+
+func putBlock(sink blockSink, codec uint64, data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	cid := binary.AppendUvarint([]byte{1}, codec)
+	cid = append(cid, 0x12, sha256.Size)
+	cid = append(cid, sum[:]...)
+	if sink != nil {
+		if err := sink(cid, data); err != nil {
+			return nil, err
+		}
+	}
+	return cid, nil
+}
+
+func appendPBBytes(buf []byte, field int, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendPBVarint(buf []byte, field int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3))
+	return binary.AppendUvarint(buf, v)
+}
+
+// putPBNode stores a dag-pb node with the given links and UnixFS data.
+// names may be nil for the unnamed links of a file.
+func putPBNode(sink blockSink, links []dagNode, names []string, unixfs []byte) (dagNode, error) {
+	var buf []byte
+	tsize := uint64(0)
+	for i, link := range links {
+		name := ""
+		if names != nil {
+			name = names[i]
+		}
+		var pb []byte
+		pb = appendPBBytes(pb, 1, link.cid)
+		pb = appendPBBytes(pb, 2, []byte(name))
+		pb = appendPBVarint(pb, 3, link.tsize)
+		buf = appendPBBytes(buf, 2, pb)
+		tsize += link.tsize
+	}
+	buf = appendPBBytes(buf, 1, unixfs)
+	cid, err := putBlock(sink, codecDagPB, buf)
+	if err != nil {
+		return dagNode{}, err
+	}
+	return dagNode{cid: cid, tsize: tsize + uint64(len(buf))}, nil
+}
+
+// fileDAG chunks r into a UnixFS file. A file of one chunk or less is just
+// that raw leaf.
+func fileDAG(r io.Reader, sink blockSink) (dagNode, error) {
+	var level []dagNode
+	buf := make([]byte, unixfsChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return dagNode{}, err
+		}
+		if n > 0 || len(level) == 0 {
+			cid, perr := putBlock(sink, codecRaw, buf[:n])
+			if perr != nil {
+				return dagNode{}, perr
+			}
+			level = append(level, dagNode{cid: cid, tsize: uint64(n), fileSize: uint64(n)})
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for len(level) > 1 {
+		var parents []dagNode
+		for start := 0; start < len(level); start += unixfsMaxLinks {
+			children := level[start:min(start+unixfsMaxLinks, len(level))]
+			size := uint64(0)
+			for _, child := range children {
+				size += child.fileSize
+			}
+			unixfs := appendPBVarint(nil, 1, 2) // Type: File
+			unixfs = appendPBVarint(unixfs, 3, size)
+			for _, child := range children {
+				unixfs = appendPBVarint(unixfs, 4, child.fileSize)
+			}
+			node, err := putPBNode(sink, children, nil, unixfs)
+			if err != nil {
+				return dagNode{}, err
+			}
+			node.fileSize = size
+			parents = append(parents, node)
+		}
+		level = parents
+	}
+	return level[0], nil
+}
+
+// dagFiles lists the files a directory DAG is built from: every regular
+// file except manifests and their signatures, which name the DAG root and
+// so cannot be part of it.
+func dagFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, ".tmp") ||
+			name == "manifest.json" || name == "manifest.json"+manifestsig.Suffix {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// buildDAG builds the DAG of path, a file or a directory of dagFiles, and
+// returns its root along with the root of each file in a directory.
+func buildDAG(path string, sink blockSink) (dagNode, map[string]dagNode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return dagNode{}, nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return dagNode{}, nil, err
+		}
+		defer f.Close()
+		node, err := fileDAG(f, sink)
+		return node, nil, err
+	}
+
+	names, err := dagFiles(path)
+	if err != nil {
+		return dagNode{}, nil, err
+	}
+	files := make(map[string]dagNode, len(names))
+	links := make([]dagNode, len(names))
+	for i, name := range names {
+		node, _, err := buildDAG(filepath.Join(path, name), sink)
+		if err != nil {
+			return dagNode{}, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		files[name], links[i] = node, node
+	}
+	root, err := putPBNode(sink, links, names, appendPBVarint(nil, 1, 1)) // Type: Directory
+	return root, files, err
+}
+
+// writeCAR writes the DAG of path to w as a CARv1 file. The root CID goes
+// in the header, so the DAG is built twice: once for the CID and once for
+// the blocks, each block written once.
+func writeCAR(w io.Writer, path string) (dagNode, error) {
+	root, _, err := buildDAG(path, nil)
+	if err != nil {
+		return dagNode{}, err
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	// DAG-CBOR {"roots": [root], "version": 1}; the root is a tag 42 byte
+	// string with a leading zero.
+	header := []byte{0xa2, 0x65}
+	header = append(header, "roots"...)
+	header = append(header, 0x81, 0xd8, 0x2a, 0x58, byte(len(root.cid)+1), 0x00)
+	header = append(header, root.cid...)
+	header = append(header, 0x67)
+	header = append(header, "version"...)
+	header = append(header, 0x01)
+	bw.Write(binary.AppendUvarint(nil, uint64(len(header))))
+	bw.Write(header)
+
+	seen := make(map[string]bool)
+	sink := func(cid, data []byte) error {
+		if seen[string(cid)] {
+			return nil
+		}
+		seen[string(cid)] = true
+		bw.Write(binary.AppendUvarint(nil, uint64(len(cid)+len(data))))
+		bw.Write(cid)
+		_, err := bw.Write(data)
+		return err
+	}
+	again, _, err := buildDAG(path, sink)
+	if err != nil {
+		return dagNode{}, err
+	}
+	if string(again.cid) != string(root.cid) {
+		return dagNode{}, errors.New("content changed while writing CAR")
+	}
+	return root, bw.Flush()
+}
+
+// exportCAR writes the DAG of path to the CAR file out.
+func exportCAR(path, out string) (dagNode, error) {
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return dagNode{}, err
+	}
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return dagNode{}, err
+	}
+	root, err := writeCAR(f, path)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return dagNode{}, err
+	}
+	return root, os.Rename(tmp, out)
+}
+
+// exportCARs writes a CAR file for every snapshot and bundle below root
+// into out, mirroring their paths, and returns the root CID of each CAR by
+// its path below out. CAR files that already exist are kept, since
+// snapshots and bundles never change once written.
+func exportCARs(root, out string) (map[string]string, error) {
+	cars := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var snapshot bool
+		switch {
+		case d.IsDir():
+			if path == out {
+				return filepath.SkipDir
+			}
+			snapshot = filepath.Base(filepath.Dir(path)) == "snapshots"
+			if !snapshot {
+				return nil
+			}
+			if _, err := os.Stat(filepath.Join(path, "manifest.json")); err != nil {
+				return filepath.SkipDir
+			}
+		case d.Type().IsRegular():
+			name := d.Name()
+			if !strings.HasPrefix(name, "bundle-") || (filepath.Ext(name) != ".bin" && filepath.Ext(name) != packedExt) {
+				return nil
+			}
+		default:
+			// The latest snapshot symlink names a snapshot exported anyway.
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		car := filepath.Join(out, rel+".car")
+		if existing, err := os.Open(car); err == nil {
+			node, err := readCARRoot(existing)
+			existing.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", car, err)
+			}
+			cars[rel+".car"] = node.CID()
+		} else {
+			node, err := exportCAR(path, car)
+			if err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			cars[rel+".car"] = node.CID()
+		}
+		if snapshot {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return cars, err
+}
+
+// runExportCAR is the export-car command. It needs no IPFS node: it writes
+// CAR files of every snapshot and bundle under the public root, for bulk
+// upload to pinning services, and prints the root CID of each.
+func runExportCAR(args []string) error {
+	flags := flag.NewFlagSet("export-car", flag.ContinueOnError)
+	root := flags.String("root", getEnv("PLINKO_STATE_PUBLIC_ROOT", "/public"), "public root to export")
+	out := flags.String("out", "", "directory to write the CAR files to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	cars, err := exportCARs(filepath.Clean(*root), filepath.Clean(*out))
+	names := make([]string, 0, len(cars))
+	for name := range cars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s %s\n", cars[name], name)
+	}
+	return err
+}
+
+// readCARRoot returns the single root in the header of a CAR file written
+// by writeCAR.
+func readCARRoot(r io.Reader) (dagNode, error) {
+	br := bufio.NewReader(r)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return dagNode{}, err
+	}
+	header := make([]byte, n)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return dagNode{}, err
+	}
+	prefix := append([]byte{0xa2, 0x65}, "roots"...)
+	prefix = append(prefix, 0x81, 0xd8, 0x2a, 0x58)
+	if len(header) < len(prefix)+2 || string(header[:len(prefix)]) != string(prefix) {
+		return dagNode{}, errors.New("unsupported CAR header")
+	}
+	size := int(header[len(prefix)])
+	start := len(prefix) + 2
+	if size < 2 || start+size-1 > len(header) {
+		return dagNode{}, errors.New("truncated CAR header")
+	}
+	return dagNode{cid: header[start : start+size-1]}, nil
+}
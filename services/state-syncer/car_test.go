@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Known CIDs: "hello world" as a raw block, and the empty UnixFS directory
+// (QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn in CIDv0).
+func TestDAGKnownCIDs(t *testing.T) {
+	leaf, err := fileDAG(strings.NewReader("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaf.CID(); got != "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e" {
+		t.Fatalf("raw leaf CID = %s", got)
+	}
+	dir, _, err := buildDAG(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.CID(); got != "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354" {
+		t.Fatalf("empty directory CID = %s", got)
+	}
+}
+
+type carBlock struct {
+	cid, data []byte
+}
+
+// readCAR reads a CAR file, checking that every block hashes to its CID.
+func readCAR(t *testing.T, path string) (dagNode, []carBlock) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	root, err := readCARRoot(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(f)
+	n, _ := binary.ReadUvarint(r)
+	r.Discard(int(n))
+	var blocks []carBlock
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		// CIDv1, one-byte codec, sha2-256.
+		block := carBlock{cid: buf[:36], data: buf[36:]}
+		if sum := sha256.Sum256(block.data); !bytes.Equal(block.cid[4:], sum[:]) {
+			t.Fatalf("block %s does not match its CID", dagNode{cid: block.cid}.CID())
+		}
+		blocks = append(blocks, block)
+	}
+	return root, blocks
+}
+
+func TestExportCARs(t *testing.T) {
+	root, out := t.TempDir(), t.TempDir()
+	snapshot := filepath.Join(root, "erc20", "snapshots", "block-000100")
+	deltas := filepath.Join(root, "erc20", "deltas")
+	for _, dir := range []string{snapshot, deltas} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Three chunks, so the file gets a dag-pb node over raw leaves.
+	db := make([]byte, 2*unixfsChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(db)
+	files := map[string][]byte{
+		filepath.Join(snapshot, "database.bin"):              db,
+		filepath.Join(snapshot, "token-mapping.bin"):         []byte("mapping"),
+		filepath.Join(snapshot, "manifest.json"):             []byte("{}"),
+		filepath.Join(deltas, "bundle-000001-000100.bin"):    db[:1000],
+		filepath.Join(deltas, "delta-000100.bin"):            []byte("delta"),
+		filepath.Join(root, "erc20", "token-mapping.bin"):    []byte("mapping"),
+		filepath.Join(deltas, "bundle-000001-000100.zst"):    []byte("packed"),
+		filepath.Join(deltas, "bundle-000001-000100.bin.gz"): []byte("other"),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("block-000100", filepath.Join(root, "erc20", "snapshots", "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	cars, err := exportCARs(root, out)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	want := []string{
+		"erc20/deltas/bundle-000001-000100.bin.car",
+		"erc20/deltas/bundle-000001-000100.zst.car",
+		"erc20/snapshots/block-000100.car",
+	}
+	if len(cars) != len(want) {
+		t.Fatalf("exported %v", cars)
+	}
+	for _, name := range want {
+		if cars[name] == "" {
+			t.Fatalf("%s not exported: %v", name, cars)
+		}
+	}
+
+	// The snapshot CAR holds the directory, the manifest left out, with
+	// the file blocks in order.
+	dag, nodes, err := buildDAG(snapshot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carRoot, blocks := readCAR(t, filepath.Join(out, "erc20/snapshots/block-000100.car"))
+	if carRoot.CID() != dag.CID() || cars["erc20/snapshots/block-000100.car"] != dag.CID() {
+		t.Fatalf("root %s, want %s", carRoot.CID(), dag.CID())
+	}
+	if len(nodes) != 2 || nodes["manifest.json"].cid != nil {
+		t.Fatalf("directory files = %v", nodes)
+	}
+	var leaves []byte
+	for _, block := range blocks {
+		if block.cid[1] == codecRaw {
+			leaves = append(leaves, block.data...)
+		}
+	}
+	if !bytes.Equal(leaves, append(append([]byte(nil), db...), "mapping"...)) {
+		t.Fatalf("leaf data differs (%d bytes)", len(leaves))
+	}
+	// Three leaves and a file node, the mapping leaf, the directory.
+	if len(blocks) != 6 || !bytes.Equal(blocks[len(blocks)-1].cid, dag.cid) {
+		t.Fatalf("%d blocks", len(blocks))
+	}
+
+	// A rerun keeps the CAR files already written.
+	bundleCAR := filepath.Join(out, "erc20/deltas/bundle-000001-000100.bin.car")
+	if err := os.WriteFile(filepath.Join(deltas, "bundle-000001-000100.bin"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := exportCARs(root, out)
+	if err != nil {
+		t.Fatalf("re-export: %v", err)
+	}
+	if again["erc20/deltas/bundle-000001-000100.bin.car"] != cars["erc20/deltas/bundle-000001-000100.bin.car"] {
+		t.Fatalf("bundle CAR rewritten")
+	}
+	if _, blocks := readCAR(t, bundleCAR); len(blocks) != 1 || !bytes.Equal(blocks[0].data, db[:1000]) {
+		t.Fatalf("bundle CAR blocks = %d", len(blocks))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Clients generate hints one chunk of ChunkSize entries at a time, so a
+// snapshot can describe database.bin in those chunks: with a SHA-256 per
+// chunk a client can fetch chunks with Range requests in any order, in
+// parallel, verify each as it arrives and resume after an interruption.
+// The files mode also writes each chunk to its own file for mirrors that
+// serve Range requests badly. A chunk is ChunkSize*32 bytes; with chunks of
+// 8192 entries or more that is a whole number of 256 KiB IPFS leaves, so
+// on IPFS the chunk files share their blocks with database.bin.
+const (
+	SnapshotChunksOff   = "off"
+	SnapshotChunksIndex = "index"
+	SnapshotChunksFiles = "files"
+)
+
+// SnapshotChunks lists the chunks of database.bin. Chunk i holds entries
+// [i*Entries, (i+1)*Entries) at byte offset i*Size; the last one may be
+// shorter. Chunks past the end of database.bin hold only empty entries and
+// are not listed.
+type SnapshotChunks struct {
+	Entries uint64 `json:"entries"`
+	Size    int64  `json:"size"`
+	// Files is the name pattern of the chunk files next to database.bin
+	// (fmt syntax, taking the chunk number), empty when there are none.
+	Files  string   `json:"files,omitempty"`
+	SHA256 []string `json:"sha256"`
+}
+
+const chunkFilePattern = "chunk-%06d.bin"
+
+func parseSnapshotChunks(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", SnapshotChunksOff:
+		return SnapshotChunksOff, nil
+	case SnapshotChunksIndex, SnapshotChunksFiles:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown snapshot chunk mode %q (want %s, %s or %s)", value, SnapshotChunksOff, SnapshotChunksIndex, SnapshotChunksFiles)
+}
+
+// writeSnapshotChunks hashes the database.bin in dir chunk by chunk and,
+// in files mode, writes each chunk next to it. It returns nil when mode is
+// off.
+func writeSnapshotChunks(dir string, chunkSize uint64, mode string) (*SnapshotChunks, error) {
+	if mode != SnapshotChunksIndex && mode != SnapshotChunksFiles {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(dir, "database.bin"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunks := &SnapshotChunks{Entries: chunkSize, Size: int64(chunkSize * DBEntrySize)}
+	if mode == SnapshotChunksFiles {
+		chunks.Files = chunkFilePattern
+	}
+	buf := make([]byte, chunks.Size)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		sum := sha256.Sum256(buf[:n])
+		chunks.SHA256 = append(chunks.SHA256, hex.EncodeToString(sum[:]))
+		if chunks.Files != "" {
+			path := filepath.Join(dir, fmt.Sprintf(chunks.Files, i))
+			if err := os.WriteFile(path+".tmp", buf[:n], 0o644); err != nil {
+				return nil, err
+			}
+			if err := os.Rename(path+".tmp", path); err != nil {
+				return nil, err
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return chunks, nil
+}
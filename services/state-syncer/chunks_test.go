@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotChunks(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{PublicRoot: root, DeltaDir: filepath.Join(root, "deltas"), Dataset: DatasetETH, SnapshotChunks: SnapshotChunksFiles}
+	db := make([]uint64, 16*DBEntryLength)
+	for i := range db {
+		db[i] = uint64(i)
+	}
+	// Ten entries in chunks of four: the last chunk is short and the
+	// fourth, past the end of the file, is not listed.
+	version, err := writeSnapshot(cfg, db, 10, ChainAnchor{Block: 1}, 4, 4, 0, "", NewDeltaBundler(cfg, nil))
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	dir := filepath.Join(cfg.SnapshotsRoot(), version)
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	chunks := manifest.Chunks
+	if chunks == nil || chunks.Entries != 4 || chunks.Size != 4*DBEntrySize || len(chunks.SHA256) != 3 {
+		t.Fatalf("chunks = %+v", chunks)
+	}
+
+	database, err := os.ReadFile(filepath.Join(dir, "database.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, digest := range chunks.SHA256 {
+		want := database[int64(i)*chunks.Size : min(int64(i+1)*chunks.Size, int64(len(database)))]
+		if sum := sha256.Sum256(want); digest != hex.EncodeToString(sum[:]) {
+			t.Fatalf("chunk %d digest %s", i, digest)
+		}
+		file, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf(chunks.Files, i)))
+		if err != nil || !bytes.Equal(file, want) {
+			t.Fatalf("chunk file %d: %v", i, err)
+		}
+	}
+
+	// The chunk files are in the snapshot DAG but not in its file list.
+	_, nodes, err := buildDAG(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nodes["chunk-000002.bin"]; !ok || len(manifest.Files) != 1 {
+		t.Fatalf("DAG files %d, manifest files %+v", len(nodes), manifest.Files)
+	}
+
+	// The index mode leaves database.bin whole.
+	cfg.SnapshotChunks = SnapshotChunksIndex
+	chunks, err = writeSnapshotChunks(t.TempDir(), 4, cfg.SnapshotChunks)
+	if err == nil || chunks != nil {
+		t.Fatalf("chunked a missing database: %+v", chunks)
+	}
+	index := t.TempDir()
+	if err := os.WriteFile(filepath.Join(index, "database.bin"), database, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err = writeSnapshotChunks(index, 4, cfg.SnapshotChunks)
+	if err != nil || chunks.Files != "" || len(chunks.SHA256) != 3 || chunks.SHA256[2] != manifest.Chunks.SHA256[2] {
+		t.Fatalf("index chunks = %+v, %v", chunks, err)
+	}
+	if names, _ := dagFiles(index); len(names) != 1 {
+		t.Fatalf("index mode wrote %v", names)
+	}
+}
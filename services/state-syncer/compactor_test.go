@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompactCoalescesBundles(t *testing.T) {
+	levels := BundleLevels
+	BundleLevels = []uint64{100, 200, 400}
+	defer func() { BundleLevels = levels }()
+
+	dir := t.TempDir()
+	bundler := NewDeltaBundler(Config{DeltaDir: dir, Dataset: DatasetETH}, nil)
+
+	// Index 7 changes in every bundle, index 9 changes twice with the same
+	// delta and cancels out, index 100+i changes once in bundle i.
+	for i := uint64(0); i < 4; i++ {
+		start, end := i*100+1, (i+1)*100
+		deltas := []HintDelta{{Index: 7, Delta: DBEntry{1 << i}}, {Index: 100 + i, Delta: DBEntry{i + 1}}}
+		if i < 2 {
+			deltas = append(deltas, HintDelta{Index: 9, Delta: DBEntry{0, 5}})
+		}
+		raw, err := encodeDelta(DeltaHeader{Block: start}, deltas)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		bundle, err := encodeBundle([]bundleDelta{{Block: start, Data: raw}})
+		if err != nil {
+			t.Fatalf("encode bundle: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, bundleFilename(start, end)), bundle, 0o644); err != nil {
+			t.Fatalf("write bundle: %v", err)
+		}
+		if err := bundler.addBundleToManifest(BundleInfo{StartBlock: start, EndBlock: end, Level: 1, Indexed: true}); err != nil {
+			t.Fatalf("manifest: %v", err)
+		}
+	}
+
+	if err := bundler.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	manifest, err := bundler.readManifest()
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var ranges [][3]uint64
+	for _, b := range manifest.Bundles {
+		ranges = append(ranges, [3]uint64{b.StartBlock, b.EndBlock, uint64(b.Level)})
+	}
+	want := [][3]uint64{{1, 400, 3}, {1, 200, 2}, {1, 100, 1}, {101, 200, 1}, {201, 400, 2}, {201, 300, 1}, {301, 400, 1}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("bundles = %v", ranges)
+	}
+
+	file, err := readDeltaFile(filepath.Join(dir, bundleFilename(1, 400)))
+	if err != nil {
+		t.Fatalf("read level 3: %v", err)
+	}
+	wantDeltas := []HintDelta{
+		{Index: 7, Delta: DBEntry{0xf}},
+		{Index: 100, Delta: DBEntry{1}},
+		{Index: 101, Delta: DBEntry{2}},
+		{Index: 102, Delta: DBEntry{3}},
+		{Index: 103, Delta: DBEntry{4}},
+	}
+	if file.Block != 400 || !reflect.DeepEqual(file.Deltas, wantDeltas) {
+		t.Fatalf("level 3 bundle: block %d, %+v", file.Block, file.Deltas)
+	}
+
+	cover := BundleCover(manifest.Bundles, 101, 405)
+	var got [][2]uint64
+	for _, item := range cover {
+		got = append(got, [2]uint64{item.StartBlock, item.EndBlock})
+		if (item.Bundle == nil) != (item.StartBlock > 400) {
+			t.Fatalf("cover item %+v", item)
+		}
+	}
+	if !reflect.DeepEqual(got, [][2]uint64{{101, 200}, {201, 400}, {401, 405}}) {
+		t.Fatalf("cover = %v", got)
+	}
+}
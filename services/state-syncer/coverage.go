@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CoverageRange is a run of consecutive processed blocks, every one of
+// which either published a delta or was recorded as empty. Ranges end at
+// each BundleSize boundary and wherever the syncer skipped blocks, so a
+// block missing from every range was never processed, and a block inside
+// one without a delta file had no changes.
+//
+// Hash chains the blocks of the range in order:
+//
+//	h = 0
+//	h = SHA-256(h || u64 LE block || SHA-256(delta file))
+//
+// with the SHA-256 of empty input for empty blocks, the same digests a
+// bundle index holds. A client that recomputes it from the deltas it
+// applied, or from a bundle index, knows it missed nothing in the range.
+type CoverageRange struct {
+	StartBlock uint64      `json:"startBlock"`
+	EndBlock   uint64      `json:"endBlock"`
+	Hash       common.Hash `json:"hash"`
+}
+
+// emptyBlockDigest is the delta digest of a block without changes.
+var emptyBlockDigest = sha256.Sum256(nil)
+
+// chainCoverage folds one block's delta digest into a range hash.
+func chainCoverage(h common.Hash, block uint64, digest [32]byte) common.Hash {
+	var buf [32 + 8 + 32]byte
+	copy(buf[:32], h[:])
+	binary.LittleEndian.PutUint64(buf[32:40], block)
+	copy(buf[40:], digest[:])
+	return sha256.Sum256(buf[:])
+}
+
+// extendCoverage appends block to the manifest's last coverage range, or
+// opens a new range for it at a bundle boundary or after a gap.
+func extendCoverage(manifest *Manifest, block uint64, digest [32]byte) {
+	n := len(manifest.Coverage)
+	if n == 0 || (block-1)%BundleSize == 0 || manifest.Coverage[n-1].EndBlock+1 != block {
+		manifest.Coverage = append(manifest.Coverage, CoverageRange{StartBlock: block, EndBlock: block - 1})
+		n++
+	}
+	r := &manifest.Coverage[n-1]
+	r.Hash = chainCoverage(r.Hash, block, digest)
+	r.EndBlock = block
+}
+
+// VerifyCoverage recomputes the hash of r from the delta digest of each of
+// its blocks.
+func VerifyCoverage(r CoverageRange, digest func(block uint64) [32]byte) bool {
+	var h common.Hash
+	for block := r.StartBlock; block <= r.EndBlock; block++ {
+		h = chainCoverage(h, block, digest(block))
+	}
+	return h == r.Hash
+}
+
+// CoveredThrough returns the last block of the contiguous coverage that
+// starts at or before from, and false when from is not covered. A client
+// can apply deltas up to that block and no further.
+func CoveredThrough(coverage []CoverageRange, from uint64) (uint64, bool) {
+	var end uint64
+	covered := false
+	for _, r := range coverage {
+		switch {
+		case covered && r.StartBlock == end+1:
+			end = r.EndBlock
+		case covered:
+			return end, true
+		case r.StartBlock <= from && from <= r.EndBlock:
+			end, covered = r.EndBlock, true
+		}
+	}
+	return end, covered
+}
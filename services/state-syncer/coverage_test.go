@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestCoverage(t *testing.T) {
+	dir := t.TempDir()
+	bundler := NewDeltaBundler(Config{DeltaDir: dir}, nil)
+	deltaPath := func(block uint64) string {
+		return filepath.Join(dir, fmt.Sprintf("delta-%06d.bin", block))
+	}
+	// Blocks 141-159 are never processed.
+	for block := uint64(51); block <= 210; block++ {
+		if block > 140 && block < 160 {
+			continue
+		}
+		if block%7 != 0 {
+			if err := bundler.RecordEmptyBlock(block); err != nil {
+				t.Fatalf("record %d: %v", block, err)
+			}
+			continue
+		}
+		if err := saveDelta(deltaPath(block), DeltaHeader{Block: block}, []HintDelta{{Index: block, Delta: DBEntry{block}}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := bundler.PublishDelta(block, deltaPath(block), ""); err != nil {
+			t.Fatalf("publish %d: %v", block, err)
+		}
+	}
+
+	manifest, err := bundler.readManifest()
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var ranges [][2]uint64
+	for _, r := range manifest.Coverage {
+		ranges = append(ranges, [2]uint64{r.StartBlock, r.EndBlock})
+	}
+	if want := [][2]uint64{{51, 100}, {101, 140}, {160, 200}, {201, 210}}; !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("coverage = %v", ranges)
+	}
+
+	digest := func(block uint64) [32]byte {
+		data, err := os.ReadFile(deltaPath(block))
+		if os.IsNotExist(err) {
+			return emptyBlockDigest
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha256.Sum256(data)
+	}
+	for _, r := range manifest.Coverage {
+		if !VerifyCoverage(r, digest) {
+			t.Fatalf("range %d-%d does not verify", r.StartBlock, r.EndBlock)
+		}
+	}
+	// A client that missed block 105's delta fails the check.
+	if VerifyCoverage(manifest.Coverage[1], func(block uint64) [32]byte {
+		if block == 105 {
+			return emptyBlockDigest
+		}
+		return digest(block)
+	}) {
+		t.Fatal("range verified without block 105")
+	}
+
+	if end, ok := CoveredThrough(manifest.Coverage, 60); !ok || end != 140 {
+		t.Fatalf("covered through %d, %v", end, ok)
+	}
+	if _, ok := CoveredThrough(manifest.Coverage, 150); ok {
+		t.Fatal("block 150 covered")
+	}
+}
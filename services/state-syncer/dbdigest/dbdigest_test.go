@@ -0,0 +1,104 @@
+// Keep in sync with plinko-pir-server/dbdigest/dbdigest_test.go and
+// plinko-update-service/dbdigest/dbdigest_test.go.
+
+package dbdigest
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestDigestFollowsDeltas(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	db := make([]uint64, 1000*EntryLength)
+	for i := range db {
+		if rng.Intn(3) == 0 {
+			db[i] = rng.Uint64()
+		}
+	}
+	d := FromWords(db, 1000)
+
+	// Sequential hashing agrees with the parallel one.
+	var seq Digest
+	for i := uint64(0); i < 1000; i++ {
+		var v Entry
+		copy(v[:], db[i*EntryLength:])
+		seq.Add(i, v)
+	}
+	if seq != d {
+		t.Fatal("parallel digest differs")
+	}
+
+	// Updating entries in place, including to and from empty, keeps the
+	// digest equal to a fresh one.
+	for n := 0; n < 200; n++ {
+		index := uint64(rng.Intn(1000))
+		var old, next Entry
+		copy(old[:], db[index*EntryLength:])
+		if rng.Intn(4) != 0 {
+			next = Entry{rng.Uint64(), rng.Uint64()}
+		}
+		copy(db[index*EntryLength:], next[:])
+		d.Update(index, old, next)
+	}
+	if fresh := FromWords(db, 1000); fresh.Sum() != d.Sum() {
+		t.Fatal("updated digest differs from a fresh one")
+	}
+
+	// Growing by empty entries changes nothing; moving a value does.
+	grown := append(append([]uint64(nil), db...), make([]uint64, 24*EntryLength)...)
+	if fresh := FromWords(grown, 1024); fresh != d {
+		t.Fatal("empty entries changed the digest")
+	}
+	moved := d
+	moved.Update(3, Entry{}, Entry{5})
+	moved.Update(3, Entry{5}, Entry{})
+	moved.Update(4, Entry{}, Entry{5})
+	if moved == d {
+		t.Fatal("digest ignores the index")
+	}
+	var empty Digest
+	if fresh := FromWords(nil, 0); empty.Sum() != fresh.Sum() {
+		t.Fatal("empty digest")
+	}
+}
+
+func TestApplyDeltasDetectsTampering(t *testing.T) {
+	db := make([]uint64, 64*EntryLength)
+	for i := range db {
+		db[i] = uint64(i)
+	}
+	deltas := []Delta{{Index: 3, Delta: Entry{1}}, {Index: 63, Delta: Entry{0, 0, 0, 7}}, {Index: 3, Delta: Entry{0, 2}}}
+
+	// The syncer's digest after the block.
+	published := append([]uint64(nil), db...)
+	d := FromWords(published, 64)
+	if err := d.ApplyDeltas(published, deltas, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fresh := FromWords(published, 64); fresh != d {
+		t.Fatal("applied digest differs from a fresh one")
+	}
+	want := d.Sum()
+
+	client := append([]uint64(nil), db...)
+	honest := FromWords(client, 64)
+	if err := honest.ApplyDeltas(client, deltas, want); err != nil {
+		t.Fatalf("honest delta: %v", err)
+	}
+
+	tampered := append([]Delta(nil), deltas...)
+	tampered[1].Delta[3] ^= 1
+	client = append([]uint64(nil), db...)
+	forged := FromWords(client, 64)
+	if err := forged.ApplyDeltas(client, tampered, want); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("tampered delta: %v", err)
+	}
+
+	// A record past the end changes nothing.
+	before := forged
+	if err := forged.ApplyDeltas(client, []Delta{{Index: 0, Delta: Entry{1}}, {Index: 64, Delta: Entry{1}}}, ""); err == nil || forged != before || client[0] != 0 {
+		t.Fatalf("out-of-range delta: %v", err)
+	}
+}
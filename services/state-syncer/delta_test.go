@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	hash, parent := common.HexToHash("0xaa"), common.HexToHash("0xbb")
+	header := newDeltaHeader("erc20", &BlockChanges{Block: 42, Hash: &hash, ParentHash: &parent})
+	deltas := []HintDelta{
+		{Index: 3, Delta: DBEntry{1, 2, 3, 4}},
+		{Index: 9, Delta: DBEntry{5}},
+	}
+	data, err := encodeDelta(header, deltas)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if len(data) != deltaV2HeaderSize+2*deltaRecordSize+deltaChecksumSize {
+		t.Fatalf("encoded %d bytes", len(data))
+	}
+
+	file, n, err := decodeDelta(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("decode: n=%d err=%v", n, err)
+	}
+	want := DeltaHeader{Version: DeltaVersion2, Dataset: "erc20", Block: 42, BlockHash: hash, ParentHash: parent, RecordWidth: DBEntrySize, Count: 2}
+	if file.DeltaHeader != want || !reflect.DeepEqual(file.Deltas, deltas) {
+		t.Fatalf("decoded %+v %+v", file.DeltaHeader, file.Deltas)
+	}
+
+	data[deltaV2HeaderSize] ^= 1
+	if _, _, err := decodeDelta(data); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("corrupted record: err=%v", err)
+	}
+	if _, _, err := decodeDelta(data[:len(data)-1]); err == nil {
+		t.Fatal("truncated file decoded")
+	}
+}
+
+// encodeDeltaV1 writes the original 16-byte-header format.
+func encodeDeltaV1(deltas []HintDelta) []byte {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(len(deltas)))
+	data = binary.LittleEndian.AppendUint64(data, DBEntryLength)
+	for _, delta := range deltas {
+		data = binary.LittleEndian.AppendUint64(data, delta.Index)
+		for _, word := range delta.Delta {
+			data = binary.LittleEndian.AppendUint64(data, word)
+		}
+	}
+	return data
+}
+
+func TestDeltaBundleMixedVersions(t *testing.T) {
+	old := []HintDelta{{Index: 1, Delta: DBEntry{7}}}
+	current := []HintDelta{{Index: 2, Delta: DBEntry{8}}, {Index: 4, Delta: DBEntry{0, 9}}}
+	v2, err := encodeDelta(DeltaHeader{Dataset: DatasetETH, Block: 5}, current)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	bundle := append(encodeDeltaV1(old), v2...)
+	bundle = append(bundle, encodeDeltaV1(nil)...)
+
+	files, err := decodeDeltaBundle(bundle)
+	if err != nil {
+		t.Fatalf("decode bundle: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("got %d files", len(files))
+	}
+	if files[0].Version != DeltaVersion1 || !reflect.DeepEqual(files[0].Deltas, old) {
+		t.Fatalf("v1 file: %+v", files[0])
+	}
+	if files[1].Version != DeltaVersion2 || files[1].Block != 5 || !reflect.DeepEqual(files[1].Deltas, current) {
+		t.Fatalf("v2 file: %+v", files[1])
+	}
+	if files[2].Count != 0 {
+		t.Fatalf("empty v1 file: %+v", files[2])
+	}
+
+	if _, err := decodeDeltaBundle(bundle[:len(bundle)-1]); err == nil {
+		t.Fatal("truncated bundle decoded")
+	}
+}
+
+func TestPackedDeltas(t *testing.T) {
+	first := []HintDelta{{Index: 900, Delta: DBEntry{3}}, {Index: 12, Delta: DBEntry{1, 0, 0, 1 << 63}}}
+	second := []HintDelta{{Index: 5, Delta: DBEntry{}}, {Index: 1 << 40, Delta: DBEntry{0, 0, 7}}}
+	raw1, err := encodeDelta(DeltaHeader{Dataset: DatasetETH, Block: 7}, first)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	raw2, err := encodeDelta(DeltaHeader{Dataset: DatasetETH, Block: 8}, second)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	files, err := decodeDeltaBundle(append(raw1, raw2...))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	packed, err := packDeltaFiles(files)
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	if len(packed) >= len(raw1)+len(raw2) {
+		t.Fatalf("packed %d bytes, raw %d", len(packed), len(raw1)+len(raw2))
+	}
+	got, err := unpackDeltaFiles(packed)
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if len(got) != 2 || got[0].Block != 7 || got[1].Block != 8 || got[1].Dataset != DatasetETH {
+		t.Fatalf("unpacked headers: %+v", got)
+	}
+	// Records come back sorted by index.
+	if want := []HintDelta{first[1], first[0]}; !reflect.DeepEqual(got[0].Deltas, want) {
+		t.Fatalf("block 7 deltas = %+v", got[0].Deltas)
+	}
+	if !reflect.DeepEqual(got[1].Deltas, second) {
+		t.Fatalf("block 8 deltas = %+v", got[1].Deltas)
+	}
+
+	if _, err := unpackDeltaFiles(packed[:len(packed)-1]); err == nil {
+		t.Fatal("truncated packed file decoded")
+	}
+}
+
+func TestBundlerPublishesPacked(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{DeltaDir: dir, Dataset: DatasetETH, PackedDeltas: true}
+	bundler := NewDeltaBundler(cfg, nil)
+
+	path := filepath.Join(dir, "delta-000001.bin")
+	deltas := []HintDelta{{Index: 4, Delta: DBEntry{9}}}
+	if err := saveDelta(path, DeltaHeader{Dataset: DatasetETH, Block: 1}, deltas); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := bundler.PublishDelta(1, path, ""); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "delta-000001.zst"))
+	if err != nil {
+		t.Fatalf("read packed: %v", err)
+	}
+	files, err := unpackDeltaFiles(data)
+	if err != nil || len(files) != 1 || !reflect.DeepEqual(files[0].Deltas, deltas) {
+		t.Fatalf("packed delta: %+v, %v", files, err)
+	}
+
+	var manifest Manifest
+	data, err = os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if !reflect.DeepEqual(manifest.Encodings, []string{EncodingRaw, EncodingPacked}) {
+		t.Fatalf("encodings = %v", manifest.Encodings)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	DatasetETH   = "eth"
+	DatasetERC20 = "erc20"
+
+	SourceERC20 = "erc20"
+
+	// tokenMappingRecordSize is holder (20) + token (20) + uint32 index.
+	tokenMappingRecordSize = 44
+)
+
+// transferTopic is keccak256("Transfer(address,address,uint256)").
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// erc20Layout describes the ERC-20 dataset in snapshot manifests: every
+// (holder, token) record in token-mapping.bin owns one balance entry.
+var erc20Layout = AccountLayout{
+	Name:              DatasetERC20,
+	EntriesPerAccount: 1,
+	Fields:            []string{FieldBalance},
+}
+
+// tokenKey identifies one ERC-20 balance.
+type tokenKey struct {
+	Holder common.Address
+	Token  common.Address
+}
+
+// loadTokenMapping reads token-mapping.bin as written by db-generator with
+// DATASET=erc20.
+func loadTokenMapping(path string) (map[tokenKey]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read token-mapping: %w", err)
+	}
+	if len(data)%tokenMappingRecordSize != 0 {
+		return nil, fmt.Errorf("token-mapping size %d invalid", len(data))
+	}
+
+	mapping := make(map[tokenKey]uint64, len(data)/tokenMappingRecordSize)
+	for i := 0; i < len(data); i += tokenMappingRecordSize {
+		key := tokenKey{
+			Holder: common.BytesToAddress(data[i : i+20]),
+			Token:  common.BytesToAddress(data[i+20 : i+40]),
+		}
+		mapping[key] = uint64(binary.LittleEndian.Uint32(data[i+40 : i+44]))
+	}
+	return mapping, nil
+}
+
+// erc20Source decodes Transfer events of the mapped tokens and turns them
+// into balance adjustments: the sender is debited and the recipient
+// credited, with mints (from 0x0) and burns (to 0x0) touching one side
+// only. Holders without a mapping entry are skipped.
+type erc20Source struct {
+	client  *ethclient.Client
+	limiter *tokenBucket
+	index   map[tokenKey]uint64
+	tokens  []common.Address
+}
+
+func newERC20Source(client *ethclient.Client, limiter *tokenBucket, index map[tokenKey]uint64) *erc20Source {
+	seen := make(map[common.Address]struct{})
+	var tokens []common.Address
+	for key := range index {
+		if _, ok := seen[key.Token]; !ok {
+			seen[key.Token] = struct{}{}
+			tokens = append(tokens, key.Token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return bytes.Compare(tokens[i][:], tokens[j][:]) < 0
+	})
+	return &erc20Source{client: client, limiter: limiter, index: index, tokens: tokens}
+}
+
+func (s *erc20Source) Name() string { return SourceERC20 }
+
+func (s *erc20Source) BlockChanges(ctx context.Context, blockNumber uint64) (*BlockChanges, error) {
+	changes := &BlockChanges{Block: blockNumber}
+	if len(s.tokens) == 0 {
+		return changes, nil
+	}
+	header, err := blockHeader(ctx, s.client, s.limiter, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	hash, parent, root := header.Hash(), header.ParentHash, header.Root
+	changes.Hash, changes.ParentHash, changes.StateRoot = &hash, &parent, &root
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	logs, err := s.client.FilterLogs(ctx, ethereum.FilterQuery{
+		BlockHash: &hash,
+		Addresses: s.tokens,
+		Topics:    [][]common.Hash{{transferTopic}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("FilterLogs: %w", err)
+	}
+	changes.Adjustments = transferAdjustments(logs, s.index)
+	return changes, nil
+}
+
+// transferAdjustments converts Transfer logs into adjustments in log order.
+// ERC-721 shares the event signature but indexes the token id, so only
+// logs with exactly three topics and a 32-byte value are treated as ERC-20.
+func transferAdjustments(logs []types.Log, index map[tokenKey]uint64) []EntryAdjustment {
+	var adjustments []EntryAdjustment
+	for _, l := range logs {
+		if l.Removed || len(l.Topics) != 3 || l.Topics[0] != transferTopic || len(l.Data) != 32 {
+			continue
+		}
+		from := common.BytesToAddress(l.Topics[1].Bytes())
+		to := common.BytesToAddress(l.Topics[2].Bytes())
+		value := new(big.Int).SetBytes(l.Data)
+		if value.Sign() == 0 {
+			continue
+		}
+
+		if from != (common.Address{}) {
+			if idx, ok := index[tokenKey{Holder: from, Token: l.Address}]; ok {
+				adjustments = append(adjustments, EntryAdjustment{Index: idx, Delta: new(big.Int).Neg(value)})
+			}
+		}
+		if to != (common.Address{}) {
+			if idx, ok := index[tokenKey{Holder: to, Token: l.Address}]; ok {
+				adjustments = append(adjustments, EntryAdjustment{Index: idx, Delta: value})
+			}
+		}
+	}
+	return adjustments
+}
+
+// openERC20Syncer sets up the ERC-20 dataset next to the ETH one. It reuses
+// cfg's change source mode: rpc and trace read Transfer logs, replay and
+// record use the "erc20" subdirectory and simulated writes synthetic entries.
+func openERC20Syncer(cfg Config, client *ethclient.Client, anchorAt anchorSource, limiter *tokenBucket, publisher Publisher, parent *SyncMetrics) (*Syncer, error) {
+	dcfg := cfg.ForDataset(DatasetERC20, cfg.ERC20DatabasePath, cfg.ERC20MappingPath)
+	dcfg.AccountLayout = erc20Layout
+
+	index, err := loadTokenMapping(dcfg.AddressMappingPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d token balance mappings\n", len(index))
+
+	var live ChangeSource
+	if client != nil {
+		live = newERC20Source(client, limiter, index)
+	}
+	return openDatasetSyncer(dcfg, live, anchorAt, publisher, parent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var (
+	testToken   = common.HexToAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48")
+	testHolderA = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	testHolderB = common.HexToAddress("0x1000000000000000000000000000000000000002")
+)
+
+func transferLog(token, from, to common.Address, value int64) types.Log {
+	return types.Log{
+		Address: token,
+		Topics: []common.Hash{
+			transferTopic,
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+		},
+		Data: common.BigToHash(big.NewInt(value)).Bytes(),
+	}
+}
+
+func TestTransferAdjustments(t *testing.T) {
+	index := map[tokenKey]uint64{
+		{Holder: testHolderA, Token: testToken}: 4,
+		{Holder: testHolderB, Token: testToken}: 5,
+	}
+	unmapped := common.HexToAddress("0x2000000000000000000000000000000000000001")
+
+	nft := transferLog(testToken, testHolderA, testHolderB, 0)
+	nft.Topics = append(nft.Topics, common.BigToHash(big.NewInt(7)))
+	nft.Data = nil
+	removed := transferLog(testToken, testHolderA, testHolderB, 9)
+	removed.Removed = true
+
+	logs := []types.Log{
+		transferLog(testToken, common.Address{}, testHolderA, 100), // mint
+		transferLog(testToken, testHolderA, testHolderB, 30),
+		transferLog(testToken, testHolderB, unmapped, 10),
+		transferLog(testToken, testHolderB, common.Address{}, 5), // burn
+		transferLog(common.HexToAddress("0xdead"), testHolderA, testHolderB, 1),
+		nft,
+		removed,
+	}
+
+	got := transferAdjustments(logs, index)
+	want := []EntryAdjustment{
+		{Index: 4, Delta: big.NewInt(100)},
+		{Index: 4, Delta: big.NewInt(-30)},
+		{Index: 5, Delta: big.NewInt(30)},
+		{Index: 5, Delta: big.NewInt(-10)},
+		{Index: 5, Delta: big.NewInt(-5)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("adjustments mismatch:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestResolveUpdatesAdjustments(t *testing.T) {
+	s := newTestSyncer(t, newSimulatedSource(16), LayoutBalance)
+	s.db[4*DBEntryLength] = 50
+
+	updates := s.resolveUpdates(&BlockChanges{
+		Block:   1,
+		Entries: []EntryChange{{Index: 6, Value: DBEntry{10}}},
+		Adjustments: []EntryAdjustment{
+			{Index: 4, Delta: big.NewInt(-20)},
+			{Index: 4, Delta: big.NewInt(5)},
+			{Index: 6, Delta: big.NewInt(1)},
+			{Index: 7, Delta: big.NewInt(-1)}, // missed credit, clamps at zero
+		},
+	})
+
+	want := []DBUpdate{
+		{Index: 6, NewValue: DBEntry{11}},
+		{Index: 4, OldValue: DBEntry{50}, NewValue: DBEntry{35}},
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("updates mismatch:\n got %+v\nwant %+v", updates, want)
+	}
+
+	// Carries propagate across words.
+	entry, ok := adjustDBEntry(DBEntry{^uint64(0)}, big.NewInt(1))
+	if !ok || entry != (DBEntry{0, 1}) {
+		t.Fatalf("carry: got %v ok=%v", entry, ok)
+	}
+}
+
+func TestLoadTokenMapping(t *testing.T) {
+	var data []byte
+	for i, holder := range []common.Address{testHolderA, testHolderB} {
+		data = append(data, holder.Bytes()...)
+		data = append(data, testToken.Bytes()...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(i))
+	}
+	path := filepath.Join(t.TempDir(), "token-mapping.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+
+	mapping, err := loadTokenMapping(path)
+	if err != nil {
+		t.Fatalf("load mapping: %v", err)
+	}
+	if len(mapping) != 2 || mapping[tokenKey{Holder: testHolderB, Token: testToken}] != 1 {
+		t.Fatalf("unexpected mapping %v", mapping)
+	}
+
+	source := newERC20Source(nil, nil, mapping)
+	if !reflect.DeepEqual(source.tokens, []common.Address{testToken}) {
+		t.Fatalf("tokens = %v", source.tokens)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type jsonrpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []string        `json:"params"`
+}
+
+// fakeAccountNode answers eth_getBalance batches with balance = last address
+// byte, eth_getTransactionCount with twice that and eth_getCode with one
+// byte of code for odd addresses and none for even ones. Addresses listed in flaky fail with a rate-limit error on their first
+// request, and the first failHTTP HTTP requests are rejected with 429.
+type fakeAccountNode struct {
+	mu        sync.Mutex
+	flaky     map[string]bool
+	failHTTP  int
+	requests  atomic.Int64
+	inFlight  atomic.Int64
+	maxFlight atomic.Int64
+}
+
+func (n *fakeAccountNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.requests.Add(1)
+	cur := n.inFlight.Add(1)
+	defer n.inFlight.Add(-1)
+	for {
+		max := n.maxFlight.Load()
+		if cur <= max || n.maxFlight.CompareAndSwap(max, cur) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	n.mu.Lock()
+	if n.failHTTP > 0 {
+		n.failHTTP--
+		n.mu.Unlock()
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	n.mu.Unlock()
+
+	var batch []jsonrpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := make([]map[string]any, len(batch))
+	for i, req := range batch {
+		addr := strings.ToLower(req.Params[0])
+		n.mu.Lock()
+		flaky := n.flaky[addr]
+		delete(n.flaky, addr)
+		n.mu.Unlock()
+		if flaky {
+			resp[i] = map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": -32005, "message": "rate limited"}}
+			continue
+		}
+		last := common.HexToAddress(addr).Bytes()[19]
+		var result string
+		switch req.Method {
+		case "eth_getBalance":
+			result = fmt.Sprintf("0x%x", last)
+		case "eth_getTransactionCount":
+			result = fmt.Sprintf("0x%x", 2*int(last))
+		case "eth_getCode":
+			result = "0x"
+			if last%2 == 1 {
+				result = fmt.Sprintf("0x%02x", last)
+			}
+		}
+		resp[i] = map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func testAddresses(n int) []common.Address {
+	out := make([]common.Address, n)
+	for i := range out {
+		out[i] = common.BigToAddress(big.NewInt(int64(0x1000 + i)))
+	}
+	return out
+}
+
+func TestAccountFetcherBatchesConcurrently(t *testing.T) {
+	addresses := testAddresses(250)
+	node := &fakeAccountNode{flaky: map[string]bool{
+		strings.ToLower(addresses[7].Hex()):   true,
+		strings.ToLower(addresses[180].Hex()): true,
+	}, failHTTP: 1}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client, err := rpc.DialHTTP(server.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	fetcher := newAccountFetcher(client, nil, 50, 3, 3, time.Millisecond)
+	balances, err := fetcher.Balances(context.Background(), addresses, big.NewInt(19000000))
+	if err != nil {
+		t.Fatalf("balances: %v", err)
+	}
+	if len(balances) != len(addresses) {
+		t.Fatalf("got %d balances, want %d", len(balances), len(addresses))
+	}
+	for _, addr := range addresses {
+		want := int64(addr.Bytes()[19])
+		if balances[addr].Int64() != want {
+			t.Fatalf("balance for %s = %s, want %d", addr.Hex(), balances[addr], want)
+		}
+	}
+
+	// 5 batches + 1 rejected HTTP request + 2 partial retries.
+	if got := node.requests.Load(); got != 8 {
+		t.Fatalf("made %d HTTP requests, want 8", got)
+	}
+	if got := node.maxFlight.Load(); got > 3 {
+		t.Fatalf("observed %d concurrent requests, limit is 3", got)
+	}
+}
+
+func TestAccountFetcherGivesUp(t *testing.T) {
+	node := &fakeAccountNode{failHTTP: 100}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client, err := rpc.DialHTTP(server.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	fetcher := newAccountFetcher(client, nil, 10, 1, 2, time.Millisecond)
+	if _, err := fetcher.Balances(context.Background(), testAddresses(5), nil); err == nil {
+		t.Fatal("expected error after exhausting retries")
+	}
+	if got := node.requests.Load(); got != 3 {
+		t.Fatalf("made %d attempts, want 3", got)
+	}
+}
+
+func TestAccountFetcherNoncesAndCodeHashes(t *testing.T) {
+	server := httptest.NewServer(&fakeAccountNode{})
+	defer server.Close()
+
+	client, err := rpc.DialHTTP(server.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	addresses := testAddresses(4)
+	fetcher := newAccountFetcher(client, nil, 3, 2, 0, time.Millisecond)
+	ctx := context.Background()
+
+	nonces, err := fetcher.Nonces(ctx, addresses, nil)
+	if err != nil {
+		t.Fatalf("nonces: %v", err)
+	}
+	hashes, err := fetcher.CodeHashes(ctx, addresses, nil)
+	if err != nil {
+		t.Fatalf("code hashes: %v", err)
+	}
+	for _, addr := range addresses {
+		last := addr.Bytes()[19]
+		if nonces[addr] != 2*uint64(last) {
+			t.Fatalf("nonce for %s = %d, want %d", addr.Hex(), nonces[addr], 2*uint64(last))
+		}
+		want := types.EmptyCodeHash
+		if last%2 == 1 {
+			want = crypto.Keccak256Hash([]byte{last})
+		}
+		if hashes[addr] != want {
+			t.Fatalf("code hash for %s = %s, want %s", addr.Hex(), hashes[addr].Hex(), want.Hex())
+		}
+	}
+}
+
+func TestTokenBucketLimitsRate(t *testing.T) {
+	bucket := newTokenBucket(100, 1)
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := bucket.Wait(ctx); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	// One token is available immediately, the remaining five take ~10ms each.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("6 tokens at 100/s took only %s", elapsed)
+	}
+
+	var unlimited *tokenBucket
+	if err := unlimited.Wait(ctx); err != nil {
+		t.Fatalf("nil bucket must not block: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	FinalityLatest        = "latest"
+	FinalityConfirmations = "confirmations"
+	FinalitySafe          = "safe"
+	FinalityFinalized     = "finalized"
+)
+
+// FinalityPolicy describes which blocks the syncer is allowed to publish.
+// It is embedded in every manifest so clients know whether published deltas
+// can still be reorged away.
+type FinalityPolicy struct {
+	Mode          string `json:"mode"`
+	Confirmations uint64 `json:"confirmations,omitempty"`
+}
+
+// parseFinalityPolicy resolves the configured mode and confirmation depth.
+// A non-zero depth with the default "latest" mode switches to confirmation
+// mode, so PLINKO_STATE_CONFIRMATIONS=12 alone is enough to enable it.
+func parseFinalityPolicy(mode string, confirmations uint64) (FinalityPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", FinalityLatest, "head":
+		if confirmations > 0 {
+			return FinalityPolicy{Mode: FinalityConfirmations, Confirmations: confirmations}, nil
+		}
+		return FinalityPolicy{Mode: FinalityLatest}, nil
+	case FinalityConfirmations, "depth":
+		return FinalityPolicy{Mode: FinalityConfirmations, Confirmations: confirmations}, nil
+	case FinalitySafe:
+		return FinalityPolicy{Mode: FinalitySafe}, nil
+	case FinalityFinalized:
+		return FinalityPolicy{Mode: FinalityFinalized}, nil
+	default:
+		return FinalityPolicy{}, fmt.Errorf("unknown finality mode %q", mode)
+	}
+}
+
+// TargetBlock returns the highest block number the syncer may process under
+// this policy. ok is false while the chain is still shallower than the
+// configured confirmation depth.
+func (p FinalityPolicy) TargetBlock(ctx context.Context, client *ethclient.Client) (uint64, bool, error) {
+	switch p.Mode {
+	case FinalitySafe, FinalityFinalized:
+		tag := rpc.SafeBlockNumber
+		if p.Mode == FinalityFinalized {
+			tag = rpc.FinalizedBlockNumber
+		}
+		header, err := client.HeaderByNumber(ctx, big.NewInt(tag.Int64()))
+		if err != nil {
+			return 0, false, fmt.Errorf("%s header: %w", p.Mode, err)
+		}
+		return header.Number.Uint64(), true, nil
+	default:
+		head, err := client.BlockNumber(ctx)
+		if err != nil {
+			return 0, false, err
+		}
+		if head < p.Confirmations {
+			return 0, false, nil
+		}
+		return head - p.Confirmations, true, nil
+	}
+}
+
+func (p FinalityPolicy) String() string {
+	if p.Mode == FinalityConfirmations {
+		return fmt.Sprintf("%s(%d)", p.Mode, p.Confirmations)
+	}
+	return p.Mode
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestParseFinalityPolicy(t *testing.T) {
+	testCases := []struct {
+		name          string
+		mode          string
+		confirmations uint64
+		want          FinalityPolicy
+		wantErr       bool
+	}{
+		{"default head", "", 0, FinalityPolicy{Mode: FinalityLatest}, false},
+		{"depth implies confirmations", "latest", 12, FinalityPolicy{Mode: FinalityConfirmations, Confirmations: 12}, false},
+		{"explicit confirmations", "confirmations", 64, FinalityPolicy{Mode: FinalityConfirmations, Confirmations: 64}, false},
+		{"safe tag", "SAFE", 0, FinalityPolicy{Mode: FinalitySafe}, false},
+		{"finalized ignores depth", "finalized", 5, FinalityPolicy{Mode: FinalityFinalized}, false},
+		{"unknown mode", "pending", 0, FinalityPolicy{}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseFinalityPolicy(tc.mode, tc.confirmations)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for mode %q", tc.mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("policy mismatch: got %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
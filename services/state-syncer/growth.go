@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// addressMappingRecordSize is address (20) + uint32 account index.
+	addressMappingRecordSize = 24
+
+	// epochHeadroomPercent is the spare capacity a new epoch is derived
+	// with, so that growth does not force a rehint every few blocks.
+	epochHeadroomPercent = 25
+)
+
+// EpochInfo records one set of PIR parameters. The database only grows by
+// appending, so indices stay stable across epochs, but hints built for an
+// older epoch's chunk and set sizes cannot absorb entries past its capacity:
+// clients holding an older epoch must rehint from Snapshot (taken at Block),
+// after which the deltas of later blocks apply as usual. The epoch becomes
+// the server's default at ActivationBlock.
+type EpochInfo struct {
+	Epoch           uint64 `json:"epoch"`
+	Block           uint64 `json:"block"`
+	ActivationBlock uint64 `json:"activationBlock"`
+	DBSize          uint64 `json:"dbSize"`
+	ChunkSize       uint64 `json:"chunkSize"`
+	SetSize         uint64 `json:"setSize"`
+	Snapshot        string `json:"snapshot"`
+}
+
+// newAccount is an address appended to the mapping while resolving a block.
+type newAccount struct {
+	Address common.Address
+	Index   uint64
+}
+
+// nextAccountIndex returns the first account index not used by mapping.
+func nextAccountIndex(mapping map[string]uint64) uint64 {
+	var next uint64
+	for _, idx := range mapping {
+		if idx+1 > next {
+			next = idx + 1
+		}
+	}
+	return next
+}
+
+// isEmptyAccount reports whether every field the layout stores is zero in
+// change. Such accounts (untouched precompiles, failed transfers) are not
+// worth a database slot.
+func isEmptyAccount(change AccountChange, layout AccountLayout) bool {
+	if layout.Has(FieldNonce) && change.Nonce != nil && *change.Nonce != 0 {
+		return false
+	}
+	if layout.Has(FieldBalance) && change.Balance != nil && change.Balance.ToInt().Sign() != 0 {
+		return false
+	}
+	if layout.Has(FieldCodeHash) && change.CodeHash != nil && *change.CodeHash != types.EmptyCodeHash && *change.CodeHash != (common.Hash{}) {
+		return false
+	}
+	return true
+}
+
+// appendAccount assigns the next account index to change.Address and grows
+// the database to hold its entries.
+func (s *Syncer) appendAccount(change AccountChange) (uint64, bool) {
+	if !s.cfg.AppendAccounts || s.addressIndex == nil || isEmptyAccount(change, s.layout) {
+		return 0, false
+	}
+	if s.nextAccount > uint64(^uint32(0)) {
+		// The address mapping stores 32-bit indices.
+		return 0, false
+	}
+	idx := s.nextAccount
+	s.nextAccount++
+	s.addressIndex[strings.ToLower(change.Address.Hex())] = idx
+	s.pendingAccounts = append(s.pendingAccounts, newAccount{Address: change.Address, Index: idx})
+	if end := (idx + 1) * s.layout.EntriesPerAccount; end > s.dbSize {
+		s.growTo(end)
+	}
+	return idx, true
+}
+
+// growTo extends the database to entries. The PIR parameters stay those of
+// the current epoch; advanceEpoch moves to new ones once the block is
+// published. Only the in-memory array is enlarged here when needed.
+func (s *Syncer) growTo(entries uint64) {
+	if entries*DBEntryLength > uint64(len(s.db)) {
+		chunkSize, setSize := derivePlinkoParams(entries + entries*epochHeadroomPercent/100)
+		s.reserve(chunkSize * setSize)
+	}
+	s.dbSize = entries
+	s.manager = NewPlinkoUpdateManager(s.db, s.dbSize, s.chunkSize, s.setSize)
+}
+
+// reserve makes room for entries in the in-memory database.
+func (s *Syncer) reserve(entries uint64) {
+	if entries*DBEntryLength <= uint64(len(s.db)) {
+		return
+	}
+	db := make([]uint64, entries*DBEntryLength)
+	copy(db, s.db)
+	s.db = db
+	s.manager = NewPlinkoUpdateManager(s.db, s.dbSize, s.chunkSize, s.setSize)
+}
+
+// publishAccounts persists the accounts appended up to block: they are added
+// to the address mapping, which is republished, and written on their own as
+// an address delta so clients can follow the mapping incrementally. They stay
+// pending, and in every write-ahead log record, until the mapping holds them.
+func (s *Syncer) publishAccounts(block uint64) error {
+	if len(s.pendingAccounts) == 0 {
+		return nil
+	}
+	accounts := s.pendingAccounts
+	records := encodeAddressRecords(accounts)
+	if err := appendAddressMapping(s.cfg.AddressMappingPath, records); err != nil {
+		return err
+	}
+	s.pendingAccounts = nil
+
+	if err := copyFile(s.cfg.AddressMappingPath, s.cfg.PublicAddressMappingPath()); err != nil {
+		return fmt.Errorf("publish address-mapping: %w", err)
+	}
+	if s.publisher != nil {
+		if err := s.publisher.Update(s.cfg.PublicAddressMappingPath()); err != nil {
+			log.Printf("%s publish (address-mapping) failed: %v", s.publisher.Name(), err)
+		}
+	}
+
+	log.Printf("%s block %d: appended %d accounts (next index %d)\n", s.cfg.Dataset, block, len(accounts), s.nextAccount)
+	return writeAddressDelta(s.cfg, s.bundler, block, records)
+}
+
+// writeAddressDelta writes records as the address delta of block and
+// publishes it.
+func writeAddressDelta(cfg Config, bundler *DeltaBundler, block uint64, records []byte) error {
+	path := filepath.Join(cfg.DeltaDir, fmt.Sprintf("address-delta-%06d.bin", block))
+	if err := os.WriteFile(path, records, 0o644); err != nil {
+		return fmt.Errorf("write address delta: %w", err)
+	}
+	return bundler.PublishAddressDelta(block, path)
+}
+
+// appendAddressMapping appends records to the address mapping at path. A
+// failed write is cut off, so that retrying does not duplicate records.
+func appendAddressMapping(path string, records []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open address-mapping: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(records); err != nil {
+		f.Truncate(info.Size())
+		f.Close()
+		return fmt.Errorf("append address-mapping: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recoverAccounts appends to the address mapping at path the accounts that
+// logged, replayed from the write-ahead log, holds but the mapping does not,
+// which a crash or a failed append in publishAccounts left behind, and
+// returns them. Indices are handed out in order, so those are the accounts
+// from the mapping's next index on; a record may repeat accounts still
+// pending from an earlier block.
+func recoverAccounts(path string, logged []newAccount) ([]newAccount, error) {
+	if len(logged) == 0 {
+		return nil, nil
+	}
+	mapping, err := loadAddressMapping(path)
+	if err != nil {
+		return nil, err
+	}
+	next := nextAccountIndex(mapping)
+	var missing []newAccount
+	for _, account := range logged {
+		switch {
+		case account.Index < next:
+			continue
+		case account.Index > next:
+			return nil, fmt.Errorf("logged account index %d skips past the mapping's next index %d", account.Index, next)
+		}
+		missing = append(missing, account)
+		next++
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if err := appendAddressMapping(path, encodeAddressRecords(missing)); err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// encodeAddressRecords uses the address-mapping.bin record format.
+func encodeAddressRecords(accounts []newAccount) []byte {
+	out := make([]byte, 0, len(accounts)*addressMappingRecordSize)
+	for _, account := range accounts {
+		out = append(out, account.Address.Bytes()...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(account.Index))
+	}
+	return out
+}
+
+// advanceEpoch runs after every published block. Once the database fills
+// EpochAnnouncePercent of the current capacity the next epoch is announced
+// with an activation block EpochLeadBlocks ahead, giving clients time to
+// rehint while the PIR server serves both; it activates at that block, or
+// immediately if the current capacity runs out first. Outgrowing capacity
+// with nothing announced starts a new epoch on the spot.
+func (s *Syncer) advanceEpoch(block uint64) error {
+	if !s.cfg.AppendAccounts || s.addressIndex == nil {
+		// Only account datasets grow.
+		return nil
+	}
+	capacity := s.chunkSize * s.setSize
+	number := s.epoch + 1
+	if next := s.nextEpoch; next != nil {
+		if s.dbSize <= next.ChunkSize*next.SetSize {
+			if block >= next.ActivationBlock || s.dbSize > capacity {
+				return s.activateEpoch(block)
+			}
+			return nil
+		}
+		// Outgrown before it activated; clients that rehinted for it
+		// must do so again.
+		log.Printf("%s block %d: announced epoch %d is already too small, replacing it", s.cfg.Dataset, block, next.Epoch)
+		s.nextEpoch = nil
+		number = next.Epoch + 1
+	}
+
+	switch {
+	case s.dbSize > capacity:
+		if err := s.announceEpoch(block, number, block); err != nil {
+			return err
+		}
+		return s.activateEpoch(block)
+	case s.cfg.EpochAnnouncePercent > 0 && s.dbSize*100 >= capacity*s.cfg.EpochAnnouncePercent:
+		return s.announceEpoch(block, number, block+s.cfg.EpochLeadBlocks)
+	}
+	return nil
+}
+
+// announceEpoch derives parameters with headroom for the current size,
+// publishes a snapshot under them and lists them as the manifest's
+// nextEpoch. Deltas are index based, so they apply to hints of either epoch.
+func (s *Syncer) announceEpoch(block, number, activation uint64) error {
+	chunkSize, setSize := derivePlinkoParams(s.dbSize + s.dbSize*epochHeadroomPercent/100)
+	s.reserve(chunkSize * setSize)
+	version, err := writeSnapshot(s.cfg, s.db, s.dbSize, s.head, chunkSize, setSize, number, s.digest.Sum(), s.bundler)
+	if err != nil {
+		return fmt.Errorf("epoch %d snapshot: %w", number, err)
+	}
+	s.chainNext = true
+	info := EpochInfo{
+		Epoch:           number,
+		Block:           block,
+		ActivationBlock: activation,
+		DBSize:          s.dbSize,
+		ChunkSize:       chunkSize,
+		SetSize:         setSize,
+		Snapshot:        version,
+	}
+	log.Printf("%s block %d: announced epoch %d (chunk_size=%d set_size=%d) from %s, active at block %d\n",
+		s.cfg.Dataset, block, number, chunkSize, setSize, version, activation)
+	s.nextEpoch = &info
+	return s.bundler.AnnounceEpoch(info)
+}
+
+func (s *Syncer) activateEpoch(block uint64) error {
+	info := *s.nextEpoch
+	info.ActivationBlock = block
+	s.nextEpoch = nil
+	s.epoch = info.Epoch
+	s.chunkSize, s.setSize = info.ChunkSize, info.SetSize
+	s.manager = NewPlinkoUpdateManager(s.db, s.dbSize, s.chunkSize, s.setSize)
+	log.Printf("%s block %d: epoch %d active, clients on older epochs must rehint from %s\n", s.cfg.Dataset, block, info.Epoch, info.Snapshot)
+	return s.bundler.StartEpoch(info)
+}
+
+// resumeEpoch picks the epoch for a freshly loaded database. The current
+// epoch is kept as long as the database still fits it, since deriving
+// parameters from the grown size would silently invalidate client hints;
+// an announced epoch that fits is activated instead, and otherwise a new
+// epoch starts. start reports whether the returned epoch still has to be
+// recorded (its Block and Snapshot are then left for the caller).
+func resumeEpoch(current, next *EpochInfo, dbSize uint64) (epoch EpochInfo, pending *EpochInfo, start bool) {
+	switch {
+	case current != nil && dbSize <= current.ChunkSize*current.SetSize:
+		return *current, next, false
+	case next != nil && dbSize <= next.ChunkSize*next.SetSize:
+		return *next, nil, true
+	case current == nil:
+		chunkSize, setSize := derivePlinkoParams(dbSize)
+		return EpochInfo{DBSize: dbSize, ChunkSize: chunkSize, SetSize: setSize}, nil, true
+	}
+	number := current.Epoch + 1
+	if next != nil {
+		number = next.Epoch + 1
+	}
+	chunkSize, setSize := derivePlinkoParams(dbSize + dbSize*epochHeadroomPercent/100)
+	return EpochInfo{Epoch: number, DBSize: dbSize, ChunkSize: chunkSize, SetSize: setSize}, nil, true
+}
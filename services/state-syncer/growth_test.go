@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestSyncerAppendsAccounts(t *testing.T) {
+	replayDir := t.TempDir()
+	s := newTestSyncer(t, newReplaySource(replayDir), LayoutBalance)
+	s.cfg.AppendAccounts = true
+	s.cfg.AddressMappingPath = filepath.Join(t.TempDir(), "address-mapping.bin")
+	s.bundler = NewDeltaBundler(s.cfg, nil)
+	s.nextAccount = s.dbSize
+
+	account := func(i int, balance int64) AccountChange {
+		return AccountChange{
+			Address: common.BigToAddress(big.NewInt(int64(0x5000 + i))),
+			Balance: (*hexutil.Big)(big.NewInt(balance)),
+		}
+	}
+	// Block 1: one new account within the padded capacity (16 of 32) and
+	// one empty account that is not worth a slot.
+	block1 := &BlockChanges{Block: 1, Accounts: []AccountChange{account(0, 7), account(1, 0)}}
+	// Block 2: enough new accounts to overflow the capacity.
+	block2 := &BlockChanges{Block: 2}
+	for i := 2; i < 20; i++ {
+		block2.Accounts = append(block2.Accounts, account(i, int64(i)))
+	}
+	for _, changes := range []*BlockChanges{block1, block2} {
+		if err := writeJSON(recordingPath(replayDir, changes.Block), changes); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+	}
+
+	capacity := s.chunkSize * s.setSize
+	if err := s.ProcessBlock(context.Background(), 1); err != nil {
+		t.Fatalf("block 1: %v", err)
+	}
+	if s.dbSize != 17 || s.chunkSize*s.setSize != capacity || s.epoch != 0 {
+		t.Fatalf("after block 1: db_size=%d capacity=%d epoch=%d", s.dbSize, s.chunkSize*s.setSize, s.epoch)
+	}
+	if got := readDBEntry(s.db, 16); got != (DBEntry{7}) {
+		t.Fatalf("entry 16 = %v", got)
+	}
+
+	if err := s.ProcessBlock(context.Background(), 2); err != nil {
+		t.Fatalf("block 2: %v", err)
+	}
+	if s.dbSize != 35 || s.chunkSize*s.setSize < 35 || s.epoch != 1 {
+		t.Fatalf("after block 2: db_size=%d capacity=%d epoch=%d", s.dbSize, s.chunkSize*s.setSize, s.epoch)
+	}
+	if got := readDBEntry(s.db, 34); got != (DBEntry{19}) {
+		t.Fatalf("entry 34 = %v", got)
+	}
+
+	mapping, err := loadAddressMapping(s.cfg.AddressMappingPath)
+	if err != nil {
+		t.Fatalf("load mapping: %v", err)
+	}
+	if len(mapping) != 19 || mapping[strings.ToLower(account(19, 0).Address.Hex())] != 34 {
+		t.Fatalf("mapping has %d accounts", len(mapping))
+	}
+	for block, want := range map[uint64]int{1: 1, 2: 18} {
+		data, err := os.ReadFile(filepath.Join(s.cfg.DeltaDir, fmt.Sprintf("address-delta-%06d.bin", block)))
+		if err != nil || len(data) != want*addressMappingRecordSize {
+			t.Fatalf("address delta %d: %d bytes, %v", block, len(data), err)
+		}
+	}
+
+	var manifest Manifest
+	data, err := os.ReadFile(filepath.Join(s.cfg.DeltaDir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if manifest.Epoch != 1 || len(manifest.Epochs) != 1 || manifest.Epochs[0].Block != 2 || manifest.Epochs[0].Snapshot != "block-000002" {
+		t.Fatalf("epochs: %+v", manifest.Epochs)
+	}
+	if len(manifest.AddressDeltas) != 2 {
+		t.Fatalf("address deltas: %+v", manifest.AddressDeltas)
+	}
+}
+
+func TestSyncerAnnouncesEpoch(t *testing.T) {
+	replayDir := t.TempDir()
+	s := newTestSyncer(t, newReplaySource(replayDir), LayoutBalance)
+	s.cfg.AppendAccounts = true
+	s.cfg.AddressMappingPath = filepath.Join(t.TempDir(), "address-mapping.bin")
+	s.cfg.EpochAnnouncePercent = 50
+	s.cfg.EpochLeadBlocks = 2
+	s.bundler = NewDeltaBundler(s.cfg, nil)
+	s.nextAccount = s.dbSize
+
+	newcomer := AccountChange{Address: common.HexToAddress("0x5000"), Balance: (*hexutil.Big)(big.NewInt(1))}
+	fixtures := []*BlockChanges{
+		{Block: 1, Accounts: []AccountChange{newcomer}},
+		{Block: 2},
+		{Block: 3},
+	}
+	for _, changes := range fixtures {
+		if err := writeJSON(recordingPath(replayDir, changes.Block), changes); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+	}
+	readManifest := func() Manifest {
+		var manifest Manifest
+		data, err := os.ReadFile(filepath.Join(s.cfg.DeltaDir, "manifest.json"))
+		if err != nil {
+			t.Fatalf("read manifest: %v", err)
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatalf("decode manifest: %v", err)
+		}
+		return manifest
+	}
+
+	chunkSize, setSize := s.chunkSize, s.setSize
+	if err := s.ProcessBlock(context.Background(), 1); err != nil {
+		t.Fatalf("block 1: %v", err)
+	}
+	manifest := readManifest()
+	next := manifest.NextEpoch
+	if next == nil || next.Epoch != 1 || next.Block != 1 || next.ActivationBlock != 3 || next.ChunkSize*next.SetSize <= chunkSize*setSize {
+		t.Fatalf("announcement: %+v", next)
+	}
+	if s.epoch != 0 || s.chunkSize != chunkSize || s.setSize != setSize {
+		t.Fatalf("epoch switched early: epoch=%d", s.epoch)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.SnapshotsRoot(), next.Snapshot, "database.bin")); err != nil {
+		t.Fatalf("announced snapshot: %v", err)
+	}
+
+	for block := uint64(2); block <= 3; block++ {
+		if err := s.ProcessBlock(context.Background(), block); err != nil {
+			t.Fatalf("block %d: %v", block, err)
+		}
+		if want := uint64(block / 3); s.epoch != want {
+			t.Fatalf("after block %d: epoch=%d, want %d", block, s.epoch, want)
+		}
+	}
+	manifest = readManifest()
+	if manifest.Epoch != 1 || manifest.NextEpoch != nil || len(manifest.Epochs) != 1 || manifest.Epochs[0].ActivationBlock != 3 {
+		t.Fatalf("activation: epoch=%d next=%+v epochs=%+v", manifest.Epoch, manifest.NextEpoch, manifest.Epochs)
+	}
+	if s.chunkSize != next.ChunkSize || s.setSize != next.SetSize {
+		t.Fatalf("params: %d/%d", s.chunkSize, s.setSize)
+	}
+}
+
+func TestResumeEpoch(t *testing.T) {
+	chunk, set := derivePlinkoParams(16)
+	current := &EpochInfo{Epoch: 3, ChunkSize: chunk, SetSize: set}
+	next := &EpochInfo{Epoch: 4, ChunkSize: chunk * 2, SetSize: set}
+
+	if epoch, pending, start := resumeEpoch(current, next, chunk*set); start || epoch.Epoch != 3 || pending != next {
+		t.Fatalf("fits: %+v pending=%v start=%v", epoch, pending, start)
+	}
+	if epoch, pending, start := resumeEpoch(current, next, chunk*set+1); !start || epoch.Epoch != 4 || pending != nil {
+		t.Fatalf("announced: %+v pending=%v start=%v", epoch, pending, start)
+	}
+	if epoch, _, start := resumeEpoch(current, next, 2*chunk*set+1); !start || epoch.Epoch != 5 || epoch.ChunkSize*epoch.SetSize <= 2*chunk*set {
+		t.Fatalf("outgrown: %+v start=%v", epoch, start)
+	}
+	if epoch, _, start := resumeEpoch(current, nil, chunk*set+1); !start || epoch.Epoch != 4 {
+		t.Fatalf("overflow: %+v start=%v", epoch, start)
+	}
+	if epoch, _, start := resumeEpoch(nil, nil, 16); !start || epoch.Epoch != 0 || epoch.ChunkSize != chunk || epoch.SetSize != set {
+		t.Fatalf("first: %+v start=%v", epoch, start)
+	}
+}
+
+func TestSyncerRecoversAccounts(t *testing.T) {
+	replayDir := t.TempDir()
+	s := newTestSyncer(t, newReplaySource(replayDir), LayoutBalance)
+	if err := flushDatabase(s.cfg.DatabasePath, s.db, s.dbSize); err != nil {
+		t.Fatal(err)
+	}
+	// The mapping's directory is missing, so appending to it fails.
+	mappingDir := filepath.Join(t.TempDir(), "mapping")
+	s.cfg.AppendAccounts = true
+	s.cfg.CheckpointEvery = 1
+	s.cfg.AddressMappingPath = filepath.Join(mappingDir, "address-mapping.bin")
+	s.bundler = NewDeltaBundler(s.cfg, nil)
+	s.nextAccount = s.dbSize
+
+	for block := uint64(1); block <= 2; block++ {
+		changes := &BlockChanges{Block: block, Accounts: []AccountChange{{
+			Address: common.BigToAddress(big.NewInt(int64(0x5000 + block))),
+			Balance: (*hexutil.Big)(big.NewInt(int64(6 + block))),
+		}}}
+		if err := writeJSON(recordingPath(replayDir, block), changes); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+		if err := s.ProcessBlock(context.Background(), block); err != nil {
+			t.Fatalf("block %d: %v", block, err)
+		}
+	}
+	// Both accounts stay pending, so the due checkpoint keeps the log.
+	if len(s.pendingAccounts) != 2 || s.wal.blocks != 2 {
+		t.Fatalf("%d accounts pending, %d blocks logged", len(s.pendingAccounts), s.wal.blocks)
+	}
+
+	// After a crash, reopening puts them into the mapping, which ends with
+	// the database's last account.
+	s.wal.f.Close()
+	if err := os.MkdirAll(mappingDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	last := encodeAddressRecords([]newAccount{{Address: common.HexToAddress("0x5000"), Index: 15}})
+	if err := os.WriteFile(s.cfg.AddressMappingPath, last, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openSyncer(s.cfg, chainAnchors(context.Background(), nil, nil, nil), nil, NewSyncMetrics(SourceReplay))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { reopened.wal.f.Close() })
+	if reopened.head.Block != 2 || readDBEntry(reopened.db, 17) != (DBEntry{8}) {
+		t.Fatalf("resumed at block %d with entry 17 = %v", reopened.head.Block, readDBEntry(reopened.db, 17))
+	}
+	mapping, err := loadAddressMapping(s.cfg.AddressMappingPath)
+	if err != nil {
+		t.Fatalf("load mapping: %v", err)
+	}
+	for block, index := range map[uint64]uint64{1: 16, 2: 17} {
+		address := strings.ToLower(common.BigToAddress(big.NewInt(int64(0x5000 + block))).Hex())
+		if got, ok := mapping[address]; !ok || got != index {
+			t.Fatalf("account of block %d: index %d (%v), want %d", block, got, ok, index)
+		}
+	}
+	if len(mapping) != 3 || nextAccountIndex(mapping) != 18 {
+		t.Fatalf("mapping has %d accounts", len(mapping))
+	}
+	data, err := os.ReadFile(filepath.Join(s.cfg.DeltaDir, "address-delta-000002.bin"))
+	if err != nil || len(data) != 2*addressMappingRecordSize {
+		t.Fatalf("recovered address delta: %d bytes, %v", len(data), err)
+	}
+}
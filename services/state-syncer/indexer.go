@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	SourceIndexer = "indexer"
+
+	OpSet = "set"
+	OpAdd = "add"
+	OpSub = "sub"
+
+	// keyContract selects the address of the contract that emitted the log.
+	keyContract = "contract"
+
+	// keyMappingRecordSize is key hash (32) + uint32 index.
+	keyMappingRecordSize = 36
+)
+
+// IndexerConfig is the file named by PLINKO_STATE_INDEXER_CONFIG. Each
+// dataset becomes its own PIR database with independent snapshots and
+// deltas, kept current from event logs alone:
+//
+//	{
+//	  "datasets": [{
+//	    "name": "ens-addr",
+//	    "capacity": 1048576,
+//	    "rules": [{
+//	      "event": "AddrChanged(bytes32 indexed node, address a)",
+//	      "key": ["node"],
+//	      "value": "a"
+//	    }]
+//	  }]
+//	}
+type IndexerConfig struct {
+	Datasets []IndexedDataset `json:"datasets"`
+}
+
+// IndexedDataset declares one log-driven dataset. Database and Mapping
+// default to <dir of PLINKO_STATE_DB_PATH>/<name>/database.bin and
+// key-mapping.bin; the database is created with Capacity zeroed entries
+// when it does not exist yet.
+type IndexedDataset struct {
+	Name     string        `json:"name"`
+	Capacity uint64        `json:"capacity,omitempty"`
+	Database string        `json:"database,omitempty"`
+	Mapping  string        `json:"mapping,omitempty"`
+	Rules    []IndexerRule `json:"rules"`
+}
+
+// IndexerRule maps one event to a database write. Key lists the event
+// parameters (or "contract") whose 32-byte ABI words, concatenated and
+// hashed with keccak256, identify the entry; Value names the parameter
+// written to it. Op is "set" (default), or "add"/"sub" to treat the entry
+// as a running total. Contracts optionally restricts the emitting contracts.
+type IndexerRule struct {
+	Event     string           `json:"event"`
+	Contracts []common.Address `json:"contracts,omitempty"`
+	Key       []string         `json:"key"`
+	Value     string           `json:"value"`
+	Op        string           `json:"op,omitempty"`
+
+	event *eventSpec
+}
+
+// eventSpec is a parsed event signature. Only static ABI types are
+// supported, so every parameter is exactly one 32-byte topic or data word.
+type eventSpec struct {
+	Topic   common.Hash
+	Params  []eventParam
+	indexed int
+}
+
+type eventParam struct {
+	Name    string
+	Type    string
+	Indexed bool
+	// slot is the topic index (from 1) for indexed params, else the data
+	// word index.
+	slot int
+}
+
+var (
+	eventSignatureRe = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*\((.*)\)\s*$`)
+	staticTypeRe     = regexp.MustCompile(`^(address|bool|u?int(8|16|24|32|40|48|56|64|72|80|88|96|104|112|120|128|136|144|152|160|168|176|184|192|200|208|216|224|232|240|248|256)?|bytes([1-9]|[12][0-9]|3[0-2]))$`)
+	datasetNameRe    = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+// parseEventSignature parses a human-readable event declaration such as
+// "Transfer(address indexed from, address indexed to, uint256 value)".
+func parseEventSignature(sig string) (*eventSpec, error) {
+	m := eventSignatureRe.FindStringSubmatch(sig)
+	if m == nil {
+		return nil, fmt.Errorf("malformed event signature %q", sig)
+	}
+	spec := &eventSpec{}
+	var types []string
+	data := 0
+	if strings.TrimSpace(m[2]) != "" {
+		for i, raw := range strings.Split(m[2], ",") {
+			fields := strings.Fields(raw)
+			if len(fields) == 0 || len(fields) > 3 {
+				return nil, fmt.Errorf("event %s: malformed parameter %q", m[1], strings.TrimSpace(raw))
+			}
+			param := eventParam{Type: fields[0], Name: "arg" + strconv.Itoa(i)}
+			rest := fields[1:]
+			if len(rest) > 0 && rest[0] == "indexed" {
+				param.Indexed = true
+				rest = rest[1:]
+			}
+			if len(rest) == 1 {
+				param.Name = rest[0]
+			} else if len(rest) > 1 {
+				return nil, fmt.Errorf("event %s: malformed parameter %q", m[1], strings.TrimSpace(raw))
+			}
+			switch param.Type {
+			case "uint":
+				param.Type = "uint256"
+			case "int":
+				param.Type = "int256"
+			}
+			if !staticTypeRe.MatchString(param.Type) {
+				return nil, fmt.Errorf("event %s: parameter %s has unsupported type %s (only static types)", m[1], param.Name, param.Type)
+			}
+			if param.Indexed {
+				spec.indexed++
+				param.slot = spec.indexed
+			} else {
+				param.slot = data
+				data++
+			}
+			types = append(types, param.Type)
+			spec.Params = append(spec.Params, param)
+		}
+	}
+	if spec.indexed > 3 {
+		return nil, fmt.Errorf("event %s: more than 3 indexed parameters", m[1])
+	}
+	spec.Topic = crypto.Keccak256Hash([]byte(m[1] + "(" + strings.Join(types, ",") + ")"))
+	return spec, nil
+}
+
+// word returns the 32-byte ABI word of the named parameter in l, or false
+// if the log does not match the event's shape (e.g. ERC-721 Transfer logs,
+// which index one more parameter than ERC-20's).
+func (e *eventSpec) word(l types.Log, name string) (common.Hash, bool) {
+	if name == keyContract {
+		return common.BytesToHash(l.Address.Bytes()), true
+	}
+	for _, p := range e.Params {
+		if p.Name != name {
+			continue
+		}
+		if p.Indexed {
+			return l.Topics[p.slot], true
+		}
+		return common.BytesToHash(l.Data[p.slot*32 : (p.slot+1)*32]), true
+	}
+	return common.Hash{}, false
+}
+
+func (e *eventSpec) matches(l types.Log) bool {
+	return !l.Removed && len(l.Topics) == e.indexed+1 && l.Topics[0] == e.Topic &&
+		len(l.Data) == 32*(len(e.Params)-e.indexed)
+}
+
+func (e *eventSpec) param(name string) (eventParam, bool) {
+	for _, p := range e.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return eventParam{}, false
+}
+
+// loadIndexerConfig reads and validates the indexer file.
+func loadIndexerConfig(path string) (*IndexerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read indexer config: %w", err)
+	}
+	var cfg IndexerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("decode indexer config: %w", err)
+	}
+	seen := map[string]bool{DatasetETH: true, DatasetERC20: true}
+	for i := range cfg.Datasets {
+		ds := &cfg.Datasets[i]
+		if !datasetNameRe.MatchString(ds.Name) {
+			return nil, fmt.Errorf("dataset name %q must be lower-case letters, digits and dashes", ds.Name)
+		}
+		if seen[ds.Name] {
+			return nil, fmt.Errorf("dataset name %q is already in use", ds.Name)
+		}
+		seen[ds.Name] = true
+		if len(ds.Rules) == 0 {
+			return nil, fmt.Errorf("dataset %s: no rules", ds.Name)
+		}
+		for j := range ds.Rules {
+			if err := ds.Rules[j].compile(); err != nil {
+				return nil, fmt.Errorf("dataset %s rule %d: %w", ds.Name, j, err)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+func (r *IndexerRule) compile() error {
+	event, err := parseEventSignature(r.Event)
+	if err != nil {
+		return err
+	}
+	if len(r.Key) == 0 {
+		return fmt.Errorf("key is empty")
+	}
+	for _, name := range r.Key {
+		if _, ok := event.param(name); !ok && name != keyContract {
+			return fmt.Errorf("key parameter %q is not in %s", name, r.Event)
+		}
+	}
+	value, ok := event.param(r.Value)
+	if !ok {
+		return fmt.Errorf("value parameter %q is not in %s", r.Value, r.Event)
+	}
+	switch r.Op {
+	case "":
+		r.Op = OpSet
+	case OpSet:
+	case OpAdd, OpSub:
+		if !strings.HasPrefix(value.Type, "uint") {
+			return fmt.Errorf("%s needs an unsigned value, %s is %s", r.Op, r.Value, value.Type)
+		}
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	r.event = event
+	return nil
+}
+
+// keyMapping assigns database indices to key hashes in first-seen order and
+// persists every assignment to an append-only file of 36-byte records
+// (keccak256 key + uint32 little-endian index). Clients look entries up by
+// hashing the key words exactly as the rule does.
+type keyMapping struct {
+	mu        sync.Mutex
+	path      string
+	public    string
+	publisher Publisher
+	capacity  uint64
+	index     map[common.Hash]uint64
+}
+
+func openKeyMapping(path, public string, publisher Publisher, capacity uint64) (*keyMapping, error) {
+	m := &keyMapping{path: path, public: public, publisher: publisher, capacity: capacity, index: make(map[common.Hash]uint64)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read key-mapping: %w", err)
+	}
+	if len(data)%keyMappingRecordSize != 0 {
+		return nil, fmt.Errorf("key-mapping size %d invalid", len(data))
+	}
+	for i := 0; i < len(data); i += keyMappingRecordSize {
+		m.index[common.BytesToHash(data[i:i+32])] = uint64(binary.LittleEndian.Uint32(data[i+32 : i+36]))
+	}
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			return nil, fmt.Errorf("create key-mapping: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// resolve returns the index for every key, assigning new ones as needed.
+// Keys that no longer fit in the database are reported as missing.
+func (m *keyMapping) resolve(keys []common.Hash) (map[common.Hash]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[common.Hash]uint64, len(keys))
+	var added []byte
+	for _, key := range keys {
+		if idx, ok := m.index[key]; ok {
+			out[key] = idx
+			continue
+		}
+		next := uint64(len(m.index))
+		if next >= m.capacity {
+			log.Printf("key-mapping %s full (%d entries), skipping key %s", filepath.Base(m.path), m.capacity, key.Hex())
+			continue
+		}
+		m.index[key] = next
+		out[key] = next
+		added = append(added, key.Bytes()...)
+		added = binary.LittleEndian.AppendUint32(added, uint32(next))
+	}
+	if len(added) == 0 {
+		return out, nil
+	}
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open key-mapping: %w", err)
+	}
+	if _, err := f.Write(added); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("append key-mapping: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if m.public != "" {
+		if err := copyFile(m.path, m.public); err != nil {
+			return nil, fmt.Errorf("publish key-mapping: %w", err)
+		}
+		if m.publisher != nil {
+			if err := m.publisher.Update(m.public); err != nil {
+				log.Printf("%s publish (%s) failed: %v", m.publisher.Name(), filepath.Base(m.public), err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// indexerSource applies an IndexedDataset's rules to the logs of each block.
+type indexerSource struct {
+	client  *ethclient.Client
+	limiter *tokenBucket
+	rules   []IndexerRule
+	mapping *keyMapping
+	query   ethereum.FilterQuery
+}
+
+func newIndexerSource(client *ethclient.Client, limiter *tokenBucket, ds IndexedDataset, mapping *keyMapping) *indexerSource {
+	var topics []common.Hash
+	var contracts []common.Address
+	seenTopic := make(map[common.Hash]bool)
+	seenContract := make(map[common.Address]bool)
+	anyContract := false
+	for _, rule := range ds.Rules {
+		if !seenTopic[rule.event.Topic] {
+			seenTopic[rule.event.Topic] = true
+			topics = append(topics, rule.event.Topic)
+		}
+		if len(rule.Contracts) == 0 {
+			anyContract = true
+		}
+		for _, c := range rule.Contracts {
+			if !seenContract[c] {
+				seenContract[c] = true
+				contracts = append(contracts, c)
+			}
+		}
+	}
+	if anyContract {
+		contracts = nil
+	}
+	return &indexerSource{
+		client:  client,
+		limiter: limiter,
+		rules:   ds.Rules,
+		mapping: mapping,
+		query:   ethereum.FilterQuery{Addresses: contracts, Topics: [][]common.Hash{topics}},
+	}
+}
+
+func (s *indexerSource) Name() string { return SourceIndexer }
+
+func (s *indexerSource) BlockChanges(ctx context.Context, blockNumber uint64) (*BlockChanges, error) {
+	header, err := blockHeader(ctx, s.client, s.limiter, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	hash, parent, root := header.Hash(), header.ParentHash, header.Root
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	query := s.query
+	query.BlockHash = &hash
+	logs, err := s.client.FilterLogs(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("FilterLogs: %w", err)
+	}
+	changes, err := applyIndexerRules(blockNumber, logs, s.rules, s.mapping)
+	if err != nil {
+		return nil, err
+	}
+	changes.Hash, changes.ParentHash, changes.StateRoot = &hash, &parent, &root
+	return changes, nil
+}
+
+// indexedWrite is one rule applied to one log, before key resolution.
+type indexedWrite struct {
+	key   common.Hash
+	op    string
+	value common.Hash
+}
+
+// applyIndexerRules evaluates rules against logs in log order. "set" rules
+// become Entries, "add"/"sub" become Adjustments; since the syncer applies
+// all Entries before Adjustments, a dataset should not mix set and add/sub
+// rules on the same keys. Keys containing the zero address (mints, burns)
+// are skipped.
+func applyIndexerRules(block uint64, logs []types.Log, rules []IndexerRule, mapping *keyMapping) (*BlockChanges, error) {
+	var writes []indexedWrite
+	for _, l := range logs {
+		for _, rule := range rules {
+			if !rule.event.matches(l) || !ruleAppliesTo(rule, l.Address) {
+				continue
+			}
+			key, ok := rule.keyHash(l)
+			if !ok {
+				continue
+			}
+			value, _ := rule.event.word(l, rule.Value)
+			writes = append(writes, indexedWrite{key: key, op: rule.Op, value: value})
+		}
+	}
+
+	changes := &BlockChanges{Block: block}
+	if len(writes) == 0 {
+		return changes, nil
+	}
+	keys := make([]common.Hash, len(writes))
+	for i, w := range writes {
+		keys[i] = w.key
+	}
+	indices, err := mapping.resolve(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range writes {
+		idx, ok := indices[w.key]
+		if !ok {
+			continue
+		}
+		value := new(big.Int).SetBytes(w.value[:])
+		switch w.op {
+		case OpSet:
+			changes.Entries = append(changes.Entries, EntryChange{Index: idx, Value: bigIntToDBEntry(value)})
+		case OpAdd:
+			changes.Adjustments = append(changes.Adjustments, EntryAdjustment{Index: idx, Delta: value})
+		case OpSub:
+			changes.Adjustments = append(changes.Adjustments, EntryAdjustment{Index: idx, Delta: value.Neg(value)})
+		}
+	}
+	return changes, nil
+}
+
+func ruleAppliesTo(rule IndexerRule, contract common.Address) bool {
+	if len(rule.Contracts) == 0 {
+		return true
+	}
+	for _, c := range rule.Contracts {
+		if c == contract {
+			return true
+		}
+	}
+	return false
+}
+
+// keyHash is keccak256 over the rule's key words in order.
+func (r IndexerRule) keyHash(l types.Log) (common.Hash, bool) {
+	buf := make([]byte, 0, 32*len(r.Key))
+	for _, name := range r.Key {
+		word, ok := r.event.word(l, name)
+		if !ok {
+			return common.Hash{}, false
+		}
+		if isAddressKey(r.event, name) && common.BytesToAddress(word[:]) == (common.Address{}) {
+			return common.Hash{}, false
+		}
+		buf = append(buf, word[:]...)
+	}
+	return crypto.Keccak256Hash(buf), true
+}
+
+func isAddressKey(e *eventSpec, name string) bool {
+	if name == keyContract {
+		return true
+	}
+	p, ok := e.param(name)
+	return ok && p.Type == "address"
+}
+
+// openIndexedSyncer sets up one declared dataset. Like the ERC-20 dataset it
+// follows cfg's change source mode, with the indexer as its live source.
+func openIndexedSyncer(cfg Config, ds IndexedDataset, client *ethclient.Client, anchorAt anchorSource, limiter *tokenBucket, publisher Publisher, parent *SyncMetrics) (*Syncer, error) {
+	dataDir := filepath.Join(filepath.Dir(cfg.DatabasePath), ds.Name)
+	if ds.Database == "" {
+		ds.Database = filepath.Join(dataDir, "database.bin")
+	}
+	if ds.Mapping == "" {
+		ds.Mapping = filepath.Join(dataDir, "key-mapping.bin")
+	}
+	dcfg := cfg.ForDataset(ds.Name, ds.Database, ds.Mapping)
+	dcfg.AccountLayout = AccountLayout{Name: SourceIndexer, EntriesPerAccount: 1, Fields: []string{"value"}}
+	dcfg.IndexedDataset = &ds
+
+	if _, err := os.Stat(ds.Database); os.IsNotExist(err) {
+		if ds.Capacity == 0 {
+			return nil, fmt.Errorf("%s does not exist and no capacity is configured", ds.Database)
+		}
+		if err := createEmptyDatabase(ds.Database, ds.Capacity); err != nil {
+			return nil, err
+		}
+		log.Printf("Created %s database with %d entries\n", ds.Name, ds.Capacity)
+	}
+	if ds.Capacity == 0 {
+		info, err := os.Stat(ds.Database)
+		if err != nil {
+			return nil, err
+		}
+		ds.Capacity = uint64(info.Size()) / DBEntrySize
+	}
+
+	mapping, err := openKeyMapping(ds.Mapping, dcfg.PublicAddressMappingPath(), publisher, ds.Capacity)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d %s keys\n", len(mapping.index), ds.Name)
+
+	var live ChangeSource
+	if client != nil {
+		live = newIndexerSource(client, limiter, ds, mapping)
+	}
+	return openDatasetSyncer(dcfg, live, anchorAt, publisher, parent)
+}
+
+func createEmptyDatabase(path string, entries uint64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(entries * DBEntrySize)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
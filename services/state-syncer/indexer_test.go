@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestParseEventSignature(t *testing.T) {
+	spec, err := parseEventSignature("Transfer(address indexed from, address indexed to, uint value)")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if spec.Topic != transferTopic {
+		t.Fatalf("topic = %s, want %s", spec.Topic.Hex(), transferTopic.Hex())
+	}
+	want := []eventParam{
+		{Name: "from", Type: "address", Indexed: true, slot: 1},
+		{Name: "to", Type: "address", Indexed: true, slot: 2},
+		{Name: "value", Type: "uint256", slot: 0},
+	}
+	if !reflect.DeepEqual(spec.Params, want) {
+		t.Fatalf("params = %+v", spec.Params)
+	}
+
+	for _, bad := range []string{
+		"Transfer",
+		"Named(string name)",
+		"Batch(uint256[] ids)",
+		"Many(uint8 indexed a, uint8 indexed b, uint8 indexed c, uint8 indexed d)",
+		"Odd(address indexed from to extra)",
+	} {
+		if _, err := parseEventSignature(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func testIndexerRule(t *testing.T, rule IndexerRule) IndexerRule {
+	t.Helper()
+	if err := rule.compile(); err != nil {
+		t.Fatalf("compile %q: %v", rule.Event, err)
+	}
+	return rule
+}
+
+func TestApplyIndexerRules(t *testing.T) {
+	// ERC-721 ownership: (contract, tokenId) → owner. Shares its topic with
+	// ERC-20 Transfer, which must not match.
+	owners := testIndexerRule(t, IndexerRule{
+		Event: "Transfer(address indexed from, address indexed to, uint256 indexed tokenId)",
+		Key:   []string{"contract", "tokenId"},
+		Value: "to",
+	})
+	// ERC-20 running balance for one side of the transfer.
+	credits := testIndexerRule(t, IndexerRule{
+		Event:     "Transfer(address indexed from, address indexed to, uint256 value)",
+		Contracts: []common.Address{testToken},
+		Key:       []string{"contract", "to"},
+		Value:     "value",
+		Op:        OpAdd,
+	})
+
+	nft := common.HexToAddress("0x3000000000000000000000000000000000000001")
+	nftLog := transferLog(nft, testHolderA, testHolderB, 0)
+	nftLog.Topics = append(nftLog.Topics, common.BigToHash(big.NewInt(7)))
+	nftLog.Data = nil
+
+	logs := []types.Log{
+		nftLog,
+		transferLog(testToken, testHolderA, testHolderB, 30),
+		transferLog(testToken, testHolderB, common.Address{}, 5), // burn, zero key
+		transferLog(common.HexToAddress("0xdead"), testHolderA, testHolderB, 1),
+		transferLog(testToken, testHolderB, testHolderB, 2),
+	}
+
+	path := filepath.Join(t.TempDir(), "key-mapping.bin")
+	mapping, err := openKeyMapping(path, "", nil, 2)
+	if err != nil {
+		t.Fatalf("open mapping: %v", err)
+	}
+	changes, err := applyIndexerRules(9, logs, []IndexerRule{owners, credits}, mapping)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	wantEntries := []EntryChange{{Index: 0, Value: bigIntToDBEntry(new(big.Int).SetBytes(testHolderB.Bytes()))}}
+	wantAdjustments := []EntryAdjustment{
+		{Index: 1, Delta: big.NewInt(30)},
+		{Index: 1, Delta: big.NewInt(2)},
+	}
+	if !reflect.DeepEqual(changes.Entries, wantEntries) {
+		t.Fatalf("entries:\n got %+v\nwant %+v", changes.Entries, wantEntries)
+	}
+	if !reflect.DeepEqual(changes.Adjustments, wantAdjustments) {
+		t.Fatalf("adjustments:\n got %+v\nwant %+v", changes.Adjustments, wantAdjustments)
+	}
+
+	// Keys are keccak256 over the key words, persisted in assignment order.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read mapping: %v", err)
+	}
+	wantKey := crypto.Keccak256Hash(common.BytesToHash(nft.Bytes()).Bytes(), common.BigToHash(big.NewInt(7)).Bytes())
+	if len(data) != 2*keyMappingRecordSize || common.BytesToHash(data[:32]) != wantKey {
+		t.Fatalf("unexpected mapping file %x", data)
+	}
+	if idx := binary.LittleEndian.Uint32(data[keyMappingRecordSize+32:]); idx != 1 {
+		t.Fatalf("second key index = %d", idx)
+	}
+
+	// The mapping is full: new keys are dropped, known keys still resolve.
+	other := transferLog(testToken, testHolderB, testHolderA, 4)
+	changes, err = applyIndexerRules(10, []types.Log{other, logs[1]}, []IndexerRule{credits}, mapping)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !reflect.DeepEqual(changes.Adjustments, []EntryAdjustment{{Index: 1, Delta: big.NewInt(30)}}) {
+		t.Fatalf("full mapping: got %+v", changes.Adjustments)
+	}
+
+	reopened, err := openKeyMapping(path, "", nil, 2)
+	if err != nil {
+		t.Fatalf("reopen mapping: %v", err)
+	}
+	if !reflect.DeepEqual(reopened.index, mapping.index) {
+		t.Fatalf("reopened mapping = %v, want %v", reopened.index, mapping.index)
+	}
+}
+
+func TestLoadIndexerConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(body string) string {
+		path := filepath.Join(dir, "indexer.json")
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		return path
+	}
+
+	cfg, err := loadIndexerConfig(write(`{"datasets":[{"name":"nft-owners","capacity":16,"rules":[
+		{"event":"Transfer(address indexed from, address indexed to, uint256 indexed tokenId)","key":["contract","tokenId"],"value":"to"}]}]}`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if rule := cfg.Datasets[0].Rules[0]; rule.Op != OpSet || rule.event == nil {
+		t.Fatalf("rule not compiled: %+v", rule)
+	}
+
+	for _, bad := range []string{
+		`{"datasets":[{"name":"erc20","rules":[{"event":"E(uint256 a)","key":["a"],"value":"a"}]}]}`,
+		`{"datasets":[{"name":"Bad Name","rules":[{"event":"E(uint256 a)","key":["a"],"value":"a"}]}]}`,
+		`{"datasets":[{"name":"x","rules":[]}]}`,
+		`{"datasets":[{"name":"x","rules":[{"event":"E(uint256 a)","key":["b"],"value":"a"}]}]}`,
+		`{"datasets":[{"name":"x","rules":[{"event":"E(uint256 a)","key":["a"],"value":"b"}]}]}`,
+		`{"datasets":[{"name":"x","rules":[{"event":"E(address a, int256 v)","key":["a"],"value":"v","op":"add"}]}]}`,
+		`{"datasets":[{"name":"x","rules":[{"event":"E(uint256 a)","key":["a"],"value":"a","op":"mul"}]}]}`,
+	} {
+		if _, err := loadIndexerConfig(write(bad)); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	shell "github.com/ipfs/go-ipfs-api"
@@ -12,6 +17,11 @@ import (
 type IPFSPublisher struct {
 	client  *shell.Shell
 	gateway string
+
+	mu sync.Mutex
+	// named maps IPNS keys known to exist to the CID they point at, which
+	// stays pinned until the name moves on.
+	named map[string]string
 }
 
 func newIPFSPublisher(api, gateway string) (*IPFSPublisher, error) {
@@ -29,6 +39,7 @@ func newIPFSPublisher(api, gateway string) (*IPFSPublisher, error) {
 	return &IPFSPublisher{
 		client:  s,
 		gateway: strings.TrimRight(gateway, "/"),
+		named:   make(map[string]string),
 	}, nil
 }
 
@@ -50,6 +61,118 @@ func (p *IPFSPublisher) PublishFile(path string) (string, error) {
 	return cid, nil
 }
 
+// importDAG streams the directory at path to the node as a CAR file and
+// pins its root.
+func (p *IPFSPublisher) importDAG(path string) (string, error) {
+	r, w := io.Pipe()
+	go func() {
+		_, err := writeCAR(w, path)
+		w.CloseWithError(err)
+	}()
+	out, err := p.client.DagImport(r, false, false)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(out.Roots) == 0 {
+		return "", fmt.Errorf("dag import of %s returned no root", filepath.Base(path))
+	}
+	return out.Roots[0].Root.Cid.Value, nil
+}
+
+func (p *IPFSPublisher) Name() string { return PublisherIPFS }
+
+// Publish pins the file and returns its CID and gateway URL. A directory
+// is imported as the DAG buildDAG makes of it, so its CID is the one
+// computed offline.
+func (p *IPFSPublisher) Publish(path string) (Published, error) {
+	var cid string
+	var err error
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		cid, err = p.importDAG(path)
+	} else {
+		cid, err = p.PublishFile(path)
+	}
+	if err != nil {
+		return Published{}, err
+	}
+	return Published{CID: cid, GatewayURL: p.GatewayURL(cid)}, nil
+}
+
+// Update does nothing: a changed file gets a new CID, so there is no name
+// to publish it under.
+func (p *IPFSPublisher) Update(path string) error { return nil }
+
+// VerifyPin checks that cid is pinned recursively on the node.
+func (p *IPFSPublisher) VerifyPin(cid string) error {
+	var out struct{ Keys map[string]shell.PinInfo }
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := p.client.Request("pin/ls", cid).Option("type", shell.RecursivePin).Exec(ctx, &out); err != nil {
+		return err
+	}
+	if len(out.Keys) == 0 {
+		return fmt.Errorf("%s is not pinned", cid)
+	}
+	return nil
+}
+
+// PublishName adds the files at paths as one directory and points the IPNS
+// name of key at it, creating the key on first use. It returns the name.
+func (p *IPFSPublisher) PublishName(key string, paths ...string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if _, ok := p.named[key]; !ok {
+		keys, err := p.client.KeyList(ctx)
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, k := range keys {
+			found = found || k.Name == key
+		}
+		if !found {
+			if _, err := p.client.KeyGen(ctx, key, shell.KeyGen.Type("ed25519")); err != nil {
+				return "", fmt.Errorf("create key %s: %w", key, err)
+			}
+		}
+		p.named[key] = ""
+	}
+
+	dir, err := os.MkdirTemp("", "plinko-ipns-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	cid, err := p.client.AddDir(dir, shell.Pin(true), shell.CidVersion(1), shell.RawLeaves(true))
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.PublishWithDetails("/ipfs/"+cid, key, 48*time.Hour, time.Minute, false)
+	if err != nil {
+		return "", err
+	}
+	if old := p.named[key]; old != "" && old != cid {
+		if err := p.client.Unpin(old); err != nil {
+			log.Printf("⚠️ Failed to unpin previous IPNS target %s: %v", old, err)
+		}
+	}
+	p.named[key] = cid
+	return resp.Name, nil
+}
+
 func (p *IPFSPublisher) GatewayURL(cid string) string {
 	if p == nil || cid == "" || p.gateway == "" {
 		return ""
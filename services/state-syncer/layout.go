@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	LayoutBalance = "balance"
+	LayoutAccount = "account"
+)
+
+const (
+	FieldNonce    = "nonce"
+	FieldBalance  = "balance"
+	FieldCodeHash = "code_hash"
+)
+
+// AccountLayout describes how accounts map onto database entries. Account i
+// owns the EntriesPerAccount consecutive entries starting at
+// i*EntriesPerAccount, one per field in Fields order. Every field is stored
+// as a 256-bit unsigned integer in four little-endian uint64 words, least
+// significant word first (see bigIntToDBEntry); the code hash is the
+// keccak256 digest read as a big-endian integer.
+//
+// The layout is recorded in the snapshot manifest so clients know which
+// entry to query for a given field.
+type AccountLayout struct {
+	Name              string   `json:"name"`
+	EntriesPerAccount uint64   `json:"entries_per_account"`
+	Fields            []string `json:"fields"`
+}
+
+var accountLayouts = map[string][]string{
+	// One balance per account, as produced by build_database_from_parquet.py.
+	LayoutBalance: {FieldBalance},
+	// Full account record: [nonce, balance, code_hash].
+	LayoutAccount: {FieldNonce, FieldBalance, FieldCodeHash},
+}
+
+func parseAccountLayout(name string) (AccountLayout, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = LayoutBalance
+	}
+	fields, ok := accountLayouts[name]
+	if !ok {
+		return AccountLayout{}, fmt.Errorf("unknown account layout %q", name)
+	}
+	return AccountLayout{
+		Name:              name,
+		EntriesPerAccount: uint64(len(fields)),
+		Fields:            append([]string(nil), fields...),
+	}, nil
+}
+
+// Has reports whether the layout stores field.
+func (l AccountLayout) Has(field string) bool {
+	_, ok := l.fieldOffset(field)
+	return ok
+}
+
+// EntryIndex returns the database index holding field for the account at
+// accountIdx in the address mapping.
+func (l AccountLayout) EntryIndex(accountIdx uint64, field string) (uint64, bool) {
+	offset, ok := l.fieldOffset(field)
+	if !ok {
+		return 0, false
+	}
+	return accountIdx*l.EntriesPerAccount + offset, true
+}
+
+func (l AccountLayout) fieldOffset(field string) (uint64, bool) {
+	for i, f := range l.Fields {
+		if f == field {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+func (l AccountLayout) String() string {
+	return fmt.Sprintf("%s[%s]", l.Name, strings.Join(l.Fields, ","))
+}
+
+func hashToDBEntry(h common.Hash) DBEntry {
+	return bigIntToDBEntry(new(big.Int).SetBytes(h[:]))
+}
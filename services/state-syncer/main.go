@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
@@ -19,9 +20,10 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
+
+	"state-syncer/manifestsig"
 )
 
 type Config struct {
@@ -38,6 +40,49 @@ type Config struct {
 	Simulated          bool
 	PollInterval       time.Duration
 	SnapshotEvery      uint64
+	Finality           FinalityPolicy
+	ChangeSource       string
+	ReplayDir          string
+	RecordDir          string
+	RPCBatchSize       int
+	RPCConcurrency     int
+	RPCRateLimit       uint64
+	RPCMaxRetries      int
+	AccountLayout      AccountLayout
+	Dataset            string
+	MappingName        string
+	ERC20DatabasePath  string
+	ERC20MappingPath   string
+	IndexerConfigPath  string
+	IndexedDataset     *IndexedDataset
+	AppendAccounts     bool
+	// CheckpointEvery is how many blocks the write-ahead log collects
+	// before the database file is rewritten (see wal.go).
+	CheckpointEvery uint64
+	// EpochAnnouncePercent and EpochLeadBlocks control when the next epoch
+	// is announced and how long clients get to rehint (see advanceEpoch).
+	EpochAnnouncePercent uint64
+	EpochLeadBlocks      uint64
+	// PackedDeltas also publishes every delta and bundle in the packed
+	// encoding (see packed.go).
+	PackedDeltas bool
+	// CompactInterval is how often the compactor looks for bundles to
+	// merge into the next level (0 disables it).
+	CompactInterval time.Duration
+	// SnapshotChunks says whether snapshots describe database.bin chunk by
+	// chunk (see chunks.go).
+	SnapshotChunks string
+	// SigningKeys sign every manifest written; none leaves them unsigned.
+	SigningKeys []manifestsig.Key
+	// IPNSKey names the IPFS key whose IPNS name points at the latest
+	// manifest; empty disables IPNS.
+	IPNSKey string
+	// Publishers lists the backends artifacts are copied to (see
+	// publisher.go); PublishDir and PublishURL configure "fs", S3 "s3".
+	Publishers []string
+	PublishDir string
+	PublishURL string
+	S3         S3Config
 }
 
 func LoadConfig() Config {
@@ -52,16 +97,91 @@ func LoadConfig() Config {
 		RPCURL:             getEnv("PLINKO_STATE_RPC_URL", "http://eth-mock:8545"),
 		RPCToken:           os.Getenv("PLINKO_STATE_RPC_TOKEN"),
 		Simulated:          getEnvBool("PLINKO_STATE_SIMULATED", true),
+		ReplayDir:          strings.TrimSpace(os.Getenv("PLINKO_STATE_REPLAY_DIR")),
+		RecordDir:          strings.TrimSpace(os.Getenv("PLINKO_STATE_RECORD_DIR")),
+		RPCBatchSize:       int(getEnvUint("PLINKO_STATE_RPC_BATCH_SIZE", defaultRPCBatchSize)),
+		RPCConcurrency:     int(getEnvUint("PLINKO_STATE_RPC_CONCURRENCY", defaultRPCConcurrency)),
+		RPCRateLimit:       getEnvUint("PLINKO_STATE_RPC_RATE_LIMIT", 0),
+		RPCMaxRetries:      int(getEnvUint("PLINKO_STATE_RPC_MAX_RETRIES", defaultRPCMaxRetries)),
 		PollInterval:       getEnvDuration("PLINKO_STATE_POLL_INTERVAL", 5*time.Second),
 		SnapshotEvery:      getEnvUint("PLINKO_STATE_SNAPSHOT_EVERY", 0),
+		CheckpointEvery:    getEnvUint("PLINKO_STATE_CHECKPOINT_EVERY", 1000),
+		Dataset:            DatasetETH,
+		ERC20DatabasePath:  strings.TrimSpace(os.Getenv("PLINKO_STATE_ERC20_DB_PATH")),
+		ERC20MappingPath:   getEnv("PLINKO_STATE_ERC20_MAPPING_PATH", "/data/erc20/token-mapping.bin"),
+		IndexerConfigPath:  strings.TrimSpace(os.Getenv("PLINKO_STATE_INDEXER_CONFIG")),
+		AppendAccounts:     getEnvBool("PLINKO_STATE_APPEND_ACCOUNTS", true),
 	}
 	if start := strings.TrimSpace(os.Getenv("PLINKO_STATE_START_BLOCK")); start != "" {
 		if val, err := strconv.ParseUint(start, 10, 64); err == nil {
 			cfg.StartBlock = val
 		}
 	}
+	finality, err := parseFinalityPolicy(os.Getenv("PLINKO_STATE_FINALITY"), getEnvUint("PLINKO_STATE_CONFIRMATIONS", 0))
+	if err != nil {
+		log.Printf("%v, following latest head", err)
+		finality = FinalityPolicy{Mode: FinalityLatest}
+	}
+	cfg.Finality = finality
+	cfg.EpochAnnouncePercent = getEnvUint("PLINKO_STATE_EPOCH_ANNOUNCE_PERCENT", 90)
+	cfg.EpochLeadBlocks = getEnvUint("PLINKO_STATE_EPOCH_LEAD_BLOCKS", 300) // about an hour of mainnet blocks
+	cfg.PackedDeltas = getEnvBool("PLINKO_STATE_PACKED_DELTAS", false)
+	cfg.CompactInterval = getEnvDuration("PLINKO_STATE_COMPACT_INTERVAL", time.Minute)
+
+	// Reading the database with the wrong layout would corrupt it, so an
+	// unknown layout is fatal rather than falling back to a default.
+	layout, err := parseAccountLayout(os.Getenv("PLINKO_STATE_ACCOUNT_LAYOUT"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.AccountLayout = layout
+
+	chunks, err := parseSnapshotChunks(os.Getenv("PLINKO_STATE_SNAPSHOT_CHUNKS"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.SnapshotChunks = chunks
+
+	// A configured key that cannot be loaded must not silently turn into
+	// unsigned manifests.
+	keys, err := manifestsig.LoadKeys(os.Getenv("PLINKO_STATE_SIGNING_KEYS"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, key := range keys {
+		log.Printf("Signing manifests with key %s (public key %s)", key.ID, key.PublicKeyHex())
+	}
+	cfg.SigningKeys = keys
+
+	// PLINKO_STATE_SIMULATED and PLINKO_STATE_TRACE_CHANGES pick the default
+	// source; PLINKO_STATE_CHANGE_SOURCE overrides both.
+	defaultSource := SourceTrace
+	if cfg.Simulated {
+		defaultSource = SourceSimulated
+	} else if !getEnvBool("PLINKO_STATE_TRACE_CHANGES", true) {
+		defaultSource = SourceRPC
+	}
+	cfg.ChangeSource = strings.ToLower(getEnv("PLINKO_STATE_CHANGE_SOURCE", defaultSource))
+	cfg.Simulated = cfg.ChangeSource == SourceSimulated
 	cfg.IPFSAPI = strings.TrimSpace(cfg.IPFSAPI)
 	cfg.IPFSGateway = strings.TrimRight(strings.TrimSpace(cfg.IPFSGateway), "/")
+
+	cfg.IPNSKey = strings.TrimSpace(os.Getenv("PLINKO_STATE_IPNS_KEY"))
+	// Without PLINKO_STATE_PUBLISHERS, artifacts are pinned to IPFS when an
+	// API is configured, as before.
+	cfg.Publishers = parsePublishers(os.Getenv("PLINKO_STATE_PUBLISHERS"), cfg.IPFSAPI)
+	cfg.PublishDir = strings.TrimSpace(os.Getenv("PLINKO_STATE_PUBLISH_DIR"))
+	cfg.PublishURL = strings.TrimSpace(os.Getenv("PLINKO_STATE_PUBLISH_URL"))
+	cfg.S3 = S3Config{
+		Endpoint:        strings.TrimSpace(os.Getenv("PLINKO_STATE_S3_ENDPOINT")),
+		Region:          getEnv("PLINKO_STATE_S3_REGION", getEnv("AWS_REGION", "us-east-1")),
+		Bucket:          strings.TrimSpace(os.Getenv("PLINKO_STATE_S3_BUCKET")),
+		Prefix:          strings.TrimSpace(os.Getenv("PLINKO_STATE_S3_PREFIX")),
+		AccessKeyID:     getEnv("PLINKO_STATE_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: getEnv("PLINKO_STATE_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PublicURL:       strings.TrimSpace(os.Getenv("PLINKO_STATE_S3_PUBLIC_URL")),
+	}
 	return cfg
 }
 
@@ -77,57 +197,71 @@ func (c Config) LatestSnapshotLink() string {
 }
 
 func (c Config) PublicAddressMappingPath() string {
+	name := "address-mapping.bin"
+	if c.MappingName != "" {
+		name = c.MappingName
+	}
 	if c.PublicRoot == "" {
-		return "address-mapping.bin"
+		return name
 	}
-	return filepath.Join(c.PublicRoot, "address-mapping.bin")
+	return filepath.Join(c.PublicRoot, name)
 }
 
-func main() {
-	cfg := LoadConfig()
-	log.Printf("State Syncer starting (rpc=%s, simulated=%v)\n", cfg.RPCURL, cfg.Simulated)
-
-	metrics := NewSyncMetrics(cfg.Simulated)
-	go startMetricsServer(cfg.HTTPPort, metrics)
+// ForDataset returns cfg for a secondary dataset stored at dbPath with its
+// key mapping at mappingPath. Its snapshots, deltas, manifest and published
+// mapping live under <PublicRoot>/<name>/ so they never collide with the
+// primary ETH dataset, and recordings go to a subdirectory of the same name.
+func (c Config) ForDataset(name, dbPath, mappingPath string) Config {
+	d := c
+	d.Dataset = name
+	d.DatabasePath = dbPath
+	d.AddressMappingPath = mappingPath
+	d.MappingName = filepath.Base(mappingPath)
+	d.PublicRoot = filepath.Join(c.PublicRoot, name)
+	d.DeltaDir = filepath.Join(d.PublicRoot, "deltas")
+	if c.IPNSKey != "" {
+		d.IPNSKey = c.IPNSKey + "-" + name
+	}
+	if c.ReplayDir != "" {
+		d.ReplayDir = filepath.Join(c.ReplayDir, name)
+	}
+	if c.RecordDir != "" {
+		d.RecordDir = filepath.Join(c.RecordDir, name)
+	}
+	return d
+}
 
-	ipfsPublisher, err := newIPFSPublisher(cfg.IPFSAPI, cfg.IPFSGateway)
-	if err != nil {
-		log.Fatalf("ipfs publisher init: %v", err)
-	}
-	if ipfsPublisher != nil {
-		log.Printf("IPFS publishing enabled (api=%s)\n", cfg.IPFSAPI)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export-car" {
+		if err := runExportCAR(os.Args[2:]); err != nil {
+			log.Fatalf("export-car: %v", err)
+		}
+		return
 	}
-
-	addressIndex, err := loadAddressMapping(cfg.AddressMappingPath)
-	if err != nil {
-		log.Fatalf("load address mapping: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:]); err != nil {
+			log.Fatalf("verify: %v", err)
+		}
+		return
 	}
-	log.Printf("Loaded %d address mappings\n", len(addressIndex))
 
-	db, dbSize, chunkSize, setSize, err := loadDatabase(cfg.DatabasePath)
-	if err != nil {
-		log.Fatalf("load database: %v", err)
-	}
+	cfg := LoadConfig()
+	log.Printf("State Syncer starting (rpc=%s, source=%s, finality=%s, layout=%s)\n", cfg.RPCURL, cfg.ChangeSource, cfg.Finality, cfg.AccountLayout)
 
-	manager := NewPlinkoUpdateManager(db, dbSize, chunkSize, setSize)
-	// manager.EnableCacheMode() - Removed as we now use raw deltas (no server-side hint mapping)
+	metrics := NewSyncMetrics(cfg.ChangeSource)
+	go startMetricsServer(cfg.HTTPPort, metrics)
 
-	if err := os.MkdirAll(cfg.DeltaDir, 0o755); err != nil {
-		log.Fatalf("create delta dir: %v", err)
-	}
-	if err := os.MkdirAll(cfg.SnapshotsRoot(), 0o755); err != nil {
-		log.Fatalf("create snapshot dir: %v", err)
+	publisher, err := newPublisher(cfg)
+	if err != nil {
+		log.Fatalf("publisher init: %v", err)
 	}
-
-	bundler := NewDeltaBundler(cfg, ipfsPublisher)
-
-	if err := ensureAddressMappingPublished(cfg.AddressMappingPath, cfg.PublicAddressMappingPath()); err != nil {
-		log.Fatalf("publish address-mapping: %v", err)
+	if publisher != nil {
+		log.Printf("Publishing artifacts to %s\n", publisher.Name())
 	}
 
 	var client *ethclient.Client
 	var chainID *big.Int
-	if !cfg.Simulated {
+	if cfg.ChangeSource == SourceRPC || cfg.ChangeSource == SourceTrace {
 		client, err = dialEthereumClient(cfg.RPCURL, cfg.RPCToken)
 		if err != nil {
 			log.Fatalf("dial rpc: %v", err)
@@ -139,73 +273,65 @@ func main() {
 		}
 	}
 
-	if version, err := writeSnapshot(cfg, db, dbSize, cfg.StartBlock, chunkSize, setSize, ipfsPublisher); err != nil {
-		log.Printf("initial snapshot error: %v", err)
-		metrics.RecordError(err)
-	} else {
-		log.Printf("Published snapshot %s\n", version)
-	}
-
-	lastBlock := cfg.StartBlock
-	for {
-		nextBlock := lastBlock + 1
-
-		if !cfg.Simulated {
-			head, err := client.BlockNumber(context.Background())
-			if err != nil {
-				log.Printf("blockNumber error: %v", err)
-				metrics.RecordError(err)
-				time.Sleep(cfg.PollInterval)
-				continue
-			}
-			if head < nextBlock {
-				time.Sleep(cfg.PollInterval)
-				continue
-			}
-		}
+	// All datasets share one limiter since they hit the same endpoint.
+	limiter := newTokenBucket(float64(cfg.RPCRateLimit), cfg.RPCConcurrency)
 
-		var updates []DBUpdate
-		if cfg.Simulated {
-			updates = simulateUpdates(db, dbSize, nextBlock)
-		} else {
-			updateCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			updates = fetchUpdates(updateCtx, client, chainID, addressIndex, db, nextBlock)
-			cancel()
-		}
+	// Every dataset's first snapshot is anchored at the block its database
+	// recovered.
+	anchorAt := chainAnchors(context.Background(), client, limiter, chainID)
 
-		if len(updates) == 0 {
-			lastBlock = nextBlock
-			continue
+	syncer, err := openSyncer(cfg, anchorAt, publisher, metrics)
+	if err != nil {
+		log.Fatalf("open %s dataset: %v", cfg.Dataset, err)
+	}
+	// Loaded after openSyncer, which recovers accounts the mapping lost.
+	addressIndex, err := loadAddressMapping(cfg.AddressMappingPath)
+	if err != nil {
+		log.Fatalf("load address mapping: %v", err)
+	}
+	log.Printf("Loaded %d address mappings\n", len(addressIndex))
+	syncer.layout = cfg.AccountLayout
+	syncer.addressIndex = addressIndex
+	syncer.nextAccount = nextAccountIndex(addressIndex)
+
+	var live ChangeSource
+	if client != nil {
+		fetcher := newAccountFetcher(client.Client(), limiter, cfg.RPCBatchSize, cfg.RPCConcurrency, cfg.RPCMaxRetries, defaultRPCRetryBackoff)
+		// With account growth every touched account is a candidate, so the
+		// source must not filter by the mapping.
+		tracked := addressIndex
+		if cfg.AppendAccounts {
+			tracked = nil
 		}
+		live = newRPCSource(client, chainID, tracked, cfg.AccountLayout, cfg.ChangeSource == SourceTrace, fetcher, limiter)
+	}
+	if syncer.source, err = newChangeSource(cfg, live, syncer.dbSize); err != nil {
+		log.Fatalf("change source: %v", err)
+	}
 
-		deltas, duration := manager.ApplyUpdates(updates)
-		log.Printf("block %d: %d updates, %d deltas (%s)\n", nextBlock, len(updates), len(deltas), duration)
-
-		if err := flushDatabase(cfg.DatabasePath, db, dbSize); err != nil {
-			log.Printf("flush database failed: %v", err)
-			metrics.RecordError(err)
+	if cfg.ERC20DatabasePath != "" {
+		erc20, err := openERC20Syncer(cfg, client, anchorAt, limiter, publisher, metrics)
+		if err != nil {
+			log.Fatalf("open %s dataset: %v", DatasetERC20, err)
 		}
+		go erc20.Run(client)
+	}
 
-		deltaPath := filepath.Join(cfg.DeltaDir, fmt.Sprintf("delta-%06d.bin", nextBlock))
-		if err := saveDelta(deltaPath, deltas); err != nil {
-			log.Printf("save delta failed: %v", err)
-			metrics.RecordError(err)
-		} else {
-			if err := bundler.PublishDelta(nextBlock, deltaPath); err != nil {
-				log.Printf("bundler error: %v", err)
-			}
+	if cfg.IndexerConfigPath != "" {
+		indexer, err := loadIndexerConfig(cfg.IndexerConfigPath)
+		if err != nil {
+			log.Fatalf("indexer config: %v", err)
 		}
-
-		if cfg.SnapshotEvery > 0 && nextBlock%cfg.SnapshotEvery == 0 {
-			if _, err := writeSnapshot(cfg, db, dbSize, nextBlock, chunkSize, setSize, ipfsPublisher); err != nil {
-				log.Printf("snapshot error: %v", err)
-				metrics.RecordError(err)
+		for _, ds := range indexer.Datasets {
+			dataset, err := openIndexedSyncer(cfg, ds, client, anchorAt, limiter, publisher, metrics)
+			if err != nil {
+				log.Fatalf("open %s dataset: %v", ds.Name, err)
 			}
+			go dataset.Run(client)
 		}
-
-		metrics.RecordBlock(nextBlock, len(updates), len(deltas), duration)
-		lastBlock = nextBlock
 	}
+
+	syncer.Run(client)
 }
 
 func loadAddressMapping(path string) (map[string]uint64, error) {
@@ -249,6 +375,8 @@ func loadDatabase(path string) ([]uint64, uint64, uint64, uint64, error) {
 	return database, dbEntries, chunkSize, setSize, nil
 }
 
+// flushDatabase writes the first dbSize entries of db to path, replacing
+// the file atomically.
 func flushDatabase(path string, db []uint64, dbSize uint64) error {
 	tmp := path + ".tmp"
 	f, err := os.Create(tmp)
@@ -257,145 +385,26 @@ func flushDatabase(path string, db []uint64, dbSize uint64) error {
 	}
 	defer f.Close() // Ensure file is closed even on error
 
+	w := bufio.NewWriterSize(f, 1<<20)
 	buf := make([]byte, DBEntrySize)
-	limit := dbSize * DBEntryLength // Iterate over actual uint64 words in the flattened array
-
-	if limit > uint64(len(db)) {
-		limit = uint64(len(db))
-	}
-
-	for i := uint64(0); i < dbSize; i++ {
+	for i := uint64(0); i < dbSize && (i+1)*DBEntryLength <= uint64(len(db)); i++ {
 		for j := 0; j < DBEntryLength; j++ {
 			binary.LittleEndian.PutUint64(buf[j*8:(j+1)*8], db[i*DBEntryLength+uint64(j)])
 		}
-		if _, err := f.Write(buf); err != nil {
+		if _, err := w.Write(buf); err != nil {
 			return err
 		}
 	}
-
-	// Ensure all data is written to disk before renaming
-	if err := f.Sync(); err != nil {
+	if err := w.Flush(); err != nil {
 		return err
 	}
 
-	return os.Rename(tmp, path)
-}
-
-func saveDelta(path string, deltas []HintDelta) error {
-	tmp := path + ".tmp"
-	f, err := os.Create(tmp)
-	if err != nil {
-		return err
-	}
-	defer f.Close() // Ensure file is closed even on error
-
-	var header [16]byte
-	binary.LittleEndian.PutUint64(header[0:8], uint64(len(deltas)))
-	// Use 8 bytes for DBEntryLength (4), so header is still 16 bytes for future compatibility
-	binary.LittleEndian.PutUint64(header[8:16], uint64(DBEntryLength))
-
-	if _, err := f.Write(header[:]); err != nil {
-		return err
-	}
-
-	if err := f.Chmod(0644); err != nil {
-		return err
-	}
-
-	// Each delta record is: Index (8 bytes) + Delta (32 bytes = 4 * uint64)
-	// Total size: 8 + 32 = 40 bytes
-	var buf [40]byte
-
-	for _, delta := range deltas {
-		binary.LittleEndian.PutUint64(buf[0:8], delta.Index)
-		
-		// Write the 4 uint64 words of the DBEntry
-		for i := 0; i < DBEntryLength; i++ {
-			binary.LittleEndian.PutUint64(buf[8+i*8:8+(i+1)*8], delta.Delta[i])
-		}
-		if _, err := f.Write(buf[:]); err != nil {
-			return err
-		}
-	}
 	// Ensure all data is written to disk before renaming
 	if err := f.Sync(); err != nil {
 		return err
 	}
-	return os.Rename(tmp, path)
-}
-
-func simulateUpdates(db []uint64, dbSize uint64, block uint64) []DBUpdate {
-	if dbSize == 0 {
-		return nil
-	}
-	updates := make([]DBUpdate, simulatedUpdatesPerBlock)
-	for i := 0; i < simulatedUpdatesPerBlock; i++ {
-		index := uint64((block*uint64(simulatedUpdatesPerBlock) + uint64(i)) % dbSize)
-		oldValue := DBEntry{db[index]}
-		newValue := DBEntry{uint64(block)*1000 + uint64(i)}
-		updates[i] = DBUpdate{
-			Index:    index,
-			OldValue: oldValue,
-			NewValue: newValue,
-		}
-	}
-	return updates
-}
-
-func fetchUpdates(ctx context.Context, client *ethclient.Client, chainID *big.Int, indexMap map[string]uint64, db []uint64, blockNumber uint64) []DBUpdate {
-	block, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(blockNumber))
-	if err != nil {
-		log.Printf("BlockByNumber error: %v", err)
-		return nil
-	}
-
-	signer := types.LatestSignerForChainID(chainID)
-	addresses := make(map[string]struct{})
-	for _, tx := range block.Transactions() {
-		if from, err := types.Sender(signer, tx); err == nil {
-			addresses[strings.ToLower(from.Hex())] = struct{}{}
-		}
-		if to := tx.To(); to != nil {
-			addresses[strings.ToLower(to.Hex())] = struct{}{}
-		}
-	}
-
-	if len(addresses) == 0 {
-		return nil
-	}
-
-	results := make([]DBUpdate, 0, len(addresses))
-	for addrHex := range addresses {
-		accountIdx, ok := indexMap[addrHex]
-		if !ok {
-			continue
-		}
-		// Account layout: [nonce, balance, bytecode_hash] = 3 words
-		// Balance is at accountIdx + 1
-		balanceIdx := accountIdx + 1
-
-		balance, err := client.BalanceAt(ctx, common.HexToAddress(addrHex), new(big.Int).SetUint64(blockNumber))
-		if err != nil {
-			log.Printf("BalanceAt error for %s: %v", addrHex, err)
-			continue
-		}
-
-		// Read old balance (256-bit = 4 uint64 words)
-		oldValue := readDBEntry(db, balanceIdx)
-
-		// Convert big.Int balance to DBEntry (little-endian 256-bit)
-		newValue := bigIntToDBEntry(balance)
 
-		if oldValue == newValue {
-			continue
-		}
-		results = append(results, DBUpdate{
-			Index:    balanceIdx,
-			OldValue: oldValue,
-			NewValue: newValue,
-		})
-	}
-	return results
+	return os.Rename(tmp, path)
 }
 
 // readDBEntry reads a 256-bit entry from the database at the given index
@@ -430,11 +439,22 @@ func bigIntToDBEntry(val *big.Int) DBEntry {
 	return entry
 }
 
+// dbEntryToBigInt is the inverse of bigIntToDBEntry.
+func dbEntryToBigInt(entry DBEntry) *big.Int {
+	var buf [32]byte
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint64(buf[24-i*8:32-i*8], entry[i])
+	}
+	return new(big.Int).SetBytes(buf[:])
+}
+
 type SnapshotFile struct {
 	Path   string            `json:"path"`
 	Size   int64             `json:"size"`
 	SHA256 string            `json:"sha256"`
 	IPFS   *SnapshotFileIPFS `json:"ipfs,omitempty"`
+	// URL is the copy on a name-addressed publisher such as S3.
+	URL string `json:"url,omitempty"`
 }
 
 type SnapshotFileIPFS struct {
@@ -443,76 +463,133 @@ type SnapshotFileIPFS struct {
 }
 
 type SnapshotManifest struct {
+	Dataset     string         `json:"dataset"`
 	Version     string         `json:"version"`
+	Epoch       uint64         `json:"epoch"`
 	Block       uint64         `json:"block"`
 	GeneratedAt time.Time      `json:"generated_at"`
 	DBSize      uint64         `json:"db_size"`
 	ChunkSize   uint64         `json:"chunk_size"`
 	SetSize     uint64         `json:"set_size"`
-	Files       []SnapshotFile `json:"files"`
+	Finality    FinalityPolicy `json:"finality"`
+	Layout      AccountLayout  `json:"layout"`
+	// Indexer carries the rules of a declared dataset so clients can derive
+	// entry keys the same way the syncer does.
+	Indexer *IndexedDataset `json:"indexer,omitempty"`
+	// IPFS is the root of the files as one UnixFS directory, which clients
+	// and pinning services can fetch as a whole. Each file's CID is the
+	// link of that name in it.
+	IPFS   *SnapshotFileIPFS `json:"ipfs,omitempty"`
+	Files  []SnapshotFile    `json:"files"`
+	Chunks *SnapshotChunks   `json:"chunks,omitempty"`
+	// Digest is the dbdigest of database.bin, which a server loading the
+	// snapshot checks before serving it.
+	Digest string `json:"digest,omitempty"`
+	// ChainID, BlockHash and StateRoot anchor database.bin to the chain as
+	// the state after Block. The first delta after the snapshot has
+	// BlockHash as its parent hash.
+	ChainID   uint64       `json:"chain_id,omitempty"`
+	BlockHash *common.Hash `json:"block_hash,omitempty"`
+	StateRoot *common.Hash `json:"state_root,omitempty"`
 }
 
-func writeSnapshot(cfg Config, db []uint64, dbSize, block, chunkSize, setSize uint64, publisher *IPFSPublisher) (string, error) {
-	version := fmt.Sprintf("block-%06d", block)
+// writeSnapshot writes the database as of anchor, with the mapping that
+// indexes it and its digest, into a new snapshot and publishes the snapshot
+// directory through bundler, which retries failed publishes.
+func writeSnapshot(cfg Config, db []uint64, dbSize uint64, anchor ChainAnchor, chunkSize, setSize, epoch uint64, digest string, bundler *DeltaBundler) (string, error) {
+	version := fmt.Sprintf("block-%06d", anchor.Block)
 	dir := filepath.Join(cfg.SnapshotsRoot(), version)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return "", err
 	}
-	path := filepath.Join(dir, "database.bin")
-	if err := flushDatabase(path, db, dbSize); err != nil {
+	if err := flushDatabase(filepath.Join(dir, "database.bin"), db, dbSize); err != nil {
 		return "", err
 	}
+	names := []string{"database.bin"}
+	if cfg.AddressMappingPath != "" {
+		name := filepath.Base(cfg.PublicAddressMappingPath())
+		if err := copyFile(cfg.AddressMappingPath, filepath.Join(dir, name)); err != nil {
+			return "", fmt.Errorf("copy %s: %w", name, err)
+		}
+		names = append(names, name)
+	}
 
-	size, hash, err := hashFile(path)
+	chunks, err := writeSnapshotChunks(dir, chunkSize, cfg.SnapshotChunks)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("split snapshot into chunks: %w", err)
 	}
 
-	fileEntry := SnapshotFile{
-		Path:   "database.bin",
-		Size:   size,
-		SHA256: hash,
+	root, nodes, err := buildDAG(dir, nil)
+	if err != nil {
+		return "", fmt.Errorf("build snapshot DAG: %w", err)
+	}
+	published := bundler.publish(dir, publishJob{Target: targetSnapshot})
+	if published.CID != "" {
+		log.Printf("Published snapshot %s to IPFS CID %s\n", version, published.CID)
 	}
 
-	if publisher != nil {
-		if cid, err := publisher.PublishFile(path); err != nil {
-			log.Printf("ipfs publish (database.bin) failed: %v", err)
-		} else {
-			fileEntry.IPFS = &SnapshotFileIPFS{
-				CID:        cid,
-				GatewayURL: publisher.GatewayURL(cid),
-			}
-			log.Printf("Pinned database.bin to IPFS CID %s\n", cid)
+	files := make([]SnapshotFile, 0, len(names))
+	for _, name := range names {
+		size, hash, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
 		}
+		files = append(files, snapshotFile(name, size, hash, nodes[name], published))
 	}
 
 	manifest := SnapshotManifest{
+		Dataset:     cfg.Dataset,
 		Version:     version,
-		Block:       block,
+		Epoch:       epoch,
+		Block:       anchor.Block,
+		ChainID:     anchor.ChainID,
+		BlockHash:   hashField(anchor.Hash),
+		StateRoot:   hashField(anchor.StateRoot),
 		GeneratedAt: time.Now().UTC(),
 		DBSize:      dbSize,
 		ChunkSize:   chunkSize,
 		SetSize:     setSize,
-		Files:       []SnapshotFile{fileEntry},
+		Finality:    cfg.Finality,
+		Layout:      cfg.AccountLayout,
+		Indexer:     cfg.IndexedDataset,
+		IPFS:        &SnapshotFileIPFS{CID: root.CID(), GatewayURL: published.GatewayURL},
+		Files:       files,
+		Chunks:      chunks,
+		Digest:      digest,
 	}
 
 	manifestPath := filepath.Join(dir, "manifest.json")
 	if err := writeJSON(manifestPath, manifest); err != nil {
 		return "", err
 	}
-	if publisher != nil {
-		if cid, err := publisher.PublishFile(manifestPath); err != nil {
-			log.Printf("ipfs publish (manifest.json) failed: %v", err)
-		} else {
-			log.Printf("Pinned manifest.json to IPFS CID %s\n", cid)
-		}
+	if err := signFile(manifestPath, manifest.Block, cfg.SigningKeys); err != nil {
+		return "", err
 	}
 	if err := updateLatestSnapshotSymlink(cfg.SnapshotsRoot(), version); err != nil {
 		return "", err
 	}
+	bundler.publishSnapshotManifest(manifestPath)
 	return version, nil
 }
 
+// snapshotFile describes the file name of a snapshot whose directory was
+// published as dir.
+func snapshotFile(name string, size int64, hash string, node dagNode, dir Published) SnapshotFile {
+	file := SnapshotFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hash,
+		IPFS:   &SnapshotFileIPFS{CID: node.CID()},
+	}
+	if dir.GatewayURL != "" {
+		file.IPFS.GatewayURL = dir.GatewayURL + "/" + name
+	}
+	if dir.URL != "" {
+		file.URL = dir.URL + "/" + name
+	}
+	return file
+}
+
 func ensureAddressMappingPublished(src, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return err
@@ -560,6 +637,19 @@ func hashFile(path string) (int64, string, error) {
 	return size, hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// signFile writes the signatures of the file at path, a manifest as of
+// block sequence, next to it.
+func signFile(path string, sequence uint64, keys []manifestsig.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return manifestsig.WriteFile(path, data, sequence, keys)
+}
+
 func writeJSON(path string, v any) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
@@ -19,19 +19,27 @@ type SyncMetrics struct {
 	lastDeltaCount  int
 	lastDuration    time.Duration
 	lastError       string
+	datasets        map[string]*SyncMetrics
 }
 
-func NewSyncMetrics(simulated bool) *SyncMetrics {
-	mode := "rpc"
-	if simulated {
-		mode = "simulated"
-	}
+func NewSyncMetrics(mode string) *SyncMetrics {
 	return &SyncMetrics{
 		startedAt: time.Now(),
 		mode:      mode,
 	}
 }
 
+// AddDataset reports a secondary dataset's metrics under "datasets" in this
+// one's /health and /metrics payloads.
+func (m *SyncMetrics) AddDataset(name string, child *SyncMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.datasets == nil {
+		m.datasets = make(map[string]*SyncMetrics)
+	}
+	m.datasets[name] = child
+}
+
 func (m *SyncMetrics) RecordBlock(block uint64, updates, deltas int, duration time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -54,7 +62,7 @@ func (m *SyncMetrics) RecordError(err error) {
 func (m *SyncMetrics) snapshot() map[string]any {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return map[string]any{
+	payload := map[string]any{
 		"mode":              m.mode,
 		"blocks_synced":     m.blocksSynced,
 		"last_block":        m.lastBlock,
@@ -64,6 +72,14 @@ func (m *SyncMetrics) snapshot() map[string]any {
 		"last_error":        m.lastError,
 		"uptime_seconds":    time.Since(m.startedAt).Seconds(),
 	}
+	if len(m.datasets) > 0 {
+		datasets := make(map[string]any, len(m.datasets))
+		for name, child := range m.datasets {
+			datasets[name] = child.snapshot()
+		}
+		payload["datasets"] = datasets
+	}
+	return payload
 }
 
 func startMetricsServer(port string, metrics *SyncMetrics) {
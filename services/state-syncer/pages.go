@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Manifest paging. The root manifest.json only holds what is still
+// changing: the open page's bundles, deltas and coverage, bundles larger
+// than a page, and the epochs. Once every block of a page has been
+// processed and bundled, and no queued publish still has to fill in the
+// CID of one of its entries (see publishqueue.go), its entries move to
+// pages/page-S-E.json, which is never rewritten, so CDNs can cache it for
+// good. The root lists each page with its SHA-256, so a signed root
+// vouches for the pages too.
+//
+// Pages line up with level 2 bundles: with compaction enabled a full page
+// waits for its level 2 bundle before it is sealed.
+const pagesDir = "pages"
+
+// ManifestPage is an immutable slice of the manifest for StartBlock to
+// EndBlock. Its fields mean the same as the root's.
+type ManifestPage struct {
+	Dataset       string          `json:"dataset,omitempty"`
+	StartBlock    uint64          `json:"startBlock"`
+	EndBlock      uint64          `json:"endBlock"`
+	Bundles       []BundleInfo    `json:"bundles"`
+	Deltas        []DeltaInfo     `json:"deltas,omitempty"`
+	Coverage      []CoverageRange `json:"coverage,omitempty"`
+	AddressDeltas []DeltaInfo     `json:"addressDeltas,omitempty"`
+}
+
+// PageInfo points from the root manifest to a sealed page. Path is
+// relative to the manifest.
+type PageInfo struct {
+	StartBlock uint64 `json:"startBlock"`
+	EndBlock   uint64 `json:"endBlock"`
+	Path       string `json:"path"`
+	SHA256     string `json:"sha256"`
+	CID        string `json:"cid,omitempty"`
+}
+
+// pageSpan is the number of blocks per manifest page.
+func pageSpan() uint64 {
+	return BundleLevels[1]
+}
+
+// sealPages moves the entries of every complete page out of manifest,
+// oldest first.
+func (b *DeltaBundler) sealPages(manifest *Manifest) error {
+	span := pageSpan()
+	var sealedTo uint64
+	if n := len(manifest.Pages); n > 0 {
+		sealedTo = manifest.Pages[n-1].EndBlock
+	}
+	for {
+		first, ok := oldestUnpaged(manifest, sealedTo)
+		if !ok {
+			return nil
+		}
+		start := (first-1)/span*span + 1
+		end := start + span - 1
+		if !b.pageComplete(manifest, start, end) || b.publishesPending(start, end) {
+			return nil
+		}
+		info, err := b.writePage(manifest, start, end)
+		if err != nil {
+			return fmt.Errorf("manifest page %d-%d: %w", start, end, err)
+		}
+		manifest.Pages = append(manifest.Pages, info)
+		sealedTo = end
+	}
+}
+
+// oldestUnpaged returns the lowest block after sealedTo that an entry
+// belonging in a page refers to.
+func oldestUnpaged(manifest *Manifest, sealedTo uint64) (uint64, bool) {
+	var first uint64
+	found := false
+	consider := func(block uint64) {
+		if block > sealedTo && (!found || block < first) {
+			first, found = block, true
+		}
+	}
+	for _, bundle := range manifest.Bundles {
+		if bundle.EndBlock-bundle.StartBlock+1 <= pageSpan() {
+			consider(bundle.StartBlock)
+		}
+	}
+	for _, delta := range manifest.Deltas {
+		consider(delta.Block)
+	}
+	for _, r := range manifest.Coverage {
+		consider(r.StartBlock)
+	}
+	for _, delta := range manifest.AddressDeltas {
+		consider(delta.Block)
+	}
+	return first, found
+}
+
+// pageComplete reports whether nothing more can be added to the page for
+// start to end: the syncer is past it, every level 1 bundle in it has been
+// cut and, when the compactor runs, a full page has its level 2 bundle.
+func (b *DeltaBundler) pageComplete(manifest *Manifest, start, end uint64) bool {
+	if manifest.LatestBlock <= end || manifest.NextBundle <= end {
+		return false
+	}
+	if b.cfg.CompactInterval <= 0 {
+		return true
+	}
+	var level1 uint64
+	for _, bundle := range manifest.Bundles {
+		if bundle.StartBlock == start && bundle.EndBlock == end {
+			return true
+		}
+		if bundle.StartBlock >= start && bundle.EndBlock <= end && bundle.EndBlock-bundle.StartBlock+1 == BundleSize {
+			level1++
+		}
+	}
+	// A page the syncer did not see from its start never gets a level 2
+	// bundle.
+	return level1 < (end-start+1)/BundleSize
+}
+
+// writePage moves the entries for start to end from manifest into a new
+// page file and pins it.
+func (b *DeltaBundler) writePage(manifest *Manifest, start, end uint64) (PageInfo, error) {
+	page := ManifestPage{Dataset: b.cfg.Dataset, StartBlock: start, EndBlock: end, Bundles: []BundleInfo{}}
+	inPage := func(block uint64) bool { return block >= start && block <= end }
+
+	bundles := manifest.Bundles[:0:0]
+	for _, bundle := range manifest.Bundles {
+		if inPage(bundle.StartBlock) && bundle.EndBlock <= end {
+			page.Bundles = append(page.Bundles, bundle)
+		} else {
+			bundles = append(bundles, bundle)
+		}
+	}
+	deltas := manifest.Deltas[:0:0]
+	for _, delta := range manifest.Deltas {
+		if inPage(delta.Block) {
+			page.Deltas = append(page.Deltas, delta)
+		} else {
+			deltas = append(deltas, delta)
+		}
+	}
+	coverage := manifest.Coverage[:0:0]
+	for _, r := range manifest.Coverage {
+		if inPage(r.StartBlock) {
+			page.Coverage = append(page.Coverage, r)
+		} else {
+			coverage = append(coverage, r)
+		}
+	}
+	addressDeltas := manifest.AddressDeltas[:0:0]
+	for _, delta := range manifest.AddressDeltas {
+		if inPage(delta.Block) {
+			page.AddressDeltas = append(page.AddressDeltas, delta)
+		} else {
+			addressDeltas = append(addressDeltas, delta)
+		}
+	}
+
+	data, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		return PageInfo{}, err
+	}
+	rel := filepath.ToSlash(filepath.Join(pagesDir, fmt.Sprintf("page-%06d-%06d.json", start, end)))
+	path := filepath.Join(b.cfg.DeltaDir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return PageInfo{}, err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return PageInfo{}, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return PageInfo{}, err
+	}
+
+	digest := sha256.Sum256(data)
+	info := PageInfo{StartBlock: start, EndBlock: end, Path: rel, SHA256: hex.EncodeToString(digest[:])}
+	info.CID = b.publish(path, publishJob{Target: targetPage, StartBlock: start, EndBlock: end}).CID
+	log.Printf("📄 Sealed manifest page %d-%d (%d bundles)", start, end, len(page.Bundles))
+
+	manifest.Bundles, manifest.Deltas, manifest.Coverage, manifest.AddressDeltas = bundles, deltas, coverage, addressDeltas
+	b.pages[start] = page
+	return info, nil
+}
+
+// readPage returns a sealed page, from memory once it has been read.
+func (b *DeltaBundler) readPage(info PageInfo) (ManifestPage, error) {
+	if page, ok := b.pages[info.StartBlock]; ok {
+		return page, nil
+	}
+	data, err := os.ReadFile(filepath.Join(b.cfg.DeltaDir, filepath.FromSlash(info.Path)))
+	if err != nil {
+		return ManifestPage{}, err
+	}
+	var page ManifestPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		return ManifestPage{}, fmt.Errorf("manifest page %s: %w", info.Path, err)
+	}
+	b.pages[info.StartBlock] = page
+	return page, nil
+}
+
+// allBundles returns the bundles in manifest and in all of its pages.
+func (b *DeltaBundler) allBundles(manifest Manifest) ([]BundleInfo, error) {
+	var bundles []BundleInfo
+	for _, info := range manifest.Pages {
+		page, err := b.readPage(info)
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, page.Bundles...)
+	}
+	return append(bundles, manifest.Bundles...), nil
+}
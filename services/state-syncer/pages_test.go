@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestPages(t *testing.T) {
+	levels := BundleLevels
+	BundleLevels = []uint64{100, 200, 400}
+	defer func() { BundleLevels = levels }()
+
+	dir := t.TempDir()
+	cfg := Config{DeltaDir: dir, Dataset: DatasetETH, CompactInterval: time.Minute}
+	bundler := NewDeltaBundler(cfg, nil)
+	for block := uint64(1); block <= 450; block++ {
+		if err := bundler.RecordEmptyBlock(block); err != nil {
+			t.Fatalf("record %d: %v", block, err)
+		}
+	}
+	if err := bundler.ScheduleBundles(); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	manifest, err := bundler.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Full pages wait for their level 2 bundle.
+	if len(manifest.Pages) != 0 {
+		t.Fatalf("pages sealed before compaction: %+v", manifest.Pages)
+	}
+
+	if err := bundler.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest = Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	var pages [][2]uint64
+	for _, page := range manifest.Pages {
+		pages = append(pages, [2]uint64{page.StartBlock, page.EndBlock})
+	}
+	if !reflect.DeepEqual(pages, [][2]uint64{{1, 200}, {201, 400}}) {
+		t.Fatalf("pages = %v", pages)
+	}
+	// The root keeps the open page and the bundle spanning both pages.
+	if len(manifest.Bundles) != 1 || manifest.Bundles[0].Level != 3 ||
+		len(manifest.Coverage) != 1 || manifest.Coverage[0].StartBlock != 401 {
+		t.Fatalf("root bundles=%+v coverage=%+v", manifest.Bundles, manifest.Coverage)
+	}
+
+	var page ManifestPage
+	data, err = os.ReadFile(filepath.Join(dir, manifest.Pages[0].Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Bundles) != 3 || len(page.Coverage) != 2 {
+		t.Fatalf("page 1-200: bundles=%+v coverage=%+v", page.Bundles, page.Coverage)
+	}
+
+	// A restarted bundler finds the paged bundles again.
+	restarted := NewDeltaBundler(cfg, nil)
+	manifest, err = restarted.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundles, err := restarted.allBundles(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cover [][2]uint64
+	for _, item := range BundleCover(bundles, 1, 450) {
+		cover = append(cover, [2]uint64{item.StartBlock, item.EndBlock})
+	}
+	if !reflect.DeepEqual(cover, [][2]uint64{{1, 400}, {401, 450}}) {
+		t.Fatalf("cover = %v", cover)
+	}
+}
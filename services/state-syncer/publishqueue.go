@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"state-syncer/manifestsig"
+)
+
+// Publishes that fail are not just logged: they go to a queue persisted
+// as publish-queue.json next to the manifest and are retried with
+// exponential backoff. Once a retry succeeds and the pin is verified, the
+// CID is back-filled into the manifest entry that was written without
+// one; until then the entry is kept out of sealed pages. The same loop
+// points an IPNS name at the latest manifest.
+const (
+	publishQueueFile   = "publish-queue.json"
+	publishQueueTick   = 10 * time.Second
+	publishRetryMin    = 30 * time.Second
+	publishRetryMax    = time.Hour
+	ipnsPublishEvery   = time.Minute
+	ipnsRepublishEvery = 12 * time.Hour
+)
+
+// Publish targets name the manifest entry a queued publish fills in. An
+// empty target only needs the file published.
+const (
+	targetDelta        = "delta"
+	targetAddressDelta = "addressDelta"
+	targetBundle       = "bundle"
+	targetPage         = "page"
+	targetSnapshot     = "snapshot"
+)
+
+// publishJob is a file waiting to be published.
+type publishJob struct {
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	// StartBlock and EndBlock identify the entry: the block of a delta,
+	// the range of a bundle or page.
+	StartBlock uint64 `json:"startBlock,omitempty"`
+	EndBlock   uint64 `json:"endBlock,omitempty"`
+	// Packed jobs fill in the packed CID of the entry.
+	Packed      bool      `json:"packed,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// pinVerifier is implemented by backends that can confirm a CID is pinned.
+type pinVerifier interface {
+	VerifyPin(cid string) error
+}
+
+// namePublisher is implemented by backends that can point a mutable name
+// at a set of files, returning the name.
+type namePublisher interface {
+	PublishName(key string, paths ...string) (string, error)
+}
+
+// publish publishes the file at path and queues job for retries if that
+// fails. The result has no CID or URL until a publish succeeds.
+func (b *DeltaBundler) publish(path string, job publishJob) Published {
+	if b.publisher == nil {
+		return Published{}
+	}
+	published, err := b.publishVerified(path)
+	if err != nil {
+		log.Printf("⚠️ Failed to publish %s to %s, will retry: %v", filepath.Base(path), b.publisher.Name(), err)
+		job.Path = path
+		b.enqueue(job, err)
+	}
+	return published
+}
+
+// publishVerified publishes path and, where the backend can tell, checks
+// that the returned CID is actually pinned.
+func (b *DeltaBundler) publishVerified(path string) (Published, error) {
+	published, err := b.publisher.Publish(path)
+	if err != nil {
+		return published, err
+	}
+	if v, ok := b.publisher.(pinVerifier); ok && published.CID != "" {
+		if err := v.VerifyPin(published.CID); err != nil {
+			return published, fmt.Errorf("verify pin %s: %w", published.CID, err)
+		}
+	}
+	return published, nil
+}
+
+// enqueue records a failed attempt at job, replacing an earlier entry for
+// the same file, and schedules the next one.
+func (b *DeltaBundler) enqueue(job publishJob, cause error) {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	jobs := b.loadQueue()
+	i := 0
+	for i < len(jobs) && jobs[i].Path != job.Path {
+		i++
+	}
+	if i == len(jobs) {
+		jobs = append(jobs, job)
+	} else {
+		job.Attempts = jobs[i].Attempts
+	}
+	job.Attempts++
+	job.NextAttempt = time.Now().Add(publishBackoff(job.Attempts))
+	job.LastError = cause.Error()
+	jobs[i] = job
+	b.saveQueue(jobs)
+}
+
+// dequeue drops the job for path.
+func (b *DeltaBundler) dequeue(path string) {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	jobs := b.loadQueue()
+	for i, job := range jobs {
+		if job.Path == path {
+			b.saveQueue(append(jobs[:i:i], jobs[i+1:]...))
+			return
+		}
+	}
+}
+
+// PendingPublishes returns the queued jobs.
+func (b *DeltaBundler) PendingPublishes() []publishJob {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	return append([]publishJob(nil), b.loadQueue()...)
+}
+
+func publishBackoff(attempts int) time.Duration {
+	d := publishRetryMin
+	for i := 1; i < attempts && d < publishRetryMax; i++ {
+		d *= 2
+	}
+	if d > publishRetryMax {
+		d = publishRetryMax
+	}
+	return d
+}
+
+// loadQueue returns the queue, reading it on first use. queueMu must be
+// held.
+func (b *DeltaBundler) loadQueue() []publishJob {
+	if b.queue != nil {
+		return b.queue
+	}
+	b.queue = []publishJob{}
+	data, err := os.ReadFile(filepath.Join(b.cfg.DeltaDir, publishQueueFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("⚠️ Failed to read publish queue: %v", err)
+		}
+		return b.queue
+	}
+	if err := json.Unmarshal(data, &b.queue); err != nil {
+		log.Printf("⚠️ Ignoring unreadable publish queue: %v", err)
+		b.queue = []publishJob{}
+	}
+	return b.queue
+}
+
+// saveQueue replaces the queue. A queue that cannot be written stays in
+// memory, so only a restart loses it. queueMu must be held.
+func (b *DeltaBundler) saveQueue(jobs []publishJob) {
+	b.queue = jobs
+	if err := writeJSON(filepath.Join(b.cfg.DeltaDir, publishQueueFile), jobs); err != nil {
+		log.Printf("⚠️ Failed to save publish queue: %v", err)
+	}
+}
+
+// RunPublishQueue retries queued publishes and keeps the IPNS name
+// current; it never returns.
+func (b *DeltaBundler) RunPublishQueue() {
+	for range time.Tick(publishQueueTick) {
+		b.RetryPublishes(time.Now())
+		if err := b.publishIPNS(time.Now()); err != nil {
+			log.Printf("⚠️ Failed to publish manifest to IPNS key %s: %v", b.cfg.IPNSKey, err)
+		}
+	}
+}
+
+// RetryPublishes retries every job due at now, back-filling the manifest
+// for those that succeed.
+func (b *DeltaBundler) RetryPublishes(now time.Time) {
+	if b.publisher == nil {
+		return
+	}
+	b.queueMu.Lock()
+	var due []publishJob
+	for _, job := range b.loadQueue() {
+		if !job.NextAttempt.After(now) {
+			due = append(due, job)
+		}
+	}
+	b.queueMu.Unlock()
+
+	for _, job := range due {
+		if _, err := os.Stat(job.Path); os.IsNotExist(err) {
+			log.Printf("⚠️ Dropping queued publish of %s: file is gone", job.Path)
+			b.dequeue(job.Path)
+			continue
+		}
+		published, err := b.publishVerified(job.Path)
+		if err == nil {
+			err = b.backfill(job, published)
+		}
+		if err != nil {
+			b.enqueue(job, err)
+			continue
+		}
+		log.Printf("🌐 Published %s to %s after %d failed attempts", filepath.Base(job.Path), b.publisher.Name(), job.Attempts)
+		b.dequeue(job.Path)
+		if err := b.sealHeldPages(); err != nil {
+			log.Printf("⚠️ Failed to seal manifest pages: %v", err)
+		}
+	}
+}
+
+// publishesPending reports whether a queued publish still has to fill in
+// an entry of the page for start to end, which must stay in the root
+// manifest until it has: pages do not change once sealed.
+func (b *DeltaBundler) publishesPending(start, end uint64) bool {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	for _, job := range b.loadQueue() {
+		switch job.Target {
+		case targetDelta, targetAddressDelta, targetBundle:
+			if job.StartBlock >= start && max(job.StartBlock, job.EndBlock) <= end {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sealHeldPages seals the pages that were only waiting for queued
+// publishes, without rewriting an unchanged manifest.
+func (b *DeltaBundler) sealHeldPages() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	sealed := len(manifest.Pages)
+	if err := b.sealPages(&manifest); err != nil {
+		return err
+	}
+	if len(manifest.Pages) == sealed {
+		return nil
+	}
+	return b.writeManifest(manifest)
+}
+
+// backfill writes the CID and URL of a late publish into its manifest
+// entry, which publishesPending kept out of sealed pages.
+func (b *DeltaBundler) backfill(job publishJob, published Published) error {
+	if job.Target == targetSnapshot {
+		return b.backfillSnapshot(job.Path, published)
+	}
+	if job.Target == "" || (published.CID == "" && published.URL == "") {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	setCID := func(cid, packedCID *string) bool {
+		if published.CID == "" {
+			return false
+		}
+		if job.Packed {
+			*packedCID = published.CID
+		} else {
+			*cid = published.CID
+		}
+		return true
+	}
+	changed := false
+	switch job.Target {
+	case targetDelta:
+		for i := range manifest.Deltas {
+			if d := &manifest.Deltas[i]; d.Block == job.StartBlock {
+				changed = setCID(&d.CID, &d.PackedCID)
+			}
+		}
+	case targetAddressDelta:
+		for i := range manifest.AddressDeltas {
+			if d := &manifest.AddressDeltas[i]; d.Block == job.StartBlock {
+				changed = setCID(&d.CID, &d.PackedCID)
+			}
+		}
+	case targetBundle:
+		for i := range manifest.Bundles {
+			if bi := &manifest.Bundles[i]; bi.StartBlock == job.StartBlock && bi.EndBlock == job.EndBlock {
+				changed = setCID(&bi.CID, &bi.PackedCID)
+				if !job.Packed && published.URL != "" {
+					bi.URL, changed = published.URL, true
+				}
+			}
+		}
+	case targetPage:
+		for i := range manifest.Pages {
+			if p := &manifest.Pages[i]; p.StartBlock == job.StartBlock && published.CID != "" {
+				p.CID, changed = published.CID, true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return b.writeManifest(manifest)
+}
+
+// backfillSnapshot records a late publish of a snapshot directory (or,
+// from older queues, a single snapshot file) in its snapshot manifest,
+// then re-signs and republishes the manifest.
+func (b *DeltaBundler) backfillSnapshot(path string, published Published) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if info.IsDir() {
+		dir = path
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest SnapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+	if info.IsDir() && manifest.IPFS != nil && published.GatewayURL != "" {
+		manifest.IPFS.GatewayURL = published.GatewayURL
+	}
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		switch {
+		case info.IsDir():
+			if file.IPFS != nil && published.GatewayURL != "" {
+				file.IPFS.GatewayURL = published.GatewayURL + "/" + file.Path
+			}
+			if published.URL != "" {
+				file.URL = published.URL + "/" + file.Path
+			}
+		case file.Path == filepath.Base(path):
+			if published.CID != "" {
+				file.IPFS = &SnapshotFileIPFS{CID: published.CID, GatewayURL: published.GatewayURL}
+			}
+			if published.URL != "" {
+				file.URL = published.URL
+			}
+		}
+	}
+	if err := writeJSON(manifestPath, manifest); err != nil {
+		return err
+	}
+	if err := signFile(manifestPath, manifest.Block, b.cfg.SigningKeys); err != nil {
+		return err
+	}
+	b.publishSnapshotManifest(manifestPath)
+	return nil
+}
+
+// publishSnapshotManifest publishes a snapshot manifest and its
+// signatures, and refreshes the latest/ copy if it is the latest snapshot.
+func (b *DeltaBundler) publishSnapshotManifest(manifestPath string) {
+	if b.publisher == nil {
+		return
+	}
+	signed := len(b.cfg.SigningKeys) > 0
+	b.publish(manifestPath, publishJob{})
+	if signed {
+		b.publish(manifestPath+manifestsig.Suffix, publishJob{})
+	}
+
+	// Object stores have no symlinks, so latest/ gets a copy of the
+	// manifest; clients find the snapshot files through its version.
+	dir := filepath.Dir(manifestPath)
+	latest := filepath.Join(filepath.Dir(dir), "latest")
+	if target, err := os.Readlink(latest); err != nil || target != filepath.Base(dir) {
+		return
+	}
+	if err := updateSigned(b.publisher, filepath.Join(latest, "manifest.json"), signed); err != nil {
+		log.Printf("%s publish (latest manifest.json) failed: %v", b.publisher.Name(), err)
+	}
+}
+
+// publishIPNS points cfg.IPNSKey at the current manifest and its
+// signatures once they have changed, at most every ipnsPublishEvery, and
+// at least every ipnsRepublishEvery so the record does not expire.
+func (b *DeltaBundler) publishIPNS(now time.Time) error {
+	names, ok := b.publisher.(namePublisher)
+	if !ok || b.cfg.IPNSKey == "" {
+		return nil
+	}
+	manifestPath := filepath.Join(b.cfg.DeltaDir, "manifest.json")
+	if _, err := os.Stat(manifestPath); err != nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	since := now.Sub(b.ipnsPublished)
+	due := (b.ipnsDirty && since >= ipnsPublishEvery) || since >= ipnsRepublishEvery
+	if due {
+		b.ipnsDirty = false
+	}
+	b.mu.Unlock()
+	if !due {
+		return nil
+	}
+
+	paths := []string{manifestPath}
+	if len(b.cfg.SigningKeys) > 0 {
+		paths = append(paths, manifestPath+manifestsig.Suffix)
+	}
+	name, err := names.PublishName(b.cfg.IPNSKey, paths...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.ipnsDirty = true
+		return err
+	}
+	b.ipnsPublished = now
+	if b.ipnsName != name {
+		b.ipnsName = name
+		log.Printf("🌐 Manifest published under /ipns/%s", name)
+	}
+	return nil
+}
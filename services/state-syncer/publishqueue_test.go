@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPublisher fails every publish while down and hands out CIDs derived
+// from the file name otherwise.
+type flakyPublisher struct {
+	mu    sync.Mutex
+	down  bool
+	names [][]string
+}
+
+func (p *flakyPublisher) Name() string { return "flaky" }
+
+func (p *flakyPublisher) Publish(path string) (Published, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return Published{}, errors.New("connection refused")
+	}
+	cid := "cid-" + filepath.Base(path)
+	return Published{CID: cid, GatewayURL: "https://gw.example/ipfs/" + cid}, nil
+}
+
+func (p *flakyPublisher) Update(path string) error { return nil }
+
+func (p *flakyPublisher) VerifyPin(cid string) error { return nil }
+
+func (p *flakyPublisher) PublishName(key string, paths ...string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.names = append(p.names, paths)
+	return "k51-" + key, nil
+}
+
+func TestPublishQueueBackfills(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{PublicRoot: root, DeltaDir: filepath.Join(root, "deltas"), Dataset: DatasetETH, IPNSKey: "plinko"}
+	if err := os.MkdirAll(cfg.DeltaDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &flakyPublisher{down: true}
+	bundler := NewDeltaBundler(cfg, publisher)
+
+	path := filepath.Join(cfg.DeltaDir, "delta-000001.bin")
+	if err := saveDelta(path, DeltaHeader{Dataset: DatasetETH, Block: 1}, []HintDelta{{Index: 4, Delta: DBEntry{9}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := bundler.PublishDelta(1, path, ""); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	db := make([]uint64, 4*DBEntryLength)
+	version, err := writeSnapshot(cfg, db, 4, ChainAnchor{Block: 1}, 2, 2, 0, "", bundler)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	// The queue survives a restart.
+	restarted := NewDeltaBundler(cfg, publisher)
+	jobs := restarted.PendingPublishes()
+	if len(jobs) != 3 || jobs[0].Target != targetDelta || jobs[1].Target != targetSnapshot || jobs[2].Target != "" {
+		t.Fatalf("queued jobs = %+v", jobs)
+	}
+
+	// Nothing is retried before the backoff, and failures back off further.
+	restarted.RetryPublishes(time.Now())
+	if got := restarted.PendingPublishes(); got[0].Attempts != 1 {
+		t.Fatalf("retried early: %+v", got[0])
+	}
+	restarted.RetryPublishes(time.Now().Add(publishRetryMin))
+	if got := restarted.PendingPublishes(); got[0].Attempts != 2 || got[0].NextAttempt.Before(time.Now().Add(publishRetryMin)) {
+		t.Fatalf("after failed retry: %+v", got[0])
+	}
+
+	publisher.down = false
+	restarted.RetryPublishes(time.Now().Add(time.Hour))
+	if jobs := restarted.PendingPublishes(); len(jobs) != 0 {
+		t.Fatalf("jobs left: %+v", jobs)
+	}
+	manifest, err := restarted.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Deltas[0].CID != "cid-delta-000001.bin" {
+		t.Fatalf("delta not back-filled: %+v", manifest.Deltas[0])
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.SnapshotsRoot(), version, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot SnapshotManifest
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if ipfs := snapshot.IPFS; ipfs == nil || ipfs.GatewayURL != "https://gw.example/ipfs/cid-"+version {
+		t.Fatalf("snapshot not back-filled: %+v", snapshot.IPFS)
+	}
+	if ipfs := snapshot.Files[0].IPFS; ipfs == nil || ipfs.GatewayURL != "https://gw.example/ipfs/cid-"+version+"/database.bin" {
+		t.Fatalf("snapshot file not back-filled: %+v", snapshot.Files[0].IPFS)
+	}
+
+	// IPNS follows the manifest, at most once per ipnsPublishEvery.
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(time.Second)} {
+		if err := restarted.publishIPNS(at); err != nil {
+			t.Fatalf("ipns: %v", err)
+		}
+	}
+	if err := restarted.RecordEmptyBlock(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.publishIPNS(now.Add(ipnsPublishEvery)); err != nil {
+		t.Fatalf("ipns: %v", err)
+	}
+	if len(publisher.names) != 2 || publisher.names[0][0] != filepath.Join(cfg.DeltaDir, "manifest.json") || restarted.ipnsName != "k51-plinko" {
+		t.Fatalf("ipns publishes = %v", publisher.names)
+	}
+}
+
+func TestPublishQueueHoldsPages(t *testing.T) {
+	levels := BundleLevels
+	BundleLevels = []uint64{100, 200}
+	defer func() { BundleLevels = levels }()
+
+	root := t.TempDir()
+	cfg := Config{PublicRoot: root, DeltaDir: filepath.Join(root, "deltas"), Dataset: DatasetETH}
+	if err := os.MkdirAll(cfg.DeltaDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &flakyPublisher{}
+	bundler := NewDeltaBundler(cfg, publisher)
+	for block := uint64(1); block <= 250; block++ {
+		if err := bundler.RecordEmptyBlock(block); err != nil {
+			t.Fatalf("record %d: %v", block, err)
+		}
+	}
+
+	// The bundles of the first page fail to publish.
+	publisher.down = true
+	if err := bundler.ScheduleBundles(); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	publisher.down = false
+
+	// Blocks 1-200 are bundled, but the page waits for the bundle CIDs.
+	manifest, err := bundler.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Pages) != 0 || manifest.NextBundle != 201 {
+		t.Fatalf("pages sealed with publishes pending: next bundle %d, pages %+v", manifest.NextBundle, manifest.Pages)
+	}
+
+	bundler.RetryPublishes(time.Now().Add(time.Hour))
+	manifest, err = bundler.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Pages) != 1 || manifest.Pages[0].EndBlock != 200 {
+		t.Fatalf("pages after the publishes = %+v", manifest.Pages)
+	}
+	page, err := bundler.readPage(manifest.Pages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Bundles) != 2 || page.Bundles[0].CID != "cid-bundle-000001-000100.bin" || page.Bundles[1].CID != "cid-bundle-000101-000200.bin" {
+		t.Fatalf("paged bundles = %+v", page.Bundles)
+	}
+}
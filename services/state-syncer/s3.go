@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the part size of multipart uploads, used for files larger
+// than one part. S3 takes parts of 5 MiB to 5 GiB and at most 10,000 of
+// them, so this covers objects up to 640 GiB.
+const s3PartSize = 64 << 20
+
+// S3Config points the s3 publisher at a bucket on AWS or any S3-compatible
+// store such as MinIO.
+type S3Config struct {
+	// Endpoint is the store's base URL; requests then use path-style
+	// addressing. Empty means AWS with virtual-hosted addressing.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PublicURL is where clients read the prefix from, usually the CDN in
+	// front of the bucket; it only fills in the URLs in the manifests.
+	PublicURL string
+}
+
+// S3Publisher PUTs artifacts into a bucket under their names below the
+// public root, signing each request with AWS Signature Version 4.
+type S3Publisher struct {
+	cfg      S3Config
+	root     string
+	client   *http.Client
+	now      func() time.Time
+	partSize int64
+}
+
+func newS3Publisher(root string, cfg S3Config) (*S3Publisher, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 publisher needs a bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 publisher needs an access key ID and secret")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	cfg.PublicURL = strings.TrimRight(cfg.PublicURL, "/")
+	return &S3Publisher{
+		cfg:      cfg,
+		root:     root,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+		now:      time.Now,
+		partSize: s3PartSize,
+	}, nil
+}
+
+func (p *S3Publisher) Name() string { return PublisherS3 }
+
+func (p *S3Publisher) Publish(path string) (Published, error) {
+	key, err := publicKey(p.root, path)
+	if err != nil {
+		return Published{}, err
+	}
+	err = eachFile(path, func(path string) error {
+		_, err := p.put(path, "")
+		return err
+	})
+	if err != nil {
+		return Published{}, err
+	}
+	if p.cfg.PublicURL == "" {
+		return Published{}, nil
+	}
+	return Published{URL: p.cfg.PublicURL + "/" + key}, nil
+}
+
+// Update overwrites the object and tells caches to revalidate it, since
+// clients poll the same name for new versions.
+func (p *S3Publisher) Update(path string) error {
+	_, err := p.put(path, "no-cache")
+	return err
+}
+
+// put uploads the file at path as the object of its public key: in one
+// PUT, or in parts of partSize once it is larger, since S3 refuses single
+// PUTs over 5 GB.
+func (p *S3Publisher) put(path, cacheControl string) (string, error) {
+	key, err := publicKey(p.root, path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType(path))
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	if info.Size() > p.partSize {
+		err = p.putMultipart(key, f, info.Size(), header)
+	} else {
+		_, err = p.send(http.MethodPut, key, nil, io.NewSectionReader(f, 0, info.Size()), header)
+	}
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// putMultipart uploads the size bytes of f as key in parts of partSize,
+// each signed with its own payload hash. A failed upload is aborted so the
+// store drops the parts already sent.
+func (p *S3Publisher) putMultipart(key string, f io.ReaderAt, size int64, header http.Header) error {
+	body, err := p.send(http.MethodPost, key, url.Values{"uploads": {""}}, nil, header)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("initiate upload of %s: no upload ID in %q", key, body)
+	}
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+
+	err = func() error {
+		type part struct {
+			PartNumber int
+			ETag       string
+		}
+		var complete struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}
+		for offset, number := int64(0), 1; offset < size; offset, number = offset+p.partSize, number+1 {
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": upload["uploadId"]}
+			n := min(p.partSize, size-offset)
+			resp, err := p.do(http.MethodPut, key, query, io.NewSectionReader(f, offset, n), nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			etag := resp.Header.Get("ETag")
+			if etag == "" {
+				return fmt.Errorf("upload part %d of %s: no ETag", number, key)
+			}
+			complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: etag})
+		}
+		data, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+		body, err := p.send(http.MethodPost, key, upload, bytes.NewReader(data), nil)
+		if err != nil {
+			return err
+		}
+		// A completion that fails after the response started still has
+		// status 200, with the error in the body.
+		if bytes.Contains(body, []byte("<Error>")) {
+			return fmt.Errorf("complete upload of %s: %s", key, strings.TrimSpace(string(body)))
+		}
+		return nil
+	}()
+	if err != nil {
+		if _, abortErr := p.send(http.MethodDelete, key, upload, nil, nil); abortErr != nil {
+			log.Printf("⚠️ Failed to abort upload of %s: %v", key, abortErr)
+		}
+	}
+	return err
+}
+
+// send makes a request through do and returns the body of the response.
+func (p *S3Publisher) send(method, key string, query url.Values, body io.ReadSeeker, header http.Header) ([]byte, error) {
+	resp, err := p.do(method, key, query, body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// do signs and sends a request for key with query, body (which may be nil)
+// and header, and fails unless the response is a 2xx. The payload hash is
+// part of the signature, so body is read twice: once to hash it and once
+// to send it.
+func (p *S3Publisher) do(method, key string, query url.Values, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	h := sha256.New()
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = io.Copy(h, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	target := p.objectURL(key)
+	if len(query) > 0 {
+		target += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if p.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.cfg.SessionToken)
+	}
+	signV4(req, hex.EncodeToString(h.Sum(nil)), p.cfg.AccessKeyID, p.cfg.SecretAccessKey, p.cfg.Region, "s3", p.now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", strings.ToLower(method), key, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// objectURL addresses key path-style on a custom endpoint and
+// virtual-hosted style on AWS.
+func (p *S3Publisher) objectURL(key string) string {
+	if p.cfg.Prefix != "" {
+		key = p.cfg.Prefix + "/" + key
+	}
+	if p.cfg.Endpoint != "" {
+		return p.cfg.Endpoint + "/" + p.cfg.Bucket + "/" + s3EscapePath(key)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", p.cfg.Bucket, p.cfg.Region, s3EscapePath(key))
+}
+
+func contentType(path string) string {
+	switch filepath.Ext(path) {
+	case ".json", ".sig":
+		return "application/json"
+	case ".zst":
+		return "application/zstd"
+	}
+	return "application/octet-stream"
+}
+
+// signV4 adds the AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set.
+func signV4(req *http.Request, payloadHash, accessKeyID, secret, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath percent-encodes a key or path the way S3 signs it, keeping
+// the slashes.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+func s3Escape(s string, escapeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
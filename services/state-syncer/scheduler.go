@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// bundleRetryInterval is how long the scheduler waits before retrying a
+// failed bundle when no new boundary wakes it first.
+const bundleRetryInterval = 30 * time.Second
+
+// RecordEmptyBlock marks block as processed without changes. It moves the
+// manifest's latestBlock, so clients know they are current, and lets the
+// scheduler bundle ranges ending in blocks that had no delta.
+func (b *DeltaBundler) RecordEmptyBlock(block uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	manifest, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	b.advance(&manifest, block, emptyBlockDigest)
+	return b.writeManifest(manifest)
+}
+
+// advance records block, whose delta file has the given digest, as
+// processed in manifest. A block that does not follow latestBlock, or the
+// first one recorded, starts a new run: the bundle range it falls in is
+// missing earlier blocks, so NextBundle moves to the next boundary and a
+// new coverage range opens. Reprocessed blocks change neither.
+func (b *DeltaBundler) advance(manifest *Manifest, block uint64, digest [32]byte) {
+	if manifest.NextBundle == 0 || block > manifest.LatestBlock+1 {
+		next := (block+BundleSize-2)/BundleSize*BundleSize + 1
+		if next > manifest.NextBundle {
+			manifest.NextBundle = next
+		}
+	}
+	if block > manifest.LatestBlock {
+		extendCoverage(manifest, block, digest)
+		manifest.LatestBlock = block
+	}
+	if block%BundleSize == 0 {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RunScheduler cuts level 1 bundles as their ranges complete, forever. It
+// wakes at every bundle boundary and otherwise every bundleRetryInterval,
+// so a failed bundle is retried rather than skipped.
+func (b *DeltaBundler) RunScheduler() {
+	for {
+		if err := b.ScheduleBundles(); err != nil {
+			log.Printf("%s bundle scheduler: %v", b.cfg.Dataset, err)
+		}
+		select {
+		case <-b.wake:
+		case <-time.After(bundleRetryInterval):
+		}
+	}
+}
+
+// ScheduleBundles creates, oldest first, every level 1 bundle whose blocks
+// have all been processed. It stops at the first failure, leaving
+// NextBundle there for the next pass.
+func (b *DeltaBundler) ScheduleBundles() error {
+	for {
+		b.mu.Lock()
+		manifest, err := b.readManifest()
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		start := manifest.NextBundle
+		end := start + BundleSize - 1
+		if start == 0 || end > manifest.LatestBlock {
+			return nil
+		}
+		if err := b.createBundle(start, end); err != nil {
+			return fmt.Errorf("bundle %d-%d: %w", start, end, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"state-syncer/dbdigest"
+)
+
+// newTestSyncer builds a Syncer over a small zeroed database whose public
+// artifacts live in a temp dir.
+func newTestSyncer(t *testing.T, source ChangeSource, layoutName string) *Syncer {
+	t.Helper()
+	tmp := t.TempDir()
+	cfg := Config{
+		DatabasePath: filepath.Join(tmp, "database.bin"),
+		PublicRoot:   filepath.Join(tmp, "public"),
+		DeltaDir:     filepath.Join(tmp, "public", "deltas"),
+		Finality:     FinalityPolicy{Mode: FinalityLatest},
+	}
+	if err := os.MkdirAll(cfg.DeltaDir, 0o755); err != nil {
+		t.Fatalf("create delta dir: %v", err)
+	}
+
+	layout, err := parseAccountLayout(layoutName)
+	if err != nil {
+		t.Fatalf("layout: %v", err)
+	}
+
+	const dbSize = 16
+	chunkSize, setSize := derivePlinkoParams(dbSize)
+	db := make([]uint64, chunkSize*setSize*DBEntryLength)
+	wal, db, _, err := openWAL(cfg.DatabasePath, db, dbSize)
+	if err != nil {
+		t.Fatalf("open WAL: %v", err)
+	}
+	t.Cleanup(func() { wal.f.Close() })
+
+	return &Syncer{
+		cfg:       cfg,
+		source:    source,
+		manager:   NewPlinkoUpdateManager(db, dbSize, chunkSize, setSize),
+		bundler:   NewDeltaBundler(cfg, nil),
+		metrics:   NewSyncMetrics(source.Name()),
+		wal:       wal,
+		db:        db,
+		dbSize:    dbSize,
+		chunkSize: chunkSize,
+		setSize:   setSize,
+		layout:    layout,
+		addressIndex: map[string]uint64{
+			"0x1000000000000000000000000000000000000001": 0,
+			"0x1000000000000000000000000000000000000002": 2,
+		},
+	}
+}
+
+func readTestDelta(t *testing.T, path string) []HintDelta {
+	t.Helper()
+	file, err := readDeltaFile(path)
+	if err != nil {
+		t.Fatalf("read delta: %v", err)
+	}
+	if file.Version != DeltaVersion2 {
+		t.Fatalf("delta header: %+v", file.DeltaHeader)
+	}
+	return file.Deltas
+}
+
+func TestSyncerReplayFixtures(t *testing.T) {
+	s := newTestSyncer(t, newReplaySource(filepath.Join("testdata", "replay")), LayoutAccount)
+	ctx := context.Background()
+
+	for block := uint64(1); block <= 3; block++ {
+		if err := s.ProcessBlock(ctx, block); err != nil {
+			t.Fatalf("process block %d: %v", block, err)
+		}
+	}
+
+	block1 := readTestDelta(t, filepath.Join(s.cfg.DeltaDir, "delta-000001.bin"))
+	want1 := []HintDelta{
+		{Index: 9, Delta: DBEntry{5}},
+		{Index: 1, Delta: DBEntry{1000000000000000000}},
+		{Index: 7, Delta: DBEntry{1}},
+	}
+	if !reflect.DeepEqual(block1, want1) {
+		t.Fatalf("block 1 deltas mismatch:\n got %+v\nwant %+v", block1, want1)
+	}
+
+	// Block 2 only repeats an unchanged balance and touches an unmapped
+	// address, so nothing is published for it.
+	if _, err := os.Stat(filepath.Join(s.cfg.DeltaDir, "delta-000002.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected no delta for block 2, stat err=%v", err)
+	}
+
+	// Block 3 sets every field of account 2 (entries 6-8), each producing
+	// its own delta.
+	block3 := readTestDelta(t, filepath.Join(s.cfg.DeltaDir, "delta-000003.bin"))
+	want3 := []HintDelta{
+		{Index: 9, Delta: DBEntry{5 ^ 8}},
+		{Index: 6, Delta: DBEntry{1}},
+		{Index: 7, Delta: DBEntry{1}},
+		{Index: 8, Delta: hashToDBEntry(types.EmptyCodeHash)},
+	}
+	if !reflect.DeepEqual(block3, want3) {
+		t.Fatalf("block 3 deltas mismatch:\n got %+v\nwant %+v", block3, want3)
+	}
+
+	if got := readDBEntry(s.db, 9); got != (DBEntry{8}) {
+		t.Fatalf("entry 9 = %v, want 8", got)
+	}
+	if got := readDBEntry(s.db, 7); got != (DBEntry{}) {
+		t.Fatalf("entry 7 = %v, want zero", got)
+	}
+
+	manifest, err := s.bundler.readManifest()
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if manifest.LatestBlock != 3 || len(manifest.Deltas) != 2 {
+		t.Fatalf("manifest mismatch: latest=%d deltas=%+v", manifest.LatestBlock, manifest.Deltas)
+	}
+	// The digest kept up with the deltas matches one of the final database.
+	digest := dbdigest.FromWords(s.db, s.dbSize)
+	if manifest.Digest != digest.Sum() || manifest.Deltas[1].Digest != manifest.Digest || manifest.Deltas[0].Digest == manifest.Digest {
+		t.Fatalf("manifest digests %q %+v, want %s", manifest.Digest, manifest.Deltas, digest.Sum())
+	}
+
+	if err := s.ProcessBlock(ctx, 4); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected end of recording, got %v", err)
+	}
+}
+
+func TestResolveUpdatesBalanceLayout(t *testing.T) {
+	s := newTestSyncer(t, newSimulatedSource(16), LayoutBalance)
+	nonce := hexutil.Uint64(3)
+	codeHash := types.EmptyCodeHash
+	updates := s.resolveUpdates(&BlockChanges{
+		Block: 1,
+		Accounts: []AccountChange{{
+			Address:  common.HexToAddress("0x1000000000000000000000000000000000000002"),
+			Nonce:    &nonce,
+			Balance:  (*hexutil.Big)(big.NewInt(42)),
+			CodeHash: &codeHash,
+		}},
+	})
+
+	// Only the balance is stored, directly at the account index.
+	want := []DBUpdate{{Index: 2, NewValue: DBEntry{42}}}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("updates mismatch:\n got %+v\nwant %+v", updates, want)
+	}
+}
+
+func TestRecordingSourceRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := newRecordingSource(newSimulatedSource(16), dir)
+	if err != nil {
+		t.Fatalf("new recorder: %v", err)
+	}
+	replay := newReplaySource(dir)
+	ctx := context.Background()
+
+	for block := uint64(1); block <= 2; block++ {
+		recorded, err := recorder.BlockChanges(ctx, block)
+		if err != nil {
+			t.Fatalf("record block %d: %v", block, err)
+		}
+		replayed, err := replay.BlockChanges(ctx, block)
+		if err != nil {
+			t.Fatalf("replay block %d: %v", block, err)
+		}
+		if !reflect.DeepEqual(recorded, replayed) {
+			t.Fatalf("block %d: replay differs from recording", block)
+		}
+	}
+}
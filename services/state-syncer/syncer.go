@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"state-syncer/dbdigest"
+)
+
+// Syncer applies the changes reported by a ChangeSource to the in-memory
+// database and publishes the resulting deltas and snapshots. It holds no
+// RPC state of its own, so tests can drive it with a replaySource.
+type Syncer struct {
+	cfg          Config
+	source       ChangeSource
+	manager      *PlinkoUpdateManager
+	bundler      *DeltaBundler
+	metrics      *SyncMetrics
+	publisher    Publisher
+	wal          *databaseWAL
+	digest       dbdigest.Digest
+	db           []uint64
+	dbSize       uint64
+	chunkSize    uint64
+	setSize      uint64
+	layout       AccountLayout
+	addressIndex map[string]uint64
+
+	// Account growth; see growth.go.
+	nextAccount     uint64
+	pendingAccounts []newAccount
+	epoch           uint64
+	nextEpoch       *EpochInfo
+
+	// head anchors the database to the chain (see anchor.go). chainNext
+	// publishes the next block as a delta even without changes, so the
+	// first delta after a snapshot chains to its block hash.
+	head      ChainAnchor
+	chainNext bool
+}
+
+// openSyncer loads the database at cfg.DatabasePath, replays its write-ahead
+// log, prepares the dataset's public directories and publishes its key
+// mapping and an initial snapshot of the recovered block, from which Run
+// resumes. The snapshot is anchored with anchorAt at that block, not at
+// cfg.StartBlock. The caller sets the change source and, for account
+// datasets, the layout and address index.
+func openSyncer(cfg Config, anchorAt anchorSource, publisher Publisher, metrics *SyncMetrics) (*Syncer, error) {
+	db, dbSize, chunkSize, setSize, err := loadDatabase(cfg.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("load database: %w", err)
+	}
+	wal, db, dbSize, err := openWAL(cfg.DatabasePath, db, dbSize)
+	if err != nil {
+		return nil, fmt.Errorf("open database WAL: %w", err)
+	}
+	// Accounts the log holds but the address mapping lacks go into the
+	// mapping before the checkpoint below empties the log.
+	recovered, err := recoverAccounts(cfg.AddressMappingPath, wal.accounts)
+	if err != nil {
+		return nil, fmt.Errorf("recover address mapping: %w", err)
+	}
+	wal.accounts = nil
+	// The database holds the state after the last block its log or
+	// checkpoint recorded; one that never went through the syncer is the
+	// state after cfg.StartBlock.
+	block := cfg.StartBlock
+	if wal.hasBlock {
+		block = wal.block
+	}
+	// A replayed log is folded into the database right away.
+	if wal.blocks > 0 {
+		if err := wal.Checkpoint(db, dbSize, block); err != nil {
+			return nil, fmt.Errorf("checkpoint database: %w", err)
+		}
+	}
+	anchor, err := anchorAt(block)
+	if err != nil {
+		return nil, fmt.Errorf("read recovered block %d: %w", block, err)
+	}
+	if anchor.Block != block {
+		return nil, fmt.Errorf("anchor of block %d is for block %d", block, anchor.Block)
+	}
+	hashStart := time.Now()
+	digest := dbdigest.FromWords(db, dbSize)
+	log.Printf("%s database digest %s (%s)", cfg.Dataset, digest.Sum(), time.Since(hashStart).Round(time.Millisecond))
+	if err := os.MkdirAll(cfg.DeltaDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create delta dir: %w", err)
+	}
+	if err := os.MkdirAll(cfg.SnapshotsRoot(), 0o755); err != nil {
+		return nil, fmt.Errorf("create snapshot dir: %w", err)
+	}
+	if err := ensureAddressMappingPublished(cfg.AddressMappingPath, cfg.PublicAddressMappingPath()); err != nil {
+		return nil, fmt.Errorf("publish %s: %w", filepath.Base(cfg.AddressMappingPath), err)
+	}
+	if publisher != nil {
+		if err := publisher.Update(cfg.PublicAddressMappingPath()); err != nil {
+			log.Printf("%s publish (%s) failed: %v", publisher.Name(), filepath.Base(cfg.AddressMappingPath), err)
+		}
+	}
+
+	bundler := NewDeltaBundler(cfg, publisher)
+	if len(recovered) > 0 {
+		if err := writeAddressDelta(cfg, bundler, block, encodeAddressRecords(recovered)); err != nil {
+			return nil, fmt.Errorf("publish recovered accounts: %w", err)
+		}
+		log.Printf("%s recovered %d accounts into %s", cfg.Dataset, len(recovered), filepath.Base(cfg.AddressMappingPath))
+	}
+	current, next, err := bundler.EpochState()
+	if err != nil {
+		return nil, err
+	}
+	epoch, next, start := resumeEpoch(current, next, dbSize)
+	capacity := epoch.ChunkSize * epoch.SetSize
+	if next != nil && next.ChunkSize*next.SetSize > capacity {
+		capacity = next.ChunkSize * next.SetSize
+	}
+	if capacity*DBEntryLength != uint64(len(db)) {
+		resized := make([]uint64, capacity*DBEntryLength)
+		copy(resized, db[:dbSize*DBEntryLength])
+		db = resized
+	}
+	chunkSize, setSize = epoch.ChunkSize, epoch.SetSize
+
+	version, err := writeSnapshot(cfg, db, dbSize, anchor, chunkSize, setSize, epoch.Epoch, digest.Sum(), bundler)
+	if err != nil {
+		log.Printf("initial %s snapshot error: %v", cfg.Dataset, err)
+		metrics.RecordError(err)
+	} else {
+		log.Printf("Published %s snapshot %s (epoch %d)\n", cfg.Dataset, version, epoch.Epoch)
+	}
+	if start {
+		epoch.Block, epoch.ActivationBlock, epoch.DBSize, epoch.Snapshot = block, block, dbSize, version
+		if err := bundler.StartEpoch(epoch); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Syncer{
+		cfg:       cfg,
+		manager:   NewPlinkoUpdateManager(db, dbSize, chunkSize, setSize),
+		bundler:   bundler,
+		metrics:   metrics,
+		publisher: publisher,
+		wal:       wal,
+		digest:    digest,
+		head:      anchor,
+		chainNext: err == nil,
+		db:        db,
+		dbSize:    dbSize,
+		chunkSize: chunkSize,
+		setSize:   setSize,
+		epoch:     epoch.Epoch,
+		nextEpoch: next,
+	}, nil
+}
+
+// openDatasetSyncer opens a secondary dataset described by dcfg (see
+// Config.ForDataset) with live as its endpoint-backed source. Its metrics
+// are reported under parent.
+func openDatasetSyncer(dcfg Config, live ChangeSource, anchorAt anchorSource, publisher Publisher, parent *SyncMetrics) (*Syncer, error) {
+	mode := dcfg.ChangeSource
+	if live != nil {
+		mode = live.Name()
+	}
+	metrics := NewSyncMetrics(mode)
+	parent.AddDataset(dcfg.Dataset, metrics)
+
+	syncer, err := openSyncer(dcfg, anchorAt, publisher, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if syncer.source, err = newChangeSource(dcfg, live, syncer.dbSize); err != nil {
+		return nil, err
+	}
+	return syncer, nil
+}
+
+// Run processes every block after the one the database holds, forever.
+// With a client each block waits for the finality target; without one
+// (simulated and replay sources) blocks are processed as fast as the source
+// delivers them. A failed block is retried, never skipped. The bundle
+// scheduler, compactor and publish queue run alongside.
+func (s *Syncer) Run(client *ethclient.Client) {
+	go s.bundler.RunScheduler()
+	if s.cfg.CompactInterval > 0 {
+		go s.bundler.RunCompactor(s.cfg.CompactInterval)
+	}
+	if s.publisher != nil {
+		go s.bundler.RunPublishQueue()
+	}
+	lastBlock := s.head.Block
+	log.Printf("%s resuming after block %d", s.cfg.Dataset, lastBlock)
+	for {
+		nextBlock := lastBlock + 1
+
+		if client != nil {
+			target, ok, err := s.cfg.Finality.TargetBlock(context.Background(), client)
+			if err != nil {
+				log.Printf("head (%s) error: %v", s.cfg.Finality, err)
+				s.metrics.RecordError(err)
+				time.Sleep(s.cfg.PollInterval)
+				continue
+			}
+			if !ok || target < nextBlock {
+				time.Sleep(s.cfg.PollInterval)
+				continue
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := s.ProcessBlock(ctx, nextBlock)
+		cancel()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Replay source has no recording for this block yet.
+				time.Sleep(s.cfg.PollInterval)
+				continue
+			}
+			log.Printf("%s block %d: %v", s.cfg.Dataset, nextBlock, err)
+			s.metrics.RecordError(err)
+			time.Sleep(s.cfg.PollInterval)
+			continue
+		}
+		lastBlock = nextBlock
+	}
+}
+
+// ProcessBlock fetches the changes for block, applies them and publishes the
+// delta. Blocks without changes produce no delta file and are recorded as
+// empty with the bundler. An error means the block was not applied and
+// should be retried.
+func (s *Syncer) ProcessBlock(ctx context.Context, block uint64) error {
+	changes, err := s.source.BlockChanges(ctx, block)
+	if err != nil {
+		return fmt.Errorf("%s source: %w", s.source.Name(), err)
+	}
+	if changes == nil {
+		changes = &BlockChanges{Block: block}
+	}
+	s.head = s.head.advance(changes)
+
+	// The first block after a snapshot is published even without changes,
+	// so that its delta chains to the snapshot's block hash.
+	chain := s.chainNext && changes.ParentHash != nil
+	s.chainNext = false
+
+	updates := s.resolveUpdates(changes)
+	if len(updates) == 0 && !chain {
+		if err := s.bundler.RecordEmptyBlock(block); err != nil {
+			log.Printf("bundler error: %v", err)
+		}
+		// An announced epoch still activates on schedule.
+		s.recordEpochError(block, s.advanceEpoch(block))
+		return nil
+	}
+
+	deltas, duration := s.manager.ApplyUpdates(updates)
+	for _, update := range updates {
+		s.digest.Update(update.Index, dbdigest.Entry(update.OldValue), dbdigest.Entry(update.NewValue))
+	}
+	log.Printf("%s block %d: %d updates, %d deltas (%s)\n", s.cfg.Dataset, block, len(updates), len(deltas), duration)
+
+	// The updates are already applied, so a block the log cannot take is
+	// covered by the next checkpoint instead (see persist).
+	if err := s.wal.Append(block, s.dbSize, updates, s.pendingAccounts); err != nil {
+		log.Printf("%s block %d: write-ahead log: %v", s.cfg.Dataset, block, err)
+		s.metrics.RecordError(err)
+	}
+
+	deltaPath := filepath.Join(s.cfg.DeltaDir, fmt.Sprintf("delta-%06d.bin", block))
+	if err := saveDelta(deltaPath, newDeltaHeader(s.cfg.Dataset, changes), deltas); err != nil {
+		log.Printf("save delta failed: %v", err)
+		s.metrics.RecordError(err)
+	} else {
+		if err := s.bundler.PublishDelta(block, deltaPath, s.digest.Sum()); err != nil {
+			log.Printf("bundler error: %v", err)
+		}
+	}
+
+	if len(updates) > 0 && s.cfg.SnapshotEvery > 0 && block%s.cfg.SnapshotEvery == 0 {
+		if _, err := writeSnapshot(s.cfg, s.db, s.dbSize, s.head, s.chunkSize, s.setSize, s.epoch, s.digest.Sum(), s.bundler); err != nil {
+			log.Printf("snapshot error: %v", err)
+			s.metrics.RecordError(err)
+		} else {
+			s.chainNext = true
+		}
+	}
+
+	if err := s.publishAccounts(block); err != nil {
+		log.Printf("%s block %d: %v", s.cfg.Dataset, block, err)
+		s.metrics.RecordError(err)
+	}
+	if err := s.persist(block); err != nil {
+		log.Printf("persist database failed: %v", err)
+		s.metrics.RecordError(err)
+	}
+	s.recordEpochError(block, s.advanceEpoch(block))
+
+	s.metrics.RecordBlock(block, len(updates), len(deltas), duration)
+	return nil
+}
+
+// persist checkpoints the database after block once the log is due, which
+// is right away after a block the log could not take; until a checkpoint
+// succeeds every later block tries again. Appended accounts the address
+// mapping does not hold yet live only in the log, so it is kept until
+// publishAccounts has written them.
+func (s *Syncer) persist(block uint64) error {
+	if !s.wal.Due(s.cfg.CheckpointEvery) || len(s.pendingAccounts) > 0 {
+		return nil
+	}
+	start := time.Now()
+	if err := s.wal.Checkpoint(s.db, s.dbSize, block); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	log.Printf("%s database checkpointed at block %d (%s)", s.cfg.Dataset, block, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (s *Syncer) recordEpochError(block uint64, err error) {
+	if err != nil {
+		log.Printf("%s block %d: %v", s.cfg.Dataset, block, err)
+		s.metrics.RecordError(err)
+	}
+}
+
+// resolveUpdates turns source changes into DBUpdates against the current
+// database. Account fields are placed according to s.layout; fields the
+// source did not report or the layout does not store are left alone.
+// Adjustments apply on top of any value already set in the same block.
+// Accounts outside the address mapping are appended to it when
+// cfg.AppendAccounts is set and skipped otherwise; unchanged entries are
+// dropped and repeated writes to one index collapse into a single
+// update carrying the last value, so every delta XORs against the true old
+// value.
+func (s *Syncer) resolveUpdates(changes *BlockChanges) []DBUpdate {
+	if changes == nil {
+		return nil
+	}
+
+	order := make([]uint64, 0, len(changes.Entries)+len(changes.Accounts))
+	values := make(map[uint64]DBEntry, cap(order))
+	set := func(index uint64, value DBEntry) {
+		if index >= s.dbSize {
+			return
+		}
+		if _, seen := values[index]; !seen {
+			order = append(order, index)
+		}
+		values[index] = value
+	}
+
+	for _, entry := range changes.Entries {
+		set(entry.Index, entry.Value)
+	}
+	setField := func(accountIdx uint64, field string, value DBEntry) {
+		if index, ok := s.layout.EntryIndex(accountIdx, field); ok {
+			set(index, value)
+		}
+	}
+	for _, account := range changes.Accounts {
+		accountIdx, ok := s.addressIndex[strings.ToLower(account.Address.Hex())]
+		if !ok {
+			if accountIdx, ok = s.appendAccount(account); !ok {
+				continue
+			}
+		}
+		if account.Nonce != nil {
+			setField(accountIdx, FieldNonce, DBEntry{uint64(*account.Nonce)})
+		}
+		if account.Balance != nil {
+			setField(accountIdx, FieldBalance, bigIntToDBEntry(account.Balance.ToInt()))
+		}
+		if account.CodeHash != nil {
+			setField(accountIdx, FieldCodeHash, hashToDBEntry(*account.CodeHash))
+		}
+	}
+
+	for _, adj := range changes.Adjustments {
+		if adj.Index >= s.dbSize || adj.Delta == nil {
+			continue
+		}
+		current, ok := values[adj.Index]
+		if !ok {
+			current = readDBEntry(s.db, adj.Index)
+		}
+		next, ok := adjustDBEntry(current, adj.Delta)
+		if !ok {
+			log.Printf("%s block %d: entry %d would go negative, clamping to zero", s.cfg.Dataset, changes.Block, adj.Index)
+		}
+		set(adj.Index, next)
+	}
+
+	updates := make([]DBUpdate, 0, len(order))
+	for _, index := range order {
+		oldValue := readDBEntry(s.db, index)
+		newValue := values[index]
+		if oldValue == newValue {
+			continue
+		}
+		updates = append(updates, DBUpdate{
+			Index:    index,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	}
+	return updates
+}
+
+// adjustDBEntry adds delta to the unsigned 256-bit integer in entry. A
+// result below zero means the database missed an earlier credit; it is
+// clamped to zero and ok is false.
+func adjustDBEntry(entry DBEntry, delta *big.Int) (DBEntry, bool) {
+	value := new(big.Int).Add(dbEntryToBigInt(entry), delta)
+	if value.Sign() < 0 {
+		return DBEntry{}, false
+	}
+	if value.BitLen() > 256 {
+		value.And(value, maxUint256)
+	}
+	return bigIntToDBEntry(value), true
+}
+
+var maxUint256 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
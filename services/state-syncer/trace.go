@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// prestateAccount is the per-account object emitted by geth's prestateTracer.
+// In diffMode "pre" holds the full pre-state of every modified account and
+// "post" holds only the fields that changed.
+type prestateAccount struct {
+	Balance *hexutil.Big                `json:"balance,omitempty"`
+	Nonce   uint64                      `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+type prestateDiff struct {
+	Pre  map[common.Address]prestateAccount `json:"pre"`
+	Post map[common.Address]prestateAccount `json:"post"`
+}
+
+type txTraceResult struct {
+	TxHash common.Hash  `json:"txHash"`
+	Result prestateDiff `json:"result"`
+	Error  string       `json:"error,omitempty"`
+}
+
+var prestateDiffTracer = map[string]any{
+	"tracer":       "prestateTracer",
+	"tracerConfig": map[string]any{"diffMode": true},
+}
+
+// traceDetector finds every account whose state changed in a block using
+// debug_traceBlockByNumber. Unlike the from/to heuristic it sees internal
+// value transfers, self-destruct beneficiaries and coinbase fee payments.
+// Once the endpoint reports the debug namespace as unavailable the detector
+// disables itself so every block does not pay for a failing round-trip.
+type traceDetector struct {
+	client   *ethclient.Client
+	limiter  *tokenBucket
+	disabled atomic.Bool
+}
+
+func newTraceDetector(client *ethclient.Client, enabled bool, limiter *tokenBucket) *traceDetector {
+	t := &traceDetector{client: client, limiter: limiter}
+	t.disabled.Store(!enabled)
+	return t
+}
+
+func (t *traceDetector) Enabled() bool {
+	return t != nil && t.client != nil && !t.disabled.Load()
+}
+
+func (t *traceDetector) traceBlock(ctx context.Context, blockNumber uint64) ([]txTraceResult, error) {
+	if err := t.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	var results []txTraceResult
+	err := t.client.Client().CallContext(ctx, &results, "debug_traceBlockByNumber",
+		hexutil.EncodeUint64(blockNumber), prestateDiffTracer)
+	if err != nil {
+		if isMethodUnavailable(err) {
+			t.disabled.Store(true)
+			log.Printf("debug_traceBlockByNumber unavailable, falling back to tx heuristic: %v", err)
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+// touchedAddresses returns the lower-case hex addresses whose account fields
+// may have changed in block. Traces are used when available; otherwise it falls back to
+// the transaction from/to heuristic. Block-level credits (coinbase, uncles and
+// EIP-4895 withdrawals) are never part of a transaction trace, so they are
+// always added from the block body.
+func (t *traceDetector) touchedAddresses(ctx context.Context, block *types.Block, signer types.Signer) map[string]struct{} {
+	var addresses map[string]struct{}
+	if t.Enabled() {
+		results, err := t.traceBlock(ctx, block.NumberU64())
+		if err == nil {
+			addresses = accountChangesFromTraces(results)
+		} else {
+			log.Printf("trace block %d failed, using tx heuristic: %v", block.NumberU64(), err)
+		}
+	}
+	if addresses == nil {
+		addresses = txHeuristicAddresses(block, signer)
+	}
+	for addr := range blockRewardAddresses(block) {
+		addresses[addr] = struct{}{}
+	}
+	return addresses
+}
+
+// accountChangesFromTraces extracts accounts whose balance, nonce or code
+// changed in a prestateTracer diff. An account present in "pre" but absent
+// from "post" was deleted (self-destructed), which also zeroes its balance.
+// Storage-only changes are ignored since no account field reflects them.
+func accountChangesFromTraces(results []txTraceResult) map[string]struct{} {
+	addresses := make(map[string]struct{})
+	for _, res := range results {
+		if res.Error != "" {
+			continue
+		}
+		for addr, post := range res.Result.Post {
+			if post.Balance != nil || post.Nonce != 0 || len(post.Code) > 0 {
+				addresses[strings.ToLower(addr.Hex())] = struct{}{}
+			}
+		}
+		for addr := range res.Result.Pre {
+			if _, ok := res.Result.Post[addr]; !ok {
+				addresses[strings.ToLower(addr.Hex())] = struct{}{}
+			}
+		}
+	}
+	return addresses
+}
+
+// txHeuristicAddresses is the original detection rule: every sender and
+// direct recipient of a transaction in the block.
+func txHeuristicAddresses(block *types.Block, signer types.Signer) map[string]struct{} {
+	addresses := make(map[string]struct{})
+	for _, tx := range block.Transactions() {
+		if from, err := types.Sender(signer, tx); err == nil {
+			addresses[strings.ToLower(from.Hex())] = struct{}{}
+		}
+		if to := tx.To(); to != nil {
+			addresses[strings.ToLower(to.Hex())] = struct{}{}
+		}
+	}
+	return addresses
+}
+
+// blockRewardAddresses lists accounts credited outside of transaction
+// execution: the fee recipient, pre-merge uncle miners and beacon-chain
+// withdrawal recipients.
+func blockRewardAddresses(block *types.Block) map[string]struct{} {
+	addresses := make(map[string]struct{})
+	if block.Coinbase() != (common.Address{}) {
+		addresses[strings.ToLower(block.Coinbase().Hex())] = struct{}{}
+	}
+	for _, uncle := range block.Uncles() {
+		addresses[strings.ToLower(uncle.Coinbase.Hex())] = struct{}{}
+	}
+	for _, w := range block.Withdrawals() {
+		addresses[strings.ToLower(w.Address.Hex())] = struct{}{}
+	}
+	return addresses
+}
+
+func isMethodUnavailable(err error) bool {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "method") &&
+		(strings.Contains(msg, "not found") || strings.Contains(msg, "not supported") ||
+			strings.Contains(msg, "does not exist") || strings.Contains(msg, "not available"))
+}
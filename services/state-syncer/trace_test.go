@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func loadTraceFixture(t *testing.T, name string) []txTraceResult {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "traces", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var results []txTraceResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	return results
+}
+
+func TestAccountChangesFromTraces(t *testing.T) {
+	results := loadTraceFixture(t, "block-19000000.json")
+	got := accountChangesFromTraces(results)
+
+	want := []string{
+		"0x1000000000000000000000000000000000000001", // sender paying gas
+		"0x1000000000000000000000000000000000000002", // direct recipient
+		"0x95222290dd7278aa3ddd389cc1e1d165cc4bafe5", // coinbase priority fee
+		"0x1000000000000000000000000000000000000003", // contract caller
+		"0x1000000000000000000000000000000000000004", // contract forwarding value
+		"0x1000000000000000000000000000000000000005", // internal transfer recipient
+		"0x1000000000000000000000000000000000000007", // self-destruct caller
+		"0x1000000000000000000000000000000000000008", // self-destructed contract
+		"0x1000000000000000000000000000000000000009", // self-destruct beneficiary
+		"0x100000000000000000000000000000000000000a", // contract created without value
+	}
+	for _, addr := range want {
+		if _, ok := got[addr]; !ok {
+			t.Errorf("missing account change for %s", addr)
+		}
+	}
+	if _, ok := got["0x1000000000000000000000000000000000000006"]; ok {
+		t.Errorf("storage-only change must not be reported as an account change")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d addresses, want %d", len(got), len(want))
+	}
+}
+
+func TestBlockRewardAddresses(t *testing.T) {
+	coinbase := common.HexToAddress("0x95222290dd7278aa3ddd389cc1e1d165cc4bafe5")
+	validator := common.HexToAddress("0x1000000000000000000000000000000000000042")
+	header := &types.Header{Number: big.NewInt(19000000), Coinbase: coinbase}
+	withdrawals := []*types.Withdrawal{{Index: 1, Validator: 7, Address: validator, Amount: 17000000}}
+	block := types.NewBlockWithHeader(header).WithWithdrawals(withdrawals)
+
+	got := blockRewardAddresses(block)
+	for _, addr := range []common.Address{coinbase, validator} {
+		if _, ok := got[strings.ToLower(addr.Hex())]; !ok {
+			t.Errorf("missing block-level credit for %s", addr.Hex())
+		}
+	}
+}
+
+type fakeRPCError struct{ code int }
+
+func (e fakeRPCError) Error() string {
+	return "the method debug_traceBlockByNumber does not exist/is not available"
+}
+func (e fakeRPCError) ErrorCode() int { return e.code }
+
+func TestIsMethodUnavailable(t *testing.T) {
+	if !isMethodUnavailable(fakeRPCError{code: -32601}) {
+		t.Fatal("expected -32601 to disable tracing")
+	}
+	if !isMethodUnavailable(errors.New("method not found")) {
+		t.Fatal("expected provider message to disable tracing")
+	}
+	if isMethodUnavailable(errors.New("header not found")) {
+		t.Fatal("transient errors must not disable tracing")
+	}
+}
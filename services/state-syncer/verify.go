@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"state-syncer/dbdigest"
+)
+
+// runVerify checks a copy of a dataset's published files the way a client
+// following them would: the snapshot against its digest, then every later
+// delta against the digest the manifest publishes for its block (see
+// publishedDeltas). It exits non-zero at the first block that does not
+// match.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	root := flags.String("root", getEnv("PLINKO_STATE_PUBLIC_ROOT", "/public"), "public root of the dataset to verify")
+	snapshot := flags.String("snapshot", "latest", "snapshot to start from, in <root>/snapshots")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	block, digest, err := verifyPublished(filepath.Clean(*root), *snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified through block %d: digest %s\n", block, digest)
+	return nil
+}
+
+// verifyPublished loads the snapshot under root and applies the deltas
+// published after it, checking the database digest after each block. It
+// returns the last block applied and the digest after it.
+func verifyPublished(root, snapshot string) (uint64, string, error) {
+	dir := filepath.Join(root, "snapshots", snapshot)
+	var info SnapshotManifest
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return 0, "", err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return 0, "", fmt.Errorf("decode snapshot manifest: %w", err)
+	}
+	db, dbSize, _, _, err := loadDatabase(filepath.Join(dir, "database.bin"))
+	if err != nil {
+		return 0, "", err
+	}
+	digest := dbdigest.FromWords(db, dbSize)
+	if info.Digest != "" && digest.Sum() != info.Digest {
+		return 0, "", fmt.Errorf("snapshot %s: %w: have %s, want %s", snapshot, dbdigest.ErrMismatch, digest.Sum(), info.Digest)
+	}
+
+	deltaDir := filepath.Join(root, "deltas")
+	entries, err := publishedDeltas(deltaDir, info.Block)
+	if err != nil {
+		return 0, "", err
+	}
+	block := info.Block
+	for _, entry := range entries {
+		file, err := readDeltaFile(filepath.Join(deltaDir, fmt.Sprintf("delta-%06d.bin", entry.Block)))
+		if err != nil {
+			return block, "", err
+		}
+		deltas := make([]dbdigest.Delta, len(file.Deltas))
+		for i, delta := range file.Deltas {
+			deltas[i] = dbdigest.Delta{Index: delta.Index, Delta: dbdigest.Entry(delta.Delta)}
+			// A grown database's new entries start out empty.
+			if need := (delta.Index + 1) * DBEntryLength; need > uint64(len(db)) {
+				db = append(db, make([]uint64, need-uint64(len(db)))...)
+			}
+		}
+		if err := digest.ApplyDeltas(db, deltas, entry.Digest); err != nil {
+			return block, "", fmt.Errorf("block %d: %w", entry.Block, err)
+		}
+		block = entry.Block
+	}
+	return block, digest.Sum(), nil
+}
+
+// publishedDeltas lists the delta files in deltaDir after block from, up
+// to the manifest's latest block, oldest first. Bundling drops the manifest
+// entries of the blocks it covers, so the files are listed from the
+// directory; each comes with the digest published for the database after
+// it by a delta entry, a bundle or the manifest itself as of its latest
+// block, whichever is latest before the next file. A block with no digest
+// published after it gets none.
+func publishedDeltas(deltaDir string, from uint64) ([]DeltaInfo, error) {
+	var manifest Manifest
+	data, err := os.ReadFile(filepath.Join(deltaDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decode delta manifest: %w", err)
+	}
+	digests := make(map[uint64]string)
+	record := func(deltas []DeltaInfo, bundles []BundleInfo) {
+		for _, delta := range deltas {
+			if delta.Digest != "" {
+				digests[delta.Block] = delta.Digest
+			}
+		}
+		for _, bundle := range bundles {
+			if bundle.Digest != "" {
+				digests[bundle.EndBlock] = bundle.Digest
+			}
+		}
+	}
+	for _, info := range manifest.Pages {
+		if info.EndBlock <= from {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(deltaDir, filepath.FromSlash(info.Path)))
+		if err != nil {
+			return nil, err
+		}
+		var page ManifestPage
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("manifest page %s: %w", info.Path, err)
+		}
+		record(page.Deltas, page.Bundles)
+	}
+	record(manifest.Deltas, manifest.Bundles)
+	latest := manifest.LatestBlock
+	if manifest.Digest != "" {
+		digests[latest] = manifest.Digest
+	}
+
+	files, err := os.ReadDir(deltaDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DeltaInfo
+	for _, file := range files {
+		name, ok := strings.CutPrefix(file.Name(), "delta-")
+		if !ok {
+			continue
+		}
+		if name, ok = strings.CutSuffix(name, ".bin"); !ok {
+			continue
+		}
+		block, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || block <= from || block > latest {
+			continue
+		}
+		entries = append(entries, DeltaInfo{Block: block})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Block < entries[j].Block })
+
+	for i := range entries {
+		next := latest + 1
+		if i+1 < len(entries) {
+			next = entries[i+1].Block
+		}
+		at := uint64(0)
+		for block, digest := range digests {
+			if block >= entries[i].Block && block < next && block >= at {
+				entries[i].Digest, at = digest, block
+			}
+		}
+	}
+	return entries, nil
+}
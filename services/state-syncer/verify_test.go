@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"state-syncer/dbdigest"
+)
+
+func TestVerifyPublished(t *testing.T) {
+	replayDir := t.TempDir()
+	s := newTestSyncer(t, newReplaySource(replayDir), LayoutAccount)
+	if _, err := writeSnapshot(s.cfg, s.db, s.dbSize, s.head, s.chunkSize, s.setSize, s.epoch, s.digest.Sum(), s.bundler); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	for block := uint64(1); block <= 3; block++ {
+		changes := &BlockChanges{Block: block, Entries: []EntryChange{{Index: block, Value: DBEntry{block * 10}}}}
+		if err := writeJSON(recordingPath(replayDir, block), changes); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+		if err := s.ProcessBlock(context.Background(), block); err != nil {
+			t.Fatalf("block %d: %v", block, err)
+		}
+	}
+
+	block, digest, err := verifyPublished(s.cfg.PublicRoot, "block-000000")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if block != 3 || digest != s.digest.Sum() {
+		t.Fatalf("verified through block %d with digest %s, want 3 and %s", block, digest, s.digest.Sum())
+	}
+
+	// Bundling blocks 1-2 drops their manifest entries; their files are
+	// still applied, and the bundle carries block 2's digest.
+	manifest, err := s.bundler.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest2 := manifest.Deltas[1].Digest
+	if err := s.bundler.addBundleToManifest(BundleInfo{StartBlock: 1, EndBlock: 2, Level: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err = s.bundler.readManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Deltas) != 1 || len(manifest.Bundles) != 1 || manifest.Bundles[0].Digest != digest2 {
+		t.Fatalf("bundled manifest: deltas %+v, bundles %+v", manifest.Deltas, manifest.Bundles)
+	}
+	block, digest, err = verifyPublished(s.cfg.PublicRoot, "block-000000")
+	if err != nil || block != 3 || digest != s.digest.Sum() {
+		t.Fatalf("verify bundled: block %d, digest %s, err %v", block, digest, err)
+	}
+
+	// A mirror serving a different, well-formed delta for block 2 is
+	// caught at that block.
+	path := filepath.Join(s.cfg.DeltaDir, "delta-000002.bin")
+	file, err := readDeltaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Deltas[0].Delta[0] ^= 1
+	if err := saveDelta(path, file.DeltaHeader, file.Deltas); err != nil {
+		t.Fatal(err)
+	}
+	block, _, err = verifyPublished(s.cfg.PublicRoot, "block-000000")
+	if !errors.Is(err, dbdigest.ErrMismatch) || block != 1 {
+		t.Fatalf("tampered delta: block %d, err %v", block, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The database file is only a checkpoint. Every applied block is appended
+// to a write-ahead log next to it (database.bin.wal), so persisting a block
+// costs its changes rather than a rewrite of the whole database. Once
+// cfg.CheckpointEvery blocks or walMaxBytes have accumulated, the database
+// is flushed, the block it holds is recorded next to it
+// (database.bin.checkpoint) and the log emptied. On startup the log is
+// replayed over the checkpoint, and the syncer resumes after the last block
+// either of them holds.
+//
+// A record holds the new value of every entry the block changed, not the
+// XOR delta, so replaying a record the checkpoint already contains (after
+// a crash between the flush and the truncation) is harmless. It also holds
+// the accounts appended to the address mapping and not yet written to it,
+// in the address-mapping.bin record format, so the mapping is recovered
+// together with the entries:
+//
+//	block uint64 | dbSize uint64 | count uint32 | accounts uint32 |
+//	count × (index uint64, value [32]byte) |
+//	accounts × (address [20]byte, index uint32) | crc32 of the preceding bytes
+//
+// All integers are little-endian.
+const (
+	walSuffix       = ".wal"
+	walMaxBytes     = 256 << 20
+	walHeaderSize   = 8 + 8 + 4 + 4
+	walEntrySize    = 8 + DBEntrySize
+	walChecksumSize = 4
+)
+
+// checkpointSuffix names the file holding the block of the last checkpoint,
+// as a little-endian uint64.
+const checkpointSuffix = ".checkpoint"
+
+// databaseWAL is the write-ahead log of one database file.
+type databaseWAL struct {
+	dbPath string
+	f      *os.File
+	size   int64
+	// blocks counts the records since the last checkpoint.
+	blocks uint64
+	// block is the last block the database and log hold; hasBlock is false
+	// for a database that never went through the syncer.
+	block    uint64
+	hasBlock bool
+	// broken is set when an append fails: the log then misses a block, so
+	// nothing more is appended until a checkpoint covers it.
+	broken bool
+	// accounts are the appended accounts the replayed records hold, in log
+	// order.
+	accounts []newAccount
+}
+
+// walRecord is one decoded log record.
+type walRecord struct {
+	block    uint64
+	dbSize   uint64
+	entries  map[uint64]DBEntry
+	accounts []newAccount
+}
+
+var errWALBroken = errors.New("write-ahead log is missing a block; waiting for a checkpoint")
+
+// openWAL opens the log of the database at dbPath and replays it over db,
+// which holds dbSize entries, growing db as needed. A torn record at the
+// end, left by a crash mid-write, is cut off. It returns the log, whose
+// block is the last one recovered, and the recovered database.
+func openWAL(dbPath string, db []uint64, dbSize uint64) (*databaseWAL, []uint64, uint64, error) {
+	w := &databaseWAL{dbPath: dbPath}
+	data, err := os.ReadFile(dbPath + checkpointSuffix)
+	switch {
+	case err == nil && len(data) == 8:
+		w.block, w.hasBlock = binary.LittleEndian.Uint64(data), true
+	case err == nil:
+		return nil, nil, 0, fmt.Errorf("%s%s: %d bytes, want 8", dbPath, checkpointSuffix, len(data))
+	case !os.IsNotExist(err):
+		return nil, nil, 0, err
+	}
+
+	f, err := os.OpenFile(dbPath+walSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	w.f = f
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	for {
+		rec, n, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("⚠️ %s: dropping WAL from offset %d: %v", dbPath, w.size, err)
+			break
+		}
+		if rec.dbSize > dbSize {
+			db = growDatabase(db, rec.dbSize)
+			dbSize = rec.dbSize
+		}
+		for index, value := range rec.entries {
+			copy(db[index*DBEntryLength:], value[:])
+		}
+		w.accounts = append(w.accounts, rec.accounts...)
+		w.size += n
+		w.blocks++
+		if !w.hasBlock || rec.block > w.block {
+			w.block, w.hasBlock = rec.block, true
+		}
+	}
+	if err := f.Truncate(w.size); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	if _, err := f.Seek(w.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	if w.blocks > 0 {
+		log.Printf("Replayed %d blocks (through block %d) from %s%s", w.blocks, w.block, dbPath, walSuffix)
+	}
+	return w, db, dbSize, nil
+}
+
+// readWALRecord reads one record and returns it with its size.
+func readWALRecord(r *bufio.Reader) (rec walRecord, n int64, err error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated record")
+		}
+		return rec, 0, err
+	}
+	rec.block = binary.LittleEndian.Uint64(header)
+	rec.dbSize = binary.LittleEndian.Uint64(header[8:])
+	count := binary.LittleEndian.Uint32(header[16:])
+	accounts := binary.LittleEndian.Uint32(header[20:])
+	if uint64(count) > rec.dbSize || uint64(accounts) > rec.dbSize {
+		return rec, 0, fmt.Errorf("record of block %d has %d entries and %d accounts for a database of %d", rec.block, count, accounts, rec.dbSize)
+	}
+	body := make([]byte, int(count)*walEntrySize+int(accounts)*addressMappingRecordSize+walChecksumSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, 0, fmt.Errorf("block %d: truncated record", rec.block)
+	}
+	crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, body[:len(body)-walChecksumSize])
+	if crc != binary.LittleEndian.Uint32(body[len(body)-walChecksumSize:]) {
+		return rec, 0, fmt.Errorf("block %d: checksum mismatch", rec.block)
+	}
+
+	rec.entries = make(map[uint64]DBEntry, count)
+	for i := 0; i < int(count); i++ {
+		b := body[i*walEntrySize:]
+		index := binary.LittleEndian.Uint64(b)
+		if index >= rec.dbSize {
+			return rec, 0, fmt.Errorf("block %d: entry %d beyond database of %d", rec.block, index, rec.dbSize)
+		}
+		var value DBEntry
+		for j := range value {
+			value[j] = binary.LittleEndian.Uint64(b[8+j*8:])
+		}
+		rec.entries[index] = value
+	}
+	for i := 0; i < int(accounts); i++ {
+		b := body[int(count)*walEntrySize+i*addressMappingRecordSize:]
+		rec.accounts = append(rec.accounts, newAccount{
+			Address: common.BytesToAddress(b[:common.AddressLength]),
+			Index:   uint64(binary.LittleEndian.Uint32(b[common.AddressLength:])),
+		})
+	}
+	return rec, int64(len(header) + len(body)), nil
+}
+
+// growDatabase returns db with room for at least entries, keeping the
+// headroom an epoch would give it.
+func growDatabase(db []uint64, entries uint64) []uint64 {
+	if entries*DBEntryLength <= uint64(len(db)) {
+		return db
+	}
+	chunkSize, setSize := derivePlinkoParams(entries + entries*epochHeadroomPercent/100)
+	grown := make([]uint64, chunkSize*setSize*DBEntryLength)
+	copy(grown, db)
+	return grown
+}
+
+// Append logs the updates applied in block, after which the database holds
+// dbSize entries, with the appended accounts not yet in the address mapping,
+// and syncs the log. After a failed append it refuses every record until the
+// next checkpoint.
+func (w *databaseWAL) Append(block, dbSize uint64, updates []DBUpdate, accounts []newAccount) error {
+	if w.broken {
+		return errWALBroken
+	}
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(updates)*walEntrySize+len(accounts)*addressMappingRecordSize+walChecksumSize)
+	binary.LittleEndian.PutUint64(buf, block)
+	binary.LittleEndian.PutUint64(buf[8:], dbSize)
+	binary.LittleEndian.PutUint32(buf[16:], uint32(len(updates)))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(len(accounts)))
+	for _, update := range updates {
+		buf = binary.LittleEndian.AppendUint64(buf, update.Index)
+		for _, word := range update.NewValue {
+			buf = binary.LittleEndian.AppendUint64(buf, word)
+		}
+	}
+	buf = append(buf, encodeAddressRecords(accounts)...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	if _, err := w.f.Write(buf); err != nil {
+		// Cut off whatever part of the record made it, so later records
+		// are not stranded behind it.
+		w.f.Truncate(w.size)
+		w.f.Seek(w.size, io.SeekStart)
+		w.broken = true
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.broken = true
+		return err
+	}
+	w.size += int64(len(buf))
+	w.blocks++
+	w.block, w.hasBlock = block, true
+	return nil
+}
+
+// Due reports whether the log has grown enough to checkpoint, given a
+// checkpoint every blocks blocks, or misses a block.
+func (w *databaseWAL) Due(blocks uint64) bool {
+	return w.broken || w.blocks >= max(blocks, 1) || w.size >= walMaxBytes
+}
+
+// Checkpoint writes the database, which holds the state after block, records
+// block and empties the log.
+func (w *databaseWAL) Checkpoint(db []uint64, dbSize, block uint64) error {
+	if err := flushDatabase(w.dbPath, db, dbSize); err != nil {
+		return err
+	}
+	// Until the log is emptied its records still replay over the new
+	// checkpoint harmlessly, so a crash at any point recovers block.
+	if err := writeCheckpointBlock(w.dbPath+checkpointSuffix, block); err != nil {
+		return err
+	}
+	w.block, w.hasBlock = block, true
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size, w.blocks, w.broken = 0, 0, false
+	return w.f.Sync()
+}
+
+// writeCheckpointBlock replaces the file at path with block.
+func writeCheckpointBlock(path string, block uint64) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(binary.LittleEndian.AppendUint64(nil, block)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func writeDBEntry(db []uint64, index uint64, value DBEntry) {
+	copy(db[index*DBEntryLength:], value[:])
+}
+
+func TestDatabaseWAL(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database.bin")
+	db := make([]uint64, 8*DBEntryLength)
+	writeDBEntry(db, 1, DBEntry{1})
+	if err := flushDatabase(dbPath, db, 8); err != nil {
+		t.Fatal(err)
+	}
+	open := func() (*databaseWAL, []uint64, uint64) {
+		t.Helper()
+		db, dbSize, _, _, err := loadDatabase(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal, db, dbSize, err := openWAL(dbPath, db, dbSize)
+		if err != nil {
+			t.Fatalf("open WAL: %v", err)
+		}
+		t.Cleanup(func() { wal.f.Close() })
+		return wal, db, dbSize
+	}
+
+	wal, _, _ := open()
+	if wal.hasBlock {
+		t.Fatalf("fresh database at block %d", wal.block)
+	}
+	if err := wal.Append(10, 8, []DBUpdate{{Index: 1, NewValue: DBEntry{2}}, {Index: 3, NewValue: DBEntry{3, 4, 5, 6}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Block 11 appends an account past the end of the database file.
+	if err := wal.Append(11, 40, []DBUpdate{{Index: 1, NewValue: DBEntry{7}}, {Index: 39, NewValue: DBEntry{9}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if wal.Due(3) || !wal.Due(2) {
+		t.Fatalf("due after %d blocks", wal.blocks)
+	}
+	// A crash in the middle of the next record leaves a torn tail.
+	if _, err := wal.f.Write([]byte{12, 0, 0, 0, 0, 0, 0, 0, 40}); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, db, dbSize := open()
+	if dbSize != 40 || wal.blocks != 2 || wal.block != 11 {
+		t.Fatalf("recovered %d entries from %d blocks, through %d", dbSize, wal.blocks, wal.block)
+	}
+	for index, want := range map[uint64]DBEntry{1: {7}, 3: {3, 4, 5, 6}, 39: {9}} {
+		if got := readDBEntry(db, index); got != want {
+			t.Fatalf("entry %d = %v, want %v", index, got, want)
+		}
+	}
+	// The torn tail is gone, so records appended now are replayed too.
+	if err := wal.Append(12, 40, []DBUpdate{{Index: 3, NewValue: DBEntry{}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(dbPath + walSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDBEntry(db, 3, DBEntry{})
+	if err := wal.Checkpoint(db, dbSize, 12); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if info, err := os.Stat(dbPath + walSuffix); err != nil || info.Size() != 0 {
+		t.Fatalf("WAL after checkpoint: %v, %v", info, err)
+	}
+	// An empty log resumes from the checkpoint's block.
+	wal.f.Close()
+	if wal, _, _ := open(); !wal.hasBlock || wal.block != 12 || wal.blocks != 0 {
+		t.Fatalf("checkpoint recovered block %d (%v)", wal.block, wal.hasBlock)
+	}
+
+	// A crash between the flush and the truncation replays the old log
+	// over the new checkpoint, which changes nothing.
+	if err := os.WriteFile(dbPath+walSuffix, stale, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wal, recovered, recoveredSize := open()
+	if recoveredSize != 40 || wal.blocks != 3 || wal.block != 12 {
+		t.Fatalf("recovered %d entries from %d blocks, through %d", recoveredSize, wal.blocks, wal.block)
+	}
+	for index := uint64(0); index < 40; index++ {
+		if got, want := readDBEntry(recovered, index), readDBEntry(db, index); got != want {
+			t.Fatalf("entry %d = %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestOpenSyncerResumesAfterRecoveredBlock(t *testing.T) {
+	tmp := t.TempDir()
+	cfg := Config{
+		DatabasePath:       filepath.Join(tmp, "database.bin"),
+		AddressMappingPath: filepath.Join(tmp, "address-mapping.bin"),
+		PublicRoot:         filepath.Join(tmp, "public"),
+		DeltaDir:           filepath.Join(tmp, "public", "deltas"),
+		StartBlock:         5,
+	}
+	if err := flushDatabase(cfg.DatabasePath, make([]uint64, 16*DBEntryLength), 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.AddressMappingPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, dbSize, _, _, err := loadDatabase(cfg.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, _, _, err := openWAL(cfg.DatabasePath, db, dbSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks 6 and 7 were applied before a crash.
+	for block := uint64(6); block <= 7; block++ {
+		if err := wal.Append(block, 16, []DBUpdate{{Index: 2, NewValue: DBEntry{block}}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.f.Close()
+
+	anchorAt := func(block uint64) (ChainAnchor, error) {
+		return ChainAnchor{ChainID: 1, Block: block, Hash: common.Hash{byte(block)}}, nil
+	}
+	s, err := openSyncer(cfg, anchorAt, nil, NewSyncMetrics(SourceReplay))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { s.wal.f.Close() })
+	if s.head.Block != 7 || s.head.Hash != (common.Hash{7}) || readDBEntry(s.db, 2) != (DBEntry{7}) {
+		t.Fatalf("resumed at %+v with entry %v", s.head, readDBEntry(s.db, 2))
+	}
+	var manifest SnapshotManifest
+	data, err := os.ReadFile(filepath.Join(cfg.SnapshotsRoot(), "block-000007", "manifest.json"))
+	if err != nil {
+		t.Fatalf("snapshot of the recovered block: %v", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Block != 7 || manifest.BlockHash == nil || *manifest.BlockHash != (common.Hash{7}) {
+		t.Fatalf("snapshot anchored at block %d, hash %v", manifest.Block, manifest.BlockHash)
+	}
+}
+
+func TestDatabaseWALFailedAppend(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database.bin")
+	db := make([]uint64, 8*DBEntryLength)
+	if err := flushDatabase(dbPath, db, 8); err != nil {
+		t.Fatal(err)
+	}
+	wal, db, dbSize, err := openWAL(dbPath, db, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wal.f.Close() })
+	if err := wal.Append(10, 8, []DBUpdate{{Index: 1, NewValue: DBEntry{1}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Block 11 cannot be written, so block 12 must not follow it in the log.
+	rw := wal.f
+	ro, err := os.Open(dbPath + walSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	wal.f = ro
+	if err := wal.Append(11, 8, []DBUpdate{{Index: 2, NewValue: DBEntry{2}}}, nil); err == nil {
+		t.Fatal("append to a read-only log succeeded")
+	}
+	wal.f = rw
+	if err := wal.Append(12, 8, []DBUpdate{{Index: 3, NewValue: DBEntry{3}}}, nil); !errors.Is(err, errWALBroken) {
+		t.Fatalf("append after a failed one: %v", err)
+	}
+	if !wal.Due(100) {
+		t.Fatal("broken log not due for a checkpoint")
+	}
+
+	// The checkpoint holds blocks 11 and 12 and mends the log.
+	writeDBEntry(db, 1, DBEntry{1})
+	writeDBEntry(db, 2, DBEntry{2})
+	writeDBEntry(db, 3, DBEntry{3})
+	if err := wal.Checkpoint(db, dbSize, 12); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if err := wal.Append(13, 8, []DBUpdate{{Index: 4, NewValue: DBEntry{4}}}, nil); err != nil {
+		t.Fatalf("append after the checkpoint: %v", err)
+	}
+	wal.f.Close()
+
+	loaded, loadedSize, _, _, err := loadDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, recovered, _, err := openWAL(dbPath, loaded, loadedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.block != 13 || wal.blocks != 1 {
+		t.Fatalf("recovered through %d from %d blocks", wal.block, wal.blocks)
+	}
+	for index := uint64(1); index <= 4; index++ {
+		if got := readDBEntry(recovered, index); got != (DBEntry{index}) {
+			t.Fatalf("entry %d = %v", index, got)
+		}
+	}
+}